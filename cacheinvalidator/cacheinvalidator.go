@@ -0,0 +1,103 @@
+package main
+
+/*
+This function consumes the DynamoDB streams from the encodings and idmapping tables. Whenever a record is inserted,
+modified or removed it deletes the cached lookups that depend on it from memcached (if MEMCACHE_HOST is set) and
+invalidates the matching endpoint URLs in CloudFront (if CLOUDFRONT_DISTRIBUTION_ID is set), so that changes show up
+straight away instead of when the cache expires.
+*/
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"go.opentelemetry.io/otel/attribute"
+	"os"
+)
+
+var ops common.DynamoDbOps
+var config common.Config
+var cache common.CacheInvalidator //nil if there is no cache configured
+var cdn common.CDNInvalidator     //nil if there is no CDN configured
+
+/*
+HandleEvent invalidates everything affected by the batch.  Invalidation is idempotent, so if anything fails an error is
+returned and the whole batch is retried by the stream.  The exceptions are a CDN invalidation that was skipped because
+one is already in progress, and one that CloudFront throttled after the cache keys were deleted; in both cases the CDN
+copies will still expire by themselves.
+*/
+func HandleEvent(ctx context.Context, event events.DynamoDBEvent) (err error) {
+	ctx = common.ContextWithLogger(ctx, common.DefaultLogger.With("function", "cacheinvalidator"))
+	ctx, metrics := common.ContextWithJobMetrics(ctx, "cacheinvalidator")
+	defer metrics.Flush()
+	ctx, span := common.StartSpan(ctx, "cacheinvalidator", attribute.Int("records", len(event.Records)))
+	defer common.FlushTracing(ctx)
+	defer func() { common.EndSpan(span, err) }()
+	logger := common.LoggerFromContext(ctx)
+
+	invalidations, collectErr := common.CollectInvalidations(ctx, event.Records, config, ops)
+	if invalidations.IsEmpty() {
+		logger.Debug("Nothing to invalidate for %d records", len(event.Records))
+		return collectErr
+	}
+
+	var errs []error
+	if collectErr != nil {
+		errs = append(errs, collectErr)
+	}
+	cacheKeysInvalidated := false
+	if cache != nil {
+		keys := invalidations.CacheKeys()
+		if err := cache.InvalidateKeys(ctx, keys); err != nil {
+			logger.Error("Could not invalidate cache keys: %s", err)
+			errs = append(errs, err)
+		} else {
+			cacheKeysInvalidated = true
+			metrics.PutMetric(common.MetricCacheKeysInvalidated, float64(len(keys)), "Count")
+		}
+	}
+	if cdn != nil {
+		paths := invalidations.CloudFrontPaths()
+		err := cdn.InvalidatePaths(ctx, paths)
+		switch {
+		case err == nil:
+			metrics.PutMetric(common.MetricCDNPathsInvalidated, float64(len(paths)), "Count")
+		case errors.Is(err, common.ErrCDNInvalidationSkipped):
+			metrics.PutCount(common.MetricCDNInvalidationsSkipped)
+		case errors.Is(err, common.ErrCDNThrottled) && cacheKeysInvalidated:
+			//retrying would repeat the cache deletes for nothing; the CDN copies expire by themselves
+			logger.Warning("Not retrying CDN invalidation: %s", err)
+			metrics.PutCount(common.MetricCDNInvalidationsThrottled)
+		default:
+			logger.Error("Could not invalidate CDN paths: %s", err)
+			errs = append(errs, err)
+		}
+	}
+	logger.Info("Invalidated %d filebases and %d octopus ids from %d records", len(invalidations.Filebases), len(invalidations.OctopusIds), len(event.Records))
+	return common.JoinErrors(errs)
+}
+
+func main() {
+	var err error
+	err = common.InitTracing(context.Background(), "cacheinvalidator")
+	if err != nil {
+		common.DefaultLogger.Error("Could not initialise tracing: %s", err)
+		panic("could not initialise tracing")
+	}
+
+	config, err = common.NewConfig()
+	if err != nil {
+		common.DefaultLogger.Error("Could not initialise config: %s", err)
+		panic("could not initialise config")
+	}
+
+	ops = common.NewDynamoDbOps(config)
+	cache = common.NewMemcacheInvalidator(config)
+	cdn = common.NewCloudFrontInvalidator(config, os.Getenv("CLOUDFRONT_DISTRIBUTION_ID"))
+	if cache == nil && cdn == nil {
+		common.DefaultLogger.Warning("Neither MEMCACHE_HOST nor CLOUDFRONT_DISTRIBUTION_ID is set, so nothing will be invalidated")
+	}
+	lambda.Start(HandleEvent)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"testing"
+)
+
+var testEvent = events.DynamoDBEvent{
+	Records: []events.DynamoDBEventRecord{
+		{
+			EventName:      "REMOVE",
+			EventSourceArn: "arn:aws:dynamodb:eu-west-1:123456789012:table/id-mapping-table/stream/2024-01-01T00:00:00.000",
+			Change: events.DynamoDBStreamRecord{
+				OldImage: map[string]events.DynamoDBAttributeValue{"filebase": events.NewStringAttribute("mygreatvideo")},
+			},
+		},
+	},
+}
+
+func TestHandleEventInvalidates(t *testing.T) {
+	mockCache := &common.CacheInvalidatorMock{}
+	mockCDN := &common.CDNInvalidatorMock{}
+	config = &common.ConfigMock{IdMappingTableVal: "id-mapping-table", EncodingsTableVal: "encodings-table"}
+	ops = &common.DynamoOpsMock{}
+	cache = mockCache
+	cdn = mockCDN
+
+	err := HandleEvent(context.Background(), testEvent)
+	if err != nil {
+		t.Fatalf("HandleEvent returned an unexpected error: %s", err)
+	}
+	if len(mockCache.KeysInvalidated) != 1 || mockCache.KeysInvalidated[0] != "resolve:file:mygreatvideo" {
+		t.Errorf("Unexpected keys invalidated %v", mockCache.KeysInvalidated)
+	}
+	if len(mockCDN.PathsInvalidated) != 1 || len(mockCDN.PathsInvalidated[0]) != 3 {
+		t.Errorf("Expected one CDN invalidation with 3 paths, got %v", mockCDN.PathsInvalidated)
+	}
+}
+
+func TestHandleEventWithoutCaches(t *testing.T) {
+	config = &common.ConfigMock{IdMappingTableVal: "id-mapping-table", EncodingsTableVal: "encodings-table"}
+	ops = &common.DynamoOpsMock{}
+	cache = nil
+	cdn = nil
+
+	err := HandleEvent(context.Background(), testEvent)
+	if err != nil {
+		t.Errorf("HandleEvent returned an unexpected error: %s", err)
+	}
+}
+
+func TestHandleEventRetriesOnFailure(t *testing.T) {
+	config = &common.ConfigMock{IdMappingTableVal: "id-mapping-table", EncodingsTableVal: "encodings-table"}
+	ops = &common.DynamoOpsMock{}
+	mockCDN := &common.CDNInvalidatorMock{}
+	cache = &common.CacheInvalidatorMock{Err: errors.New("connection refused")}
+	cdn = mockCDN
+
+	err := HandleEvent(context.Background(), testEvent)
+	if err == nil {
+		t.Error("Expected an error so that the batch is retried")
+	}
+	if len(mockCDN.PathsInvalidated) != 1 {
+		t.Error("A cache failure should not stop the CDN being invalidated")
+	}
+}
+
+/*
+During a bulk write CloudFront turns down some invalidations.  Once the cache keys are gone the batch should not be
+retried just for that, since every retry would delete the cache keys again.
+*/
+func TestHandleEventCDNThrottled(t *testing.T) {
+	config = &common.ConfigMock{IdMappingTableVal: "id-mapping-table", EncodingsTableVal: "encodings-table"}
+	ops = &common.DynamoOpsMock{}
+	cdn = &common.CDNInvalidatorMock{Err: fmt.Errorf("%w: TooManyInvalidationsInProgress", common.ErrCDNThrottled)}
+
+	cache = &common.CacheInvalidatorMock{}
+	if err := HandleEvent(context.Background(), testEvent); err != nil {
+		t.Errorf("A throttled CDN invalidation should not fail the batch once the cache keys are invalidated, got %s", err)
+	}
+
+	cache = nil
+	if err := HandleEvent(context.Background(), testEvent); err == nil {
+		t.Error("A throttled CDN invalidation should be retried if nothing else was invalidated")
+	}
+
+	cdn = &common.CDNInvalidatorMock{Err: common.ErrCDNInvalidationSkipped}
+	if err := HandleEvent(context.Background(), testEvent); err != nil {
+		t.Errorf("A skipped CDN invalidation should not fail the batch, got %s", err)
+	}
+}
@@ -0,0 +1,408 @@
+package common
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/google/uuid"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/*
+ResolutionCacheKey gives the memcached key under which the result of looking up `file={filebase}` or
+`octopusid={id}` is cached.  Keys that memcached would not accept (too long, or containing spaces or control
+characters) are hashed.
+
+Arguments:
+- lookupField - the query parameter that the lookup is on, i.e. "file" or "octopusid"
+- value - the value of that parameter
+*/
+func ResolutionCacheKey(lookupField string, value string) string {
+	key := "resolve:" + lookupField + ":" + value
+	if len(key) > 250 || strings.IndexFunc(key, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		hash := sha1.Sum([]byte(value))
+		return "resolve:" + lookupField + ":sha1:" + hex.EncodeToString(hash[:])
+	}
+	return key
+}
+
+// the endpoints whose responses depend on the encodings and idmapping tables
+var invalidatedEndpoints = []string{"reference.php", "video.php", "mediatag.php"}
+
+/*
+InvalidationSet collects the lookups that are affected by a batch of changes to the tables
+*/
+type InvalidationSet struct {
+	Filebases  map[string]bool
+	OctopusIds map[int64]bool
+}
+
+func NewInvalidationSet() *InvalidationSet {
+	return &InvalidationSet{Filebases: make(map[string]bool), OctopusIds: make(map[int64]bool)}
+}
+
+func (s *InvalidationSet) IsEmpty() bool {
+	return len(s.Filebases) == 0 && len(s.OctopusIds) == 0
+}
+
+/*
+CacheKeys returns the memcached keys to delete, sorted so that the output is stable
+*/
+func (s *InvalidationSet) CacheKeys() []string {
+	keys := make([]string, 0, len(s.Filebases)+len(s.OctopusIds))
+	for filebase := range s.Filebases {
+		keys = append(keys, ResolutionCacheKey("file", filebase))
+	}
+	for octopusId := range s.OctopusIds {
+		keys = append(keys, ResolutionCacheKey("octopusid", fmt.Sprintf("%d", octopusId)))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+sortedLookups returns the filebases and octopus IDs in the set, sorted so that the output is stable
+*/
+func (s *InvalidationSet) sortedLookups() ([]string, []int64) {
+	filebases := make([]string, 0, len(s.Filebases))
+	for filebase := range s.Filebases {
+		filebases = append(filebases, filebase)
+	}
+	sort.Strings(filebases)
+	octopusIds := make([]int64, 0, len(s.OctopusIds))
+	for octopusId := range s.OctopusIds {
+		octopusIds = append(octopusIds, octopusId)
+	}
+	sort.Slice(octopusIds, func(i, j int) bool { return octopusIds[i] < octopusIds[j] })
+	return filebases, octopusIds
+}
+
+/*
+CloudFrontPaths returns the paths to invalidate.  CloudFront matches invalidation paths without the query string, and
+only honours a `*` at the end of the path, so a single lookup can't be picked out; instead every cached response from
+the affected endpoints is invalidated.  This is nothing if the set is empty.
+*/
+func (s *InvalidationSet) CloudFrontPaths() []string {
+	if s.IsEmpty() {
+		return []string{}
+	}
+	paths := make([]string, len(invalidatedEndpoints))
+	for i, endpoint := range invalidatedEndpoints {
+		paths[i] = "/interactivevideos/" + endpoint + "*"
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+/*
+RawDynamoRecordFromStreamImage converts a record image from a DynamoDB stream event into the RawDynamoRecord that the
+rest of the code understands.  Only the attribute types used by our tables are converted; anything else is dropped.
+*/
+func RawDynamoRecordFromStreamImage(image map[string]events.DynamoDBAttributeValue) RawDynamoRecord {
+	rec := make(RawDynamoRecord, len(image))
+	for k, v := range image {
+		switch v.DataType() {
+		case events.DataTypeString:
+			rec[k] = &types.AttributeValueMemberS{Value: v.String()}
+		case events.DataTypeNumber:
+			rec[k] = &types.AttributeValueMemberN{Value: v.Number()}
+		case events.DataTypeBoolean:
+			rec[k] = &types.AttributeValueMemberBOOL{Value: v.Boolean()}
+		}
+	}
+	return rec
+}
+
+/*
+tableNameFromStreamArn extracts the table name from a stream ARN like
+arn:aws:dynamodb:eu-west-1:123456789012:table/{name}/stream/2024-01-01T00:00:00.000
+*/
+func tableNameFromStreamArn(arn string) string {
+	parts := strings.Split(arn, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+/*
+addEncodingChange adds the lookups that depend on an encoding.  Lookups find their encodings through the content ID of
+the idmapping record, so the filebases and octopus IDs are found from the idmapping records with the same content ID.
+This gives the same cache keys as a change to those idmapping records would.
+*/
+func (s *InvalidationSet) addEncodingChange(ctx context.Context, rec RawDynamoRecord, ops DynamoDbOps) error {
+	contentId, _ := extractDynamoField(&rec, "contentid", reflect.Int64, true).(int64)
+	if contentId == 0 {
+		LoggerFromContext(ctx).Warning("CollectInvalidations encoding %v has no contentid so can't be invalidated", rec["encodingid"])
+		return nil
+	}
+	filebases, octopusIds, err := ops.QueryLookupsForContentId(ctx, contentId)
+	if err != nil {
+		return err
+	}
+	for _, filebase := range filebases {
+		s.Filebases[filebase] = true
+	}
+	for _, octopusId := range octopusIds {
+		s.OctopusIds[octopusId] = true
+	}
+	return nil
+}
+
+/*
+addIdMappingChange adds the lookups that depend on an idmapping record
+*/
+func (s *InvalidationSet) addIdMappingChange(rec RawDynamoRecord) {
+	if filebase, isString := rec["filebase"].(*types.AttributeValueMemberS); isString && filebase.Value != "" {
+		s.Filebases[filebase.Value] = true
+	}
+	if octopusId, _ := extractDynamoField(&rec, "octopus_id", reflect.Int64, true).(int64); octopusId != 0 {
+		s.OctopusIds[octopusId] = true
+	}
+}
+
+/*
+CollectInvalidations works out which lookups are affected by a batch of stream records from the encodings and
+idmapping tables.  Both the old and new images are considered, so that e.g. renaming a filebase invalidates the old
+name as well as the new one; the streams must be set up with the NEW_AND_OLD_IMAGES view type.
+
+Arguments:
+- ctx - context carrying the logger, metrics and trace
+- records - the stream records
+- config - Config used to tell the tables apart
+- ops - DynamoDbOps used to find the lookups for changed encodings
+Returns:
+- an InvalidationSet. This is never nil.
+- an error if the affected lookups could not all be found. The set still contains everything that was found.
+*/
+func CollectInvalidations(ctx context.Context, records []events.DynamoDBEventRecord, config Config, ops DynamoDbOps) (*InvalidationSet, error) {
+	logger := LoggerFromContext(ctx)
+	result := NewInvalidationSet()
+	var errs []error
+
+	for _, record := range records {
+		tableName := tableNameFromStreamArn(record.EventSourceArn)
+		for _, image := range []map[string]events.DynamoDBAttributeValue{record.Change.OldImage, record.Change.NewImage} {
+			if len(image) == 0 {
+				continue
+			}
+			rec := RawDynamoRecordFromStreamImage(image)
+			switch tableName {
+			case config.IdMappingTable():
+				result.addIdMappingChange(rec)
+			case *config.EncodingsTablePtr():
+				if err := result.addEncodingChange(ctx, rec, ops); err != nil {
+					logger.Error("CollectInvalidations could not find lookups for a changed encoding: %s", err)
+					errs = append(errs, err)
+				}
+			default:
+				logger.Warning("CollectInvalidations ignoring %s event from unknown table %s", record.EventName, tableName)
+			}
+		}
+	}
+	return result, JoinErrors(errs)
+}
+
+/*
+JoinErrors combines several errors into one whose message lists them all, or returns nil if there are none
+*/
+func JoinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+/*
+CacheInvalidator removes entries from the resolution cache
+*/
+type CacheInvalidator interface {
+	InvalidateKeys(ctx context.Context, keys []string) error
+}
+
+type MemcacheInvalidator struct {
+	client *memcache.Client
+}
+
+/*
+NewMemcacheInvalidator creates a CacheInvalidator for the memcached server in the config, or returns nil if there is
+no memcached server configured
+*/
+func NewMemcacheInvalidator(config Config) CacheInvalidator {
+	server := config.MemcacheServer()
+	if server == "" {
+		return nil
+	}
+	return &MemcacheInvalidator{client: memcache.New(server)}
+}
+
+func (m *MemcacheInvalidator) InvalidateKeys(ctx context.Context, keys []string) (err error) {
+	ctx, span := StartSpan(ctx, "MemcacheInvalidator.InvalidateKeys")
+	defer func() { EndSpan(span, err) }()
+
+	var errs []error
+	for _, key := range keys {
+		err := m.client.Delete(key)
+		if err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	LoggerFromContext(ctx).Debug("InvalidateKeys deleted %d keys with %d errors", len(keys), len(errs))
+	return JoinErrors(errs)
+}
+
+/*
+ErrCDNInvalidationSkipped is returned by a CDNInvalidator that did not start an invalidation because one covering the
+same paths is already in progress
+*/
+var ErrCDNInvalidationSkipped = errors.New("an invalidation of the same paths is already in progress")
+
+/*
+ErrCDNThrottled is returned (wrapped) by a CDNInvalidator when the CDN turned down an invalidation because too many are
+in progress, or because we are asking too often
+*/
+var ErrCDNThrottled = errors.New("the CDN is throttling invalidations")
+
+/*
+CDNInvalidator removes paths from the CDN's cache
+*/
+type CDNInvalidator interface {
+	InvalidatePaths(ctx context.Context, paths []string) error
+}
+
+type CloudFrontInvalidator struct {
+	client         *cloudfront.Client
+	distributionId string
+}
+
+/*
+NewCloudFrontInvalidator creates a CDNInvalidator for the given CloudFront distribution, or returns nil if
+distributionId is empty
+*/
+func NewCloudFrontInvalidator(config Config, distributionId string) CDNInvalidator {
+	if distributionId == "" {
+		return nil
+	}
+	return &CloudFrontInvalidator{client: config.GetCloudFrontClient(), distributionId: distributionId}
+}
+
+/*
+InvalidatePaths creates an invalidation of the given paths, unless one that covers all of them is already in progress.
+Every batch of changes invalidates the same few paths, so during a bulk write this keeps us well inside CloudFront's
+limit on concurrent wildcard invalidations.
+
+Returns:
+- nil if an invalidation was created
+- ErrCDNInvalidationSkipped if there is already one in progress
+- an error wrapping ErrCDNThrottled if CloudFront turned it down for now
+- any other error on failure
+*/
+func (c *CloudFrontInvalidator) InvalidatePaths(ctx context.Context, paths []string) (err error) {
+	ctx, span := StartSpan(ctx, "CloudFrontInvalidator.InvalidatePaths")
+	defer func() { EndSpan(span, err) }()
+
+	inProgress, err := c.findInProgress(ctx, paths)
+	if err != nil {
+		return classifyCloudFrontError(err)
+	}
+	if inProgress != "" {
+		LoggerFromContext(ctx).Info("InvalidatePaths invalidation %s already covers %d paths, not creating another", inProgress, len(paths))
+		return ErrCDNInvalidationSkipped
+	}
+
+	response, err := c.client.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(c.distributionId),
+		InvalidationBatch: &cftypes.InvalidationBatch{
+			CallerReference: aws.String(uuid.NewString()),
+			Paths: &cftypes.Paths{
+				Quantity: aws.Int32(int32(len(paths))),
+				Items:    paths,
+			},
+		},
+	})
+	if err != nil {
+		return classifyCloudFrontError(err)
+	}
+	LoggerFromContext(ctx).Info("InvalidatePaths created invalidation %s for %d paths", aws.ToString(response.Invalidation.Id), len(paths))
+	return nil
+}
+
+/*
+findInProgress returns the ID of an invalidation that is in progress and covers every one of `paths`, or an empty
+string if there isn't one.  Only the most recent invalidations are looked at, since that is where any in progress
+ones will be.
+*/
+func (c *CloudFrontInvalidator) findInProgress(ctx context.Context, paths []string) (string, error) {
+	listed, err := c.client.ListInvalidations(ctx, &cloudfront.ListInvalidationsInput{
+		DistributionId: aws.String(c.distributionId),
+		MaxItems:       aws.Int32(20),
+	})
+	if err != nil {
+		return "", err
+	}
+	if listed.InvalidationList == nil {
+		return "", nil
+	}
+	for _, summary := range listed.InvalidationList.Items {
+		if aws.ToString(summary.Status) != "InProgress" {
+			continue
+		}
+		invalidation, err := c.client.GetInvalidation(ctx, &cloudfront.GetInvalidationInput{
+			DistributionId: aws.String(c.distributionId),
+			Id:             summary.Id,
+		})
+		if err != nil {
+			return "", err
+		}
+		if invalidation.Invalidation != nil && invalidation.Invalidation.InvalidationBatch != nil &&
+			invalidation.Invalidation.InvalidationBatch.Paths != nil &&
+			coversPaths(invalidation.Invalidation.InvalidationBatch.Paths.Items, paths) {
+			return aws.ToString(summary.Id), nil
+		}
+	}
+	return "", nil
+}
+
+/*
+coversPaths returns true if every one of `wanted` is in `have`
+*/
+func coversPaths(have []string, wanted []string) bool {
+	haveSet := make(map[string]bool, len(have))
+	for _, path := range have {
+		haveSet[path] = true
+	}
+	for _, path := range wanted {
+		if !haveSet[path] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+classifyCloudFrontError wraps the errors that mean "not now" in ErrCDNThrottled
+*/
+func classifyCloudFrontError(err error) error {
+	var tooMany *cftypes.TooManyInvalidationsInProgress
+	var apiErr smithy.APIError
+	if errors.As(err, &tooMany) || (errors.As(err, &apiErr) && apiErr.ErrorCode() == "Throttling") {
+		return fmt.Errorf("%w: %s", ErrCDNThrottled, err)
+	}
+	return err
+}
@@ -0,0 +1,29 @@
+package common
+
+import "context"
+
+type CacheInvalidatorMock struct {
+	KeysInvalidated []string
+	Err             error
+}
+
+func (m *CacheInvalidatorMock) InvalidateKeys(ctx context.Context, keys []string) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	m.KeysInvalidated = append(m.KeysInvalidated, keys...)
+	return nil
+}
+
+type CDNInvalidatorMock struct {
+	PathsInvalidated [][]string
+	Err              error
+}
+
+func (m *CDNInvalidatorMock) InvalidatePaths(ctx context.Context, paths []string) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	m.PathsInvalidated = append(m.PathsInvalidated, paths)
+	return nil
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/aws/smithy-go"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testIdMappingStreamArn = "arn:aws:dynamodb:eu-west-1:123456789012:table/id-mapping-table/stream/2024-01-01T00:00:00.000"
+const testEncodingsStreamArn = "arn:aws:dynamodb:eu-west-1:123456789012:table/encodings-table/stream/2024-01-01T00:00:00.000"
+
+func TestResolutionCacheKey(t *testing.T) {
+	if key := ResolutionCacheKey("file", "mygreatvideo"); key != "resolve:file:mygreatvideo" {
+		t.Errorf("Unexpected key %s", key)
+	}
+	key := ResolutionCacheKey("file", "my great video")
+	if strings.Contains(key, " ") || !strings.HasPrefix(key, "resolve:file:sha1:") {
+		t.Errorf("A key with spaces should be hashed, got %s", key)
+	}
+	if key := ResolutionCacheKey("file", strings.Repeat("a", 300)); len(key) > 250 {
+		t.Errorf("A long key should be hashed, got %d characters", len(key))
+	}
+}
+
+func TestCollectInvalidations(t *testing.T) {
+	config := &ConfigMock{IdMappingTableVal: "id-mapping-table", EncodingsTableVal: "encodings-table"}
+	ops := &DynamoOpsMock{
+		FilebasesForContentId:  map[int64][]string{1234: {"mygreatvideo", "myoldvideo"}},
+		OctopusIdsForContentId: map[int64][]int64{1234: {34567}},
+	}
+	records := []events.DynamoDBEventRecord{
+		{
+			EventName:      "MODIFY",
+			EventSourceArn: testIdMappingStreamArn,
+			Change: events.DynamoDBStreamRecord{
+				OldImage: map[string]events.DynamoDBAttributeValue{"filebase": events.NewStringAttribute("renamedvideo")},
+				NewImage: map[string]events.DynamoDBAttributeValue{
+					"filebase":   events.NewStringAttribute("anothervideo"),
+					"octopus_id": events.NewNumberAttribute("11111"),
+				},
+			},
+		},
+		{
+			EventName:      "INSERT",
+			EventSourceArn: testEncodingsStreamArn,
+			Change: events.DynamoDBStreamRecord{
+				NewImage: map[string]events.DynamoDBAttributeValue{
+					"encodingid": events.NewNumberAttribute("123"),
+					"contentid":  events.NewNumberAttribute("1234"),
+				},
+			},
+		},
+	}
+
+	result, err := CollectInvalidations(context.Background(), records, config, ops)
+	if err != nil {
+		t.Fatalf("CollectInvalidations returned an unexpected error: %s", err)
+	}
+	expectedKeys := []string{
+		"resolve:file:anothervideo",
+		"resolve:file:mygreatvideo",
+		"resolve:file:myoldvideo",
+		"resolve:file:renamedvideo",
+		"resolve:octopusid:11111",
+		"resolve:octopusid:34567",
+	}
+	if !reflect.DeepEqual(result.CacheKeys(), expectedKeys) {
+		t.Errorf("Unexpected cache keys %v", result.CacheKeys())
+	}
+
+	ops.LookupsForContentIdError = errors.New("kaboom")
+	result, err = CollectInvalidations(context.Background(), records, config, ops)
+	if err == nil {
+		t.Error("Expected an error if the filebases could not be found")
+	}
+	if !result.OctopusIds[11111] || !result.Filebases["anothervideo"] {
+		t.Error("Everything that could be found should still be returned")
+	}
+}
+
+/*
+A change to an encoding must invalidate the same lookups as a change to the idmapping record that the lookups find it
+through, and nothing that only shares its octopus ID
+*/
+func TestCollectInvalidationsSameKeysForBothTables(t *testing.T) {
+	config := &ConfigMock{IdMappingTableVal: "id-mapping-table", EncodingsTableVal: "encodings-table"}
+	ops := testMemoryOps(t)
+	idMappingImage := map[string]events.DynamoDBAttributeValue{
+		"uuid":       events.NewStringAttribute("b"),
+		"contentid":  events.NewNumberAttribute("1234"),
+		"filebase":   events.NewStringAttribute("myfile"),
+		"octopus_id": events.NewNumberAttribute("5678"),
+		"lastupdate": events.NewStringAttribute("2020-01-01T00:00:00Z"),
+	}
+	encodingImage := map[string]events.DynamoDBAttributeValue{
+		"encodingid": events.NewNumberAttribute("1"),
+		"contentid":  events.NewNumberAttribute("1234"),
+		"octopus_id": events.NewNumberAttribute("5678"),
+	}
+
+	fromIdMapping, err := CollectInvalidations(context.Background(), []events.DynamoDBEventRecord{
+		{EventName: "MODIFY", EventSourceArn: testIdMappingStreamArn, Change: events.DynamoDBStreamRecord{NewImage: idMappingImage}},
+	}, config, ops)
+	if err != nil {
+		t.Fatalf("CollectInvalidations returned an unexpected error: %s", err)
+	}
+	fromEncoding, err := CollectInvalidations(context.Background(), []events.DynamoDBEventRecord{
+		{EventName: "MODIFY", EventSourceArn: testEncodingsStreamArn, Change: events.DynamoDBStreamRecord{NewImage: encodingImage}},
+	}, config, ops)
+	if err != nil {
+		t.Fatalf("CollectInvalidations returned an unexpected error: %s", err)
+	}
+
+	expectedKeys := []string{ResolutionCacheKey("file", "myfile"), ResolutionCacheKey("octopusid", "5678")}
+	if !reflect.DeepEqual(fromIdMapping.CacheKeys(), expectedKeys) {
+		t.Errorf("Unexpected cache keys from the idmapping record %v", fromIdMapping.CacheKeys())
+	}
+	if !reflect.DeepEqual(fromEncoding.CacheKeys(), expectedKeys) {
+		t.Errorf("Unexpected cache keys from the encoding %v", fromEncoding.CacheKeys())
+	}
+
+	delete(encodingImage, "contentid")
+	result, err := CollectInvalidations(context.Background(), []events.DynamoDBEventRecord{
+		{EventName: "MODIFY", EventSourceArn: testEncodingsStreamArn, Change: events.DynamoDBStreamRecord{NewImage: encodingImage}},
+	}, config, ops)
+	if err != nil || !result.IsEmpty() {
+		t.Errorf("An encoding with no contentid can't be found by any lookup, got %v, %v", result.CacheKeys(), err)
+	}
+}
+
+func TestCloudFrontPaths(t *testing.T) {
+	if paths := NewInvalidationSet().CloudFrontPaths(); len(paths) != 0 {
+		t.Errorf("Nothing should be invalidated for an empty set, got %v", paths)
+	}
+
+	set := NewInvalidationSet()
+	set.Filebases["my video"] = true
+	set.OctopusIds[34567] = true
+	expected := []string{
+		"/interactivevideos/mediatag.php*",
+		"/interactivevideos/reference.php*",
+		"/interactivevideos/video.php*",
+	}
+	if !reflect.DeepEqual(set.CloudFrontPaths(), expected) {
+		t.Errorf("Unexpected paths %v", set.CloudFrontPaths())
+	}
+	for _, path := range set.CloudFrontPaths() {
+		if strings.Contains(path, "?") || strings.Index(path, "*") != len(path)-1 {
+			t.Errorf("%s would not be matched by CloudFront, the only wildcard must be at the end and there can't be a query string", path)
+		}
+	}
+}
+
+func TestCoversPaths(t *testing.T) {
+	inProgress := []string{"/interactivevideos/mediatag.php*", "/interactivevideos/reference.php*", "/interactivevideos/video.php*"}
+	if !coversPaths(inProgress, []string{"/interactivevideos/video.php*", "/interactivevideos/reference.php*"}) {
+		t.Error("Expected the paths to be covered")
+	}
+	if coversPaths(inProgress[1:], inProgress) {
+		t.Error("An invalidation without mediatag.php* does not cover it")
+	}
+}
+
+func TestClassifyCloudFrontError(t *testing.T) {
+	if err := classifyCloudFrontError(&cftypes.TooManyInvalidationsInProgress{}); !errors.Is(err, ErrCDNThrottled) {
+		t.Errorf("TooManyInvalidationsInProgress should be throttling, got %s", err)
+	}
+	if err := classifyCloudFrontError(&smithy.GenericAPIError{Code: "Throttling"}); !errors.Is(err, ErrCDNThrottled) {
+		t.Errorf("Throttling should be throttling, got %s", err)
+	}
+	if err := classifyCloudFrontError(&cftypes.NoSuchDistribution{}); errors.Is(err, ErrCDNThrottled) {
+		t.Errorf("NoSuchDistribution should not be throttling, got %s", err)
+	}
+}
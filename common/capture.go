@@ -0,0 +1,302 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CaptureSinkNone = "none"
+const CaptureSinkDynamo = "dynamo"
+const CaptureSinkJSONL = "jsonl"
+
+// longest that writing a captured record can hold up the response
+const captureWriteTimeout = 250 * time.Millisecond
+
+/*
+CapturedRequest is a request and the response that was sent to it.  The json form is the same as the corpus files
+read by test-against-captureddata, and the Dynamo form is the same as the captured-data table that the PHP wrote,
+so captures from the Go endpoints can be used as regression tests in the same way.
+*/
+type CapturedRequest struct {
+	Uid          uuid.UUID         `json:"uid"`
+	Timestamp    time.Time         `json:"timestamp"`
+	AccessUrl    string            `json:"access_url"`
+	Body         string            `json:"output_message"`
+	Headers      map[string]string `json:"headers"`
+	ResponseCode int               `json:"response_code"`
+}
+
+/*
+toDynamo converts the record into the form used by the captured-data table
+*/
+func (c *CapturedRequest) toDynamo() RawDynamoRecord {
+	headerNames := make([]string, 0, len(c.Headers))
+	for name := range c.Headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	headers := make([]types.AttributeValue, 0, len(headerNames))
+	for _, name := range headerNames {
+		headers = append(headers, &types.AttributeValueMemberS{Value: name + ": " + c.Headers[name]})
+	}
+
+	record := RawDynamoRecord{
+		"uid":           &types.AttributeValueMemberS{Value: c.Uid.String()},
+		"timestamp":     &types.AttributeValueMemberS{Value: c.Timestamp.UTC().Format(time.RFC3339)},
+		"access_url":    &types.AttributeValueMemberS{Value: c.AccessUrl},
+		"php_headers":   &types.AttributeValueMemberL{Value: headers},
+		"response_code": &types.AttributeValueMemberN{Value: strconv.Itoa(c.ResponseCode)},
+	}
+	if c.Body == "" {
+		record["output_message"] = &types.AttributeValueMemberNULL{Value: true}
+	} else {
+		record["output_message"] = &types.AttributeValueMemberS{Value: c.Body}
+	}
+	return record
+}
+
+/*
+CaptureSink is somewhere that captured requests are written to
+*/
+type CaptureSink interface {
+	Write(ctx context.Context, record *CapturedRequest) error
+}
+
+/*
+DynamoCaptureSink writes captured requests to a DynamoDB table with the same layout as the PHP captured-data table
+*/
+type DynamoCaptureSink struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoCaptureSink(client *dynamodb.Client, tableName string) *DynamoCaptureSink {
+	return &DynamoCaptureSink{client: client, tableName: tableName}
+}
+
+func (s *DynamoCaptureSink) Write(ctx context.Context, record *CapturedRequest) error {
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      record.toDynamo(),
+	})
+	return err
+}
+
+/*
+JSONLCaptureSink writes captured requests to a stream as JSON Lines, e.g. a local file when running the endpoints on a
+development machine
+*/
+type JSONLCaptureSink struct {
+	out  io.Writer
+	lock sync.Mutex
+}
+
+func NewJSONLCaptureSink(out io.Writer) *JSONLCaptureSink {
+	return &JSONLCaptureSink{out: out}
+}
+
+func (s *JSONLCaptureSink) Write(ctx context.Context, record *CapturedRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.out.Write(append(content, '\n'))
+	return err
+}
+
+/*
+Capture records a sample of requests and their responses to a CaptureSink.  Each sampled record is written before the
+handler returns, because Lambda freezes the environment between invocations and anything left to a background
+goroutine could be lost.  The write is bounded by captureWriteTimeout so that a slow sink only holds up a sampled
+response by that much, and if it fails the record is dropped and counted rather than failing the request.
+
+All methods are safe to call on a nil pointer, which is what NewCaptureFromEnvironment returns when capturing is off.
+*/
+type Capture struct {
+	sink          CaptureSink
+	samplePercent float64
+	timeout       time.Duration
+	random        *rand.Rand
+	randomLock    sync.Mutex
+}
+
+/*
+NewCapture starts capturing `samplePercent` percent of requests to the given sink
+*/
+func NewCapture(sink CaptureSink, samplePercent float64) *Capture {
+	return &Capture{
+		sink:          sink,
+		samplePercent: samplePercent,
+		timeout:       captureWriteTimeout,
+		random:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+/*
+NewCaptureFromEnvironment sets up capturing as given by the environment, or returns nil if it is turned off:
+- CAPTURE_SINK - "dynamo", "jsonl" or "none" (the default)
+- CAPTURE_TABLE - for "dynamo", the table to write to
+- CAPTURE_FILE - for "jsonl", the file to append to
+- CAPTURE_SAMPLE_PERCENT - percentage of requests to capture, defaults to 1
+*/
+func NewCaptureFromEnvironment(config Config) (*Capture, error) {
+	sinkName := strings.ToLower(strings.TrimSpace(os.Getenv("CAPTURE_SINK")))
+	if sinkName == "" || sinkName == CaptureSinkNone {
+		return nil, nil
+	}
+
+	samplePercent := 1.0
+	if percentString := os.Getenv("CAPTURE_SAMPLE_PERCENT"); percentString != "" {
+		var err error
+		samplePercent, err = strconv.ParseFloat(percentString, 64)
+		if err != nil || samplePercent < 0 || samplePercent > 100 {
+			return nil, errors.New("CAPTURE_SAMPLE_PERCENT must be a number from 0 to 100")
+		}
+	}
+
+	var sink CaptureSink
+	switch sinkName {
+	case CaptureSinkDynamo:
+		tableName := os.Getenv("CAPTURE_TABLE")
+		if tableName == "" {
+			return nil, errors.New("CAPTURE_TABLE is not set")
+		}
+		sink = NewDynamoCaptureSink(config.GetDynamoClient(), tableName)
+	case CaptureSinkJSONL:
+		filename := os.Getenv("CAPTURE_FILE")
+		if filename == "" {
+			return nil, errors.New("CAPTURE_FILE is not set")
+		}
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		sink = NewJSONLCaptureSink(f)
+	default:
+		return nil, errors.New(fmt.Sprintf("capture sink '%s' is not recognised", sinkName))
+	}
+	DefaultLogger.Info("NewCaptureFromEnvironment capturing %.2f%% of requests to %s", samplePercent, sinkName)
+	return NewCapture(sink, samplePercent), nil
+}
+
+func (c *Capture) sampled() bool {
+	if c.samplePercent >= 100 {
+		return true
+	}
+	c.randomLock.Lock()
+	defer c.randomLock.Unlock()
+	return c.random.Float64()*100 < c.samplePercent
+}
+
+/*
+accessUrl rebuilds the URL that the request was made to, in the same form as the PHP captured it
+*/
+func accessUrl(event *events.APIGatewayProxyRequest) string {
+	host := event.Headers["Host"]
+	if host == "" {
+		host = event.Headers["host"]
+	}
+	if host == "" {
+		host = event.RequestContext.DomainName
+	}
+
+	query := url.Values{}
+	for k, v := range event.QueryStringParameters {
+		query.Set(k, v)
+	}
+	for k, values := range event.MultiValueQueryStringParameters {
+		query[k] = values
+	}
+	query.Del("explain_key") //never store a secret in the corpus
+	accessUrl := "https://" + host + event.Path
+	if len(query) > 0 {
+		accessUrl += "?" + query.Encode()
+	}
+	return accessUrl
+}
+
+/*
+Record writes a request and its response to the sink, if it is in the sample.  The write is part of the request's
+trace and gives up after the capture's timeout, or sooner if `ctx` is cancelled.
+*/
+func (c *Capture) Record(ctx context.Context, event *events.APIGatewayProxyRequest, response *events.APIGatewayProxyResponse) {
+	if c == nil || response == nil || !c.sampled() {
+		return
+	}
+
+	body := response.Body
+	if response.IsBase64Encoded {
+		if decoded, err := base64.StdEncoding.DecodeString(body); err == nil {
+			body = string(decoded)
+		}
+	}
+	headers := make(map[string]string, len(response.Headers)+len(response.MultiValueHeaders))
+	for k, v := range response.Headers {
+		headers[k] = v
+	}
+	for k, values := range response.MultiValueHeaders {
+		headers[k] = strings.Join(values, ";")
+	}
+
+	record := &CapturedRequest{
+		Uid:          uuid.New(),
+		Timestamp:    time.Now(),
+		AccessUrl:    accessUrl(event),
+		Body:         body,
+		Headers:      headers,
+		ResponseCode: response.StatusCode,
+	}
+
+	ctx, span := StartSpan(ctx, "CaptureRecord")
+	writeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	err := c.sink.Write(writeCtx, record)
+	EndSpan(span, err)
+	if err != nil {
+		MetricsFromContext(ctx).PutCount(MetricCaptureFailed)
+		LoggerFromContext(ctx).Warning("Capture could not write record for %s: %s", record.AccessUrl, err)
+		return
+	}
+	MetricsFromContext(ctx).PutCount(MetricCapturedRequests)
+}
+
+/*
+CaptureHandler wraps an endpoint's handler so that a sample of its requests and responses are recorded.  If capture is
+nil the handler is returned as it is.
+It should go inside InstrumentHandler, so that requests in explain mode can be left out: their responses are replaced
+afterwards, so they would never match when replayed.
+*/
+func CaptureHandler(capture *Capture, handler EndpointHandler) EndpointHandler {
+	if capture == nil {
+		return handler
+	}
+	return func(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+		response, err := handler(ctx, event)
+		if err == nil && ExplanationFromContext(ctx) == nil {
+			capture.Record(ctx, event, response)
+		}
+		return response, err
+	}
+}
@@ -0,0 +1,184 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureTestRequest() *events.APIGatewayProxyRequest {
+	return &events.APIGatewayProxyRequest{
+		Path:    "/interactivevideos/video.php",
+		Headers: map[string]string{"Host": "multimedia.example.com"},
+		QueryStringParameters: map[string]string{
+			"octopusid":   "5678",
+			"format":      "video/webm",
+			"explain_key": "sekrit",
+		},
+		MultiValueQueryStringParameters: map[string][]string{
+			"format": {"video/mp4", "video/webm"},
+		},
+	}
+}
+
+/*
+accessUrl should give a URL in the same form as the PHP captured, without any explain key
+*/
+func TestCaptureAccessUrl(t *testing.T) {
+	result := accessUrl(captureTestRequest())
+	expected := "https://multimedia.example.com/interactivevideos/video.php?format=video%2Fmp4&format=video%2Fwebm&octopusid=5678"
+	if result != expected {
+		t.Errorf("expected %s got %s", expected, result)
+	}
+
+	noHost := &events.APIGatewayProxyRequest{
+		Path:           "/interactivevideos/reference.php",
+		RequestContext: events.APIGatewayProxyRequestContext{DomainName: "api.example.com"},
+	}
+	if result := accessUrl(noHost); result != "https://api.example.com/interactivevideos/reference.php" {
+		t.Errorf("expected the API Gateway domain name to be used without a Host header, got %s", result)
+	}
+}
+
+/*
+CaptureHandler should write sampled requests to the sink in the corpus format before it returns
+*/
+func TestCaptureHandler(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	capture := NewCapture(NewJSONLCaptureSink(buffer), 100)
+	handler := CaptureHandler(capture, func(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+		return &events.APIGatewayProxyResponse{
+			StatusCode: 302,
+			Headers:    map[string]string{"Location": "https://cdn.example.com/low.webm"},
+		}, nil
+	})
+
+	ctx := ContextWithMetrics(context.Background(), NewMetrics(&bytes.Buffer{}, "test-namespace"))
+	for i := 0; i < 2; i++ {
+		if _, err := handler(ctx, captureTestRequest()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	explainCtx := ContextWithExplanation(ctx, &Explanation{})
+	handler(explainCtx, captureTestRequest())
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records without the explain request, got %d: %s", len(lines), buffer.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("record was not valid json: %s", err)
+	}
+	for _, field := range []string{"uid", "timestamp", "access_url", "output_message", "headers", "response_code"} {
+		if _, haveField := record[field]; !haveField {
+			t.Errorf("record was missing %s: %s", field, lines[0])
+		}
+	}
+	if record["response_code"] != float64(302) || record["headers"].(map[string]interface{})["Location"] != "https://cdn.example.com/low.webm" {
+		t.Errorf("record did not have the response: %s", lines[0])
+	}
+}
+
+/*
+A sample percentage of 0 should never capture anything, and a nil Capture should be a no-op
+*/
+func TestCaptureSampling(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	capture := NewCapture(NewJSONLCaptureSink(buffer), 0)
+	for i := 0; i < 100; i++ {
+		capture.Record(context.Background(), captureTestRequest(), &events.APIGatewayProxyResponse{StatusCode: 200})
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("expected nothing to be captured, got %s", buffer.String())
+	}
+
+	var nilCapture *Capture
+	nilCapture.Record(context.Background(), captureTestRequest(), &events.APIGatewayProxyResponse{StatusCode: 200})
+}
+
+/*
+slowCaptureSink never finishes a write until it is cancelled
+*/
+type slowCaptureSink struct{}
+
+func (s *slowCaptureSink) Write(ctx context.Context, record *CapturedRequest) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+/*
+A sink that can't keep up should only hold up the response until the timeout, and the failure should be counted
+*/
+func TestCaptureWriteTimeout(t *testing.T) {
+	capture := NewCapture(&slowCaptureSink{}, 100)
+	capture.timeout = 20 * time.Millisecond
+	metricsOut := &bytes.Buffer{}
+	metrics := NewMetrics(metricsOut, "test-namespace")
+
+	start := time.Now()
+	capture.Record(ContextWithMetrics(context.Background(), metrics), captureTestRequest(), &events.APIGatewayProxyResponse{StatusCode: 200})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Record should have given up after the timeout, took %s", elapsed)
+	}
+	metrics.Flush()
+	if !strings.Contains(metricsOut.String(), MetricCaptureFailed) || strings.Contains(metricsOut.String(), MetricCapturedRequests) {
+		t.Errorf("expected only a failed capture to be counted, got %s", metricsOut.String())
+	}
+}
+
+/*
+toDynamo should give a record in the same layout as the PHP captured-data table
+*/
+func TestCapturedRequestToDynamo(t *testing.T) {
+	record := (&CapturedRequest{
+		AccessUrl:    "https://multimedia.example.com/interactivevideos/reference.php?file=a",
+		Headers:      map[string]string{"Content-Type": "text/plain", "Access-Control-Allow-Origin": "*"},
+		ResponseCode: 404,
+	}).toDynamo()
+
+	headers := record["php_headers"].(*types.AttributeValueMemberL).Value
+	if len(headers) != 2 || headers[0].(*types.AttributeValueMemberS).Value != "Access-Control-Allow-Origin: *" {
+		t.Errorf("got unexpected headers %v", headers)
+	}
+	if _, isNull := record["output_message"].(*types.AttributeValueMemberNULL); !isNull {
+		t.Error("an empty body should be stored as null")
+	}
+	if record["response_code"].(*types.AttributeValueMemberN).Value != "404" {
+		t.Errorf("got unexpected response code %v", record["response_code"])
+	}
+}
+
+/*
+NewCaptureFromEnvironment should be off by default, and check its settings
+*/
+func TestNewCaptureFromEnvironment(t *testing.T) {
+	t.Setenv("CAPTURE_SINK", "")
+	capture, err := NewCaptureFromEnvironment(&ConfigMock{})
+	if capture != nil || err != nil {
+		t.Errorf("expected capture to be off, got %v %v", capture, err)
+	}
+
+	t.Setenv("CAPTURE_SINK", "jsonl")
+	t.Setenv("CAPTURE_FILE", filepath.Join(t.TempDir(), "capture.jsonl"))
+	t.Setenv("CAPTURE_SAMPLE_PERCENT", "")
+	capture, err = NewCaptureFromEnvironment(&ConfigMock{})
+	if err != nil || capture == nil || capture.samplePercent != 1 {
+		t.Errorf("expected a jsonl capture at 1%%, got %v %v", capture, err)
+	}
+
+	for sink, percent := range map[string]string{"jsonl": "101", "dynamo": "10", "kinesis": "10"} {
+		t.Setenv("CAPTURE_SINK", sink)
+		t.Setenv("CAPTURE_TABLE", "")
+		t.Setenv("CAPTURE_SAMPLE_PERCENT", percent)
+		if _, err := NewCaptureFromEnvironment(&ConfigMock{}); err == nil {
+			t.Errorf("expected an error for %s at %s%%", sink, percent)
+		}
+	}
+}
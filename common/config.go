@@ -3,10 +3,12 @@ package common
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"log"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"os"
 	"strconv"
 )
@@ -16,12 +18,15 @@ type ConfigImpl struct {
 	idMappingTable                string
 	MimeEquivalentsTable          string
 	PosterFramesTable             string
+	AuditTable                    string
 	MemcacheHost                  string
 	MemcachePort                  int16
 	MemcacheExpirySeconds         int16
 	MemcacheNotfoundExpirySeconds int16
 	awsClientsConfig              aws.Config
 	ddbClient                     *dynamodb.Client
+	s3Client                      *s3.Client
+	cloudFrontClient              *cloudfront.Client
 }
 
 /*
@@ -29,9 +34,14 @@ Config is exposed as an interface to allow for mocking
 */
 type Config interface {
 	GetDynamoClient() *dynamodb.Client
+	GetS3Client() *s3.Client
+	GetCloudFrontClient() *cloudfront.Client
 	IdMappingTable() string
 	EncodingsTablePtr() *string
 	MimeEquivalentsTablePtr() *string
+	PosterFramesTablePtr() *string
+	AuditTablePtr() *string
+	MemcacheServer() string
 }
 
 /*
@@ -48,18 +58,21 @@ func NewConfig() (Config, error) {
 		os.Getenv("ID_MAPPING_TABLE"),
 		os.Getenv("MIME_EQUIVALENTS_TABLE"),
 		os.Getenv("POSTER_FRAMES_TABLE"),
+		os.Getenv("AUDIT_TABLE"), //only needed by the write API
 		os.Getenv("MEMCACHE_HOST"),
 		11211,
 		240,
 		10,
 		awscfg,
 		dynamodb.NewFromConfig(awscfg),
+		s3.NewFromConfig(awscfg),
+		cloudfront.NewFromConfig(awscfg),
 	}
 
 	if os.Getenv("MEMCACHE_PORT") != "" {
 		maybeNewPort, err := strconv.ParseInt(os.Getenv("MEMCACHE_PORT"), 10, 16)
 		if err != nil {
-			log.Printf("ERROR NewConfig MEMCACHE_PORT is not a valid number: %s", err)
+			DefaultLogger.Error("NewConfig MEMCACHE_PORT is not a valid number: %s", err)
 			return nil, errors.New("MEMCACHE_PORT not valid")
 		}
 		basicConfig.MemcachePort = int16(maybeNewPort)
@@ -79,6 +92,14 @@ func (c *ConfigImpl) GetDynamoClient() *dynamodb.Client {
 	return c.ddbClient
 }
 
+func (c *ConfigImpl) GetS3Client() *s3.Client {
+	return c.s3Client
+}
+
+func (c *ConfigImpl) GetCloudFrontClient() *cloudfront.Client {
+	return c.cloudFrontClient
+}
+
 func (c *ConfigImpl) IdMappingTable() string {
 	return c.idMappingTable
 }
@@ -90,3 +111,21 @@ func (c *ConfigImpl) EncodingsTablePtr() *string {
 func (c *ConfigImpl) MimeEquivalentsTablePtr() *string {
 	return aws.String(c.MimeEquivalentsTable)
 }
+
+func (c *ConfigImpl) PosterFramesTablePtr() *string {
+	return aws.String(c.PosterFramesTable)
+}
+
+func (c *ConfigImpl) AuditTablePtr() *string {
+	return aws.String(c.AuditTable)
+}
+
+/*
+MemcacheServer returns the host:port of the memcached server, or an empty string if MEMCACHE_HOST is not set
+*/
+func (c *ConfigImpl) MemcacheServer() string {
+	if c.MemcacheHost == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", c.MemcacheHost, c.MemcachePort)
+}
@@ -2,7 +2,9 @@ package common
 
 import (
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 type ConfigMock struct {
@@ -14,6 +16,14 @@ func (c *ConfigMock) GetDynamoClient() *dynamodb.Client {
 	panic("GetDynamoClient should not be called on the mock")
 }
 
+func (c *ConfigMock) GetS3Client() *s3.Client {
+	panic("GetS3Client should not be called on the mock")
+}
+
+func (c *ConfigMock) GetCloudFrontClient() *cloudfront.Client {
+	panic("GetCloudFrontClient should not be called on the mock")
+}
+
 func (c *ConfigMock) IdMappingTable() string {
 	return c.IdMappingTableVal
 }
@@ -26,3 +36,15 @@ func (c *ConfigMock) EncodingsTablePtr() *string {
 func (c *ConfigMock) MimeEquivalentsTablePtr() *string {
 	return aws.String("mime-equivalents")
 }
+
+func (c *ConfigMock) PosterFramesTablePtr() *string {
+	return aws.String("poster-frames")
+}
+
+func (c *ConfigMock) AuditTablePtr() *string {
+	return aws.String("audit")
+}
+
+func (c *ConfigMock) MemcacheServer() string {
+	return ""
+}
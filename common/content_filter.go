@@ -1,7 +1,8 @@
 package common
 
 import (
-	"log"
+	"context"
+	"go.opentelemetry.io/otel/attribute"
 	"time"
 )
 
@@ -17,65 +18,87 @@ func isStringInList(needle *string, haystack *[]string) bool {
 	return false
 }
 
+// names of the criteria that an encoding can be rejected on. These match the query parameters that set them.
+const FilterCriterionFormat = "format"
+const FilterCriterionMobile = "need_mobile"
+const FilterCriterionMinBitrate = "minbitrate"
+const FilterCriterionMaxBitrate = "maxbitrate"
+const FilterCriterionMinHeight = "minheight"
+const FilterCriterionMaxHeight = "maxheight"
+const FilterCriterionMinWidth = "minwidth"
+const FilterCriterionMaxWidth = "maxwidth"
+const FilterCriterionWithdrawn = "withdrawn" //not really a filter criterion, withdrawn encodings are removed before filtering
+
 /*
-TestEncoding Output true if the encoding should pass the filter and false if it should not
-Arguments:
-- encoding - A pointer to Encoding
-- format - The required format
-- need_mobile - Set this to true if a mobile encoding is required
-- minbitrate - The minimum required bit rate
-- maxbitrate - The maximum required bit rate
-- minheight - The minimum required frame height
-- maxheight - The maximum required frame height
-- minwidth - The minimum required frame width
-- maxwidth - The maximum required frame width
-Returns:
-- bool - true if the encoding should pass and false if it should not
+encodingRejectionReason checks the encoding against the filter and returns the name of the first criterion that it
+fails on (one of the FilterCriterion* constants), or an empty string if it passes.
+See TestEncoding for a description of the arguments
 */
-func TestEncoding(encoding *Encoding, formats *[]string, need_mobile bool, minbitrate int32, maxbitrate int32, minheight int32, maxheight int32, minwidth int32, maxwidth int32) bool {
-	log.Printf("DEBUG ContentFilter.TestEncoding parameters are need_mobile=%v minbitrate=%d maxbitrate=%d minheight=%d maxheight=%d minwidth=%d maxwidth %d", need_mobile, minbitrate, maxbitrate, minheight, maxheight, minwidth, maxwidth)
-	log.Printf("DEBUG ContentFilter.TestEncoding encoding's format is %s, potential formats list is %v", encoding.Format, *formats)
+func encodingRejectionReason(ctx context.Context, encoding *Encoding, formats *[]string, need_mobile bool, minbitrate int32, maxbitrate int32, minheight int32, maxheight int32, minwidth int32, maxwidth int32) string {
+	logger := LoggerFromContext(ctx)
+	logger.Debug("ContentFilter.TestEncoding parameters are need_mobile=%v minbitrate=%d maxbitrate=%d minheight=%d maxheight=%d minwidth=%d maxwidth %d", need_mobile, minbitrate, maxbitrate, minheight, maxheight, minwidth, maxwidth)
+	logger.Debug("ContentFilter.TestEncoding encoding's format is %s, potential formats list is %v", encoding.Format, *formats)
 	if len(*formats) > 0 && !isStringInList(&encoding.Format, formats) {
-		log.Printf("DEBUG ContentFilter.TestEncoding %s discounted on format", encoding.Url)
-		return false
+		logger.Debug("ContentFilter.TestEncoding %s discounted on format", encoding.Url)
+		return FilterCriterionFormat
 	}
 
 	if need_mobile && !encoding.Mobile { //if need_mobile is false that means "don't discount on basis of mobile flag"
-		log.Printf("DEBUG ContentFilter.TestEncoding %s discounted on mobile", encoding.Url)
-		return false
+		logger.Debug("ContentFilter.TestEncoding %s discounted on mobile", encoding.Url)
+		return FilterCriterionMobile
 	}
 
 	if (encoding.VBitrate < minbitrate) && (minbitrate != 0) {
-		log.Printf("DEBUG ContentFilter.TestEncoding %s discounted on min vbitrate", encoding.Url)
-		return false
+		logger.Debug("ContentFilter.TestEncoding %s discounted on min vbitrate", encoding.Url)
+		return FilterCriterionMinBitrate
 	}
 
 	if (encoding.VBitrate > maxbitrate) && (maxbitrate != 0) {
-		log.Printf("DEBUG ContentFilter.TestEncoding %s discounted on max vbitrate", encoding.Url)
-		return false
+		logger.Debug("ContentFilter.TestEncoding %s discounted on max vbitrate", encoding.Url)
+		return FilterCriterionMaxBitrate
 	}
 
 	if (encoding.FrameHeight < minheight) && (minheight != 0) {
-		log.Printf("DEBUG ContentFilter.TestEncoding %s discounted on min height", encoding.Url)
-		return false
+		logger.Debug("ContentFilter.TestEncoding %s discounted on min height", encoding.Url)
+		return FilterCriterionMinHeight
 	}
 
 	if (encoding.FrameHeight > maxheight) && (maxheight != 0) {
-		log.Printf("DEBUG ContentFilter.TestEncoding %s discounted on max height", encoding.Url)
-		return false
+		logger.Debug("ContentFilter.TestEncoding %s discounted on max height", encoding.Url)
+		return FilterCriterionMaxHeight
 	}
 
 	if (encoding.FrameWidth < minwidth) && (minwidth != 0) {
-		log.Printf("DEBUG ContentFilter.TestEncoding %s discounted on min width", encoding.Url)
-		return false
+		logger.Debug("ContentFilter.TestEncoding %s discounted on min width", encoding.Url)
+		return FilterCriterionMinWidth
 	}
 
 	if (encoding.FrameWidth > maxwidth) && (maxwidth != 0) {
-		log.Printf("DEBUG ContentFilter.TestEncoding %s discounted on max width", encoding.Url)
-		return false
+		logger.Debug("ContentFilter.TestEncoding %s discounted on max width", encoding.Url)
+		return FilterCriterionMaxWidth
 	}
 
-	return true
+	return ""
+}
+
+/*
+TestEncoding Output true if the encoding should pass the filter and false if it should not
+Arguments:
+- ctx - context carrying the request logger
+- encoding - A pointer to Encoding
+- format - The required format
+- need_mobile - Set this to true if a mobile encoding is required
+- minbitrate - The minimum required bit rate
+- maxbitrate - The maximum required bit rate
+- minheight - The minimum required frame height
+- maxheight - The maximum required frame height
+- minwidth - The minimum required frame width
+- maxwidth - The maximum required frame width
+Returns:
+- bool - true if the encoding should pass and false if it should not
+*/
+func TestEncoding(ctx context.Context, encoding *Encoding, formats *[]string, need_mobile bool, minbitrate int32, maxbitrate int32, minheight int32, maxheight int32, minwidth int32, maxwidth int32) bool {
+	return encodingRejectionReason(ctx, encoding, formats, need_mobile, minbitrate, maxbitrate, minheight, maxheight, minwidth, maxwidth) == ""
 }
 
 /*
@@ -97,6 +120,7 @@ func mostRecentIndex(encodings []*Encoding) int {
 /*
 ContentFilter Output a pointer to a ContentResult object after filtering an array of pointers to Encoding based on the other arguments
 Arguments:
+- ctx - context carrying the request logger
 - encodings - An array of pointers to Encoding
 - formats - An array of 0 or more strings representing a MIME type. If this is non-zero-length then at least one of the format strings must match.
 - need_mobile - Set this to true if a mobile encoding is required
@@ -109,21 +133,43 @@ Arguments:
 Returns:
 - ContentResult object populated with the best pointer to an Encoding
 */
-func ContentFilter(encodings []*Encoding, formats *[]string, need_mobile bool, minbitrate int32, maxbitrate int32, minheight int32, maxheight int32, minwidth int32, maxwidth int32) *ContentResult {
+func ContentFilter(ctx context.Context, encodings []*Encoding, formats *[]string, need_mobile bool, minbitrate int32, maxbitrate int32, minheight int32, maxheight int32, minwidth int32, maxwidth int32) *ContentResult {
+	result, _ := contentFilterWithReasons(ctx, encodings, formats, need_mobile, minbitrate, maxbitrate, minheight, maxheight, minwidth, maxwidth)
+	return result
+}
+
+/*
+contentFilterWithReasons is ContentFilter but also returns a count of how many encodings were rejected on each of the
+FilterCriterion* constants, so that FindContent can tell the client why nothing matched
+*/
+func contentFilterWithReasons(ctx context.Context, encodings []*Encoding, formats *[]string, need_mobile bool, minbitrate int32, maxbitrate int32, minheight int32, maxheight int32, minwidth int32, maxwidth int32) (*ContentResult, map[string]int) {
+	ctx, span := StartSpan(ctx, "ContentFilter", attribute.Int("input_count", len(encodings)))
+	defer span.End()
+
+	logger := LoggerFromContext(ctx)
+	explanation := ExplanationFromContext(ctx)
 	var encodingsToReturn []*Encoding
+	reasons := map[string]int{}
 	for _, element := range encodings {
-		if TestEncoding(element, formats, need_mobile, minbitrate, maxbitrate, minheight, maxheight, minwidth, maxwidth) {
+		reason := encodingRejectionReason(ctx, element, formats, need_mobile, minbitrate, maxbitrate, minheight, maxheight, minwidth, maxwidth)
+		explanation.AddDecision(element, reason)
+		if reason == "" {
 			encodingsToReturn = append(encodingsToReturn, element)
+		} else {
+			reasons[reason]++
 		}
 	}
 
-	log.Printf("ContentFilter: %d records remaining after filter", len(encodingsToReturn))
-	for _, e := range encodingsToReturn {
-		log.Printf("\t%v", e)
+	logger.Debug("ContentFilter: %d records remaining after filter", len(encodingsToReturn))
+	if logger.IsEnabled(LogLevelDebug) {
+		for _, e := range encodingsToReturn {
+			logger.Debug("ContentFilter: remaining record %v", e)
+		}
 	}
+	span.SetAttributes(attribute.Int("output_count", len(encodingsToReturn)))
 	if len(encodingsToReturn) == 0 {
-		return nil
+		return nil, reasons
 	} else {
-		return &ContentResult{*encodingsToReturn[0], "", ""}
+		return &ContentResult{*encodingsToReturn[0], "", ""}, reasons
 	}
 }
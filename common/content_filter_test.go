@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"reflect"
@@ -21,9 +22,9 @@ Tests that the code which removes records with the wrong format works
 */
 func TestContentFilterFormat(t *testing.T) {
 	formats := []string{"test"}
-	testarray := []*Encoding{{1, 1, "test", "test2", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, {1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}}
-	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, "", ""}
-	result := ContentFilter(testarray, &formats, false, 1, 1, 1, 1, 1, 1)
+	testarray := []*Encoding{{1, 1, "test", "test2", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, {1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}}
+	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, "", ""}
+	result := ContentFilter(context.Background(), testarray, &formats, false, 1, 1, 1, 1, 1, 1)
 	if !reflect.DeepEqual(result, expectedOutput) {
 		t.Errorf("Unexpected output")
 	}
@@ -34,9 +35,9 @@ Should return data that has _any_ of the given formats specified
 */
 func TestContentFilterAlternateFormat(t *testing.T) {
 	formats := []string{"socks", "test"}
-	testarray := []*Encoding{{1, 1, "test", "test2", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, {1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}}
-	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, "", ""}
-	result := ContentFilter(testarray, &formats, false, 1, 1, 1, 1, 1, 1)
+	testarray := []*Encoding{{1, 1, "test", "test2", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, {1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}}
+	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, "", ""}
+	result := ContentFilter(context.Background(), testarray, &formats, false, 1, 1, 1, 1, 1, 1)
 	if !reflect.DeepEqual(result, expectedOutput) {
 		t.Errorf("Unexpected output")
 	}
@@ -47,9 +48,9 @@ Tests that the code which removes records with the wrong mobile setting works
 */
 func TestContentFilterMobile(t *testing.T) {
 	formats := []string{"test"}
-	testarray := []*Encoding{{1, 1, "test", "test", true, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, {1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}}
-	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", true, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, "", ""}
-	result := ContentFilter(testarray, &formats, true, 1, 1, 1, 1, 1, 1)
+	testarray := []*Encoding{{1, 1, "test", "test", true, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, {1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}}
+	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", true, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, "", ""}
+	result := ContentFilter(context.Background(), testarray, &formats, true, 1, 1, 1, 1, 1, 1)
 	if !reflect.DeepEqual(result, expectedOutput) {
 		t.Errorf("Unexpected output")
 	}
@@ -60,9 +61,9 @@ Tests that the code which removes records with too low a bit rate works
 */
 func TestContentFilterMinBitRate(t *testing.T) {
 	formats := []string{"test"}
-	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, {1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}}
-	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, "", ""}
-	result := ContentFilter(testarray, &formats, false, 3000, 6000, 1, 1, 1, 1)
+	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, {1, 1, "test", "test", false, false, "test", "test", 1, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}}
+	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, "", ""}
+	result := ContentFilter(context.Background(), testarray, &formats, false, 3000, 6000, 1, 1, 1, 1)
 	if !reflect.DeepEqual(result, expectedOutput) {
 		t.Errorf("Unexpected output")
 	}
@@ -73,9 +74,9 @@ Tests that the code which removes records with too high a bit rate works
 */
 func TestContentFilterMaxBitRate(t *testing.T) {
 	formats := []string{"test"}
-	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, {1, 1, "test", "test", false, false, "test", "test", 8000, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}}
-	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}, "", ""}
-	result := ContentFilter(testarray, &formats, false, 3000, 6000, 1, 1, 1, 1)
+	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, {1, 1, "test", "test", false, false, "test", "test", 8000, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}}
+	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}, "", ""}
+	result := ContentFilter(context.Background(), testarray, &formats, false, 3000, 6000, 1, 1, 1, 1)
 	if !reflect.DeepEqual(result, expectedOutput) {
 		t.Errorf("Unexpected output")
 	}
@@ -86,9 +87,9 @@ Tests that the code which removes records with too low a frame height works
 */
 func TestContentFilterMinHeight(t *testing.T) {
 	formats := []string{"test"}
-	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1000, 4.0, 1, "test", 1, "test"}, {1, 1, "test", "test", false, false, "test", "test", 4000, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test"}}
-	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1000, 4.0, 1, "test", 1, "test"}, "", ""}
-	result := ContentFilter(testarray, &formats, false, 3000, 6000, 800, 2000, 1, 1)
+	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1000, 4.0, 1, "test", 1, "test", nil}, {1, 1, "test", "test", false, false, "test", "test", 4000, 1, ReturnCorrectTimeObject(), 1, 1, 4.0, 1, "test", 1, "test", nil}}
+	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1000, 4.0, 1, "test", 1, "test", nil}, "", ""}
+	result := ContentFilter(context.Background(), testarray, &formats, false, 3000, 6000, 800, 2000, 1, 1)
 	if !reflect.DeepEqual(result, expectedOutput) {
 		t.Errorf("Unexpected output")
 	}
@@ -99,9 +100,9 @@ Tests that the code which removes records with too high a frame height works
 */
 func TestContentFilterMaxHeight(t *testing.T) {
 	formats := []string{"test"}
-	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1000, 4.0, 1, "test", 1, "test"}, {1, 1, "test", "test", false, false, "test", "test", 4000, 1, ReturnCorrectTimeObject(), 1, 4000, 4.0, 1, "test", 1, "test"}}
-	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1000, 4.0, 1, "test", 1, "test"}, "", ""}
-	result := ContentFilter(testarray, &formats, false, 3000, 6000, 800, 2000, 1, 1)
+	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1000, 4.0, 1, "test", 1, "test", nil}, {1, 1, "test", "test", false, false, "test", "test", 4000, 1, ReturnCorrectTimeObject(), 1, 4000, 4.0, 1, "test", 1, "test", nil}}
+	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1, 1000, 4.0, 1, "test", 1, "test", nil}, "", ""}
+	result := ContentFilter(context.Background(), testarray, &formats, false, 3000, 6000, 800, 2000, 1, 1)
 	if !reflect.DeepEqual(result, expectedOutput) {
 		t.Errorf("Unexpected output")
 	}
@@ -112,9 +113,9 @@ Tests that the code which removes records with too low a frame width works
 */
 func TestContentFilterMinWidth(t *testing.T) {
 	formats := []string{"test"}
-	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1000, 1000, 4.0, 1, "test", 1, "test"}, {1, 1, "test", "test", false, false, "test", "test", 4000, 1, ReturnCorrectTimeObject(), 800, 1000, 4.0, 1, "test", 1, "test"}}
-	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1000, 1000, 4.0, 1, "test", 1, "test"}, "", ""}
-	result := ContentFilter(testarray, &formats, false, 3000, 6000, 800, 2000, 900, 2000)
+	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1000, 1000, 4.0, 1, "test", 1, "test", nil}, {1, 1, "test", "test", false, false, "test", "test", 4000, 1, ReturnCorrectTimeObject(), 800, 1000, 4.0, 1, "test", 1, "test", nil}}
+	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1000, 1000, 4.0, 1, "test", 1, "test", nil}, "", ""}
+	result := ContentFilter(context.Background(), testarray, &formats, false, 3000, 6000, 800, 2000, 900, 2000)
 	if !reflect.DeepEqual(result, expectedOutput) {
 		t.Errorf("Unexpected output")
 	}
@@ -125,9 +126,9 @@ Tests that the code which removes records with too high a frame width works
 */
 func TestContentFilterMaxWidth(t *testing.T) {
 	formats := []string{"test"}
-	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1000, 1000, 4.0, 1, "test", 1, "test"}, {1, 1, "test", "test", false, false, "test", "test", 4000, 1, ReturnCorrectTimeObject(), 3000, 1000, 4.0, 1, "test", 1, "test"}}
-	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1000, 1000, 4.0, 1, "test", 1, "test"}, "", ""}
-	result := ContentFilter(testarray, &formats, false, 3000, 6000, 800, 2000, 900, 2000)
+	testarray := []*Encoding{{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1000, 1000, 4.0, 1, "test", 1, "test", nil}, {1, 1, "test", "test", false, false, "test", "test", 4000, 1, ReturnCorrectTimeObject(), 3000, 1000, 4.0, 1, "test", 1, "test", nil}}
+	expectedOutput := &ContentResult{Encoding{1, 1, "test", "test", false, false, "test", "test", 3557, 1, ReturnCorrectTimeObject(), 1000, 1000, 4.0, 1, "test", 1, "test", nil}, "", ""}
+	result := ContentFilter(context.Background(), testarray, &formats, false, 3000, 6000, 800, 2000, 900, 2000)
 	if !reflect.DeepEqual(result, expectedOutput) {
 		t.Errorf("Unexpected output")
 	}
@@ -2,7 +2,6 @@ package common
 
 import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"log"
 	"reflect"
 	"strconv"
 )
@@ -23,54 +22,54 @@ func extractDynamoField(rec *RawDynamoRecord, fieldName string, t reflect.Kind,
 			if v, isRightType := dynamoValue.(*types.AttributeValueMemberS); isRightType {
 				return v.Value
 			} else {
-				log.Printf("WARNING Field %s was not castable to a string", fieldName)
+				DefaultLogger.Warning("Field %s was not castable to a string", fieldName)
 				return nil
 			}
 		case reflect.Int32:
 			if v, isRightType := dynamoValue.(*types.AttributeValueMemberN); isRightType {
 				intval, err := strconv.ParseInt(v.Value, 10, 32)
 				if err != nil {
-					log.Printf("WARNING Field %s value %s could not be converted to int32: %s", fieldName, v.Value, err)
+					DefaultLogger.Warning("Field %s value %s could not be converted to int32: %s", fieldName, v.Value, err)
 					return nil
 				}
 				return int32(intval)
 			} else {
-				log.Printf("WARNING Field %s was not castable to a number", fieldName)
+				DefaultLogger.Warning("Field %s was not castable to a number", fieldName)
 				return nil
 			}
 		case reflect.Int64:
 			if v, isRightType := dynamoValue.(*types.AttributeValueMemberN); isRightType {
 				intval, err := strconv.ParseInt(v.Value, 10, 64)
 				if err != nil {
-					log.Printf("WARNING Field %s value %s could not be converted to int64: %s", fieldName, v.Value, err)
+					DefaultLogger.Warning("Field %s value %s could not be converted to int64: %s", fieldName, v.Value, err)
 					return nil
 				}
 				return intval
 			} else {
-				log.Printf("WARNING Field %s was not castable to a number", fieldName)
+				DefaultLogger.Warning("Field %s was not castable to a number", fieldName)
 				return nil
 			}
 		case reflect.Float32:
 			if v, isRightType := dynamoValue.(*types.AttributeValueMemberN); isRightType {
 				intval, err := strconv.ParseFloat(v.Value, 32)
 				if err != nil {
-					log.Printf("WARNING Field %s value %s could not be converted to float32: %s", fieldName, v.Value, err)
+					DefaultLogger.Warning("Field %s value %s could not be converted to float32: %s", fieldName, v.Value, err)
 					return nil
 				}
 				return float32(intval)
 			} else {
-				log.Printf("WARNING Field %s was not castable to a number", fieldName)
+				DefaultLogger.Warning("Field %s was not castable to a number", fieldName)
 				return nil
 			}
 		case reflect.Bool:
 			if v, isRightType := dynamoValue.(*types.AttributeValueMemberBOOL); isRightType {
 				return v.Value
 			} else {
-				log.Printf("WARNING Field %s was not castable to a bool", fieldName)
+				DefaultLogger.Warning("Field %s was not castable to a bool", fieldName)
 				return nil
 			}
 		default:
-			log.Printf("WARNING Field %s has a type of %s which is not handled", fieldName, reflect.TypeOf(dynamoValue))
+			DefaultLogger.Warning("Field %s has a type of %s which is not handled", fieldName, reflect.TypeOf(dynamoValue))
 			return nil
 		}
 	} else {
@@ -90,7 +89,7 @@ func extractDynamoField(rec *RawDynamoRecord, fieldName string, t reflect.Kind,
 				return nil
 			}
 		} else {
-			log.Printf("WARNING Field %s does not exist on the incoming record", fieldName)
+			DefaultLogger.Warning("Field %s does not exist on the incoming record", fieldName)
 			return nil
 		}
 	}
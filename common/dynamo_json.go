@@ -0,0 +1,167 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"sort"
+)
+
+/*
+attributeValueToJSON converts a single Dynamo value into the typed json form that the AWS CLI uses, e.g.
+{"S": "hello"} or {"N": "12"}.  Binary values are base64 encoded by encoding/json.
+*/
+func attributeValueToJSON(value types.AttributeValue) (map[string]interface{}, error) {
+	switch v := value.(type) {
+	case *types.AttributeValueMemberS:
+		return map[string]interface{}{"S": v.Value}, nil
+	case *types.AttributeValueMemberN:
+		return map[string]interface{}{"N": v.Value}, nil
+	case *types.AttributeValueMemberB:
+		return map[string]interface{}{"B": v.Value}, nil
+	case *types.AttributeValueMemberBOOL:
+		return map[string]interface{}{"BOOL": v.Value}, nil
+	case *types.AttributeValueMemberNULL:
+		return map[string]interface{}{"NULL": v.Value}, nil
+	case *types.AttributeValueMemberSS:
+		return map[string]interface{}{"SS": v.Value}, nil
+	case *types.AttributeValueMemberNS:
+		return map[string]interface{}{"NS": v.Value}, nil
+	case *types.AttributeValueMemberBS:
+		return map[string]interface{}{"BS": v.Value}, nil
+	case *types.AttributeValueMemberL:
+		list := make([]interface{}, len(v.Value))
+		for i, member := range v.Value {
+			converted, err := attributeValueToJSON(member)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = converted
+		}
+		return map[string]interface{}{"L": list}, nil
+	case *types.AttributeValueMemberM:
+		converted, err := attributeMapToJSON(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"M": converted}, nil
+	default:
+		return nil, fmt.Errorf("unsupported attribute value type %T", value)
+	}
+}
+
+func attributeMapToJSON(values map[string]types.AttributeValue) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		converted, err := attributeValueToJSON(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+		out[k] = converted
+	}
+	return out, nil
+}
+
+/*
+RawDynamoRecordToJSON converts a record into typed json, in the same form as `aws dynamodb scan` outputs for each item.
+The keys come out in a stable order, so that two snapshots of the same table can be compared with diff.
+*/
+func RawDynamoRecordToJSON(rec RawDynamoRecord) ([]byte, error) {
+	converted, err := attributeMapToJSON(rec)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted) //encoding/json sorts map keys
+}
+
+/*
+typedJSONValue is one value in typed json. Exactly one of the fields should be set.
+*/
+type typedJSONValue struct {
+	S    *string                    `json:"S"`
+	N    *string                    `json:"N"`
+	B    []byte                     `json:"B"`
+	BOOL *bool                      `json:"BOOL"`
+	NULL *bool                      `json:"NULL"`
+	SS   []string                   `json:"SS"`
+	NS   []string                   `json:"NS"`
+	BS   [][]byte                   `json:"BS"`
+	L    []typedJSONValue           `json:"L"`
+	M    map[string]*typedJSONValue `json:"M"`
+}
+
+func (t *typedJSONValue) toAttributeValue() (types.AttributeValue, error) {
+	switch {
+	case t.S != nil:
+		return &types.AttributeValueMemberS{Value: *t.S}, nil
+	case t.N != nil:
+		return &types.AttributeValueMemberN{Value: *t.N}, nil
+	case t.B != nil:
+		return &types.AttributeValueMemberB{Value: t.B}, nil
+	case t.BOOL != nil:
+		return &types.AttributeValueMemberBOOL{Value: *t.BOOL}, nil
+	case t.NULL != nil:
+		return &types.AttributeValueMemberNULL{Value: *t.NULL}, nil
+	case t.SS != nil:
+		return &types.AttributeValueMemberSS{Value: t.SS}, nil
+	case t.NS != nil:
+		return &types.AttributeValueMemberNS{Value: t.NS}, nil
+	case t.BS != nil:
+		return &types.AttributeValueMemberBS{Value: t.BS}, nil
+	case t.L != nil:
+		list := make([]types.AttributeValue, len(t.L))
+		for i := range t.L {
+			converted, err := t.L[i].toAttributeValue()
+			if err != nil {
+				return nil, err
+			}
+			list[i] = converted
+		}
+		return &types.AttributeValueMemberL{Value: list}, nil
+	case t.M != nil:
+		converted, err := typedJSONMapToAttributes(t.M)
+		if err != nil {
+			return nil, err
+		}
+		return &types.AttributeValueMemberM{Value: converted}, nil
+	default:
+		return nil, fmt.Errorf("value has no recognised type")
+	}
+}
+
+func typedJSONMapToAttributes(values map[string]*typedJSONValue) (map[string]types.AttributeValue, error) {
+	out := make(map[string]types.AttributeValue, len(values))
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) //so that the same field is reported every time if there are several bad ones
+	for _, k := range keys {
+		if values[k] == nil {
+			return nil, fmt.Errorf("%s: value is null", k)
+		}
+		converted, err := values[k].toAttributeValue()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+		out[k] = converted
+	}
+	return out, nil
+}
+
+/*
+RawDynamoRecordFromJSON is the reverse of RawDynamoRecordToJSON. It also accepts items exported by the AWS CLI or by
+DynamoDB's own export to S3 (one line per item, after unwrapping the "Item" key).
+*/
+func RawDynamoRecordFromJSON(content []byte) (RawDynamoRecord, error) {
+	var parsed map[string]*typedJSONValue
+	err := json.Unmarshal(content, &parsed)
+	if err != nil {
+		return nil, err
+	}
+	converted, err := typedJSONMapToAttributes(parsed)
+	if err != nil {
+		return nil, err
+	}
+	return converted, nil
+}
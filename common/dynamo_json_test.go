@@ -0,0 +1,51 @@
+package common
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"reflect"
+	"testing"
+)
+
+func TestRawDynamoRecordJSONRoundTrip(t *testing.T) {
+	rec := RawDynamoRecord{
+		"fcs_id":     &types.AttributeValueMemberS{Value: "KP-1234"},
+		"encodingid": &types.AttributeValueMemberN{Value: "12"},
+		"mobile":     &types.AttributeValueMemberBOOL{Value: false},
+		"thumbnail":  &types.AttributeValueMemberB{Value: []byte{0, 1, 2}},
+		"nothing":    &types.AttributeValueMemberNULL{Value: true},
+		"tags":       &types.AttributeValueMemberSS{Value: []string{"a", "b"}},
+		"sizes":      &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberN{Value: "1"}}},
+		"extra": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"inner": &types.AttributeValueMemberS{Value: "x"},
+		}},
+	}
+
+	content, err := RawDynamoRecordToJSON(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"encodingid":{"N":"12"},"extra":{"M":{"inner":{"S":"x"}}},"fcs_id":{"S":"KP-1234"},"mobile":{"BOOL":false},"nothing":{"NULL":true},"sizes":{"L":[{"N":"1"}]},"tags":{"SS":["a","b"]},"thumbnail":{"B":"AAEC"}}`
+	if string(content) != expected {
+		t.Errorf("unexpected json\n%s\nexpected\n%s", content, expected)
+	}
+
+	parsed, err := RawDynamoRecordFromJSON(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, rec) {
+		t.Errorf("round trip changed the record: %v", parsed)
+	}
+}
+
+func TestRawDynamoRecordFromJSONInvalid(t *testing.T) {
+	for _, content := range []string{
+		`not json`,
+		`{"a": {"X": "1"}}`,
+		`{"a": null}`,
+	} {
+		if _, err := RawDynamoRecordFromJSON([]byte(content)); err == nil {
+			t.Errorf("expected %s to be rejected", content)
+		}
+	}
+}
@@ -2,11 +2,12 @@ package common
 
 import (
 	"context"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
 	"reflect"
 	"sort"
 	"time"
@@ -25,7 +26,9 @@ type DynamoDbOps interface {
 	QueryEncodingsForFCSId(ctx context.Context, fcsid string) ([]*Encoding, error)
 	QueryEncodingsForContentId(ctx context.Context, contentid int64, maybeSince *time.Time) ([]*Encoding, error)
 	QueryIdMappings(ctx context.Context, indexName string, keyFieldName string, searchTerm interface{}) (*IdMappingRecord, error)
+	QueryLookupsForContentId(ctx context.Context, contentId int64) ([]string, []int64, error)
 	GetAllMimeEquivalents(ctx context.Context) ([]*MimeEquivalent, error)
+	CheckTable(ctx context.Context, tableName string) error
 }
 
 /*
@@ -35,6 +38,16 @@ func NewDynamoDbOps(config Config) DynamoDbOps {
 	return &DynamoDbOpsImpl{client: config.GetDynamoClient(), config: config}
 }
 
+/*
+recordDynamoCall sends call count and latency metrics for a DynamoDbOps method. Call it via `defer` at the start of
+the method.
+*/
+func recordDynamoCall(ctx context.Context, methodName string, start time.Time) {
+	metrics := MetricsFromContext(ctx)
+	metrics.PutCount("Dynamo" + methodName + "Calls")
+	metrics.PutDuration("Dynamo"+methodName+"Latency", start)
+}
+
 type SortableString struct {
 	StringValue string
 	LastUpdate  string
@@ -54,13 +67,18 @@ select fcs_id from encodings left join mime_equivalents on (real_name=encodings.
 ```
 from line 273 of the original code
 */
-func (ops *DynamoDbOpsImpl) QueryFCSIdForContentId(ctx context.Context, contentId int64) (*[]string, error) {
+func (ops *DynamoDbOpsImpl) QueryFCSIdForContentId(ctx context.Context, contentId int64) (result *[]string, err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "QueryFCSIdForContentId", start)
+	ctx, span := StartSpan(ctx, "DynamoDbOps.QueryFCSIdForContentId", attribute.Int64("contentid", contentId))
+	defer func() { EndSpan(span, err) }()
+	logger := LoggerFromContext(ctx)
 	expr, err := expression.NewBuilder().
 		WithKeyCondition(expression.Key("contentid").Equal(expression.Value(contentId))).
 		Build()
 
 	if err != nil {
-		log.Printf("ERROR Could not build query expression for FCS ID -> Content ID: %s", err)
+		logger.Error("Could not build query expression for FCS ID -> Content ID: %s", err)
 		return nil, err
 	}
 
@@ -77,9 +95,10 @@ func (ops *DynamoDbOpsImpl) QueryFCSIdForContentId(ctx context.Context, contentI
 			IndexName:                 aws.String("contentid"),
 			KeyConditionExpression:    expr.KeyCondition(),
 		}
+		MetricsFromContext(ctx).PutCount(MetricDynamoQueries)
 		results, err := ops.client.Query(ctx, rq)
 		if err != nil {
-			log.Printf("ERROR FCS ID -> Content ID query failed on iteration %d: %s", ctr, err)
+			logger.Error("FCS ID -> Content ID query failed on iteration %d: %s", ctr, err)
 			return nil, err
 		}
 
@@ -103,9 +122,10 @@ func (ops *DynamoDbOpsImpl) QueryFCSIdForContentId(ctx context.Context, contentI
 		return output[j].LastUpdate < output[i].LastUpdate
 	})
 
+	logger.WithDuration(start).Debug("QueryFCSIdForContentId got %d items for %d in %d pages", len(output), contentId, ctr)
 	finalOutputs := make([]string, len(output))
 	for i, v := range output {
-		log.Printf("DEBUG FCS query for contentid %d got %v @ %v", contentId, v.StringValue, v.LastUpdate)
+		logger.Debug("FCS query for contentid %d got %v @ %v", contentId, v.StringValue, v.LastUpdate)
 		if v.StringValue != "" {
 			finalOutputs[i] = v.StringValue
 		}
@@ -116,13 +136,13 @@ func (ops *DynamoDbOpsImpl) QueryFCSIdForContentId(ctx context.Context, contentI
 /*
 Internal function that takes a QueryOutput and builds a list of Encodings to return then sorts them by VBitrate
 */
-func _marshalResponseToSortedEncodings(response *dynamodb.QueryOutput) ([]*Encoding, error) {
+func _marshalResponseToSortedEncodings(logger *Logger, response *dynamodb.QueryOutput) ([]*Encoding, error) {
 	var err error
 	encodings := make([]*Encoding, len(response.Items))
 	for i, rawData := range response.Items {
 		encodings[i], err = EncodingFromDynamo((*RawDynamoRecord)(&rawData))
 		if err != nil {
-			log.Printf("ERROR QueryEncodingsForFCSId could not marshal item %d (%v): %s", i, rawData, err)
+			logger.Error("QueryEncodingsForFCSId could not marshal item %d (%v): %s", i, rawData, err)
 			return nil, err
 		}
 	}
@@ -137,13 +157,18 @@ func _marshalResponseToSortedEncodings(response *dynamodb.QueryOutput) ([]*Encod
 QueryEncodingsForFCSId searches the Encodings table for videos corresponding to the given fcsid
 and returns a slice of pointers to the marshalled Encoding objects
 */
-func (ops *DynamoDbOpsImpl) QueryEncodingsForFCSId(ctx context.Context, fcsid string) ([]*Encoding, error) {
+func (ops *DynamoDbOpsImpl) QueryEncodingsForFCSId(ctx context.Context, fcsid string) (result []*Encoding, err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "QueryEncodingsForFCSId", start)
+	ctx, span := StartSpan(ctx, "DynamoDbOps.QueryEncodingsForFCSId", attribute.String("fcs_id", fcsid))
+	defer func() { EndSpan(span, err) }()
+	logger := LoggerFromContext(ctx)
 	//equivalent SQL is select * from encodings left join mime_equivalents on (real_name=encodings.format) where fcs_id='$fcsid' order by vbitrate desc
 	expr, err := expression.NewBuilder().
 		WithKeyCondition(expression.Key("fcs_id").Equal(expression.Value(fcsid))).
 		Build()
 	if err != nil {
-		log.Printf("ERROR QueryEncodingsForFCSId could not build the query expression: %s", err)
+		logger.Error("QueryEncodingsForFCSId could not build the query expression: %s", err)
 		return nil, err
 	}
 
@@ -154,13 +179,15 @@ func (ops *DynamoDbOpsImpl) QueryEncodingsForFCSId(ctx context.Context, fcsid st
 		ExpressionAttributeValues: expr.Values(),
 		KeyConditionExpression:    expr.KeyCondition(),
 	}
+	MetricsFromContext(ctx).PutCount(MetricDynamoQueries)
 	response, err := ops.client.Query(ctx, rq)
 	if err != nil {
-		log.Printf("ERROR QueryEncodingsForFCSId could not perform the query: %s", err)
+		logger.Error("QueryEncodingsForFCSId could not perform the query: %s", err)
 		return nil, err
 	}
 
-	return _marshalResponseToSortedEncodings(response)
+	logger.WithDuration(start).Debug("QueryEncodingsForFCSId got %d items for %s", len(response.Items), fcsid)
+	return _marshalResponseToSortedEncodings(logger, response)
 }
 
 /*
@@ -175,7 +202,12 @@ Returns:
 - a slice of pointers to matching Encoding records on success
 - an error on failure
 */
-func (ops *DynamoDbOpsImpl) QueryEncodingsForContentId(ctx context.Context, contentid int64, maybeSince *time.Time) ([]*Encoding, error) {
+func (ops *DynamoDbOpsImpl) QueryEncodingsForContentId(ctx context.Context, contentid int64, maybeSince *time.Time) (result []*Encoding, err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "QueryEncodingsForContentId", start)
+	ctx, span := StartSpan(ctx, "DynamoDbOps.QueryEncodingsForContentId", attribute.Int64("contentid", contentid), attribute.Bool("since", maybeSince != nil))
+	defer func() { EndSpan(span, err) }()
+	logger := LoggerFromContext(ctx)
 	//equivalent SQL is select * from encodings left join mime_equivalents on (real_name=encodings.format) where contentid=$contentid order by vbitrate desc,lastupdate desc
 	keyTerms := expression.Key("contentid").Equal(expression.Value(contentid))
 	if maybeSince != nil {
@@ -187,7 +219,7 @@ func (ops *DynamoDbOpsImpl) QueryEncodingsForContentId(ctx context.Context, cont
 		Build()
 
 	if err != nil {
-		log.Printf("ERROR QueryEncodingsForContentId could not build the query expression: %s", err)
+		logger.Error("QueryEncodingsForContentId could not build the query expression: %s", err)
 		return nil, err
 	}
 	rq := &dynamodb.QueryInput{
@@ -199,13 +231,15 @@ func (ops *DynamoDbOpsImpl) QueryEncodingsForContentId(ctx context.Context, cont
 		KeyConditionExpression:    expr.KeyCondition(),
 	}
 
+	MetricsFromContext(ctx).PutCount(MetricDynamoQueries)
 	response, err := ops.client.Query(ctx, rq)
 	if err != nil {
-		log.Printf("ERROR QueryEncodingsForContentId could not execute the query: %s", err)
+		logger.Error("QueryEncodingsForContentId could not execute the query: %s", err)
 		return nil, err
 	}
 
-	encodings, err := _marshalResponseToSortedEncodings(response)
+	logger.WithDuration(start).Debug("QueryEncodingsForContentId got %d items for %d", len(response.Items), contentid)
+	encodings, err := _marshalResponseToSortedEncodings(logger, response)
 	if err == nil {
 		//apply a most-recent-first search
 		sort.Slice(encodings, func(i int, j int) bool {
@@ -221,6 +255,8 @@ const IdMappingIndexFilebase = "filebase"
 const IdMappingKeyfieldFilebase = "filebase"
 const IdMappingIndexOctid = "octopusid"
 const IdMappingKeyfieldOctid = "octopus_id"
+const IdMappingIndexContentId = "contentid"
+const IdMappingKeyfieldContentId = "contentid"
 
 /*
 QueryIdMappings performs a lookup on the IdMappings table.  There should only ever be 1 or 0 matches; in the event of
@@ -236,7 +272,12 @@ Returns:
 there was no data found
 - an error on failure
 */
-func (ops *DynamoDbOpsImpl) QueryIdMappings(ctx context.Context, indexName string, keyFieldName string, searchTerm interface{}) (*IdMappingRecord, error) {
+func (ops *DynamoDbOpsImpl) QueryIdMappings(ctx context.Context, indexName string, keyFieldName string, searchTerm interface{}) (result *IdMappingRecord, err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "QueryIdMappings", start)
+	ctx, span := StartSpan(ctx, "DynamoDbOps.QueryIdMappings", attribute.String("index", indexName), attribute.String("search_term", fmt.Sprintf("%v", searchTerm)))
+	defer func() { EndSpan(span, err) }()
+	logger := LoggerFromContext(ctx)
 	expr, err := expression.NewBuilder().
 		WithKeyCondition(expression.
 			Key(keyFieldName).
@@ -247,6 +288,7 @@ func (ops *DynamoDbOpsImpl) QueryIdMappings(ctx context.Context, indexName strin
 		return nil, err
 	}
 
+	MetricsFromContext(ctx).PutCount(MetricDynamoQueries)
 	response, err := ops.client.Query(ctx, &dynamodb.QueryInput{
 		KeyConditionExpression:    expr.KeyCondition(),
 		ExpressionAttributeValues: expr.Values(),
@@ -257,9 +299,11 @@ func (ops *DynamoDbOpsImpl) QueryIdMappings(ctx context.Context, indexName strin
 	})
 
 	if err != nil {
+		logger.Error("QueryIdMappings could not query %s for %v: %s", indexName, searchTerm, err)
 		return nil, err
 	}
 
+	logger.WithDuration(start).Debug("QueryIdMappings got %d items from %s for %v", len(response.Items), indexName, searchTerm)
 	if response.Items == nil {
 		return nil, nil
 	}
@@ -269,32 +313,129 @@ func (ops *DynamoDbOpsImpl) QueryIdMappings(ctx context.Context, indexName strin
 	} else if len(response.Items) == 1 {
 		return NewIdMappingRecord(&response.Items[0])
 	} else {
-		log.Printf("WARNING Got %d idmapping records, expected only 1. Note that there is a hard limit of 50. Using the most recent.", len(response.Items))
+		logger.Warning("Got %d idmapping records, expected only 1. Note that there is a hard limit of 50. Using the most recent.", len(response.Items))
 		mostRecent := len(response.Items) - 1 //the indexing setup in DynamoDB returns the oldest first (sort key is lastupdate)
 		return NewIdMappingRecord(&response.Items[mostRecent])
 	}
 }
 
+/*
+QueryLookupsForContentId returns every filebase and octopus ID that has ever been mapped to the given content ID,
+including ones that have since been replaced.  Lookups find their encodings through the content ID of the idmapping
+record, so these are the lookups that are affected when an encoding changes.
+
+Arguments:
+- ctx - context that can be used to cancel the operation
+- contentId - the content ID of the encoding
+Returns:
+- a (possibly empty) slice of distinct filebases
+- a (possibly empty) slice of distinct octopus IDs
+- an error on failure
+*/
+func (ops *DynamoDbOpsImpl) QueryLookupsForContentId(ctx context.Context, contentId int64) (filebases []string, octopusIds []int64, err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "QueryLookupsForContentId", start)
+	ctx, span := StartSpan(ctx, "DynamoDbOps.QueryLookupsForContentId", attribute.Int64("contentid", contentId))
+	defer func() { EndSpan(span, err) }()
+	logger := LoggerFromContext(ctx)
+
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key(IdMappingKeyfieldContentId).Equal(expression.Value(contentId))).
+		WithProjection(expression.NamesList(expression.Name("filebase"), expression.Name(IdMappingKeyfieldOctid))).
+		Build()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lookups := NewInvalidationSet()
+	var startKey map[string]types.AttributeValue
+	for {
+		MetricsFromContext(ctx).PutCount(MetricDynamoQueries)
+		response, err := ops.client.Query(ctx, &dynamodb.QueryInput{
+			KeyConditionExpression:    expr.KeyCondition(),
+			ExpressionAttributeValues: expr.Values(),
+			ExpressionAttributeNames:  expr.Names(),
+			ProjectionExpression:      expr.Projection(),
+			TableName:                 aws.String(ops.config.IdMappingTable()),
+			IndexName:                 aws.String(IdMappingIndexContentId),
+			ExclusiveStartKey:         startKey,
+		})
+		if err != nil {
+			logger.Error("QueryLookupsForContentId could not query for %d: %s", contentId, err)
+			return nil, nil, err
+		}
+		for _, item := range response.Items {
+			lookups.addIdMappingChange(item)
+		}
+		if response.LastEvaluatedKey == nil {
+			break
+		}
+		startKey = response.LastEvaluatedKey
+	}
+	filebases, octopusIds = lookups.sortedLookups()
+	logger.WithDuration(start).Debug("QueryLookupsForContentId got %d filebases and %d octopus ids for %d", len(filebases), len(octopusIds), contentId)
+	return filebases, octopusIds, nil
+}
+
 /*
 GetAllMimeEquivalents downloads the MIME equivalents table to use for lookups
 */
-func (ops *DynamoDbOpsImpl) GetAllMimeEquivalents(ctx context.Context) ([]*MimeEquivalent, error) {
+func (ops *DynamoDbOpsImpl) GetAllMimeEquivalents(ctx context.Context) (result []*MimeEquivalent, err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "GetAllMimeEquivalents", start)
+	ctx, span := StartSpan(ctx, "DynamoDbOps.GetAllMimeEquivalents")
+	defer func() { EndSpan(span, err) }()
+	logger := LoggerFromContext(ctx)
 	rq := &dynamodb.ScanInput{
 		TableName: ops.config.MimeEquivalentsTablePtr(),
 	}
+	MetricsFromContext(ctx).PutCount(MetricDynamoQueries)
 	response, err := ops.client.Scan(ctx, rq)
 	if err != nil {
-		log.Printf("ERROR Can't load in mime equivalents: %s", err)
+		logger.Error("Can't load in mime equivalents: %s", err)
 		return nil, err
 	}
 
+	logger.WithDuration(start).Debug("GetAllMimeEquivalents got %d items", len(response.Items))
 	results := make([]*MimeEquivalent, len(response.Items))
 	for i, raw := range response.Items {
 		results[i], err = MimeEquivalentFromDynamo((*RawDynamoRecord)(&raw))
 		if err != nil {
-			log.Printf("ERROR Can't load in record %d from mime equivalents (%v): %s", i, raw, err)
+			logger.Error("Can't load in record %d from mime equivalents (%v): %s", i, raw, err)
 			return nil, err
 		}
 	}
 	return results, nil
 }
+
+/*
+CheckTable does the least work possible to prove that the given table exists, is usable and that we have permission to
+read it: a DescribeTable followed by a single-item Scan.  This is used by the healthcheck.
+Returns:
+- nil if the table is ok, or an error describing what is wrong
+*/
+func (ops *DynamoDbOpsImpl) CheckTable(ctx context.Context, tableName string) (err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "CheckTable", start)
+	ctx, span := StartSpan(ctx, "DynamoDbOps.CheckTable", attribute.String("table", tableName))
+	defer func() { EndSpan(span, err) }()
+
+	description, err := ops.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return err
+	}
+	if description.Table == nil || description.Table.TableStatus != types.TableStatusActive {
+		status := "unknown"
+		if description.Table != nil {
+			status = string(description.Table.TableStatus)
+		}
+		return fmt.Errorf("table %s is in state %s", tableName, status)
+	}
+
+	MetricsFromContext(ctx).PutCount(MetricDynamoQueries)
+	_, err = ops.client.Scan(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+		Limit:     aws.Int32(1),
+	})
+	return err
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+MemoryDynamoDbOps is a DynamoDbOps that answers queries from records held in memory, rather than from DynamoDB.
+It gives the same results as DynamoDbOpsImpl would for a table holding the same items, so it is used to run the
+endpoints without any AWS access, e.g. from a snapshot of the live tables made by `migration export`.
+
+The zero value is an empty set of tables; fill them in directly or from ReadSnapshot.  It is not safe to add records
+while queries are running.
+*/
+type MemoryDynamoDbOps struct {
+	Encodings       []RawDynamoRecord
+	IdMappings      []RawDynamoRecord
+	MimeEquivalents []RawDynamoRecord
+}
+
+/*
+ReadSnapshot reads a JSON Lines snapshot (as written by `migration export`) into a list of records.  Blank lines are
+ignored.
+*/
+func ReadSnapshot(in io.Reader) ([]RawDynamoRecord, error) {
+	records := make([]RawDynamoRecord, 0)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024) //an item can be up to 400k in Dynamo, allow plenty for the json
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		rec, err := RawDynamoRecordFromJSON([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+/*
+attributeMatches returns true if the given Dynamo value is equal to a query term, in the same way that a key condition
+would compare them
+*/
+func attributeMatches(value types.AttributeValue, term interface{}) bool {
+	switch v := value.(type) {
+	case *types.AttributeValueMemberS:
+		return v.Value == fmt.Sprintf("%v", term)
+	case *types.AttributeValueMemberN:
+		actual, err := strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			return false
+		}
+		expected, err := strconv.ParseFloat(fmt.Sprintf("%v", term), 64)
+		return err == nil && actual == expected
+	default:
+		return false
+	}
+}
+
+/*
+matchingRecords returns the records that have `fieldName` equal to `term`, in the order they were added
+*/
+func matchingRecords(records []RawDynamoRecord, fieldName string, term interface{}) []map[string]types.AttributeValue {
+	result := make([]map[string]types.AttributeValue, 0)
+	for _, rec := range records {
+		if value, haveValue := rec[fieldName]; haveValue && attributeMatches(value, term) {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+func lastUpdateOf(rec map[string]types.AttributeValue) string {
+	if s, isString := rec["lastupdate"].(*types.AttributeValueMemberS); isString {
+		return s.Value
+	}
+	return ""
+}
+
+func (ops *MemoryDynamoDbOps) QueryFCSIdForContentId(ctx context.Context, contentId int64) (*[]string, error) {
+	matches := matchingRecords(ops.Encodings, "contentid", contentId)
+	//same ordering as the real query, most-recent-first
+	sort.SliceStable(matches, func(i, j int) bool {
+		return lastUpdateOf(matches[j]) < lastUpdateOf(matches[i])
+	})
+
+	result := make([]string, len(matches))
+	for i, rec := range matches {
+		result[i] = extractDynamoField((*RawDynamoRecord)(&rec), "fcs_id", reflect.String, true).(string)
+	}
+	return &result, nil
+}
+
+func (ops *MemoryDynamoDbOps) QueryEncodingsForFCSId(ctx context.Context, fcsid string) ([]*Encoding, error) {
+	return _marshalResponseToSortedEncodings(LoggerFromContext(ctx), &dynamodb.QueryOutput{
+		Items: matchingRecords(ops.Encodings, "fcs_id", fcsid),
+	})
+}
+
+func (ops *MemoryDynamoDbOps) QueryEncodingsForContentId(ctx context.Context, contentid int64, maybeSince *time.Time) ([]*Encoding, error) {
+	matches := matchingRecords(ops.Encodings, "contentid", contentid)
+	if maybeSince != nil {
+		since := maybeSince.Format(time.RFC3339)
+		filtered := make([]map[string]types.AttributeValue, 0, len(matches))
+		for _, rec := range matches {
+			if lastUpdateOf(rec) >= since {
+				filtered = append(filtered, rec)
+			}
+		}
+		matches = filtered
+	}
+
+	encodings, err := _marshalResponseToSortedEncodings(LoggerFromContext(ctx), &dynamodb.QueryOutput{Items: matches})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(encodings, func(i int, j int) bool {
+		return encodings[i].LastUpdate.Unix() > encodings[j].LastUpdate.Unix()
+	})
+	return encodings, nil
+}
+
+func (ops *MemoryDynamoDbOps) QueryIdMappings(ctx context.Context, indexName string, keyFieldName string, searchTerm interface{}) (*IdMappingRecord, error) {
+	matches := matchingRecords(ops.IdMappings, keyFieldName, searchTerm)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	//the real indices are sorted on lastupdate and the most recent is used
+	sort.SliceStable(matches, func(i, j int) bool {
+		return lastUpdateOf(matches[i]) < lastUpdateOf(matches[j])
+	})
+	return NewIdMappingRecord(&matches[len(matches)-1])
+}
+
+func (ops *MemoryDynamoDbOps) QueryLookupsForContentId(ctx context.Context, contentId int64) ([]string, []int64, error) {
+	lookups := NewInvalidationSet()
+	for _, rec := range matchingRecords(ops.IdMappings, IdMappingKeyfieldContentId, contentId) {
+		lookups.addIdMappingChange(rec)
+	}
+	filebases, octopusIds := lookups.sortedLookups()
+	return filebases, octopusIds, nil
+}
+
+func (ops *MemoryDynamoDbOps) GetAllMimeEquivalents(ctx context.Context) ([]*MimeEquivalent, error) {
+	results := make([]*MimeEquivalent, len(ops.MimeEquivalents))
+	for i := range ops.MimeEquivalents {
+		var err error
+		results[i], err = MimeEquivalentFromDynamo(&ops.MimeEquivalents[i])
+		if err != nil {
+			return nil, fmt.Errorf("mime equivalent %d: %s", i, err)
+		}
+	}
+	return results, nil
+}
+
+/*
+CheckTable always succeeds, since the in-memory tables always exist
+*/
+func (ops *MemoryDynamoDbOps) CheckTable(ctx context.Context, tableName string) error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEncodingsSnapshot = `{"encodingid":{"N":"1"},"contentid":{"N":"1234"},"fcs_id":{"S":"KP-1234"},"url":{"S":"https://cdn.example.com/low.mp4"},"format":{"S":"video/mp4"},"mobile":{"BOOL":false},"multirate":{"BOOL":false},"vbitrate":{"N":"512"},"lastupdate":{"S":"2020-01-02T03:04:05Z"},"frame_width":{"N":"640"},"frame_height":{"N":"360"},"duration":{"N":"12.5"},"file_size":{"N":"100000"},"octopus_id":{"N":"5678"},"aspect":{"S":"16:9"}}
+{"encodingid":{"N":"2"},"contentid":{"N":"1234"},"fcs_id":{"S":"KP-1234"},"url":{"S":"https://cdn.example.com/high.mp4"},"format":{"S":"video/mp4"},"mobile":{"BOOL":false},"multirate":{"BOOL":false},"vbitrate":{"N":"2048"},"lastupdate":{"S":"2020-01-02T03:04:05Z"},"frame_width":{"N":"1280"},"frame_height":{"N":"720"},"duration":{"N":"12.5"},"file_size":{"N":"400000"},"octopus_id":{"N":"5678"},"aspect":{"S":"16:9"}}
+
+{"encodingid":{"N":"3"},"contentid":{"N":"99"},"fcs_id":{"S":"KP-99"},"url":{"S":"https://cdn.example.com/other.mp4"},"format":{"S":"video/mp4"},"mobile":{"BOOL":false},"multirate":{"BOOL":false},"vbitrate":{"N":"512"},"lastupdate":{"S":"2019-01-01T00:00:00Z"},"frame_width":{"N":"640"},"frame_height":{"N":"360"},"duration":{"N":"3"},"file_size":{"N":"1000"},"aspect":{"S":"16:9"}}
+`
+
+const testIdMappingSnapshot = `{"uuid":{"S":"a"},"contentid":{"N":"1000"},"filebase":{"S":"oldfile"},"octopus_id":{"N":"5678"},"lastupdate":{"S":"2019-01-01T00:00:00Z"}}
+{"uuid":{"S":"b"},"contentid":{"N":"1234"},"filebase":{"S":"myfile"},"octopus_id":{"N":"5678"},"lastupdate":{"S":"2020-01-01T00:00:00Z"}}
+`
+
+func testMemoryOps(t *testing.T) *MemoryDynamoDbOps {
+	encodings, err := ReadSnapshot(strings.NewReader(testEncodingsSnapshot))
+	if err != nil {
+		t.Fatalf("could not read encodings snapshot: %s", err)
+	}
+	idMappings, err := ReadSnapshot(strings.NewReader(testIdMappingSnapshot))
+	if err != nil {
+		t.Fatalf("could not read idmapping snapshot: %s", err)
+	}
+	return &MemoryDynamoDbOps{Encodings: encodings, IdMappings: idMappings}
+}
+
+func TestReadSnapshot(t *testing.T) {
+	records, err := ReadSnapshot(strings.NewReader(testEncodingsSnapshot))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(records) != 3 {
+		t.Errorf("expected 3 records, got %d", len(records))
+	}
+
+	_, err = ReadSnapshot(strings.NewReader("{\"a\":{\"S\":\"b\"}}\nnot json\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error for line 2, got %v", err)
+	}
+}
+
+func TestMemoryDynamoDbOpsQueries(t *testing.T) {
+	ops := testMemoryOps(t)
+	ctx := context.Background()
+
+	fcsIds, err := ops.QueryFCSIdForContentId(ctx, 1234)
+	if err != nil {
+		t.Fatalf("QueryFCSIdForContentId failed: %s", err)
+	}
+	if len(*fcsIds) != 2 || (*fcsIds)[0] != "KP-1234" {
+		t.Errorf("QueryFCSIdForContentId got %v", *fcsIds)
+	}
+
+	encodings, err := ops.QueryEncodingsForFCSId(ctx, "KP-1234")
+	if err != nil {
+		t.Fatalf("QueryEncodingsForFCSId failed: %s", err)
+	}
+	if len(encodings) != 2 || encodings[0].VBitrate != 2048 {
+		t.Errorf("QueryEncodingsForFCSId should return the highest bitrate first, got %d items", len(encodings))
+	}
+
+	since := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	encodings, err = ops.QueryEncodingsForContentId(ctx, 1234, &since)
+	if err != nil {
+		t.Fatalf("QueryEncodingsForContentId failed: %s", err)
+	}
+	if len(encodings) != 0 {
+		t.Errorf("QueryEncodingsForContentId should not return anything before %s, got %d items", since, len(encodings))
+	}
+
+	mapping, err := ops.QueryIdMappings(ctx, IdMappingIndexOctid, IdMappingKeyfieldOctid, int64(5678))
+	if err != nil {
+		t.Fatalf("QueryIdMappings failed: %s", err)
+	}
+	if mapping == nil || mapping.filebase != "myfile" {
+		t.Errorf("QueryIdMappings should return the most recent mapping, got %v", mapping)
+	}
+
+	mapping, err = ops.QueryIdMappings(ctx, IdMappingIndexFilebase, IdMappingKeyfieldFilebase, "nothere")
+	if mapping != nil || err != nil {
+		t.Errorf("QueryIdMappings for a missing filebase should return nil, nil, got %v, %v", mapping, err)
+	}
+
+	filebases, octopusIds, err := ops.QueryLookupsForContentId(ctx, 1234)
+	if err != nil || !reflect.DeepEqual(filebases, []string{"myfile"}) || !reflect.DeepEqual(octopusIds, []int64{5678}) {
+		t.Errorf("QueryLookupsForContentId got %v, %v, %v", filebases, octopusIds, err)
+	}
+}
@@ -3,6 +3,7 @@ package common
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 )
 
@@ -24,6 +25,14 @@ type DynamoOpsMock struct {
 	IdMappingSearchTermQueried   interface{}
 	IdMappingResult              IdMappingRecord
 	IdMappingError               error
+
+	FilebasesForContentId    map[int64][]string
+	OctopusIdsForContentId   map[int64][]int64
+	LookupsForContentIdError error
+
+	CheckTableErrors map[string]error
+	TablesChecked    []string
+	checkTableLock   sync.Mutex //CheckTable is called in parallel by the healthcheck
 }
 
 func (ops *DynamoOpsMock) QueryFCSIdForContentId(ctx context.Context, contentId int64) (*[]string, error) {
@@ -46,8 +55,12 @@ func (ops *DynamoOpsMock) QueryEncodingsForFCSId(ctx context.Context, fcsid stri
 
 func (ops *DynamoOpsMock) QueryEncodingsForContentId(ctx context.Context, contentid int64, maybeSince *time.Time) ([]*Encoding, error) {
 	ops.ContentIdQueried = contentid
-	copiedTime := *maybeSince
-	ops.ContentIdSince = &copiedTime
+	if maybeSince != nil {
+		copiedTime := *maybeSince
+		ops.ContentIdSince = &copiedTime
+	} else {
+		ops.ContentIdSince = nil
+	}
 	if ops.EncodingsForContentIdError != nil {
 		return nil, ops.EncodingsForContentIdError
 	} else {
@@ -74,3 +87,17 @@ func (ops *DynamoOpsMock) QueryIdMappings(ctx context.Context, indexName string,
 func (ops *DynamoOpsMock) GetAllMimeEquivalents(ctx context.Context) ([]*MimeEquivalent, error) {
 	return nil, errors.New("not implemented in DynamoOpsMock")
 }
+
+func (ops *DynamoOpsMock) CheckTable(ctx context.Context, tableName string) error {
+	ops.checkTableLock.Lock()
+	defer ops.checkTableLock.Unlock()
+	ops.TablesChecked = append(ops.TablesChecked, tableName)
+	return ops.CheckTableErrors[tableName]
+}
+
+func (ops *DynamoOpsMock) QueryLookupsForContentId(ctx context.Context, contentId int64) ([]string, []int64, error) {
+	if ops.LookupsForContentIdError != nil {
+		return nil, nil, ops.LookupsForContentIdError
+	}
+	return ops.FilebasesForContentId[contentId], ops.OctopusIdsForContentId[contentId], nil
+}
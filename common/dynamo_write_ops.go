@@ -0,0 +1,354 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+	"time"
+)
+
+/*
+ErrWriteConflict is returned by DynamoWriteOps when a conditional write fails because somebody else got there first
+*/
+var ErrWriteConflict = errors.New("the record was changed by another writer")
+
+/*
+DynamoWriteOps abstracts the DynamoDb write operations used by the write API, so that we can mock them in testing.
+This is kept separate from DynamoDbOps because the read-only endpoints have no business writing.
+*/
+type DynamoWriteOps interface {
+	GetEncoding(ctx context.Context, fcsId string, encodingId int32) (*Encoding, error)
+	PutEncoding(ctx context.Context, record RawDynamoRecord, mustNotExist bool) error
+	ReplaceIdMapping(ctx context.Context, record RawDynamoRecord, previous *IdMappingRecord) error
+	SetIdMappingWithdrawn(ctx context.Context, record *IdMappingRecord, w *Withdrawal) error
+	SetEncodingWithdrawn(ctx context.Context, fcsId string, encodingId int32, w *Withdrawal) error
+	PutAuditRecord(ctx context.Context, record *AuditRecord) error
+	QueryAuditHistory(ctx context.Context, target string) ([]*AuditRecord, error)
+}
+
+type DynamoWriteOpsImpl struct {
+	client *dynamodb.Client
+	config Config
+}
+
+/*
+NewDynamoWriteOps creates a new DynamoWriteOps object from the given configuration
+*/
+func NewDynamoWriteOps(config Config) DynamoWriteOps {
+	return &DynamoWriteOpsImpl{client: config.GetDynamoClient(), config: config}
+}
+
+/*
+translateConditionalError turns the errors that Dynamo returns for a failed condition into ErrWriteConflict
+*/
+func translateConditionalError(err error) error {
+	var conditionFailed *types.ConditionalCheckFailedException
+	var transactionCancelled *types.TransactionCanceledException
+	if errors.As(err, &conditionFailed) || errors.As(err, &transactionCancelled) {
+		return ErrWriteConflict
+	}
+	return err
+}
+
+/*
+GetEncoding reads an encoding by its key.  This is a strongly consistent read, unlike the queries in DynamoDbOps which
+go through an index, so it sees a write that has only just been made.
+
+Arguments:
+- ctx - context that can be used to cancel the operation
+- fcsId - the FCS ID of the encoding, which is the partition key of the table
+- encodingId - the ID of the encoding, which is the sort key of the table
+Returns:
+- the Encoding, or nil if there is no encoding with that key
+- an error on failure
+*/
+func (ops *DynamoWriteOpsImpl) GetEncoding(ctx context.Context, fcsId string, encodingId int32) (result *Encoding, err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "GetEncoding", start)
+	ctx, span := StartSpan(ctx, "DynamoWriteOps.GetEncoding", attribute.String("fcs_id", fcsId), attribute.Int("encodingid", int(encodingId)))
+	defer func() { EndSpan(span, err) }()
+
+	response, err := ops.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: ops.config.EncodingsTablePtr(),
+		Key: map[string]types.AttributeValue{
+			"fcs_id":     &types.AttributeValueMemberS{Value: fcsId},
+			"encodingid": &types.AttributeValueMemberN{Value: strconv.FormatInt(int64(encodingId), 10)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Item) == 0 {
+		return nil, nil
+	}
+	rec := RawDynamoRecord(response.Item)
+	return EncodingFromDynamo(&rec)
+}
+
+/*
+PutEncoding writes a record to the Encodings table.
+
+Arguments:
+- ctx - context that can be used to cancel the operation
+- record - the record to write, normally from EncodingToDynamo
+- mustNotExist - if true then the write only succeeds if there is no record with the same key already
+Returns:
+- nil on success, ErrWriteConflict if `mustNotExist` was set and the record exists, or another error on failure
+*/
+func (ops *DynamoWriteOpsImpl) PutEncoding(ctx context.Context, record RawDynamoRecord, mustNotExist bool) (err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "PutEncoding", start)
+	ctx, span := StartSpan(ctx, "DynamoWriteOps.PutEncoding", attribute.Bool("must_not_exist", mustNotExist))
+	defer func() { EndSpan(span, err) }()
+
+	rq := &dynamodb.PutItemInput{
+		TableName: ops.config.EncodingsTablePtr(),
+		Item:      record,
+	}
+	if mustNotExist {
+		expr, err := expression.NewBuilder().WithCondition(expression.AttributeNotExists(expression.Name("encodingid"))).Build()
+		if err != nil {
+			return err
+		}
+		rq.ConditionExpression = expr.Condition()
+		rq.ExpressionAttributeNames = expr.Names()
+	}
+	_, err = ops.client.PutItem(ctx, rq)
+	return translateConditionalError(err)
+}
+
+/*
+ReplaceIdMapping writes a record to the IdMapping table.  Because `lastupdate` is part of the primary key, updating a
+record means writing a new item and deleting the old one; this is done in a single transaction so that readers never
+see zero or two records for the same file.
+
+Arguments:
+- ctx - context that can be used to cancel the operation
+- record - the record to write, normally from IdMappingToDynamo
+- previous - the record that this one replaces, or nil if this is a new record
+Returns:
+- nil on success, ErrWriteConflict if `previous` has already been changed or removed, or is not older than `record`
+(or is nil, and a record with the same key exists), or another error on failure
+*/
+func (ops *DynamoWriteOpsImpl) ReplaceIdMapping(ctx context.Context, record RawDynamoRecord, previous *IdMappingRecord) (err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "ReplaceIdMapping", start)
+	ctx, span := StartSpan(ctx, "DynamoWriteOps.ReplaceIdMapping", attribute.Bool("replacing", previous != nil))
+	defer func() { EndSpan(span, err) }()
+
+	tableName := aws.String(ops.config.IdMappingTable())
+	if previous == nil {
+		expr, err := expression.NewBuilder().WithCondition(expression.AttributeNotExists(expression.Name("uuid"))).Build()
+		if err != nil {
+			return err
+		}
+		_, err = ops.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                tableName,
+			Item:                     record,
+			ConditionExpression:      expr.Condition(),
+			ExpressionAttributeNames: expr.Names(),
+		})
+		return translateConditionalError(err)
+	}
+
+	incoming, haveLastUpdate := record["lastupdate"].(*types.AttributeValueMemberS)
+	if !haveLastUpdate {
+		return errors.New("idmapping record has no lastupdate")
+	}
+	//never replace a record with an older one
+	expr, err := expression.NewBuilder().WithCondition(
+		expression.AttributeExists(expression.Name("uuid")).
+			And(expression.Name("lastupdate").LessThan(expression.Value(incoming.Value))),
+	).Build()
+	if err != nil {
+		return err
+	}
+	_, err = ops.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Delete: &types.Delete{
+					TableName: tableName,
+					Key: map[string]types.AttributeValue{
+						"uuid":       &types.AttributeValueMemberS{Value: previous.uuid},
+						"lastupdate": &types.AttributeValueMemberS{Value: previous.lastupdate.Format(time.RFC3339)},
+					},
+					ConditionExpression:       expr.Condition(),
+					ExpressionAttributeNames:  expr.Names(),
+					ExpressionAttributeValues: expr.Values(),
+				},
+			},
+			{
+				Put: &types.Put{
+					TableName: tableName,
+					Item:      record,
+				},
+			},
+		},
+	})
+	return translateConditionalError(err)
+}
+
+/*
+withdrawalUpdate builds the update expression that sets the withdrawal fields, or removes them if `w` is nil.
+The update only succeeds if the item already exists, so that we never create half-empty records.
+*/
+func withdrawalUpdate(keyField string, w *Withdrawal) (expression.Expression, error) {
+	var update expression.UpdateBuilder
+	if w != nil {
+		update = expression.Set(expression.Name("withdrawn_at"), expression.Value(w.At.Format(time.RFC3339))).
+			Set(expression.Name("withdrawn_reason"), expression.Value(w.Reason))
+	} else {
+		update = expression.Remove(expression.Name("withdrawn_at")).
+			Remove(expression.Name("withdrawn_reason"))
+	}
+	return expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.AttributeExists(expression.Name(keyField))).
+		Build()
+}
+
+/*
+SetIdMappingWithdrawn marks an idmapping record as withdrawn, or restores it if `w` is nil.  This is done in place, so
+unlike ReplaceIdMapping the record keeps its key.
+
+Arguments:
+- ctx - context that can be used to cancel the operation
+- record - the record to change, as returned by QueryIdMappings
+- w - the Withdrawal to set, or nil to restore the record
+Returns:
+- nil on success, ErrWriteConflict if the record no longer exists, or another error on failure
+*/
+func (ops *DynamoWriteOpsImpl) SetIdMappingWithdrawn(ctx context.Context, record *IdMappingRecord, w *Withdrawal) (err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "SetIdMappingWithdrawn", start)
+	ctx, span := StartSpan(ctx, "DynamoWriteOps.SetIdMappingWithdrawn", attribute.Bool("withdrawn", w != nil))
+	defer func() { EndSpan(span, err) }()
+
+	expr, err := withdrawalUpdate("uuid", w)
+	if err != nil {
+		return err
+	}
+	_, err = ops.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ops.config.IdMappingTable()),
+		Key: map[string]types.AttributeValue{
+			"uuid":       &types.AttributeValueMemberS{Value: record.uuid},
+			"lastupdate": &types.AttributeValueMemberS{Value: record.lastupdate.Format(time.RFC3339)},
+		},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return translateConditionalError(err)
+}
+
+/*
+SetEncodingWithdrawn marks an encoding as withdrawn, or restores it if `w` is nil.
+
+Arguments:
+- ctx - context that can be used to cancel the operation
+- fcsId - the FCS ID of the encoding, which is the partition key of the table
+- encodingId - the ID of the encoding, which is the sort key of the table
+- w - the Withdrawal to set, or nil to restore the encoding
+Returns:
+- nil on success, ErrWriteConflict if the encoding no longer exists, or another error on failure
+*/
+func (ops *DynamoWriteOpsImpl) SetEncodingWithdrawn(ctx context.Context, fcsId string, encodingId int32, w *Withdrawal) (err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "SetEncodingWithdrawn", start)
+	ctx, span := StartSpan(ctx, "DynamoWriteOps.SetEncodingWithdrawn",
+		attribute.String("fcs_id", fcsId), attribute.Int("encodingid", int(encodingId)), attribute.Bool("withdrawn", w != nil))
+	defer func() { EndSpan(span, err) }()
+
+	expr, err := withdrawalUpdate("encodingid", w)
+	if err != nil {
+		return err
+	}
+	_, err = ops.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: ops.config.EncodingsTablePtr(),
+		Key: map[string]types.AttributeValue{
+			"fcs_id":     &types.AttributeValueMemberS{Value: fcsId},
+			"encodingid": &types.AttributeValueMemberN{Value: strconv.FormatInt(int64(encodingId), 10)},
+		},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return translateConditionalError(err)
+}
+
+/*
+PutAuditRecord writes a record to the audit table
+*/
+func (ops *DynamoWriteOpsImpl) PutAuditRecord(ctx context.Context, record *AuditRecord) (err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "PutAuditRecord", start)
+	ctx, span := StartSpan(ctx, "DynamoWriteOps.PutAuditRecord", attribute.String("target", record.Target))
+	defer func() { EndSpan(span, err) }()
+
+	_, err = ops.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: ops.config.AuditTablePtr(),
+		Item:      record.toDynamo(),
+	})
+	return err
+}
+
+/*
+QueryAuditHistory returns every audit record for the given target, oldest first.
+
+Arguments:
+- ctx - context that can be used to cancel the operation
+- target - the target to look up, see RetireRequest.Target
+Returns:
+- a (possibly empty) slice of AuditRecord pointers, or an error
+*/
+func (ops *DynamoWriteOpsImpl) QueryAuditHistory(ctx context.Context, target string) (result []*AuditRecord, err error) {
+	start := time.Now()
+	defer recordDynamoCall(ctx, "QueryAuditHistory", start)
+	ctx, span := StartSpan(ctx, "DynamoWriteOps.QueryAuditHistory", attribute.String("target", target))
+	defer func() { EndSpan(span, err) }()
+	logger := LoggerFromContext(ctx)
+
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("target").Equal(expression.Value(target))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result = make([]*AuditRecord, 0)
+	var startKey map[string]types.AttributeValue
+	for {
+		MetricsFromContext(ctx).PutCount(MetricDynamoQueries)
+		response, err := ops.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 ops.config.AuditTablePtr(),
+			ExclusiveStartKey:         startKey,
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			KeyConditionExpression:    expr.KeyCondition(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range response.Items {
+			rec, err := AuditRecordFromDynamo(item)
+			if err != nil {
+				logger.Warning("QueryAuditHistory could not read an audit record for %s: %s", target, err)
+				continue
+			}
+			result = append(result, rec)
+		}
+		if response.LastEvaluatedKey == nil {
+			break
+		}
+		startKey = response.LastEvaluatedKey
+	}
+	return result, nil
+}
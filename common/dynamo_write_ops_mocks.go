@@ -0,0 +1,104 @@
+package common
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"time"
+)
+
+type DynamoWriteOpsMock struct {
+	ExistingEncodings []*Encoding //returned by GetEncoding if the key matches
+	GetEncodingError  error
+
+	EncodingsPut         []RawDynamoRecord
+	EncodingMustNotExist bool
+	PutEncodingError     error
+
+	IdMappingsPut         []RawDynamoRecord
+	IdMappingReplaced     *IdMappingRecord
+	ReplaceIdMappingError error
+
+	IdMappingsWithdrawn      []*IdMappingRecord
+	IdMappingWithdrawal      *Withdrawal
+	SetIdMappingWithdrawnErr error
+
+	EncodingsWithdrawn      []int32
+	EncodingWithdrawal      *Withdrawal
+	SetEncodingWithdrawnErr error
+
+	AuditRecordsPut   []*AuditRecord
+	PutAuditRecordErr error
+
+	AuditHistoryResults []*AuditRecord
+	AuditHistoryErr     error
+	AuditTargetQueried  string
+}
+
+func (ops *DynamoWriteOpsMock) GetEncoding(ctx context.Context, fcsId string, encodingId int32) (*Encoding, error) {
+	if ops.GetEncodingError != nil {
+		return nil, ops.GetEncodingError
+	}
+	for _, e := range ops.ExistingEncodings {
+		if e.FCSID == fcsId && e.EncodingId == encodingId {
+			copied := *e
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (ops *DynamoWriteOpsMock) PutEncoding(ctx context.Context, record RawDynamoRecord, mustNotExist bool) error {
+	if ops.PutEncodingError != nil {
+		return ops.PutEncodingError
+	}
+	ops.EncodingsPut = append(ops.EncodingsPut, record)
+	ops.EncodingMustNotExist = mustNotExist
+	return nil
+}
+
+func (ops *DynamoWriteOpsMock) ReplaceIdMapping(ctx context.Context, record RawDynamoRecord, previous *IdMappingRecord) error {
+	if ops.ReplaceIdMappingError != nil {
+		return ops.ReplaceIdMappingError
+	}
+	//same condition as the real write, the record being replaced must be older
+	if incoming, isString := record["lastupdate"].(*types.AttributeValueMemberS); previous != nil && (!isString || incoming.Value <= previous.lastupdate.Format(time.RFC3339)) {
+		return ErrWriteConflict
+	}
+	ops.IdMappingsPut = append(ops.IdMappingsPut, record)
+	ops.IdMappingReplaced = previous
+	return nil
+}
+
+func (ops *DynamoWriteOpsMock) SetIdMappingWithdrawn(ctx context.Context, record *IdMappingRecord, w *Withdrawal) error {
+	if ops.SetIdMappingWithdrawnErr != nil {
+		return ops.SetIdMappingWithdrawnErr
+	}
+	ops.IdMappingsWithdrawn = append(ops.IdMappingsWithdrawn, record)
+	ops.IdMappingWithdrawal = w
+	return nil
+}
+
+func (ops *DynamoWriteOpsMock) SetEncodingWithdrawn(ctx context.Context, fcsId string, encodingId int32, w *Withdrawal) error {
+	if ops.SetEncodingWithdrawnErr != nil {
+		return ops.SetEncodingWithdrawnErr
+	}
+	ops.EncodingsWithdrawn = append(ops.EncodingsWithdrawn, encodingId)
+	ops.EncodingWithdrawal = w
+	return nil
+}
+
+func (ops *DynamoWriteOpsMock) PutAuditRecord(ctx context.Context, record *AuditRecord) error {
+	if ops.PutAuditRecordErr != nil {
+		return ops.PutAuditRecordErr
+	}
+	ops.AuditRecordsPut = append(ops.AuditRecordsPut, record)
+	return nil
+}
+
+func (ops *DynamoWriteOpsMock) QueryAuditHistory(ctx context.Context, target string) ([]*AuditRecord, error) {
+	ops.AuditTargetQueried = target
+	if ops.AuditHistoryErr != nil {
+		return nil, ops.AuditHistoryErr
+	}
+	return ops.AuditHistoryResults, nil
+}
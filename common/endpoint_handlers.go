@@ -0,0 +1,193 @@
+package common
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"html/template"
+	"strings"
+)
+
+/*
+HandlerDeps is everything that the lookup endpoints need to answer a request.  The lambdas build one from the
+environment at startup; tests and the captured-data tester can build one around any DynamoDbOps.
+*/
+type HandlerDeps struct {
+	Ops       DynamoDbOps
+	Config    Config
+	MimeCache MimeEquivalentsCache
+}
+
+/*
+NewHandlerDeps builds a HandlerDeps around the given ops, loading the MIME equivalents cache from them
+*/
+func NewHandlerDeps(ctx context.Context, ops DynamoDbOps, config Config) (*HandlerDeps, error) {
+	cache, err := NewMimeEquivalentsCache(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
+	return &HandlerDeps{
+		Ops:       ops,
+		Config:    config,
+		MimeCache: cache,
+	}, nil
+}
+
+/*
+renderLookupError turns a LookupError into a response for the client.  Unless LEGACY_ERROR_BODIES is "false", we send the
+same bodies that the PHP version of the endpoint did, i.e. `legacyNotFoundBody` as `legacyContentType` for a 404 and
+generic json for anything else.  Otherwise the error is rendered in the format the client asked for, or `defaultFormat`.
+*/
+func renderLookupError(event *events.APIGatewayProxyRequest, lookupErr *LookupError, legacyNotFoundBody string, legacyContentType string, defaultFormat string) *events.APIGatewayProxyResponse {
+	if LegacyErrorBodiesEnabled() {
+		if lookupErr.StatusCode() == 404 {
+			return MakeResponseRaw(404, aws.String(legacyNotFoundBody), legacyContentType)
+		}
+		return lookupErr.LegacyResponse()
+	}
+	return MakeErrorResponse(event, lookupErr, defaultFormat)
+}
+
+/*
+NewReferenceHandler returns the handler for reference.php, which returns the URL of the content as plain text
+*/
+func NewReferenceHandler(deps *HandlerDeps) EndpointHandler {
+	return func(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+		foundContent, lookupErr := FindContent(ctx, &event.QueryStringParameters, deps.Ops, deps.Config, deps.MimeCache)
+		if lookupErr != nil {
+			return renderLookupError(event, lookupErr, "No content found.\n", "text/plain;charset=UTF-8", ErrorFormatText), nil
+		}
+
+		_, renderSpan := StartSpan(ctx, "RenderResponse")
+		defer renderSpan.End()
+
+		if _, ok := (event.QueryStringParameters)["poster"]; ok {
+			if foundContent.PosterURL != "" {
+				return MakeResponseRaw(200, &foundContent.PosterURL, "text/plain;charset=UTF-8"), nil
+			} else {
+				return renderLookupError(event, NewNotFoundError("No poster URL found"), "No poster URL found", "text/plain;charset=UTF-8", ErrorFormatText), nil
+			}
+		}
+
+		return MakeResponseRaw(200, &foundContent.Url, "text/plain;charset=UTF-8"), nil
+	}
+}
+
+/*
+NewVideoHandler returns the handler for video.php, which redirects to the content
+*/
+func NewVideoHandler(deps *HandlerDeps) EndpointHandler {
+	return func(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+		foundContent, lookupErr := FindContent(ctx, &event.QueryStringParameters, deps.Ops, deps.Config, deps.MimeCache)
+		if lookupErr != nil {
+			return renderLookupError(event, lookupErr, "", "text/plain", ErrorFormatText), nil
+		}
+
+		_, renderSpan := StartSpan(ctx, "RenderResponse")
+		defer renderSpan.End()
+
+		if _, havePoster := (event.QueryStringParameters)["poster"]; havePoster {
+			if foundContent.PosterURL != "" {
+				return MakeResponseRedirect(foundContent.PosterURL), nil
+			} else {
+				return renderLookupError(event, NewNotFoundError("No poster URL found"), "No poster URL found", "text/plain", ErrorFormatText), nil
+			}
+		}
+
+		return MakeResponseRedirect(foundContent.Url), nil
+	}
+}
+
+const HtmlTagTemplate = `<video preload='auto' id='video_{{.OctopusId}}' poster='{{.PosterURL}}'{{.ExtraArguments|attr}}>
+  <source src='{{.Url}}' type='{{.Format}}'>
+</video>`
+
+type TemplateData struct {
+	ContentResult
+	ExtraArguments string
+}
+
+/*
+templateHTML renders an html tag for the given found content that is injection-safe.
+
+Arguments:
+
+- ctx - context carrying the request logger
+- foundContent - a non-NULL pointer to a ContentResult instance giving the content to build the tag for
+- extraArguments - a string of extra arguments to put into the video tag
+
+Returns:
+
+- a string of the rendered html on success
+- an error on failure.
+*/
+func templateHTML(ctx context.Context, foundContent *ContentResult, extraArguments string) (string, error) {
+	//see https://stackoverflow.com/questions/14765395/why-am-i-seeing-zgotmplz-in-my-go-html-template-output
+	extraFuncMap := template.FuncMap{
+		//defines a "filter function" that marks the text as html-safe
+		"safe": func(s string) template.HTML {
+			return template.HTML(s)
+		},
+		//defines a "filter function" that marks the text as an HTML attribute
+		"attr": func(s string) template.HTMLAttr {
+			return template.HTMLAttr(s)
+		},
+	}
+
+	logger := LoggerFromContext(ctx)
+	tmpl, err := template.New("html").Funcs(extraFuncMap).Parse(HtmlTagTemplate)
+	if err != nil {
+		logger.Error("Could not parse builtin html template \"%s\": %s", HtmlTagTemplate, err)
+		return "", err
+	}
+
+	templateData := &TemplateData{
+		ContentResult:  *foundContent,
+		ExtraArguments: extraArguments,
+	}
+
+	wr := &strings.Builder{}
+	err = tmpl.Execute(wr, templateData)
+	if err != nil {
+		logger.Error("Could not render found content %v to template \"%s\": %s", foundContent, HtmlTagTemplate, err)
+		return "", err
+	}
+	return wr.String(), nil
+}
+
+/*
+NewMediaTagHandler returns the handler for mediatag.php, which returns an HTML video tag with the URL of the content in
+*/
+func NewMediaTagHandler(deps *HandlerDeps) EndpointHandler {
+	return func(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+		foundContent, lookupErr := FindContent(ctx, &event.QueryStringParameters, deps.Ops, deps.Config, deps.MimeCache)
+		if lookupErr != nil {
+			return renderLookupError(event, lookupErr, "No content found.\n", "text/plain;charset=UTF-8", ErrorFormatHtmlComment), nil
+		}
+
+		_, renderSpan := StartSpan(ctx, "RenderResponse")
+		defer renderSpan.End()
+
+		extraArguments := ""
+		if _, hasNoControls := (event.QueryStringParameters)["nocontrols"]; hasNoControls == false {
+			extraArguments = extraArguments + " controls"
+		}
+		if _, hasAutoPlay := (event.QueryStringParameters)["autoplay"]; hasAutoPlay {
+			extraArguments = extraArguments + " autoplay muted"
+		}
+		if _, hasMuted := (event.QueryStringParameters)["nomuted"]; hasMuted {
+			extraArguments = strings.ReplaceAll(extraArguments, "muted", "")
+		}
+
+		if _, hasLoop := (event.QueryStringParameters)["loop"]; hasLoop {
+			extraArguments = extraArguments + " loop"
+		}
+
+		hTMLToReturn, err := templateHTML(ctx, foundContent, extraArguments)
+
+		if err != nil {
+			return renderLookupError(event, NewBackendError("Internal error, see logs", err), "", "text/plain;charset=UTF-8", ErrorFormatHtmlComment), nil
+		}
+		return MakeResponseRaw(200, &hTMLToReturn, "text/html;charset=UTF-8"), nil
+	}
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"strings"
+	"testing"
+)
+
+func testHandlerDeps(t *testing.T) *HandlerDeps {
+	return &HandlerDeps{
+		Ops:       testMemoryOps(t),
+		Config:    &ConfigMock{},
+		MimeCache: &MimeEquivalentsCacheMock{},
+	}
+}
+
+func TestReferenceHandler(t *testing.T) {
+	handler := NewReferenceHandler(testHandlerDeps(t))
+	response, err := handler(context.Background(), &events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"file": "myfile"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if response.StatusCode != 200 {
+		t.Errorf("expected 200 got %d", response.StatusCode)
+	}
+	if response.Body != "https://cdn.example.com/high.mp4" {
+		t.Errorf("expected the highest bitrate url, got %s", response.Body)
+	}
+
+	response, _ = handler(context.Background(), &events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"file": "nothere"},
+	})
+	if response.StatusCode != 404 {
+		t.Errorf("expected 404 for a missing file, got %d", response.StatusCode)
+	}
+}
+
+func TestVideoHandler(t *testing.T) {
+	handler := NewVideoHandler(testHandlerDeps(t))
+	response, err := handler(context.Background(), &events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"octopusid": "5678"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if response.StatusCode != 302 {
+		t.Errorf("expected a redirect, got %d", response.StatusCode)
+	}
+	if response.Headers["Location"] != "https://cdn.example.com/high.mp4" {
+		t.Errorf("got unexpected location %s", response.Headers["Location"])
+	}
+}
+
+func TestMediaTagHandler(t *testing.T) {
+	handler := NewMediaTagHandler(testHandlerDeps(t))
+	response, err := handler(context.Background(), &events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"file": "myfile", "autoplay": ""},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if response.StatusCode != 200 {
+		t.Errorf("expected 200 got %d", response.StatusCode)
+	}
+	if !strings.Contains(response.Body, "<source src='https://cdn.example.com/high.mp4' type='video/mp4'>") {
+		t.Errorf("body did not contain the source tag: %s", response.Body)
+	}
+	if !strings.Contains(response.Body, " controls autoplay muted>") {
+		t.Errorf("body did not have the expected video arguments: %s", response.Body)
+	}
+}
@@ -0,0 +1,272 @@
+package common
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+IdMappingExplanation is the part of an Explanation that describes the idmapping record that was matched
+*/
+type IdMappingExplanation struct {
+	ContentId  int64       `json:"content_id"`
+	Filebase   string      `json:"filebase"`
+	Project    *string     `json:"project,omitempty"`
+	OctopusId  *int64      `json:"octopus_id,omitempty"`
+	LastUpdate time.Time   `json:"last_update"`
+	Withdrawn  *Withdrawal `json:"withdrawn,omitempty"`
+}
+
+/*
+EncodingDecision records whether a single encoding passed the filter, and if not which criterion it failed on
+*/
+type EncodingDecision struct {
+	EncodingId  int32  `json:"encoding_id"`
+	FCSID       string `json:"fcs_id"`
+	Url         string `json:"url"`
+	Format      string `json:"format"`
+	Mobile      bool   `json:"mobile"`
+	VBitrate    int32  `json:"vbitrate"`
+	FrameWidth  int32  `json:"frame_width"`
+	FrameHeight int32  `json:"frame_height"`
+	Accepted    bool   `json:"accepted"`
+	RejectedOn  string `json:"rejected_on,omitempty"` //one of the FilterCriterion* constants
+}
+
+/*
+ExplainedResponse is a summary of the response that the endpoint would have sent if explain mode was not on
+*/
+type ExplainedResponse struct {
+	StatusCode int               `json:"status_code"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
+/*
+Explanation is a trace of the decisions made by FindContent, which is returned instead of the normal response when a
+request has `explain=1` set.  It lets a client work out for themselves why they got "No encodings matching your request".
+
+Like Metrics, all methods are safe to call on a nil pointer so FindContent does not need to check whether explain mode
+is on.
+*/
+type Explanation struct {
+	lock *sync.Mutex
+
+	Query            map[string]string     `json:"query"`
+	IdMapping        *IdMappingExplanation `json:"idmapping"`
+	FCSIdsConsidered []string              `json:"fcs_ids_considered"`
+	ChosenFCSId      string                `json:"chosen_fcs_id,omitempty"`
+	UsedFallback     bool                  `json:"used_fallback"`
+	FallbackSince    *time.Time            `json:"fallback_since,omitempty"`
+	RequestedFormats []string              `json:"requested_formats"`
+	Decisions        []EncodingDecision    `json:"decisions"`
+	Result           *ContentResult        `json:"result"`
+	Response         *ExplainedResponse    `json:"response"`
+}
+
+func NewExplanation(queryStringParams map[string]string) *Explanation {
+	return &Explanation{
+		lock:             &sync.Mutex{},
+		Query:            queryStringParams,
+		FCSIdsConsidered: []string{},
+		RequestedFormats: []string{},
+		Decisions:        []EncodingDecision{},
+	}
+}
+
+func (e *Explanation) SetIdMapping(rec *IdMappingRecord) {
+	if e == nil || rec == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.IdMapping = &IdMappingExplanation{
+		ContentId:  rec.contentId,
+		Filebase:   rec.filebase,
+		Project:    rec.project,
+		OctopusId:  rec.octopus_id,
+		LastUpdate: rec.lastupdate,
+		Withdrawn:  rec.withdrawn,
+	}
+}
+
+func (e *Explanation) SetFCSIds(considered []string, chosen *string) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.FCSIdsConsidered = append(e.FCSIdsConsidered, considered...)
+	if chosen != nil {
+		e.ChosenFCSId = *chosen
+	}
+}
+
+func (e *Explanation) SetFallback(maybeSince *time.Time) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.UsedFallback = true
+	if maybeSince != nil {
+		copied := *maybeSince
+		e.FallbackSince = &copied
+	}
+}
+
+func (e *Explanation) SetRequestedFormats(formats []string) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.RequestedFormats = append([]string{}, formats...)
+}
+
+/*
+AddDecision records the filter result for an encoding. `rejectedOn` is the criterion that it failed on, or an empty
+string if it passed
+*/
+func (e *Explanation) AddDecision(encoding *Encoding, rejectedOn string) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Decisions = append(e.Decisions, EncodingDecision{
+		EncodingId:  encoding.EncodingId,
+		FCSID:       encoding.FCSID,
+		Url:         encoding.Url,
+		Format:      encoding.Format,
+		Mobile:      encoding.Mobile,
+		VBitrate:    encoding.VBitrate,
+		FrameWidth:  encoding.FrameWidth,
+		FrameHeight: encoding.FrameHeight,
+		Accepted:    rejectedOn == "",
+		RejectedOn:  rejectedOn,
+	})
+}
+
+func (e *Explanation) SetResult(result *ContentResult) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Result = result
+}
+
+/*
+MakeResponse records the response that the endpoint generated and returns a JSON response containing the whole explanation
+*/
+func (e *Explanation) MakeResponse(original *events.APIGatewayProxyResponse) *events.APIGatewayProxyResponse {
+	e.lock.Lock()
+	if original != nil {
+		e.Response = &ExplainedResponse{
+			StatusCode: original.StatusCode,
+			Headers:    original.Headers,
+			Body:       original.Body,
+		}
+	}
+	content, err := json.Marshal(e)
+	e.lock.Unlock()
+
+	if err != nil {
+		DefaultLogger.Error("Explanation.MakeResponse could not marshal explanation: %s", err)
+		return MakeResponseJson(500, GenericErrorBody("invalid output content"))
+	}
+	stringContent := string(content)
+	response := MakeResponseRaw(200, &stringContent, "application/json")
+	response.Headers["Cache-Control"] = "no-store"
+	return response
+}
+
+type explanationContextKey struct{}
+
+func ContextWithExplanation(ctx context.Context, explanation *Explanation) context.Context {
+	return context.WithValue(ctx, explanationContextKey{}, explanation)
+}
+
+/*
+ExplanationFromContext returns the explanation attached to the context, or nil if explain mode is not on
+*/
+func ExplanationFromContext(ctx context.Context) *Explanation {
+	if ctx != nil {
+		if explanation, haveExplanation := ctx.Value(explanationContextKey{}).(*Explanation); haveExplanation {
+			return explanation
+		}
+	}
+	return nil
+}
+
+/*
+explainStages returns the list of API Gateway stages that explain mode is always allowed on, from the EXPLAIN_STAGES
+environment variable (comma-separated).  This defaults to CODE only.
+*/
+func explainStages() []string {
+	stagesString := os.Getenv("EXPLAIN_STAGES")
+	if stagesString == "" {
+		return []string{"CODE"}
+	}
+	stages := strings.Split(stagesString, ",")
+	for i, s := range stages {
+		stages[i] = strings.TrimSpace(s)
+	}
+	return stages
+}
+
+/*
+IsExplainAllowed returns true if the given request is allowed to use explain mode. This is either because the request
+came through one of the stages listed in EXPLAIN_STAGES, or because the `explain_key` parameter (or X-Explain-Key header)
+matches the EXPLAIN_KEY environment variable.  If EXPLAIN_KEY is not set then keys are never accepted.
+*/
+func IsExplainAllowed(event *events.APIGatewayProxyRequest) bool {
+	stages := explainStages()
+	if event.RequestContext.Stage != "" && isStringInList(&event.RequestContext.Stage, &stages) {
+		return true
+	}
+
+	expectedKey := os.Getenv("EXPLAIN_KEY")
+	if expectedKey == "" {
+		return false
+	}
+	providedKey := event.QueryStringParameters["explain_key"]
+	if providedKey == "" {
+		for k, v := range event.Headers {
+			if strings.EqualFold(k, "X-Explain-Key") {
+				providedKey = v
+			}
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(providedKey), []byte(expectedKey)) == 1
+}
+
+/*
+NewExplanationIfRequested returns a new Explanation if the request asked for explain mode and is allowed to have it,
+or nil otherwise.  Requests that ask for explain mode but are not allowed it are processed as normal.
+*/
+func NewExplanationIfRequested(ctx context.Context, event *events.APIGatewayProxyRequest) *Explanation {
+	if value, haveExplain := event.QueryStringParameters["explain"]; !haveExplain || (value != "1" && value != "true") {
+		return nil
+	}
+	if !IsExplainAllowed(event) {
+		LoggerFromContext(ctx).Warning("Explain mode was requested but is not allowed on stage %s", event.RequestContext.Stage)
+		return nil
+	}
+
+	//don't echo the key back out again
+	params := make(map[string]string, len(event.QueryStringParameters))
+	for k, v := range event.QueryStringParameters {
+		if k != "explain_key" {
+			params[k] = v
+		}
+	}
+	return NewExplanation(params)
+}
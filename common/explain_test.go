@@ -0,0 +1,150 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"testing"
+	"time"
+)
+
+/*
+Explain mode should be allowed on the stages in EXPLAIN_STAGES, or anywhere with the right key
+*/
+func TestIsExplainAllowed(t *testing.T) {
+	t.Setenv("EXPLAIN_STAGES", "")
+	t.Setenv("EXPLAIN_KEY", "")
+
+	codeRequest := &events.APIGatewayProxyRequest{RequestContext: events.APIGatewayProxyRequestContext{Stage: "CODE"}}
+	if !IsExplainAllowed(codeRequest) {
+		t.Error("Explain should be allowed on CODE by default")
+	}
+
+	prodRequest := &events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"explain_key": "sekrit"},
+		RequestContext:        events.APIGatewayProxyRequestContext{Stage: "PROD"},
+	}
+	if IsExplainAllowed(prodRequest) {
+		t.Error("Explain should not be allowed on PROD if no key is configured")
+	}
+
+	t.Setenv("EXPLAIN_KEY", "sekrit")
+	if !IsExplainAllowed(prodRequest) {
+		t.Error("Explain should be allowed on PROD with the right key")
+	}
+
+	headerRequest := &events.APIGatewayProxyRequest{
+		Headers:        map[string]string{"x-explain-key": "sekrit"},
+		RequestContext: events.APIGatewayProxyRequestContext{Stage: "PROD"},
+	}
+	if !IsExplainAllowed(headerRequest) {
+		t.Error("Explain should be allowed on PROD with the right key in a header")
+	}
+
+	wrongKeyRequest := &events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"explain_key": "guess"},
+		RequestContext:        events.APIGatewayProxyRequestContext{Stage: "PROD"},
+	}
+	if IsExplainAllowed(wrongKeyRequest) {
+		t.Error("Explain should not be allowed with the wrong key")
+	}
+
+	t.Setenv("EXPLAIN_STAGES", "PROD, CODE")
+	if !IsExplainAllowed(wrongKeyRequest) {
+		t.Error("Explain should be allowed on a stage listed in EXPLAIN_STAGES")
+	}
+}
+
+/*
+FindContent should record which encodings were rejected and why
+*/
+func TestFindContentExplainsDecisions(t *testing.T) {
+	tim, _ := time.Parse(time.RFC3339, "2021-01-02T03:04:05Z")
+	ops := &DynamoOpsMock{
+		IdMappingResult: IdMappingRecord{
+			contentId:  2222,
+			filebase:   "mygreatvideo",
+			lastupdate: tim,
+		},
+		FCSIdForContentIdResults: &[]string{"", "KP-12345"},
+		EncodingsForFCSIdResults: []*Encoding{
+			{EncodingId: 1, Url: "http://url/to/content.webm", Format: "video/webm", VBitrate: 2000, LastUpdate: tim},
+			{EncodingId: 2, Url: "http://url/to/big.mp4", Format: "video/mp4", VBitrate: 8000, LastUpdate: tim},
+			{EncodingId: 3, Url: "http://url/to/small.mp4", Format: "video/mp4", VBitrate: 1000, LastUpdate: tim},
+		},
+	}
+	fakeParams := map[string]string{"file": "mygreatvideo", "format": "video/mp4", "maxbitrate": "4000"}
+	explanation := NewExplanation(fakeParams)
+	ctx := ContextWithExplanation(context.Background(), explanation)
+
+	result, errResponse := FindContent(ctx, &fakeParams, ops, &ConfigMock{}, &MimeEquivalentsCacheMock{})
+	if errResponse != nil {
+		t.Fatalf("FindContent returned an unexpected error %v", errResponse)
+	}
+
+	if explanation.IdMapping == nil || explanation.IdMapping.ContentId != 2222 {
+		t.Errorf("Explanation did not record the idmapping, got %v", explanation.IdMapping)
+	}
+	if len(explanation.FCSIdsConsidered) != 2 || explanation.ChosenFCSId != "KP-12345" {
+		t.Errorf("Explanation did not record the FCS IDs, got %v / %s", explanation.FCSIdsConsidered, explanation.ChosenFCSId)
+	}
+	if explanation.UsedFallback {
+		t.Error("Explanation said the fallback was used when it was not")
+	}
+	if len(explanation.Decisions) != 3 {
+		t.Fatalf("Expected 3 decisions, got %d", len(explanation.Decisions))
+	}
+	expectedReasons := []string{FilterCriterionFormat, FilterCriterionMaxBitrate, ""}
+	for i, reason := range expectedReasons {
+		if explanation.Decisions[i].RejectedOn != reason {
+			t.Errorf("Decision %d was rejected on '%s', expected '%s'", i, explanation.Decisions[i].RejectedOn, reason)
+		}
+		if explanation.Decisions[i].Accepted != (reason == "") {
+			t.Errorf("Decision %d had unexpected accepted value %v", i, explanation.Decisions[i].Accepted)
+		}
+	}
+	if explanation.Result == nil || explanation.Result.EncodingId != result.EncodingId {
+		t.Errorf("Explanation did not record the result, got %v", explanation.Result)
+	}
+}
+
+/*
+InstrumentHandler should replace the response with the explanation when explain=1 is set and allowed, and
+leave it alone otherwise
+*/
+func TestInstrumentHandlerExplainMode(t *testing.T) {
+	t.Setenv("EXPLAIN_STAGES", "")
+	t.Setenv("EXPLAIN_KEY", "")
+
+	inner := func(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+		ExplanationFromContext(ctx).SetFallback(nil)
+		return MakeResponseJson(404, GenericErrorBody("No encodings matching your request")), nil
+	}
+
+	evt := &events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"file": "something", "explain": "1"},
+		RequestContext:        events.APIGatewayProxyRequestContext{Stage: "CODE"},
+	}
+	response, _ := InstrumentHandler("test", inner)(context.Background(), evt)
+	if response.StatusCode != 200 {
+		t.Errorf("Expected explain response to have status 200, got %d", response.StatusCode)
+	}
+
+	var explained Explanation
+	err := json.Unmarshal([]byte(response.Body), &explained)
+	if err != nil {
+		t.Fatalf("Explain response was not valid json: %s", err)
+	}
+	if !explained.UsedFallback {
+		t.Error("Explain response did not include the handler's decisions")
+	}
+	if explained.Response == nil || explained.Response.StatusCode != 404 {
+		t.Errorf("Explain response did not include the original response, got %v", explained.Response)
+	}
+
+	evt.RequestContext.Stage = "PROD"
+	response, _ = InstrumentHandler("test", inner)(context.Background(), evt)
+	if response.StatusCode != 404 {
+		t.Errorf("Explain mode should have been ignored on PROD, got status %d", response.StatusCode)
+	}
+}
@@ -2,8 +2,7 @@ package common
 
 import (
 	"context"
-	"github.com/aws/aws-lambda-go/events"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
 	"net/url"
 	"regexp"
 	"strconv"
@@ -37,7 +36,10 @@ Some entries may not have FCS IDs, and if uncaught this leads to all such entrie
 So, we iterate across them all and get the first non-empty one. If no ids are found then we must fall back to the
 old behaviour (step 3)
 */
-func getFCSId(ctx context.Context, ops DynamoDbOps, contentId int64) (*string, error) {
+func getFCSId(ctx context.Context, ops DynamoDbOps, contentId int64) (fcsId *string, err error) {
+	ctx, span := StartSpan(ctx, "getFCSId", attribute.Int64("contentid", contentId))
+	defer func() { EndSpan(span, err) }()
+
 	results, err := ops.QueryFCSIdForContentId(ctx, contentId)
 
 	if err != nil {
@@ -50,9 +52,11 @@ func getFCSId(ctx context.Context, ops DynamoDbOps, contentId int64) (*string, e
 	for _, r := range *results {
 		if r != "" && r != "ABSENT" {
 			finalResult := r
+			ExplanationFromContext(ctx).SetFCSIds(*results, &finalResult)
 			return &finalResult, nil
 		}
 	}
+	ExplanationFromContext(ctx).SetFCSIds(*results, nil)
 	return nil, nil
 }
 
@@ -72,44 +76,86 @@ func uRLDecodeAndTrim(inputString string) (string, error) {
 getIDMapping tries to find an ID mapping record for the given URL, which must contain either a `file` or `octopusid`
 parameter
 */
-func getIDMapping(ctx context.Context, queryStringParams *map[string]string, ops DynamoDbOps, config Config) (*IdMappingRecord, *events.APIGatewayProxyResponse) {
+func getIDMapping(ctx context.Context, queryStringParams *map[string]string, ops DynamoDbOps, config Config) (result *IdMappingRecord, lookupErr *LookupError) {
+	ctx, span := StartSpan(ctx, "getIDMapping")
+	defer func() {
+		if lookupErr != nil {
+			span.SetAttributes(attribute.Int("http.status_code", lookupErr.StatusCode()))
+		}
+		span.SetAttributes(attribute.Bool("found", result != nil))
+		span.End()
+	}()
+
+	logger := LoggerFromContext(ctx)
 	var idMapping *IdMappingRecord
 	var err error
 
 	if fname, haveFn := (*queryStringParams)["file"]; haveFn {
 		fn, possibleDecodeError := uRLDecodeAndTrim(fname)
 		if possibleDecodeError != nil {
-			log.Print("ERROR FindContent could not decode the file object: ", possibleDecodeError)
-			return nil, MakeResponseJson(400, GenericErrorBody("URL decode error"))
+			logger.Error("FindContent could not decode the file object: %s", possibleDecodeError)
+			return nil, NewInvalidQueryError("URL decode error")
 		}
 		if isFilenameValid(fn) {
 			idMapping, err = ops.QueryIdMappings(ctx, IdMappingIndexFilebase, IdMappingKeyfieldFilebase, fn)
 			if err != nil {
-				log.Print("ERROR FindContent could not get id mapping: ", err)
-				return nil, MakeResponseJson(500, GenericErrorBody("Database error"))
+				logger.Error("FindContent could not get id mapping: %s", err)
+				return nil, NewBackendError("Database error", err)
 			}
 		} else {
-			return nil, MakeResponseJson(400, GenericErrorBody("Invalid filespec"))
+			return nil, NewInvalidQueryError("Invalid filespec")
 		}
 	} else if octopusId, haveOctId := (*queryStringParams)["octopusid"]; haveOctId {
 		octId, possibleError := uRLDecodeAndTrim(octopusId)
 		if possibleError != nil {
-			log.Print("ERROR FindContent could not decode the octopusid object: ", possibleError)
-			return nil, MakeResponseJson(400, GenericErrorBody("URL decode error"))
+			logger.Error("FindContent could not decode the octopusid object: %s", possibleError)
+			return nil, NewInvalidQueryError("URL decode error")
 		}
 		if isOctIdValid(octId) {
 			octIdNum, _ := strconv.ParseInt(octId, 10, 64)
 			idMapping, err = ops.QueryIdMappings(ctx, IdMappingIndexOctid, IdMappingKeyfieldOctid, octIdNum)
 		} else {
-			return nil, MakeResponseJson(400, GenericErrorBody("Invalid octid"))
+			return nil, NewInvalidQueryError("Invalid octid")
 		}
 	} else {
-		return nil, MakeResponseJson(400, GenericErrorBody("No search"))
+		return nil, NewInvalidQueryError("No search")
 	}
 
 	return idMapping, nil
 }
 
+/*
+removeWithdrawn returns the encodings that have not been withdrawn, along with the number that were removed.
+Withdrawn encodings are recorded in the explanation, if there is one.
+*/
+func removeWithdrawn(ctx context.Context, encodings []*Encoding) ([]*Encoding, int) {
+	if encodings == nil {
+		return nil, 0
+	}
+	explanation := ExplanationFromContext(ctx)
+	result := make([]*Encoding, 0, len(encodings))
+	for _, e := range encodings {
+		if e.Withdrawn != nil {
+			explanation.AddDecision(e, FilterCriterionWithdrawn)
+		} else {
+			result = append(result, e)
+		}
+	}
+	return result, len(encodings) - len(result)
+}
+
+/*
+recordEncodingServed sends a metric for the format and bitrate of the encoding that we returned. This goes in its own
+document because the format and bitrate dimensions don't apply to anything else in the request
+*/
+func recordEncodingServed(metrics *Metrics, result *ContentResult) {
+	served := metrics.Derive()
+	served.PutDimension("Format", result.Format)
+	served.PutDimension("BitrateBucket", BitrateBucket(result.VBitrate))
+	served.PutCount(MetricEncodingServed)
+	served.Flush()
+}
+
 /*
 FindContent is the main entry point to the common logic for all the endpoints. It takes in the query parameters and tries to
 find the best match for them, returning this as a pointer to ContentResult.
@@ -121,52 +167,96 @@ Arguments:
 - config - a Config object that encapsulates the runtime configuration
 Returns:
 - a pointer to ContentResult on success
-- a pointer to APIGatewayProxyResponse on error. This can be passed back directly to the runtime.
+- a pointer to LookupError on error. Endpoints render this for the client with MakeErrorResponse.
 */
-func FindContent(ctx context.Context, queryStringParams *map[string]string, ops DynamoDbOps, config Config, cache MimeEquivalentsCache) (*ContentResult, *events.APIGatewayProxyResponse) {
-	idMapping, errResponse := getIDMapping(ctx, queryStringParams, ops, config)
-	if errResponse != nil {
-		return nil, errResponse
+func FindContent(ctx context.Context, queryStringParams *map[string]string, ops DynamoDbOps, config Config, cache MimeEquivalentsCache) (*ContentResult, *LookupError) {
+	start := time.Now()
+	logger := LoggerFromContext(ctx)
+	metrics := MetricsFromContext(ctx)
+	defer metrics.PutDuration(MetricLookupLatency, start)
+	explanation := ExplanationFromContext(ctx)
+
+	idMapping, lookupErr := getIDMapping(ctx, queryStringParams, ops, config)
+	if lookupErr != nil {
+		logger.WithDuration(start).Info("FindContent lookup failed with status %d: %s", lookupErr.StatusCode(), lookupErr)
+		if lookupErr.Kind == LookupErrorBackend {
+			metrics.PutCount(MetricLookupBackendError)
+		} else {
+			metrics.PutCount(MetricLookupInvalidQuery)
+		}
+		return nil, lookupErr
 	}
 
 	var contentToFilter []*Encoding
-	log.Printf("DEBUGGING got id mapping result %v", idMapping)
+	logger.Debug("FindContent got id mapping result %v", idMapping)
+	explanation.SetIdMapping(idMapping)
 	if idMapping == nil { //nothing in idmapping => does not exist
-		return nil, MakeResponseJson(404, GenericErrorBody("Content not found"))
+		logger.WithDuration(start).Info("FindContent found no id mapping")
+		metrics.PutCount(MetricLookupNoIdMapping)
+		return nil, NewNotFoundError("Content not found")
+	}
+	if idMapping.withdrawn != nil {
+		logger.WithDuration(start).Info("FindContent id mapping was withdrawn at %s: %s", idMapping.withdrawn.At.Format(time.RFC3339), idMapping.withdrawn.Reason)
+		metrics.PutCount(MetricLookupWithdrawn)
+		return nil, NewGoneError("This content has been withdrawn")
 	}
 	var err error
+	var withdrawnCount int
 
 	fcsId, err := getFCSId(ctx, ops, idMapping.contentId)
 	if err != nil {
-		return nil, MakeResponseJson(500, GenericErrorBody("Database error"))
+		logger.Error("FindContent could not look up FCS ID: %s", err)
+		metrics.PutCount(MetricLookupBackendError)
+		return nil, NewBackendError("Database error", err)
 	}
 
 	if fcsId != nil {
-		log.Printf("DEBUGGING got FCS ID %s", *fcsId)
+		logger.Debug("FindContent got FCS ID %s", *fcsId)
 		contentToFilter, err = ops.QueryEncodingsForFCSId(ctx, *fcsId)
 		if err != nil {
-			log.Printf("ERROR Could not query encodings: %s", err)
-			return nil, MakeResponseJson(500, GenericErrorBody("Database error"))
+			logger.Error("FindContent could not query encodings: %s", err)
+			metrics.PutCount(MetricLookupBackendError)
+			return nil, NewBackendError("Database error", err)
+		}
+		var removed int
+		contentToFilter, removed = removeWithdrawn(ctx, contentToFilter)
+		withdrawnCount += removed
+		if removed > 0 && len(contentToFilter) == 0 { //the whole version was withdrawn, so see if there is anything older
+			contentToFilter = nil
 		}
 	}
 
 	if contentToFilter == nil { //we didn't get any results yet
-		log.Print("INFO No content from primary search, falling back to secondary")
+		logger.Info("FindContent got no content from primary search, falling back to secondary")
+		metrics.PutCount(MetricLookupNoFCSIdFallback)
 		_, haveAllowOld := (*queryStringParams)["allow_old"]
 		var maybeSince *time.Time
 		if !haveAllowOld {
 			maybeSince = &idMapping.lastupdate
-			log.Printf("INFO allow_old not set, only looking for results since %s", maybeSince.Format(time.RFC3339))
+			logger.Info("FindContent allow_old not set, only looking for results since %s", maybeSince.Format(time.RFC3339))
 		}
+		explanation.SetFallback(maybeSince)
 		contentToFilter, err = ops.QueryEncodingsForContentId(ctx, idMapping.contentId, maybeSince)
 		if err != nil {
-			log.Printf("ERROR Could not query encodings: %s", err)
-			return nil, MakeResponseJson(500, GenericErrorBody("Database error"))
+			logger.Error("FindContent could not query encodings: %s", err)
+			metrics.PutCount(MetricLookupBackendError)
+			return nil, NewBackendError("Database error", err)
 		}
+		var removed int
+		contentToFilter, removed = removeWithdrawn(ctx, contentToFilter)
+		withdrawnCount += removed
+	}
+
+	if withdrawnCount > 0 && len(contentToFilter) == 0 {
+		logger.WithDuration(start).Info("FindContent found only withdrawn encodings")
+		metrics.PutCount(MetricLookupWithdrawn)
+		return nil, NewGoneError("This content has been withdrawn")
 	}
 
-	for _, c := range contentToFilter {
-		log.Printf("INFO Got record %v", *c)
+	if logger.IsEnabled(LogLevelDebug) {
+		for _, c := range contentToFilter {
+			logger.Debug("FindContent got record %v", *c)
+		}
 	}
 
 	var filenameOverride string
@@ -180,11 +270,18 @@ func FindContent(ctx context.Context, queryStringParams *map[string]string, ops
 		} else {
 			initialFormat, err = url.QueryUnescape(val) //the format part was not messed around so just use it
 			if err != nil {
-				log.Printf("ERROR could not unescape requested format string %s: %s", val, err)
-				return nil, MakeResponseJson(400, GenericErrorBody("Invalid query"))
+				logger.Error("FindContent could not unescape requested format string %s: %s", val, err)
+				metrics.PutCount(MetricLookupInvalidQuery)
+				return nil, NewInvalidQueryError("Invalid query")
 			}
 		}
 		formats = cache.EquivalentsFor(initialFormat)
+		explanation.SetRequestedFormats(formats)
+		if len(formats) > 1 {
+			metrics.PutCount(MetricMimeEquivalentsExpanded)
+		} else {
+			metrics.PutCount(MetricMimeEquivalentsNone)
+		}
 	}
 
 	var need_mobile = false
@@ -235,7 +332,7 @@ func FindContent(ctx context.Context, queryStringParams *map[string]string, ops
 		pngPoster = true
 	}
 
-	filteredContent := ContentFilter(contentToFilter, &formats, need_mobile, minbitrate, maxbitrate, minheight, maxheight, minwidth, maxwidth)
+	filteredContent, rejectionReasons := contentFilterWithReasons(ctx, contentToFilter, &formats, need_mobile, minbitrate, maxbitrate, minheight, maxheight, minwidth, maxwidth)
 	if filteredContent != nil {
 		_, allowInsecure := (*queryStringParams)["allow_insecure"]
 		filteredContent.Url = ForceHTTPS(filteredContent.Url, allowInsecure)
@@ -243,7 +340,7 @@ func FindContent(ctx context.Context, queryStringParams *map[string]string, ops
 		if possiblePosterImageError == nil {
 			filteredContent.PosterURL = generatedPosterImageURL
 		} else {
-			log.Printf("WARNING GeneratePosterImageURL could not generate poster image URL for: %s, error: %s", filteredContent.Url, possiblePosterImageError)
+			logger.Warning("GeneratePosterImageURL could not generate poster image URL for: %s, error: %s", filteredContent.Url, possiblePosterImageError)
 		}
 
 		if len(formats) > 0 {
@@ -253,8 +350,14 @@ func FindContent(ctx context.Context, queryStringParams *map[string]string, ops
 			endOfURL := regexp.MustCompile(`/[^/]+$`)
 			filteredContent.Url = endOfURL.ReplaceAllString(filteredContent.Url, "/"+filenameOverride)
 		}
+		logger.WithDuration(start).Info("FindContent matched encoding %d (%s)", filteredContent.EncodingId, filteredContent.Url)
+		metrics.PutCount(MetricLookupHit)
+		recordEncodingServed(metrics, filteredContent)
+		explanation.SetResult(filteredContent)
 		return filteredContent, nil
 	} else {
-		return nil, MakeResponseJson(404, GenericErrorBody("No encodings matching your request"))
+		logger.WithDuration(start).Info("FindContent found no encodings matching the request, rejections were %v", rejectionReasons)
+		metrics.PutCount(MetricLookupFilterEliminatedAll)
+		return nil, NewNoMatchingEncodingError(rejectionReasons)
 	}
 }
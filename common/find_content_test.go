@@ -35,11 +35,11 @@ func TestFindContentInvalidParams(t *testing.T) {
 	if errResponse == nil {
 		t.Error("FindContent did not return an error response for an invalid query")
 	} else {
-		if errResponse.StatusCode != 400 {
-			t.Errorf("FindContent returned wrong status code for invalid query, got %d wanted 400", errResponse.StatusCode)
+		if errResponse.StatusCode() != 400 {
+			t.Errorf("FindContent returned wrong status code for invalid query, got %d wanted 400", errResponse.StatusCode())
 		}
-		if !strings.Contains(errResponse.Body, "No search") {
-			t.Errorf("FindContent returned content body '%s' did not include the expected error string", errResponse.Body)
+		if !strings.Contains(errResponse.Error(), "No search") {
+			t.Errorf("FindContent returned content body '%s' did not include the expected error string", errResponse.Error())
 		}
 	}
 }
@@ -71,11 +71,11 @@ func TestFindContentInvalidFilename(t *testing.T) {
 	if errResponse == nil {
 		t.Error("FindContent did not return an error response for an invalid filebase")
 	} else {
-		if errResponse.StatusCode != 400 {
-			t.Errorf("FindContent returned wrong status code for invalid filebase, got %d wanted 400", errResponse.StatusCode)
+		if errResponse.StatusCode() != 400 {
+			t.Errorf("FindContent returned wrong status code for invalid filebase, got %d wanted 400", errResponse.StatusCode())
 		}
-		if !strings.Contains(errResponse.Body, "Invalid filespec") {
-			t.Errorf("FindContent returned content body '%s' did not include the expected error string", errResponse.Body)
+		if !strings.Contains(errResponse.Error(), "Invalid filespec") {
+			t.Errorf("FindContent returned content body '%s' did not include the expected error string", errResponse.Error())
 		}
 	}
 }
@@ -205,12 +205,12 @@ func TestFindContentValidFilenameNotFound(t *testing.T) {
 		t.FailNow()
 	}
 
-	if errResponse.StatusCode != 404 {
-		t.Errorf("FindContent returned error %d for file not found, expected 404", errResponse.StatusCode)
+	if errResponse.StatusCode() != 404 {
+		t.Errorf("FindContent returned error %d for file not found, expected 404", errResponse.StatusCode())
 	}
 
-	if !strings.Contains(errResponse.Body, "Content not found") {
-		t.Errorf("Did not found the 'Not Found' string in the error body, got %s", errResponse.Body)
+	if !strings.Contains(errResponse.Error(), "Content not found") {
+		t.Errorf("Did not found the 'Not Found' string in the error body, got %s", errResponse.Error())
 	}
 	if content != nil {
 		t.Error("FindContent returned content for an id not found")
@@ -245,11 +245,11 @@ func TestFindContentInvalidOctopusId(t *testing.T) {
 	if errResponse == nil {
 		t.Error("FindContent did not return an error response for an invalid octid")
 	} else {
-		if errResponse.StatusCode != 400 {
-			t.Errorf("FindContent returned wrong status code for invalid octid, got %d wanted 400", errResponse.StatusCode)
+		if errResponse.StatusCode() != 400 {
+			t.Errorf("FindContent returned wrong status code for invalid octid, got %d wanted 400", errResponse.StatusCode())
 		}
-		if !strings.Contains(errResponse.Body, "Invalid octid") {
-			t.Errorf("FindContent returned content body '%s' did not include the expected error string", errResponse.Body)
+		if !strings.Contains(errResponse.Error(), "Invalid octid") {
+			t.Errorf("FindContent returned content body '%s' did not include the expected error string", errResponse.Error())
 		}
 	}
 }
@@ -281,11 +281,11 @@ func TestFindContentAnotherInvalidOctopusId(t *testing.T) {
 	if errResponse == nil {
 		t.Error("FindContent did not return an error response for an invalid octid")
 	} else {
-		if errResponse.StatusCode != 400 {
-			t.Errorf("FindContent returned wrong status code for invalid octid, got %d wanted 400", errResponse.StatusCode)
+		if errResponse.StatusCode() != 400 {
+			t.Errorf("FindContent returned wrong status code for invalid octid, got %d wanted 400", errResponse.StatusCode())
 		}
-		if !strings.Contains(errResponse.Body, "Invalid octid") {
-			t.Errorf("FindContent returned content body '%s' did not include the expected error string", errResponse.Body)
+		if !strings.Contains(errResponse.Error(), "Invalid octid") {
+			t.Errorf("FindContent returned content body '%s' did not include the expected error string", errResponse.Error())
 		}
 	}
 }
@@ -537,3 +537,116 @@ func TestFindContentM3U8(t *testing.T) {
 		t.Errorf("Unexpected output: %s", content.Url)
 	}
 }
+
+/*
+FindContent should return a NoMatchingEncoding error, with the reasons, if every encoding is filtered out
+*/
+func TestFindContentNoMatchingEncodingReasons(t *testing.T) {
+	fakeParams := map[string]string{"file": "mygreatvideo", "maxbitrate": "1000"}
+	tim, _ := time.Parse(time.RFC3339, time.RFC3339)
+	ops := &DynamoOpsMock{
+		IdMappingResult: IdMappingRecord{
+			contentId:  2222,
+			filebase:   "mygreatvideo",
+			lastupdate: tim,
+		},
+		FCSIdForContentIdResults: &[]string{"KP-12345"},
+		EncodingsForFCSIdResults: []*Encoding{
+			&Encoding{EncodingId: 123, Url: "http://url/to/content.mp4", Format: "mp4", VBitrate: 12345, FCSID: "KP-12345"},
+			&Encoding{EncodingId: 124, Url: "http://url/to/content2.mp4", Format: "mp4", VBitrate: 4000, FCSID: "KP-12345"},
+		},
+	}
+	config := &ConfigMock{
+		IdMappingTableVal: "id-mapping-table",
+		EncodingsTableVal: "encodings-table",
+	}
+
+	content, lookupErr := FindContent(context.Background(), &fakeParams, ops, config, &MimeEquivalentsCacheMock{})
+	if content != nil {
+		t.Errorf("FindContent returned content %v when everything should have been filtered out", content)
+	}
+	if lookupErr == nil {
+		t.Fatal("FindContent returned no error when everything was filtered out")
+	}
+	if lookupErr.Kind != LookupErrorNoMatchingEncoding || lookupErr.StatusCode() != 404 {
+		t.Errorf("FindContent returned the wrong error, got %s", lookupErr.Kind)
+	}
+	if len(lookupErr.Reasons) != 1 || lookupErr.Reasons[FilterCriterionMaxBitrate] != 2 {
+		t.Errorf("FindContent returned the wrong rejection reasons, got %v", lookupErr.Reasons)
+	}
+}
+
+/*
+FindContent should return 410 Gone if the idmapping record has been withdrawn, without looking up any encodings
+*/
+func TestFindContentWithdrawnIdMapping(t *testing.T) {
+	fakeParams := map[string]string{"file": "mygreatvideo"}
+	ops := &DynamoOpsMock{
+		IdMappingResult: IdMappingRecord{
+			contentId: 2222,
+			filebase:  "mygreatvideo",
+			withdrawn: &Withdrawal{Reason: "legal", At: time.Now()},
+		},
+		FCSIdForContentIdResults: &[]string{"KP-12345"},
+	}
+
+	content, errResponse := FindContent(context.Background(), &fakeParams, ops, &ConfigMock{}, &MimeEquivalentsCacheMock{})
+	if content != nil {
+		t.Error("FindContent returned content for a withdrawn idmapping record")
+	}
+	if errResponse == nil || errResponse.StatusCode() != 410 {
+		t.Fatalf("Expected a 410 for withdrawn content, got %v", errResponse)
+	}
+	if ops.LastContentId != 0 {
+		t.Error("FindContent should not have looked for encodings of withdrawn content")
+	}
+}
+
+/*
+FindContent should skip withdrawn encodings, fall back to older versions if a whole version is withdrawn, and return
+410 if everything is withdrawn
+*/
+func TestFindContentWithdrawnEncodings(t *testing.T) {
+	fakeParams := map[string]string{"file": "mygreatvideo", "allow_old": "true"}
+	withdrawal := &Withdrawal{Reason: "legal", At: time.Now()}
+	ops := &DynamoOpsMock{
+		IdMappingResult: IdMappingRecord{
+			contentId: 2222,
+			filebase:  "mygreatvideo",
+		},
+		FCSIdForContentIdResults: &[]string{"KP-12345"},
+		EncodingsForFCSIdResults: []*Encoding{
+			&Encoding{EncodingId: 123, Url: "http://url/to/content.mp4", Format: "mp4", VBitrate: 12345, FCSID: "KP-12345", Withdrawn: withdrawal},
+			&Encoding{EncodingId: 124, Url: "http://url/to/content2.mp4", Format: "mp4", VBitrate: 4000, FCSID: "KP-12345"},
+		},
+	}
+
+	content, errResponse := FindContent(context.Background(), &fakeParams, ops, &ConfigMock{}, &MimeEquivalentsCacheMock{})
+	if errResponse != nil {
+		t.Fatalf("FindContent returned an unexpected error: %s", errResponse)
+	}
+	if content.EncodingId != 124 {
+		t.Errorf("Expected the withdrawn encoding to be skipped, got encoding %d", content.EncodingId)
+	}
+
+	ops.EncodingsForFCSIdResults[1].Withdrawn = withdrawal
+	ops.EncodingsForContentIdResults = []*Encoding{
+		&Encoding{EncodingId: 99, Url: "http://url/to/old.mp4", Format: "mp4", VBitrate: 2000, FCSID: "KP-11111"},
+	}
+	content, errResponse = FindContent(context.Background(), &fakeParams, ops, &ConfigMock{}, &MimeEquivalentsCacheMock{})
+	if errResponse != nil {
+		t.Fatalf("FindContent returned an unexpected error: %s", errResponse)
+	}
+	if content.EncodingId != 99 {
+		t.Errorf("Expected to fall back to the older version, got encoding %d", content.EncodingId)
+	}
+
+	ops.EncodingsForContentIdResults[0].Withdrawn = withdrawal
+	content, errResponse = FindContent(context.Background(), &fakeParams, ops, &ConfigMock{}, &MimeEquivalentsCacheMock{})
+	if content != nil {
+		t.Error("FindContent returned content when every encoding was withdrawn")
+	}
+	if errResponse == nil || errResponse.StatusCode() != 410 {
+		t.Errorf("Expected a 410 when every encoding was withdrawn, got %v", errResponse)
+	}
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden from the current handlers")
+
+const goldenDir = "testdata/golden"
+
+/*
+goldenCase is one request to one of the lookup endpoints.  Its response is compared to testdata/golden/{name}.golden
+*/
+type goldenCase struct {
+	name     string
+	endpoint string //reference, video or mediatag
+	query    map[string]string
+	headers  map[string]string
+	legacy   bool //leave LEGACY_ERROR_BODIES at its default, otherwise it is "false"
+}
+
+var goldenCases = []goldenCase{
+	{name: "reference_file", endpoint: "reference", query: map[string]string{"file": "myfile"}},
+	{name: "reference_octopusid", endpoint: "reference", query: map[string]string{"octopusid": "5678"}},
+	{name: "reference_format_webm", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/webm"}},
+	{name: "reference_format_webm_insecure", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/webm", "allow_insecure": ""}},
+	{name: "reference_format_mime_equivalent", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "application/x-mpegURL"}},
+	{name: "reference_need_mobile", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/mp4", "need_mobile": "true"}},
+	{name: "reference_maxbitrate", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/mp4", "maxbitrate": "1000"}},
+	{name: "reference_poster", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/mp4", "poster": ""}},
+	{name: "reference_poster_png", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/mp4", "poster": "", "png": ""}},
+	{name: "reference_not_found", endpoint: "reference", query: map[string]string{"file": "nosuchfile"}},
+	{name: "reference_not_found_json", endpoint: "reference", query: map[string]string{"file": "nosuchfile"}, headers: map[string]string{"Accept": "application/json"}},
+	{name: "reference_not_found_legacy", endpoint: "reference", query: map[string]string{"file": "nosuchfile"}, legacy: true},
+	{name: "reference_no_matching_encoding", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/mp4", "minbitrate": "4000"}},
+	{name: "reference_no_matching_encoding_json", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/mp4", "minbitrate": "4000"}, headers: map[string]string{"Accept": "application/json"}},
+	{name: "reference_withdrawn_encodings", endpoint: "reference", query: map[string]string{"file": "pulledfile"}},
+	{name: "reference_withdrawn_idmapping", endpoint: "reference", query: map[string]string{"file": "takendown"}},
+	{name: "reference_no_parameters", endpoint: "reference", query: map[string]string{}},
+	{name: "reference_invalid_format", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/%zz"}},
+	{name: "reference_invalid_format_legacy", endpoint: "reference", query: map[string]string{"file": "myfile", "format": "video/%zz"}, legacy: true},
+
+	{name: "video_file", endpoint: "video", query: map[string]string{"file": "myfile", "format": "video/mp4"}},
+	{name: "video_octopusid", endpoint: "video", query: map[string]string{"octopusid": "5678", "format": "video/webm"}},
+	{name: "video_dodgy_m3u8_format", endpoint: "video", query: map[string]string{"file": "myfile", "format": "video/myfile_1080.m3u8"}},
+	{name: "video_poster", endpoint: "video", query: map[string]string{"file": "myfile", "format": "video/mp4", "poster": ""}},
+	{name: "video_not_found", endpoint: "video", query: map[string]string{"file": "nosuchfile"}},
+	{name: "video_not_found_legacy", endpoint: "video", query: map[string]string{"file": "nosuchfile"}, legacy: true},
+	{name: "video_withdrawn_idmapping_json", endpoint: "video", query: map[string]string{"file": "takendown"}, headers: map[string]string{"Accept": "application/json"}},
+
+	{name: "mediatag_file", endpoint: "mediatag", query: map[string]string{"file": "myfile", "format": "video/mp4"}},
+	{name: "mediatag_autoplay_loop", endpoint: "mediatag", query: map[string]string{"file": "myfile", "format": "video/mp4", "autoplay": "", "loop": ""}},
+	{name: "mediatag_autoplay_nomuted_nocontrols", endpoint: "mediatag", query: map[string]string{"file": "myfile", "format": "video/mp4", "autoplay": "", "nomuted": "", "nocontrols": ""}},
+	{name: "mediatag_mime_equivalent", endpoint: "mediatag", query: map[string]string{"octopusid": "5678", "format": "application/x-mpegURL"}},
+	{name: "mediatag_not_found", endpoint: "mediatag", query: map[string]string{"file": "nosuchfile"}},
+	{name: "mediatag_not_found_legacy", endpoint: "mediatag", query: map[string]string{"file": "nosuchfile"}, legacy: true},
+	{name: "mediatag_no_matching_encoding", endpoint: "mediatag", query: map[string]string{"file": "myfile", "format": "video/ogg"}},
+}
+
+/*
+goldenHandlerDeps builds the handler dependencies from the snapshots in testdata/golden/fixtures, including the MIME
+equivalents cache, so that the lookups go through the same code that they do in the lambdas
+*/
+func goldenHandlerDeps(t *testing.T) *HandlerDeps {
+	ops := &MemoryDynamoDbOps{}
+	for filename, target := range map[string]*[]RawDynamoRecord{
+		"encodings.jsonl":        &ops.Encodings,
+		"idmapping.jsonl":        &ops.IdMappings,
+		"mime_equivalents.jsonl": &ops.MimeEquivalents,
+	} {
+		f, err := os.Open(filepath.Join(goldenDir, "fixtures", filename))
+		if err != nil {
+			t.Fatalf("could not open fixture: %s", err)
+		}
+		*target, err = ReadSnapshot(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("could not read fixture %s: %s", filename, err)
+		}
+	}
+	deps, err := NewHandlerDeps(context.Background(), ops, &ConfigMock{})
+	if err != nil {
+		t.Fatalf("could not build handler deps: %s", err)
+	}
+	return deps
+}
+
+/*
+renderGolden writes out a response as its status line, then the headers in order one per line, then a blank line and
+the body
+*/
+func renderGolden(response *events.APIGatewayProxyResponse) string {
+	headers := make([]string, 0, len(response.Headers)+len(response.MultiValueHeaders))
+	for name, value := range response.Headers {
+		headers = append(headers, name+": "+value)
+	}
+	for name, values := range response.MultiValueHeaders {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	sort.Strings(headers)
+
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "HTTP %d\n", response.StatusCode)
+	for _, header := range headers {
+		out.WriteString(header + "\n")
+	}
+	out.WriteString("\n")
+	out.WriteString(response.Body)
+	return out.String()
+}
+
+/*
+TestGolden runs every endpoint against the fixture data and checks that the responses have not changed.  If a change is
+intended, regenerate the golden files with `go test ./common -run TestGolden -update` and review the diff.
+*/
+func TestGolden(t *testing.T) {
+	deps := goldenHandlerDeps(t)
+	handlers := map[string]EndpointHandler{
+		"reference": NewReferenceHandler(deps),
+		"video":     NewVideoHandler(deps),
+		"mediatag":  NewMediaTagHandler(deps),
+	}
+
+	for _, c := range goldenCases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.legacy {
+				t.Setenv("LEGACY_ERROR_BODIES", "")
+			} else {
+				t.Setenv("LEGACY_ERROR_BODIES", "false")
+			}
+			response, err := handlers[c.endpoint](context.Background(), &events.APIGatewayProxyRequest{
+				Path:                  "/interactivevideos/" + c.endpoint + ".php",
+				Headers:               c.headers,
+				QueryStringParameters: c.query,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := renderGolden(response)
+
+			goldenFile := filepath.Join(goldenDir, c.name+".golden")
+			if *updateGolden {
+				if err := os.WriteFile(goldenFile, []byte(got), 0644); err != nil {
+					t.Fatalf("could not update golden file: %s", err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatalf("could not read golden file, run with -update to create it: %s", err)
+			}
+			if got != string(expected) {
+				t.Errorf("response did not match %s, run with -update if this is intended.\nexpected:\n%s\ngot:\n%s", goldenFile, expected, got)
+			}
+		})
+	}
+}
+
+/*
+Every golden file should belong to a case, so that removing a case doesn't leave a stale file behind
+*/
+func TestGoldenFilesHaveCases(t *testing.T) {
+	names := make(map[string]bool, len(goldenCases))
+	for _, c := range goldenCases {
+		if names[c.name] {
+			t.Errorf("more than one case is called %s", c.name)
+		}
+		names[c.name] = true
+	}
+	files, err := filepath.Glob(filepath.Join(goldenDir, "*.golden"))
+	if err != nil {
+		t.Fatalf("could not list golden files: %s", err)
+	}
+	for _, file := range files {
+		if name := strings.TrimSuffix(filepath.Base(file), ".golden"); !names[name] {
+			t.Errorf("%s has no case, remove it", file)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+/*
+EndpointHandler is the signature of the HandleEvent function that each endpoint lambda provides
+*/
+type EndpointHandler func(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error)
+
+/*
+InstrumentHandler wraps an endpoint's handler so that every request gets a request logger, a metrics document and a
+trace span attached to its context.  Metrics and spans are flushed out once the handler returns.
+If the request asks for explain mode (and is allowed it) then the handler's response is replaced with the Explanation
+of how it was arrived at.
+
+Arguments:
+- endpointName - name of the endpoint, used to tag the logs, metrics and traces
+- handler - the endpoint's HandleEvent function
+Returns:
+- an EndpointHandler that can be passed to lambda.Start
+*/
+func InstrumentHandler(endpointName string, handler EndpointHandler) EndpointHandler {
+	return func(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+		ctx = ContextWithRequestLogger(ctx, endpointName, event)
+		ctx, metrics := ContextWithRequestMetrics(ctx, endpointName, event)
+		defer metrics.Flush()
+		ctx, span := StartRequestSpan(ctx, endpointName, event)
+
+		explanation := NewExplanationIfRequested(ctx, event)
+		if explanation != nil {
+			ctx = ContextWithExplanation(ctx, explanation)
+		}
+
+		response, err := handler(ctx, event)
+		if explanation != nil && err == nil {
+			response = explanation.MakeResponse(response)
+		}
+		EndRequestSpan(ctx, span, response)
+		return response, err
+	}
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"go.opentelemetry.io/otel/attribute"
+	"testing"
+)
+
+/*
+InstrumentHandler should give the wrapped handler a context with a request logger and metrics, and record the
+response status on the request span
+*/
+func TestInstrumentHandler(t *testing.T) {
+	recorder := setUpTestTracing(t)
+
+	var sawLogger *Logger
+	var sawMetrics *Metrics
+	inner := func(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+		sawLogger = LoggerFromContext(ctx)
+		sawMetrics = MetricsFromContext(ctx)
+		return MakeResponseJson(404, GenericErrorBody("not here")), nil
+	}
+
+	evt := &events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"octopusid": "12345"},
+		RequestContext:        events.APIGatewayProxyRequestContext{RequestID: "req-5678", Stage: "CODE"},
+	}
+	response, err := InstrumentHandler("test", inner)(context.Background(), evt)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if response.StatusCode != 404 {
+		t.Errorf("Wrapped handler changed the response status to %d", response.StatusCode)
+	}
+
+	if sawLogger == nil || sawLogger.fields["request_id"] != "req-5678" || sawLogger.fields["lookup_key"] != "12345" {
+		t.Errorf("Handler did not get the request logger, got %v", sawLogger)
+	}
+	if _, haveTraceId := sawLogger.fields["trace_id"]; !haveTraceId {
+		t.Error("Request logger did not include the trace ID")
+	}
+	if sawMetrics == nil || sawMetrics.dimensions["Endpoint"] != "test" || sawMetrics.dimensions["Stage"] != "CODE" {
+		t.Errorf("Handler did not get the request metrics, got %v", sawMetrics)
+	}
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("Expected 1 ended span, got %d", len(ended))
+	}
+	found := false
+	for _, attr := range ended[0].Attributes() {
+		if attr.Key == attribute.Key("http.status_code") && attr.Value.AsInt64() == 404 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Request span did not record the status code, got %v", ended[0].Attributes())
+	}
+}
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"sort"
+	"sync"
+	"time"
+)
+
+const HealthStatusOk = "ok"
+const HealthStatusFailed = "failed"
+
+/*
+DependencyHealth is the result of checking a single thing that the endpoints depend on
+*/
+type DependencyHealth struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+/*
+MimeEquivalentsCacheHealth describes the state of the in-memory MIME equivalents cache
+*/
+type MimeEquivalentsCacheHealth struct {
+	Status     string    `json:"status"`
+	Entries    int       `json:"entries"`
+	LoadedAt   time.Time `json:"loaded_at"`
+	AgeSeconds float64   `json:"age_seconds"`
+	Error      string    `json:"error,omitempty"`
+}
+
+/*
+HealthReport is the json document returned by the healthcheck endpoint. `Status` is only "ok" if every dependency is ok.
+*/
+type HealthReport struct {
+	Status               string                      `json:"status"`
+	CheckedAt            time.Time                   `json:"checked_at"`
+	Dependencies         []DependencyHealth          `json:"dependencies"`
+	MimeEquivalentsCache *MimeEquivalentsCacheHealth `json:"mime_equivalents_cache"`
+}
+
+/*
+configuredTables returns the names of the tables that the endpoints need, keyed by a short name for the report
+*/
+func configuredTables(config Config) map[string]string {
+	return map[string]string{
+		"encodings":        *config.EncodingsTablePtr(),
+		"idmapping":        config.IdMappingTable(),
+		"mime-equivalents": *config.MimeEquivalentsTablePtr(),
+		"poster-frames":    *config.PosterFramesTablePtr(),
+	}
+}
+
+/*
+checkDependency runs the given check and times it
+*/
+func checkDependency(name string, check func() error) DependencyHealth {
+	start := time.Now()
+	err := check()
+	result := DependencyHealth{
+		Name:      name,
+		Status:    HealthStatusOk,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000.0,
+	}
+	if err != nil {
+		result.Status = HealthStatusFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+/*
+RunHealthCheck checks that the configuration is valid, that every table can be read and that the MIME equivalents
+cache was loaded.  The table checks run in parallel so that the total time is roughly that of the slowest one.
+
+Arguments:
+- ctx - context carrying the request logger, metrics and trace
+- config - the Config from NewConfig, or nil if that failed
+- configErr - the error from NewConfig, if any
+- ops - a DynamoDbOps object. Can be nil if config is nil
+- cache - the MimeEquivalentsCache, or nil if it could not be loaded
+- cacheErr - the error from NewMimeEquivalentsCache, if any
+Returns:
+- a HealthReport. This is never nil.
+*/
+func RunHealthCheck(ctx context.Context, config Config, configErr error, ops DynamoDbOps, cache MimeEquivalentsCache, cacheErr error) *HealthReport {
+	ctx, span := StartSpan(ctx, "RunHealthCheck")
+	defer span.End()
+
+	report := &HealthReport{
+		Status:    HealthStatusOk,
+		CheckedAt: time.Now(),
+	}
+
+	report.Dependencies = append(report.Dependencies, checkDependency("config", func() error { return configErr }))
+	if configErr == nil {
+		tables := configuredTables(config)
+		results := make(chan DependencyHealth, len(tables))
+		wg := &sync.WaitGroup{}
+		for name, tableName := range tables {
+			wg.Add(1)
+			go func(name string, tableName string) {
+				defer wg.Done()
+				results <- checkDependency("dynamodb:"+name, func() error {
+					if tableName == "" {
+						return errors.New("table name is not configured")
+					}
+					return ops.CheckTable(ctx, tableName)
+				})
+			}(name, tableName)
+		}
+		wg.Wait()
+		close(results)
+		for r := range results {
+			report.Dependencies = append(report.Dependencies, r)
+		}
+		sort.Slice(report.Dependencies, func(i, j int) bool { return report.Dependencies[i].Name < report.Dependencies[j].Name })
+	}
+
+	report.MimeEquivalentsCache = &MimeEquivalentsCacheHealth{Status: HealthStatusOk}
+	if cacheErr != nil || cache == nil {
+		report.MimeEquivalentsCache.Status = HealthStatusFailed
+		if cacheErr != nil {
+			report.MimeEquivalentsCache.Error = cacheErr.Error()
+		} else {
+			report.MimeEquivalentsCache.Error = "cache was not loaded"
+		}
+	} else {
+		report.MimeEquivalentsCache.Entries = cache.Size()
+		report.MimeEquivalentsCache.LoadedAt = cache.LoadedAt()
+		report.MimeEquivalentsCache.AgeSeconds = time.Since(cache.LoadedAt()).Seconds()
+	}
+
+	logger := LoggerFromContext(ctx)
+	for _, d := range report.Dependencies {
+		if d.Status != HealthStatusOk {
+			logger.Warning("RunHealthCheck %s failed: %s", d.Name, d.Error)
+			report.Status = HealthStatusFailed
+		}
+	}
+	if report.MimeEquivalentsCache.Status != HealthStatusOk {
+		logger.Warning("RunHealthCheck mime equivalents cache failed: %s", report.MimeEquivalentsCache.Error)
+		report.Status = HealthStatusFailed
+	}
+	return report
+}
+
+/*
+MakeResponse renders the report as json, with a 200 status if everything is ok and 503 otherwise so that the canary
+(or anything else) can just look at the status code
+*/
+func (r *HealthReport) MakeResponse() *events.APIGatewayProxyResponse {
+	statusCode := 200
+	if r.Status != HealthStatusOk {
+		statusCode = 503
+	}
+	content, err := json.Marshal(r)
+	if err != nil {
+		DefaultLogger.Error("HealthReport.MakeResponse could not marshal report: %s", err)
+		return MakeResponseJson(500, GenericErrorBody("invalid output content"))
+	}
+	stringContent := string(content)
+	response := MakeResponseRaw(statusCode, &stringContent, "application/json")
+	response.Headers["Cache-Control"] = "no-store"
+	return response
+}
@@ -3,21 +3,22 @@ package common
 import (
 	"errors"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"log"
 	"strconv"
 	"time"
 )
 
 type IdMappingRecord struct {
+	uuid       string //primary key, along with lastupdate
 	contentId  int64
 	filebase   string //base index
 	project    *string
 	lastupdate time.Time //range key for all indices
 	octopus_id *int64    //indexed
+	withdrawn  *Withdrawal
 }
 
 func NewIdMappingRecord(from *map[string]types.AttributeValue) (*IdMappingRecord, error) {
-	log.Printf("DEBUG NewIdMappingRecord from %v", from)
+	DefaultLogger.Debug("NewIdMappingRecord from %v", from)
 	var result IdMappingRecord
 	if contentId, haveContentId := (*from)["contentid"]; haveContentId {
 		if contentIdNumber, contentIdIsNum := contentId.(*types.AttributeValueMemberN); contentIdIsNum {
@@ -28,6 +29,11 @@ func NewIdMappingRecord(from *map[string]types.AttributeValue) (*IdMappingRecord
 			result.contentId = intValue
 		}
 	}
+	if uuid, haveUuid := (*from)["uuid"]; haveUuid {
+		if uuidString, uuidIsString := uuid.(*types.AttributeValueMemberS); uuidIsString {
+			result.uuid = uuidString.Value
+		}
+	}
 	if filebase, haveFileBase := (*from)["filebase"]; haveFileBase {
 		if filebaseString, filebaseIsString := filebase.(*types.AttributeValueMemberS); filebaseIsString {
 			result.filebase = filebaseString.Value
@@ -55,10 +61,12 @@ func NewIdMappingRecord(from *map[string]types.AttributeValue) (*IdMappingRecord
 		}
 	}
 
+	result.withdrawn = withdrawalFromDynamo((*RawDynamoRecord)(from))
+
 	nullTime := time.Time{}
 	if result.contentId == 0 || result.filebase == "" || result.lastupdate == nullTime {
-		log.Printf("ERROR ID mapping record is inaccurate, does not contain required fields")
-		log.Printf("ERROR Partial result was %d %s %s", result.contentId, result.filebase, result.lastupdate)
+		DefaultLogger.Error("ID mapping record is inaccurate, does not contain required fields")
+		DefaultLogger.Error("Partial result was %d %s %s", result.contentId, result.filebase, result.lastupdate)
 		return nil, errors.New("ID mapping record is inaccurate, does not contain required fields")
 	}
 	return &result, nil
@@ -0,0 +1,255 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+IngestSidecar is the metadata file that the transcoder writes next to its output.  It describes one title and every
+encoding that was made of it.  Each encoding is a flat json object with the same field names as the Encodings table,
+plus `file`, the key of the media file in the same bucket.  Fields that can be worked out from the file name (see
+probeFilename) or from the title (`contentid`, `octopus_id`, `fcs_id`) can be left out.
+*/
+type IngestSidecar struct {
+	Filebase  string                   `json:"filebase"`
+	ContentId json.Number              `json:"contentid"`
+	Project   string                   `json:"project,omitempty"`
+	OctopusId json.Number              `json:"octopus_id,omitempty"`
+	FCSID     string                   `json:"fcs_id,omitempty"`
+	Encodings []map[string]interface{} `json:"encodings"`
+}
+
+/*
+IngestResult records what was done with a sidecar file
+*/
+type IngestResult struct {
+	IdMapping *WriteResult
+	Encodings []*WriteResult
+	Failed    int //number of encodings that could not be stored
+}
+
+var formatsByExtension = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".m3u8": "video/m3u8",
+	".mp3":  "audio/mpeg",
+}
+
+var frameSizeMatcher = regexp.MustCompile(`_(\d+)x(\d+)(?:[_.]|$)`)
+var bitrateMatcher = regexp.MustCompile(`_(\d+)k(?:[_.]|$)`)
+
+/*
+probeFilename works out what it can about an encoding from the transcoder's naming convention,
+`{filebase}_{width}x{height}_{vbitrate}k.{ext}`.  Any part of the convention can be missing.
+
+Arguments:
+- file - the key of the media file
+Returns:
+- a map of Encodings table fields to values, containing only the fields that could be worked out
+*/
+func probeFilename(file string) map[string]interface{} {
+	probed := make(map[string]interface{})
+	base := path.Base(file)
+	ext := strings.ToLower(path.Ext(base))
+	if format, known := formatsByExtension[ext]; known {
+		probed["format"] = format
+		probed["multirate"] = ext == ".m3u8"
+	}
+	if matches := frameSizeMatcher.FindStringSubmatch(base); matches != nil {
+		probed["frame_width"] = json.Number(matches[1])
+		probed["frame_height"] = json.Number(matches[2])
+		width, _ := strconv.ParseInt(matches[1], 10, 32)
+		height, _ := strconv.ParseInt(matches[2], 10, 32)
+		if aspect := aspectRatio(width, height); aspect != "" {
+			probed["aspect"] = aspect
+		}
+	}
+	if matches := bitrateMatcher.FindStringSubmatch(base); matches != nil {
+		probed["vbitrate"] = json.Number(matches[1])
+	}
+	return probed
+}
+
+/*
+aspectRatio reduces a frame size to an aspect ratio string like "16:9", or returns an empty string if it can't
+*/
+func aspectRatio(width int64, height int64) string {
+	if width <= 0 || height <= 0 {
+		return ""
+	}
+	a, b := width, height
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return fmt.Sprintf("%d:%d", width/a, height/a)
+}
+
+/*
+mediaUrl builds the public URL for a media file from the MEDIA_BASE_URL environment variable
+*/
+func mediaUrl(file string) (string, error) {
+	baseUrl := os.Getenv("MEDIA_BASE_URL")
+	if baseUrl == "" {
+		return "", fmt.Errorf("MEDIA_BASE_URL is not set so no url can be made for %s", file)
+	}
+	return strings.TrimSuffix(baseUrl, "/") + "/" + strings.TrimPrefix(file, "/"), nil
+}
+
+/*
+worseError returns whichever of the two errors should be reported for a batch. Backend errors win because they are
+worth retrying, whereas retrying an invalid sidecar will never help.
+*/
+func worseError(current *LookupError, next *LookupError) *LookupError {
+	if current == nil || (next != nil && next.Kind == LookupErrorBackend && current.Kind != LookupErrorBackend) {
+		return next
+	}
+	return current
+}
+
+/*
+IngestSidecarFile reads a sidecar file from S3 and upserts the idmapping record and encodings that it describes.
+The idmapping record is written first so that the encodings are never older than it, which matters for the fallback
+lookup in FindContent.  An encoding that can't be stored does not stop the others from being stored.
+
+The idmapping record and the encodings are stamped with `asOf` and only replace older ones, so a replayed notification
+for an old sidecar can't roll back records that have been changed since.  If the idmapping record is newer than the
+sidecar then none of the encodings are stored.
+
+Arguments:
+- ctx - context carrying the logger, metrics and trace
+- bucket - the bucket that the sidecar (and the media files) are in
+- key - the key of the sidecar
+- asOf - when the sidecar was written, i.e. the time of the S3 event. If this is zero the current time is used.
+- s3ops - S3Ops used to read the sidecar and to find the size of media files
+- ops - DynamoDbOps used to find existing records
+- writeOps - DynamoWriteOps used to store records
+Returns:
+- an IngestResult describing what was stored. This is never nil.
+- a LookupError if anything could not be stored. If this is a LookupErrorBackend then it is worth trying again.
+*/
+func IngestSidecarFile(ctx context.Context, bucket string, key string, asOf time.Time, s3ops S3Ops, ops DynamoDbOps, writeOps DynamoWriteOps) (*IngestResult, *LookupError) {
+	logger := LoggerFromContext(ctx)
+	result := &IngestResult{Encodings: []*WriteResult{}}
+
+	content, err := s3ops.GetObject(ctx, bucket, key)
+	if err != nil {
+		logger.Error("IngestSidecarFile could not read s3://%s/%s: %s", bucket, key, err)
+		return result, NewBackendError("Could not read sidecar", err)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(content)))
+	decoder.UseNumber()
+	var sidecar IngestSidecar
+	err = decoder.Decode(&sidecar)
+	if err != nil {
+		logger.Error("IngestSidecarFile s3://%s/%s is not a valid sidecar: %s", bucket, key, err)
+		return result, NewInvalidQueryError(fmt.Sprintf("Sidecar is not valid json: %s", err))
+	}
+	if sidecar.Filebase == "" || sidecar.ContentId == "" {
+		return result, NewInvalidQueryError("Sidecar must have filebase and contentid")
+	}
+
+	idMapping := map[string]interface{}{"filebase": sidecar.Filebase, "contentid": sidecar.ContentId}
+	if sidecar.Project != "" {
+		idMapping["project"] = sidecar.Project
+	}
+	if sidecar.OctopusId != "" {
+		idMapping["octopus_id"] = sidecar.OctopusId
+	}
+	idMappingBody, _ := json.Marshal(idMapping)
+	var lookupErr *LookupError
+	if asOf.IsZero() {
+		asOf = nowForWrite()
+	}
+	result.IdMapping, lookupErr = UpsertIdMappingAsOf(ctx, string(idMappingBody), asOf, ops, writeOps)
+	if lookupErr != nil {
+		logger.Error("IngestSidecarFile could not store idmapping for %s: %s", sidecar.Filebase, lookupErr)
+		return result, lookupErr
+	}
+	if result.IdMapping.Status == WriteStatusStale {
+		//the title has been changed since this sidecar was written, so its encodings are out of date too
+		logger.Info("IngestSidecarFile s3://%s/%s is older than the idmapping record for %s, not storing its encodings", bucket, key, sidecar.Filebase)
+		return result, nil
+	}
+
+	var worstErr *LookupError
+	for i, enc := range sidecar.Encodings {
+		encodingBody, lookupErr := buildIngestEncoding(ctx, bucket, &sidecar, enc, s3ops)
+		if lookupErr == nil {
+			var written *WriteResult
+			written, lookupErr = UpsertEncodingAsOf(ctx, encodingBody, asOf, ops, writeOps)
+			if lookupErr == nil {
+				result.Encodings = append(result.Encodings, written)
+				continue
+			}
+		}
+		logger.Error("IngestSidecarFile could not store encoding %d of %s: %s", i, key, lookupErr)
+		result.Failed++
+		worstErr = worseError(worstErr, lookupErr)
+	}
+	logger.Info("IngestSidecarFile stored %d encodings for %s from s3://%s/%s, %d failed", len(result.Encodings), sidecar.Filebase, bucket, key, result.Failed)
+	return result, worstErr
+}
+
+/*
+buildIngestEncoding fills in an encoding from the sidecar with everything that can be worked out, and returns it as a
+body for RegisterEncoding
+*/
+func buildIngestEncoding(ctx context.Context, bucket string, sidecar *IngestSidecar, enc map[string]interface{}, s3ops S3Ops) (string, *LookupError) {
+	fields := make(map[string]interface{}, len(enc)+8)
+	for k, v := range enc {
+		fields[k] = v
+	}
+	setDefault := func(field string, value interface{}) {
+		if _, haveField := fields[field]; !haveField {
+			fields[field] = value
+		}
+	}
+
+	setDefault("contentid", sidecar.ContentId)
+	if sidecar.OctopusId != "" {
+		setDefault("octopus_id", sidecar.OctopusId)
+	}
+	if sidecar.FCSID != "" {
+		setDefault("fcs_id", sidecar.FCSID)
+	}
+
+	if file, haveFile := fields["file"].(string); haveFile {
+		delete(fields, "file")
+		for k, v := range probeFilename(file) {
+			setDefault(k, v)
+		}
+		if _, haveUrl := fields["url"]; !haveUrl {
+			url, err := mediaUrl(file)
+			if err != nil {
+				return "", NewInvalidQueryError(err.Error())
+			}
+			fields["url"] = url
+		}
+		if _, haveSize := fields["file_size"]; !haveSize {
+			size, err := s3ops.ObjectSize(ctx, bucket, file)
+			if err != nil {
+				return "", NewBackendError(fmt.Sprintf("Could not get the size of %s", file), err)
+			}
+			fields["file_size"] = size
+		}
+	}
+	setDefault("mobile", false)
+	setDefault("multirate", false)
+
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return "", NewInvalidQueryError(fmt.Sprintf("Encoding could not be encoded: %s", err))
+	}
+	return string(body), nil
+}
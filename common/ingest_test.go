@@ -0,0 +1,178 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"testing"
+	"time"
+)
+
+func TestProbeFilename(t *testing.T) {
+	probed := probeFilename("output/mygreatvideo_1280x720_2000k.mp4")
+	expected := map[string]interface{}{
+		"format":       "video/mp4",
+		"multirate":    false,
+		"frame_width":  "1280",
+		"frame_height": "720",
+		"aspect":       "16:9",
+		"vbitrate":     "2000",
+	}
+	if len(probed) != len(expected) {
+		t.Errorf("Expected %d fields, got %v", len(expected), probed)
+	}
+	for k, v := range expected {
+		if fmt.Sprint(probed[k]) != fmt.Sprint(v) {
+			t.Errorf("Expected %s to be %v, got %v", k, v, probed[k])
+		}
+	}
+
+	probed = probeFilename("mygreatvideo.m3u8")
+	if probed["format"] != "video/m3u8" || probed["multirate"] != true || len(probed) != 2 {
+		t.Errorf("Unexpected probe result for an m3u8 %v", probed)
+	}
+
+	if len(probeFilename("README")) != 0 {
+		t.Error("Nothing should be probed from a file that does not follow the convention")
+	}
+}
+
+const testSidecar = `{
+	"filebase": "mygreatvideo",
+	"contentid": 2222,
+	"octopus_id": 34567,
+	"fcs_id": "KP-12345",
+	"encodings": [
+		{"encodingid": 123, "file": "output/mygreatvideo_1280x720_2000k.mp4", "duration": 12.5, "vcodec": "h264"},
+		{"encodingid": 124, "file": "output/mygreatvideo_640x360_768k.mp4", "duration": 12.5, "file_size": 1000},
+		{"encodingid": 125, "duration": 12.5}
+	]
+}`
+
+func TestIngestSidecarFile(t *testing.T) {
+	t.Setenv("MEDIA_BASE_URL", "https://media.example.com/")
+	s3ops := &S3OpsMock{
+		Objects:     map[string][]byte{"media/output/mygreatvideo.json": []byte(testSidecar)},
+		ObjectSizes: map[string]int64{"media/output/mygreatvideo_1280x720_2000k.mp4": 98765432},
+	}
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{}
+
+	result, lookupErr := IngestSidecarFile(context.Background(), "media", "output/mygreatvideo.json", time.Time{}, s3ops, ops, writeOps)
+	if result.IdMapping == nil || result.IdMapping.Status != WriteStatusCreated || len(writeOps.IdMappingsPut) != 1 {
+		t.Fatalf("Expected the idmapping record to be created, got %v", result.IdMapping)
+	}
+	if len(result.Encodings) != 2 || len(writeOps.EncodingsPut) != 2 {
+		t.Fatalf("Expected 2 encodings to be stored, got %d", len(writeOps.EncodingsPut))
+	}
+	//the third encoding has no file, url, format etc. so can't be stored
+	if result.Failed != 1 || lookupErr == nil || lookupErr.Kind != LookupErrorInvalidQuery {
+		t.Errorf("Expected one invalid encoding, got %d failures and %v", result.Failed, lookupErr)
+	}
+
+	stored, err := EncodingFromDynamo(&writeOps.EncodingsPut[0])
+	if err != nil {
+		t.Fatalf("Stored encoding could not be read back: %s", err)
+	}
+	if stored.Url != "https://media.example.com/output/mygreatvideo_1280x720_2000k.mp4" {
+		t.Errorf("Unexpected url %s", stored.Url)
+	}
+	if stored.ContentId != 2222 || stored.OctopusId != 34567 || stored.FCSID != "KP-12345" {
+		t.Errorf("Title fields were not copied to the encoding: %v", stored)
+	}
+	if stored.Format != "video/mp4" || stored.FrameWidth != 1280 || stored.VBitrate != 2000 || stored.Aspect != "16:9" {
+		t.Errorf("Fields were not probed from the filename: %v", stored)
+	}
+	if stored.FileSize != 98765432 || stored.VCodec != "h264" {
+		t.Errorf("Unexpected file size or codec: %v", stored)
+	}
+
+	second, _ := EncodingFromDynamo(&writeOps.EncodingsPut[1])
+	if second.FileSize != 1000 {
+		t.Errorf("file_size from the sidecar should not be overridden, got %d", second.FileSize)
+	}
+}
+
+/*
+A replayed notification for an old sidecar must not replace an idmapping record that has been changed since
+*/
+func TestIngestSidecarFileReplay(t *testing.T) {
+	t.Setenv("MEDIA_BASE_URL", "https://media.example.com/")
+	s3ops := &S3OpsMock{
+		Objects:     map[string][]byte{"media/output/mygreatvideo.json": []byte(testSidecar)},
+		ObjectSizes: map[string]int64{"media/output/mygreatvideo_1280x720_2000k.mp4": 98765432},
+	}
+	sidecarTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ops := &DynamoOpsMock{
+		IdMappingResult: IdMappingRecord{uuid: "existing-uuid", contentId: 1111, filebase: "mygreatvideo", lastupdate: sidecarTime.Add(time.Hour)},
+	}
+	writeOps := &DynamoWriteOpsMock{}
+
+	result, _ := IngestSidecarFile(context.Background(), "media", "output/mygreatvideo.json", sidecarTime, s3ops, ops, writeOps)
+	if result.IdMapping == nil || result.IdMapping.Status != WriteStatusStale || len(writeOps.IdMappingsPut) != 0 {
+		t.Errorf("A newer idmapping record should be left alone, got %v", result.IdMapping)
+	}
+	if len(writeOps.EncodingsPut) != 0 || len(result.Encodings) != 0 {
+		t.Errorf("The encodings of an out of date sidecar should not be stored, got %d", len(writeOps.EncodingsPut))
+	}
+
+	//encoding 124 has been changed since the sidecar was written, but 123 has not been stored yet
+	ops.IdMappingResult.lastupdate = sidecarTime.Add(-time.Hour)
+	writeOps.ExistingEncodings = []*Encoding{
+		{EncodingId: 124, ContentId: 2222, FCSID: "KP-12345", Url: "https://media.example.com/fixed.mp4", Format: "video/mp4", LastUpdate: sidecarTime.Add(time.Minute)},
+	}
+	result, _ = IngestSidecarFile(context.Background(), "media", "output/mygreatvideo.json", sidecarTime, s3ops, ops, writeOps)
+	if result.IdMapping == nil || result.IdMapping.Status != WriteStatusUpdated || len(writeOps.IdMappingsPut) != 1 {
+		t.Fatalf("An older idmapping record should be replaced, got %v", result.IdMapping)
+	}
+	if stored := writeOps.IdMappingsPut[0]["lastupdate"].(*types.AttributeValueMemberS).Value; stored != "2024-03-01T12:00:00Z" {
+		t.Errorf("The idmapping record should be stamped with the time of the sidecar, got %s", stored)
+	}
+	if len(writeOps.EncodingsPut) != 1 || len(result.Encodings) != 2 || result.Encodings[1].Status != WriteStatusStale {
+		t.Fatalf("Only the encoding that has not changed since should be stored, got %d", len(writeOps.EncodingsPut))
+	}
+	if stored, _ := EncodingFromDynamo(&writeOps.EncodingsPut[0]); stored.EncodingId != 123 || !stored.LastUpdate.Equal(sidecarTime) {
+		t.Errorf("Encoding 123 should be stored with the time of the sidecar, got %v", stored)
+	}
+}
+
+func TestIngestSidecarFileErrors(t *testing.T) {
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{}
+
+	_, lookupErr := IngestSidecarFile(context.Background(), "media", "missing.json", time.Time{}, &S3OpsMock{}, ops, writeOps)
+	if lookupErr == nil || lookupErr.Kind != LookupErrorBackend {
+		t.Errorf("A sidecar that can't be read should be a backend error, got %v", lookupErr)
+	}
+
+	s3ops := &S3OpsMock{Objects: map[string][]byte{
+		"media/bad.json":      []byte(`{"filebase":`),
+		"media/untitled.json": []byte(`{"encodings": []}`),
+	}}
+	for _, key := range []string{"bad.json", "untitled.json"} {
+		_, lookupErr = IngestSidecarFile(context.Background(), "media", key, time.Time{}, s3ops, ops, writeOps)
+		if lookupErr == nil || lookupErr.Kind != LookupErrorInvalidQuery {
+			t.Errorf("Expected %s to be invalid, got %v", key, lookupErr)
+		}
+	}
+
+	s3ops = &S3OpsMock{Objects: map[string][]byte{"media/output/mygreatvideo.json": []byte(testSidecar)}}
+	writeOps = &DynamoWriteOpsMock{PutEncodingError: errors.New("kaboom")}
+	t.Setenv("MEDIA_BASE_URL", "https://media.example.com")
+	_, lookupErr = IngestSidecarFile(context.Background(), "media", "output/mygreatvideo.json", time.Time{}, s3ops, ops, writeOps)
+	if lookupErr == nil || lookupErr.Kind != LookupErrorBackend {
+		t.Errorf("A database failure should be reported over an invalid encoding, got %v", lookupErr)
+	}
+}
+
+func TestAspectRatio(t *testing.T) {
+	for _, tc := range []struct {
+		width, height int64
+		expected      string
+	}{{1920, 1080, "16:9"}, {640, 480, "4:3"}, {1080, 1920, "9:16"}, {0, 720, ""}} {
+		if result := aspectRatio(tc.width, tc.height); result != tc.expected {
+			t.Errorf("aspectRatio(%d, %d) gave %s, expected %s", tc.width, tc.height, result, tc.expected)
+		}
+	}
+}
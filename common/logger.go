@@ -0,0 +1,208 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarning:
+		return "WARNING"
+	case LogLevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+/*
+LogLevelFromString converts a level name such as "debug" or "WARNING" into a LogLevel.  Anything that is not
+recognised (including an empty string) gives LogLevelInfo.
+*/
+func LogLevelFromString(s string) LogLevel {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "DEBUG":
+		return LogLevelDebug
+	case "WARN":
+		fallthrough
+	case "WARNING":
+		return LogLevelWarning
+	case "ERROR":
+		return LogLevelError
+	default:
+		return LogLevelInfo
+	}
+}
+
+/*
+Logger is a levelled logger that writes one JSON object per line.  Every line carries the fields that have been
+attached via `With`, so a logger set up at the start of a request will tag everything it writes with the
+request ID, endpoint name etc.
+Loggers are immutable; `With` returns a new Logger sharing the same output.
+*/
+type Logger struct {
+	level  LogLevel
+	out    io.Writer
+	lock   *sync.Mutex
+	fields map[string]interface{}
+}
+
+/*
+NewLogger creates a Logger that writes to `out` and discards anything below `level`
+*/
+func NewLogger(out io.Writer, level LogLevel) *Logger {
+	return &Logger{
+		level:  level,
+		out:    out,
+		lock:   &sync.Mutex{},
+		fields: map[string]interface{}{},
+	}
+}
+
+/*
+DefaultLogger is used when there is no logger attached to the context.  Its level is taken from the LOG_LEVEL
+environment variable
+*/
+var DefaultLogger = NewLogger(os.Stdout, LogLevelFromString(os.Getenv("LOG_LEVEL")))
+
+/*
+With returns a copy of the logger that adds the given field to every line it writes
+*/
+func (l *Logger) With(key string, value interface{}) *Logger {
+	newFields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		newFields[k] = v
+	}
+	newFields[key] = value
+	return &Logger{
+		level:  l.level,
+		out:    l.out,
+		lock:   l.lock,
+		fields: newFields,
+	}
+}
+
+/*
+WithDuration returns a copy of the logger that adds the time elapsed since `start` as `duration_ms`
+*/
+func (l *Logger) WithDuration(start time.Time) *Logger {
+	return l.With("duration_ms", float64(time.Since(start).Microseconds())/1000.0)
+}
+
+/*
+IsEnabled returns true if a message at the given level would be written.  Use this to avoid building
+expensive debug output that would just be thrown away
+*/
+func (l *Logger) IsEnabled(level LogLevel) bool {
+	return level >= l.level
+}
+
+func (l *Logger) write(level LogLevel, format string, args ...interface{}) {
+	if !l.IsEnabled(level) {
+		return
+	}
+
+	line := make(map[string]interface{}, len(l.fields)+3)
+	for k, v := range l.fields {
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = fmt.Sprintf(format, args...)
+
+	content, err := json.Marshal(line)
+	if err != nil {
+		//one of the fields could not be serialised, so fall back to something that definitely can be
+		content, _ = json.Marshal(map[string]string{
+			"time":  line["time"].(string),
+			"level": level.String(),
+			"msg":   line["msg"].(string),
+			"error": fmt.Sprintf("could not marshal log fields: %s", err),
+		})
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(append(content, '\n'))
+}
+
+func (l *Logger) Debug(format string, args ...interface{}) {
+	l.write(LogLevelDebug, format, args...)
+}
+
+func (l *Logger) Info(format string, args ...interface{}) {
+	l.write(LogLevelInfo, format, args...)
+}
+
+func (l *Logger) Warning(format string, args ...interface{}) {
+	l.write(LogLevelWarning, format, args...)
+}
+
+func (l *Logger) Error(format string, args ...interface{}) {
+	l.write(LogLevelError, format, args...)
+}
+
+type loggerContextKey struct{}
+
+/*
+ContextWithLogger returns a copy of the context that carries the given logger
+*/
+func ContextWithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+/*
+LoggerFromContext returns the logger attached to the context, or DefaultLogger if there is none
+*/
+func LoggerFromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if logger, haveLogger := ctx.Value(loggerContextKey{}).(*Logger); haveLogger && logger != nil {
+			return logger
+		}
+	}
+	return DefaultLogger
+}
+
+/*
+ContextWithRequestLogger sets up a logger for an incoming API Gateway request and attaches it to the context.
+Every line written through the returned context is tagged with the API Gateway request ID, the name of the endpoint
+and the key that is being looked up (the `file` or `octopusid` parameter).
+
+Arguments:
+- ctx - context passed in from the lambda runtime
+- endpointName - name of the endpoint handling the request, e.g. "video"
+- event - the incoming request
+*/
+func ContextWithRequestLogger(ctx context.Context, endpointName string, event *events.APIGatewayProxyRequest) context.Context {
+	logger := DefaultLogger.
+		With("request_id", event.RequestContext.RequestID).
+		With("endpoint", endpointName)
+
+	if fn, haveFn := event.QueryStringParameters["file"]; haveFn {
+		logger = logger.With("lookup_key", fn)
+	} else if octid, haveOctId := event.QueryStringParameters["octopusid"]; haveOctId {
+		logger = logger.With("lookup_key", octid)
+	}
+	return ContextWithLogger(ctx, logger)
+}
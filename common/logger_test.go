@@ -0,0 +1,109 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"strings"
+	"testing"
+)
+
+/*
+LogLevelFromString should recognise the level names regardless of case and default to INFO
+*/
+func TestLogLevelFromString(t *testing.T) {
+	expected := map[string]LogLevel{
+		"debug":   LogLevelDebug,
+		"DEBUG":   LogLevelDebug,
+		"warn":    LogLevelWarning,
+		"Warning": LogLevelWarning,
+		"error":   LogLevelError,
+		"info":    LogLevelInfo,
+		"":        LogLevelInfo,
+		"rubbish": LogLevelInfo,
+	}
+	for input, level := range expected {
+		if result := LogLevelFromString(input); result != level {
+			t.Errorf("LogLevelFromString('%s') returned %s, expected %s", input, result, level)
+		}
+	}
+}
+
+/*
+Logger should drop anything below its level and write everything else as a JSON line including the attached fields
+*/
+func TestLoggerWritesJsonLines(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLogger(buf, LogLevelInfo).With("request_id", "abcd").With("endpoint", "video")
+
+	logger.Debug("should not be seen")
+	logger.Info("hello %s", "world")
+	logger.Error("oh no")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d: %v", len(lines), lines)
+	}
+
+	var first map[string]interface{}
+	err := json.Unmarshal([]byte(lines[0]), &first)
+	if err != nil {
+		t.Fatalf("Log line '%s' was not valid json: %s", lines[0], err)
+	}
+	if first["msg"] != "hello world" {
+		t.Errorf("Unexpected message '%v'", first["msg"])
+	}
+	if first["level"] != "INFO" {
+		t.Errorf("Unexpected level '%v'", first["level"])
+	}
+	if first["request_id"] != "abcd" {
+		t.Errorf("Unexpected request_id '%v'", first["request_id"])
+	}
+	if first["endpoint"] != "video" {
+		t.Errorf("Unexpected endpoint '%v'", first["endpoint"])
+	}
+	if _, haveTime := first["time"]; !haveTime {
+		t.Error("Log line had no time field")
+	}
+}
+
+/*
+With should not modify the logger it was called on
+*/
+func TestLoggerWithDoesNotMutate(t *testing.T) {
+	buf := &bytes.Buffer{}
+	base := NewLogger(buf, LogLevelDebug)
+	_ = base.With("extra", "field")
+
+	base.Info("test")
+	if strings.Contains(buf.String(), "extra") {
+		t.Errorf("Calling With changed the original logger: %s", buf.String())
+	}
+}
+
+/*
+LoggerFromContext should give back DefaultLogger if nothing was attached, and the request logger should carry
+the request ID, endpoint and lookup key
+*/
+func TestContextWithRequestLogger(t *testing.T) {
+	if LoggerFromContext(context.Background()) != DefaultLogger {
+		t.Error("LoggerFromContext did not return DefaultLogger for an empty context")
+	}
+
+	evt := &events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"file": "myvideo"},
+		RequestContext:        events.APIGatewayProxyRequestContext{RequestID: "req-1234"},
+	}
+	logger := LoggerFromContext(ContextWithRequestLogger(context.Background(), "reference", evt))
+
+	if logger.fields["request_id"] != "req-1234" {
+		t.Errorf("Unexpected request_id %v", logger.fields["request_id"])
+	}
+	if logger.fields["endpoint"] != "reference" {
+		t.Errorf("Unexpected endpoint %v", logger.fields["endpoint"])
+	}
+	if logger.fields["lookup_key"] != "myvideo" {
+		t.Errorf("Unexpected lookup_key %v", logger.fields["lookup_key"])
+	}
+}
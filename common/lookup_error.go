@@ -0,0 +1,267 @@
+package common
+
+import (
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+LookupErrorKind classifies the ways in which FindContent (or the write API) can fail
+*/
+type LookupErrorKind string
+
+const LookupErrorNotFound LookupErrorKind = "not_found"
+const LookupErrorInvalidQuery LookupErrorKind = "invalid_query"
+const LookupErrorBackend LookupErrorKind = "backend_error"
+const LookupErrorNoMatchingEncoding LookupErrorKind = "no_matching_encoding"
+const LookupErrorConflict LookupErrorKind = "conflict"
+const LookupErrorUnauthorized LookupErrorKind = "unauthorized"
+const LookupErrorGone LookupErrorKind = "gone"
+
+/*
+LookupError is returned by FindContent when it can't give back any content, and by the write API when it can't store it.  It carries enough information for each
+endpoint to render the error in whichever way suits its clients, see MakeErrorResponse.
+*/
+type LookupError struct {
+	Kind    LookupErrorKind
+	Message string
+	Reasons map[string]int //for LookupErrorNoMatchingEncoding, the number of encodings rejected on each FilterCriterion*
+	Cause   error          //underlying error for LookupErrorBackend, if any. This is logged but never sent to the client.
+}
+
+func NewNotFoundError(msg string) *LookupError {
+	return &LookupError{Kind: LookupErrorNotFound, Message: msg}
+}
+
+func NewInvalidQueryError(msg string) *LookupError {
+	return &LookupError{Kind: LookupErrorInvalidQuery, Message: msg}
+}
+
+func NewBackendError(msg string, cause error) *LookupError {
+	return &LookupError{Kind: LookupErrorBackend, Message: msg, Cause: cause}
+}
+
+/*
+NewConflictError is used by the write API when a record already exists with different content
+*/
+func NewConflictError(msg string) *LookupError {
+	return &LookupError{Kind: LookupErrorConflict, Message: msg}
+}
+
+func NewUnauthorizedError(msg string) *LookupError {
+	return &LookupError{Kind: LookupErrorUnauthorized, Message: msg}
+}
+
+/*
+NewGoneError is used when the content exists but has been withdrawn, see Withdrawal
+*/
+func NewGoneError(msg string) *LookupError {
+	return &LookupError{Kind: LookupErrorGone, Message: msg}
+}
+
+/*
+NewNoMatchingEncodingError builds the error for when encodings exist but none of them pass the filter.
+`reasons` is a count of how many encodings were rejected on each FilterCriterion* and can be nil.
+*/
+func NewNoMatchingEncodingError(reasons map[string]int) *LookupError {
+	return &LookupError{Kind: LookupErrorNoMatchingEncoding, Message: "No encodings matching your request", Reasons: reasons}
+}
+
+func (e *LookupError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.Cause)
+	}
+	return e.Message
+}
+
+/*
+StatusCode returns the HTTP status code that goes with the error
+*/
+func (e *LookupError) StatusCode() int {
+	switch e.Kind {
+	case LookupErrorNotFound:
+		return 404
+	case LookupErrorNoMatchingEncoding:
+		return 404
+	case LookupErrorInvalidQuery:
+		return 400
+	case LookupErrorUnauthorized:
+		return 401
+	case LookupErrorConflict:
+		return 409
+	case LookupErrorGone:
+		return 410
+	default:
+		return 500
+	}
+}
+
+/*
+reasonsSummary returns the rejection reasons as a stable, human-readable string like "format: 3, maxbitrate: 1", or an
+empty string if there are none
+*/
+func (e *LookupError) reasonsSummary() string {
+	if len(e.Reasons) == 0 {
+		return ""
+	}
+	criteria := make([]string, 0, len(e.Reasons))
+	for k := range e.Reasons {
+		criteria = append(criteria, k)
+	}
+	sort.Strings(criteria)
+	parts := make([]string, len(criteria))
+	for i, k := range criteria {
+		parts[i] = fmt.Sprintf("%s: %d", k, e.Reasons[k])
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+Detail builds the ErrorDetail for this error in the context of the given request
+*/
+func (e *LookupError) Detail(event *events.APIGatewayProxyRequest) *ErrorDetail {
+	return &ErrorDetail{
+		ErrorCode:   e.StatusCode(),
+		ErrorType:   string(e.Kind),
+		ErrorString: e.Message,
+		FileName:    event.QueryStringParameters["file"],
+		QueryUrl:    requestUrlForError(event),
+		Reasons:     e.Reasons,
+	}
+}
+
+/*
+LegacyResponse renders the error in the same way as the original PHP endpoints did before they were rewritten by the
+individual endpoints, i.e. a json GenericErrorBody
+*/
+func (e *LookupError) LegacyResponse() *events.APIGatewayProxyResponse {
+	return MakeResponseJson(e.StatusCode(), GenericErrorBody(e.Message))
+}
+
+/*
+requestUrlForError rebuilds the path and query string of the request, leaving out the explain key
+*/
+func requestUrlForError(event *events.APIGatewayProxyRequest) string {
+	values := url.Values{}
+	for k, v := range event.QueryStringParameters {
+		if k != "explain_key" {
+			values.Set(k, v)
+		}
+	}
+	if len(values) == 0 {
+		return event.Path
+	}
+	return event.Path + "?" + values.Encode() //Encode sorts by key so this is stable
+}
+
+const ErrorFormatJson = "json"
+const ErrorFormatText = "text"
+const ErrorFormatHtmlComment = "html"
+
+/*
+NegotiateErrorFormat picks one of the ErrorFormat* constants based on the Accept header of the request. Types are
+considered in order of their q-value; if nothing recognisable is asked for then `defaultFormat` is returned.
+*/
+func NegotiateErrorFormat(event *events.APIGatewayProxyRequest, defaultFormat string) string {
+	var accept string
+	for k, v := range event.Headers {
+		if strings.EqualFold(k, "Accept") {
+			accept = v
+		}
+	}
+	if accept == "" {
+		return defaultFormat
+	}
+
+	type acceptedType struct {
+		mimeType string
+		q        float64
+	}
+	var accepted []acceptedType
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		entry := acceptedType{mimeType: strings.ToLower(strings.TrimSpace(fields[0])), q: 1.0}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					entry.q = q
+				}
+			}
+		}
+		accepted = append(accepted, entry)
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+
+	for _, a := range accepted {
+		if a.q <= 0 {
+			continue
+		}
+		switch a.mimeType {
+		case "application/json":
+			return ErrorFormatJson
+		case "text/plain":
+			return ErrorFormatText
+		case "text/html":
+			return ErrorFormatHtmlComment
+		case "*/*":
+			return defaultFormat
+		}
+	}
+	return defaultFormat
+}
+
+/*
+MakeErrorResponse renders a LookupError for the client, in the format that NegotiateErrorFormat chooses.
+
+Arguments:
+- event - the incoming request, used for content negotiation and to fill in the ErrorDetail
+- lookupErr - the error to render
+- defaultFormat - one of the ErrorFormat* constants, used when the client does not express a preference
+Returns:
+- Pointer to an APIGatewayProxyResponse object
+*/
+func MakeErrorResponse(event *events.APIGatewayProxyRequest, lookupErr *LookupError, defaultFormat string) *events.APIGatewayProxyResponse {
+	detail := lookupErr.Detail(event)
+	var body string
+	var contentType string
+
+	switch NegotiateErrorFormat(event, defaultFormat) {
+	case ErrorFormatJson:
+		return MakeResponseJson(detail.ErrorCode, detail)
+	case ErrorFormatHtmlComment:
+		//the mediatag output is embedded directly into a page, so the error has to be invisible there.
+		//"--" is not allowed inside an html comment
+		text := fmt.Sprintf("%d %s", detail.ErrorCode, detail.ErrorString)
+		if summary := lookupErr.reasonsSummary(); summary != "" {
+			text += " (rejected on " + summary + ")"
+		}
+		body = "<!-- " + strings.ReplaceAll(text, "--", "- -") + " -->\n"
+		contentType = "text/html;charset=UTF-8"
+	default:
+		body = detail.ErrorString + ".\n"
+		if summary := lookupErr.reasonsSummary(); summary != "" {
+			body += "Encodings were rejected on " + summary + "\n"
+		}
+		contentType = "text/plain;charset=UTF-8"
+	}
+	return MakeResponseRaw(detail.ErrorCode, &body, contentType)
+}
+
+/*
+LegacyErrorBodiesEnabled returns true unless the LEGACY_ERROR_BODIES environment variable is set to "false".  In this
+case the endpoints return exactly the same error bodies that the original PHP versions did, for clients that depend on
+them and so that responses still match the captured data.  The newer, negotiated bodies have to be turned on explicitly.
+*/
+func LegacyErrorBodiesEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv("LEGACY_ERROR_BODIES"))
+	if err != nil {
+		return true
+	}
+	return enabled
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"strings"
+	"testing"
+)
+
+func TestLookupErrorStatusCode(t *testing.T) {
+	expected := map[*LookupError]int{
+		NewNotFoundError("x"):                 404,
+		NewNoMatchingEncodingError(nil):       404,
+		NewInvalidQueryError("x"):             400,
+		NewBackendError("x", errors.New("y")): 500,
+	}
+	for lookupErr, code := range expected {
+		if lookupErr.StatusCode() != code {
+			t.Errorf("%s error gave status %d, expected %d", lookupErr.Kind, lookupErr.StatusCode(), code)
+		}
+	}
+}
+
+func TestNegotiateErrorFormat(t *testing.T) {
+	expected := map[string]string{
+		"":                 ErrorFormatText,
+		"application/json": ErrorFormatJson,
+		"text/html,application/xhtml+xml,*/*;q=0.8": ErrorFormatHtmlComment,
+		"text/plain;q=0.5, application/json":        ErrorFormatJson,
+		"application/json;q=0, text/plain":          ErrorFormatText,
+		"video/webm,video/*;q=0.9,*/*;q=0.5":        ErrorFormatText,
+		"image/png":                                 ErrorFormatText,
+	}
+	for accept, format := range expected {
+		evt := &events.APIGatewayProxyRequest{Headers: map[string]string{"accept": accept}}
+		if result := NegotiateErrorFormat(evt, ErrorFormatText); result != format {
+			t.Errorf("Accept '%s' gave format %s, expected %s", accept, result, format)
+		}
+	}
+}
+
+/*
+MakeErrorResponse should return an ErrorDetail when json is asked for, including the rejection reasons
+*/
+func TestMakeErrorResponseJson(t *testing.T) {
+	evt := &events.APIGatewayProxyRequest{
+		Path:                  "/interactivevideos/reference.php",
+		Headers:               map[string]string{"Accept": "application/json"},
+		QueryStringParameters: map[string]string{"file": "some-file", "format": "video/mp4", "explain_key": "secret"},
+	}
+	response := MakeErrorResponse(evt, NewNoMatchingEncodingError(map[string]int{FilterCriterionFormat: 2}), ErrorFormatText)
+	if response.StatusCode != 404 {
+		t.Errorf("Unexpected status code %d", response.StatusCode)
+	}
+	if response.Headers["Content-Type"] != "application/json" {
+		t.Errorf("Unexpected content type %s", response.Headers["Content-Type"])
+	}
+
+	var detail ErrorDetail
+	err := json.Unmarshal([]byte(response.Body), &detail)
+	if err != nil {
+		t.Fatalf("Response body was not valid json: %s", err)
+	}
+	if detail.ErrorCode != 404 || detail.ErrorType != string(LookupErrorNoMatchingEncoding) || detail.FileName != "some-file" {
+		t.Errorf("Unexpected error detail %v", detail)
+	}
+	if detail.QueryUrl != "/interactivevideos/reference.php?file=some-file&format=video%2Fmp4" {
+		t.Errorf("Unexpected query url %s", detail.QueryUrl)
+	}
+	if detail.Reasons[FilterCriterionFormat] != 2 {
+		t.Errorf("Unexpected reasons %v", detail.Reasons)
+	}
+}
+
+func TestMakeErrorResponseText(t *testing.T) {
+	evt := &events.APIGatewayProxyRequest{}
+	response := MakeErrorResponse(evt, NewNoMatchingEncodingError(map[string]int{FilterCriterionMaxBitrate: 1, FilterCriterionFormat: 3}), ErrorFormatText)
+	expected := "No encodings matching your request.\nEncodings were rejected on format: 3, maxbitrate: 1\n"
+	if response.Body != expected {
+		t.Errorf("Unexpected body '%s'", response.Body)
+	}
+	if response.Headers["Content-Type"] != "text/plain;charset=UTF-8" {
+		t.Errorf("Unexpected content type %s", response.Headers["Content-Type"])
+	}
+}
+
+/*
+The html comment format must never produce something that closes the comment early
+*/
+func TestMakeErrorResponseHtmlComment(t *testing.T) {
+	evt := &events.APIGatewayProxyRequest{}
+	response := MakeErrorResponse(evt, NewInvalidQueryError("bad --> <script>"), ErrorFormatHtmlComment)
+	if response.StatusCode != 400 {
+		t.Errorf("Unexpected status code %d", response.StatusCode)
+	}
+	if !strings.HasPrefix(response.Body, "<!-- 400 ") || strings.Count(response.Body, "-->") != 1 {
+		t.Errorf("Unexpected body '%s'", response.Body)
+	}
+}
+
+/*
+Backend errors must not leak the underlying cause to the client
+*/
+func TestBackendErrorHidesCause(t *testing.T) {
+	lookupErr := NewBackendError("Database error", errors.New("ResourceNotFoundException: table secret-table"))
+	evt := &events.APIGatewayProxyRequest{Headers: map[string]string{"Accept": "application/json"}}
+	for _, response := range []*events.APIGatewayProxyResponse{
+		MakeErrorResponse(evt, lookupErr, ErrorFormatText),
+		lookupErr.LegacyResponse(),
+	} {
+		if strings.Contains(response.Body, "secret-table") {
+			t.Errorf("Response leaked the underlying error: %s", response.Body)
+		}
+	}
+}
+
+/*
+Legacy error bodies should be on unless they are explicitly turned off, so that a deploy doesn't change them
+*/
+func TestLegacyErrorBodiesEnabled(t *testing.T) {
+	for value, expected := range map[string]bool{"": true, "true": true, "not a bool": true, "false": false, "0": false} {
+		t.Setenv("LEGACY_ERROR_BODIES", value)
+		if LegacyErrorBodiesEnabled() != expected {
+			t.Errorf("expected %t for '%s'", expected, value)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package common
 
 import (
-	"log"
 	"regexp"
 )
 
@@ -22,7 +21,7 @@ func HasDodgyM3U8Format(format string) (string, bool) {
 	matcher := regexp.MustCompile("video/(.*\\.m3u8)$")
 	results := matcher.FindAllStringSubmatch(format, -1)
 	if results != nil {
-		log.Printf("DEBUG HasDodgyM3U8Format got matches %v", results)
+		DefaultLogger.Debug("HasDodgyM3U8Format got matches %v", results)
 		return results[0][1], true
 	} else {
 		return "", false
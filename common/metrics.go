@@ -0,0 +1,296 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const MetricUnitCount = "Count"
+const MetricUnitMilliseconds = "Milliseconds"
+
+const DefaultMetricsNamespace = "MultimediaEncodingsEndpoints"
+
+/*
+Metrics accumulates values for a single CloudWatch Embedded Metric Format (EMF) document.  When `Flush` is called
+the document is written out as a single JSON line; the Lambda runtime ships this to Cloudwatch Logs which then
+extracts the metrics, so no extra AWS calls are needed.
+See https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+
+All methods are safe to call on a nil pointer, in which case they do nothing. This means that code can always call
+MetricsFromContext(ctx).PutCount(...) without checking whether metrics have been set up.
+*/
+type Metrics struct {
+	namespace  string
+	out        io.Writer
+	lock       *sync.Mutex
+	dimensions map[string]string
+	values     map[string][]float64
+	units      map[string]string
+	properties map[string]interface{}
+}
+
+/*
+NewMetrics creates a new, empty, metrics document that will be written to `out` in the given namespace
+*/
+func NewMetrics(out io.Writer, namespace string) *Metrics {
+	return &Metrics{
+		namespace:  namespace,
+		out:        out,
+		lock:       &sync.Mutex{},
+		dimensions: map[string]string{},
+		values:     map[string][]float64{},
+		units:      map[string]string{},
+		properties: map[string]interface{}{},
+	}
+}
+
+/*
+metricsNamespaceFromEnv returns the namespace set in the METRICS_NAMESPACE environment variable, or DefaultMetricsNamespace
+if it is not set
+*/
+func metricsNamespaceFromEnv() string {
+	if ns := os.Getenv("METRICS_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return DefaultMetricsNamespace
+}
+
+/*
+PutDimension sets a dimension value that applies to every metric in the document
+*/
+func (m *Metrics) PutDimension(name string, value string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dimensions[name] = value
+}
+
+/*
+PutMetric adds a value for the given metric. If the same metric is put more than once, all of the values are sent
+*/
+func (m *Metrics) PutMetric(name string, value float64, unit string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[name] = append(m.values[name], value)
+	m.units[name] = unit
+}
+
+/*
+PutCount is a convenience for adding 1 to a counter metric
+*/
+func (m *Metrics) PutCount(name string) {
+	m.PutMetric(name, 1, MetricUnitCount)
+}
+
+/*
+PutDuration is a convenience for recording the time elapsed since `start` as a latency metric
+*/
+func (m *Metrics) PutDuration(name string, start time.Time) {
+	m.PutMetric(name, float64(time.Since(start).Microseconds())/1000.0, MetricUnitMilliseconds)
+}
+
+/*
+PutProperty adds a value to the document which is not a metric or dimension but is searchable in Logs Insights
+*/
+func (m *Metrics) PutProperty(name string, value interface{}) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.properties[name] = value
+}
+
+/*
+Derive returns a new, empty, document that has the same namespace, output and dimensions as this one.  Use it when
+you need to send metrics with extra dimensions without multiplying up every other metric in the request.
+*/
+func (m *Metrics) Derive() *Metrics {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	newMetrics := NewMetrics(m.out, m.namespace)
+	for k, v := range m.dimensions {
+		newMetrics.dimensions[k] = v
+	}
+	return newMetrics
+}
+
+/*
+render builds the EMF document as a map ready for json serialisation
+*/
+func (m *Metrics) render(timestamp time.Time) map[string]interface{} {
+	doc := make(map[string]interface{}, len(m.properties)+len(m.dimensions)+len(m.values)+1)
+	for k, v := range m.properties {
+		doc[k] = v
+	}
+
+	dimensionNames := make([]string, 0, len(m.dimensions))
+	for k, v := range m.dimensions {
+		dimensionNames = append(dimensionNames, k)
+		doc[k] = v
+	}
+	sort.Strings(dimensionNames)
+
+	metricNames := make([]string, 0, len(m.values))
+	for k := range m.values {
+		metricNames = append(metricNames, k)
+	}
+	sort.Strings(metricNames)
+
+	metricDefinitions := make([]map[string]string, len(metricNames))
+	for i, name := range metricNames {
+		metricDefinitions[i] = map[string]string{"Name": name, "Unit": m.units[name]}
+		if len(m.values[name]) == 1 {
+			doc[name] = m.values[name][0]
+		} else {
+			doc[name] = m.values[name]
+		}
+	}
+
+	doc["_aws"] = map[string]interface{}{
+		"Timestamp": timestamp.UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []map[string]interface{}{
+			{
+				"Namespace":  m.namespace,
+				"Dimensions": [][]string{dimensionNames},
+				"Metrics":    metricDefinitions,
+			},
+		},
+	}
+	return doc
+}
+
+/*
+Flush writes out the document as a single line and resets the metric values, so that the same object can't send
+a value twice.  Nothing is written if no metrics have been put.
+*/
+func (m *Metrics) Flush() error {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.values) == 0 {
+		return nil
+	}
+
+	content, err := json.Marshal(m.render(time.Now()))
+	if err != nil {
+		DefaultLogger.Error("Metrics.Flush could not marshal metrics document: %s", err)
+		return err
+	}
+	m.values = map[string][]float64{}
+	m.units = map[string]string{}
+
+	_, err = m.out.Write(append(content, '\n'))
+	return err
+}
+
+type metricsContextKey struct{}
+
+/*
+ContextWithMetrics returns a copy of the context that carries the given metrics document
+*/
+func ContextWithMetrics(ctx context.Context, metrics *Metrics) context.Context {
+	return context.WithValue(ctx, metricsContextKey{}, metrics)
+}
+
+/*
+MetricsFromContext returns the metrics document attached to the context or nil if there is none. As the methods
+on Metrics are all nil-safe the result can be used directly.
+*/
+func MetricsFromContext(ctx context.Context) *Metrics {
+	if ctx != nil {
+		if metrics, haveMetrics := ctx.Value(metricsContextKey{}).(*Metrics); haveMetrics {
+			return metrics
+		}
+	}
+	return nil
+}
+
+/*
+ContextWithRequestMetrics sets up a metrics document for an incoming API Gateway request, dimensioned by endpoint name
+and API Gateway stage, and attaches it to the context.  The caller is responsible for calling `Flush` on the returned
+Metrics once the request is complete.
+*/
+func ContextWithRequestMetrics(ctx context.Context, endpointName string, event *events.APIGatewayProxyRequest) (context.Context, *Metrics) {
+	metrics := NewMetrics(os.Stdout, metricsNamespaceFromEnv())
+	metrics.PutDimension("Endpoint", endpointName)
+	metrics.PutDimension("Stage", event.RequestContext.Stage)
+	metrics.PutProperty("request_id", event.RequestContext.RequestID)
+	return ContextWithMetrics(ctx, metrics), metrics
+}
+
+/*
+ContextWithJobMetrics sets up a metrics document for a lambda that is not behind API Gateway (e.g. one triggered by S3),
+dimensioned by function name, and attaches it to the context. The caller is responsible for calling `Flush`.
+*/
+func ContextWithJobMetrics(ctx context.Context, functionName string) (context.Context, *Metrics) {
+	metrics := NewMetrics(os.Stdout, metricsNamespaceFromEnv())
+	metrics.PutDimension("Function", functionName)
+	return ContextWithMetrics(ctx, metrics), metrics
+}
+
+/*
+BitrateBucket groups a video bitrate (in kbit/s) into a small number of bands, so that it can be used as a metric dimension
+*/
+func BitrateBucket(vbitrate int32) string {
+	switch {
+	case vbitrate <= 0:
+		return "unknown"
+	case vbitrate < 500:
+		return "0-499"
+	case vbitrate < 1000:
+		return "500-999"
+	case vbitrate < 2000:
+		return "1000-1999"
+	case vbitrate < 4000:
+		return "2000-3999"
+	default:
+		return "4000+"
+	}
+}
+
+// metric names emitted by FindContent and DynamoDbOpsImpl
+const MetricLookupLatency = "LookupLatency"
+const MetricLookupHit = "LookupHit"
+const MetricLookupInvalidQuery = "LookupInvalidQuery"
+const MetricLookupBackendError = "LookupBackendError"
+const MetricLookupNoIdMapping = "LookupNoIdMapping"
+const MetricLookupNoFCSIdFallback = "LookupNoFCSIdFallback"
+const MetricLookupFilterEliminatedAll = "LookupFilterEliminatedAll"
+const MetricLookupWithdrawn = "LookupWithdrawn"
+const MetricMimeEquivalentsExpanded = "MimeEquivalentsExpanded"
+const MetricMimeEquivalentsNone = "MimeEquivalentsNone"
+const MetricEncodingServed = "EncodingServed"
+const MetricDynamoQueries = "DynamoQueries"
+
+// metric names emitted by the s3ingest lambda
+const MetricIngestEncodingsStored = "IngestEncodingsStored"
+const MetricIngestEncodingsFailed = "IngestEncodingsFailed"
+const MetricIngestSidecarFailed = "IngestSidecarFailed"
+
+// metric names emitted by CaptureHandler
+const MetricCapturedRequests = "CapturedRequests"
+const MetricCaptureFailed = "CaptureFailed"
+
+// metric names emitted by the cacheinvalidator lambda
+const MetricCacheKeysInvalidated = "CacheKeysInvalidated"
+const MetricCDNPathsInvalidated = "CDNPathsInvalidated"
+const MetricCDNInvalidationsSkipped = "CDNInvalidationsSkipped"
+const MetricCDNInvalidationsThrottled = "CDNInvalidationsThrottled"
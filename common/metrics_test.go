@@ -0,0 +1,156 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Flush should write a single EMF document that declares every metric and dimension that was put
+*/
+func TestMetricsFlushWritesEMF(t *testing.T) {
+	buf := &bytes.Buffer{}
+	m := NewMetrics(buf, "test-namespace")
+	m.PutDimension("Endpoint", "video")
+	m.PutCount(MetricLookupHit)
+	m.PutMetric("SomeLatency", 12.5, MetricUnitMilliseconds)
+	m.PutMetric("SomeLatency", 7.5, MetricUnitMilliseconds)
+	m.PutProperty("request_id", "abcd")
+
+	err := m.Flush()
+	if err != nil {
+		t.Fatalf("Flush returned an unexpected error: %s", err)
+	}
+
+	var doc map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("Flush did not write valid json: %s", err)
+	}
+
+	if doc["Endpoint"] != "video" {
+		t.Errorf("Unexpected dimension value %v", doc["Endpoint"])
+	}
+	if doc["request_id"] != "abcd" {
+		t.Errorf("Unexpected property value %v", doc["request_id"])
+	}
+	if doc[MetricLookupHit] != float64(1) {
+		t.Errorf("Unexpected metric value %v", doc[MetricLookupHit])
+	}
+	if latencies, isList := doc["SomeLatency"].([]interface{}); !isList || len(latencies) != 2 {
+		t.Errorf("Expected SomeLatency to be a list of 2 values, got %v", doc["SomeLatency"])
+	}
+
+	aws := doc["_aws"].(map[string]interface{})
+	if _, haveTimestamp := aws["Timestamp"]; !haveTimestamp {
+		t.Error("EMF document had no timestamp")
+	}
+	directives := aws["CloudWatchMetrics"].([]interface{})
+	if len(directives) != 1 {
+		t.Fatalf("Expected 1 metric directive, got %d", len(directives))
+	}
+	directive := directives[0].(map[string]interface{})
+	if directive["Namespace"] != "test-namespace" {
+		t.Errorf("Unexpected namespace %v", directive["Namespace"])
+	}
+	if len(directive["Metrics"].([]interface{})) != 2 {
+		t.Errorf("Expected 2 metric definitions, got %v", directive["Metrics"])
+	}
+	dimensions := directive["Dimensions"].([]interface{})[0].([]interface{})
+	if len(dimensions) != 1 || dimensions[0] != "Endpoint" {
+		t.Errorf("Unexpected dimensions %v", dimensions)
+	}
+}
+
+/*
+Flush should not write anything if there are no metric values, and should not send the same values twice
+*/
+func TestMetricsFlushOnlyOnce(t *testing.T) {
+	buf := &bytes.Buffer{}
+	m := NewMetrics(buf, "test-namespace")
+	m.Flush()
+	if buf.Len() != 0 {
+		t.Errorf("Flush wrote output for an empty document: %s", buf.String())
+	}
+
+	m.PutCount("Something")
+	m.Flush()
+	m.Flush()
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 {
+		t.Errorf("Expected 1 line of output, got %d", lines)
+	}
+}
+
+/*
+A nil Metrics should silently ignore everything
+*/
+func TestMetricsNilSafe(t *testing.T) {
+	m := MetricsFromContext(context.Background())
+	if m != nil {
+		t.Fatal("MetricsFromContext returned a value for an empty context")
+	}
+	m.PutDimension("a", "b")
+	m.PutCount("c")
+	m.PutDuration("d", time.Now())
+	m.PutProperty("e", "f")
+	if m.Derive() != nil {
+		t.Error("Derive on nil metrics should return nil")
+	}
+	if err := m.Flush(); err != nil {
+		t.Errorf("Flush on nil metrics returned an error: %s", err)
+	}
+}
+
+func TestBitrateBucket(t *testing.T) {
+	expected := map[int32]string{
+		0:     "unknown",
+		128:   "0-499",
+		768:   "500-999",
+		1500:  "1000-1999",
+		3500:  "2000-3999",
+		12345: "4000+",
+	}
+	for bitrate, bucket := range expected {
+		if result := BitrateBucket(bitrate); result != bucket {
+			t.Errorf("BitrateBucket(%d) returned %s, expected %s", bitrate, result, bucket)
+		}
+	}
+}
+
+/*
+FindContent should record the lookup outcome in the metrics attached to the context
+*/
+func TestFindContentRecordsOutcomeMetric(t *testing.T) {
+	buf := &bytes.Buffer{}
+	m := NewMetrics(buf, "test-namespace")
+	ctx := ContextWithMetrics(context.Background(), m)
+
+	fakeParams := map[string]string{"file": "nothinghere"}
+	ops := &DynamoOpsMock{}
+	config := &ConfigMock{
+		IdMappingTableVal: "id-mapping-table",
+		EncodingsTableVal: "encodings-table",
+	}
+
+	_, errResponse := FindContent(ctx, &fakeParams, ops, config, &MimeEquivalentsCacheMock{})
+	if errResponse == nil || errResponse.StatusCode() != 404 {
+		t.Fatalf("Expected a 404 response, got %v", errResponse)
+	}
+
+	m.Flush()
+	var doc map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("Metrics output was not valid json: %s", err)
+	}
+	if doc[MetricLookupNoIdMapping] != float64(1) {
+		t.Errorf("Expected %s to be 1, got %v", MetricLookupNoIdMapping, doc[MetricLookupNoIdMapping])
+	}
+	if _, haveLatency := doc[MetricLookupLatency]; !haveLatency {
+		t.Errorf("Expected %s to be recorded", MetricLookupLatency)
+	}
+}
@@ -1,19 +1,35 @@
 package common
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type MimeEquivalentsCache interface {
 	/*
 		EquivalentsFor will return a list of _all_ known equivalents to the given MIME type (including itself).
 	*/
 	EquivalentsFor(input string) []string
+	/*
+		Size returns the number of equivalences that were loaded
+	*/
+	Size() int
+	/*
+		LoadedAt returns the time at which the cache was loaded from the database
+	*/
+	LoadedAt() time.Time
 }
 
 type MimeEquivalentsCacheImpl struct {
 	loadedData map[string]string
+	entryCount int
+	loadedAt   time.Time
 }
 
 func NewMimeEquivalentsCache(ctx context.Context, ops DynamoDbOps) (MimeEquivalentsCache, error) {
+	ctx, span := StartSpan(ctx, "NewMimeEquivalentsCache")
+	defer span.End()
+
 	equivs, err := ops.GetAllMimeEquivalents(ctx)
 	if err != nil {
 		return nil, err
@@ -21,6 +37,8 @@ func NewMimeEquivalentsCache(ctx context.Context, ops DynamoDbOps) (MimeEquivale
 
 	cache := &MimeEquivalentsCacheImpl{
 		loadedData: make(map[string]string, 2*len(equivs)),
+		entryCount: len(equivs),
+		loadedAt:   time.Now(),
 	}
 
 	for _, equiv := range equivs {
@@ -41,10 +59,28 @@ func (cache *MimeEquivalentsCacheImpl) EquivalentsFor(input string) []string {
 	}
 }
 
+func (cache *MimeEquivalentsCacheImpl) Size() int {
+	return cache.entryCount
+}
+
+func (cache *MimeEquivalentsCacheImpl) LoadedAt() time.Time {
+	return cache.loadedAt
+}
+
 type MimeEquivalentsCacheMock struct {
+	SizeVal     int
+	LoadedAtVal time.Time
 }
 
 func (cache *MimeEquivalentsCacheMock) EquivalentsFor(input string) []string {
 	result := []string{input}
 	return result
 }
+
+func (cache *MimeEquivalentsCacheMock) Size() int {
+	return cache.SizeVal
+}
+
+func (cache *MimeEquivalentsCacheMock) LoadedAt() time.Time {
+	return cache.LoadedAtVal
+}
@@ -2,7 +2,6 @@ package common
 
 import (
 	"errors"
-	"log"
 	"reflect"
 	"time"
 )
@@ -29,6 +28,8 @@ type Encoding struct {
 	FCSID       string    `json:"fcs_id"`       //NOT NULL
 	OctopusId   int32     `json:"octopus_id"`   //NOT NULL aka 'title id'
 	Aspect      string    `json:"aspect"`       //NOT NULL
+
+	Withdrawn *Withdrawal `json:"withdrawn,omitempty"` //set if the encoding has been retired, see SetWithdrawn
 }
 
 /*
@@ -51,7 +52,7 @@ func EncodingFromDynamo(rec *RawDynamoRecord) (result *Encoding, e error) {
 
 	lastUpdateTime, err := time.Parse(time.RFC3339, extractDynamoField(rec, "lastupdate", reflect.String, false).(string))
 	if err != nil {
-		log.Printf("WARNING Field 'lastupdate' is not a valid timestamp: %s", err)
+		DefaultLogger.Warning("Field 'lastupdate' is not a valid timestamp: %s", err)
 		return nil, errors.New("invalid timestamp")
 	}
 
@@ -74,6 +75,7 @@ func EncodingFromDynamo(rec *RawDynamoRecord) (result *Encoding, e error) {
 		FCSID:       extractDynamoField(rec, "fcs_id", reflect.String, true).(string),
 		OctopusId:   extractDynamoField(rec, "octopus_id", reflect.Int32, true).(int32),
 		Aspect:      extractDynamoField(rec, "aspect", reflect.String, false).(string),
+		Withdrawn:   withdrawalFromDynamo(rec),
 	}
 
 	return newRecord, nil
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"time"
+)
+
+/*
+Withdrawal records that an idmapping record or encoding has been retired (e.g. for a legal takedown). Withdrawn records
+are kept in the database, so that they can be restored, but FindContent treats them as if they were not there.
+*/
+type Withdrawal struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+/*
+withdrawalFromDynamo reads the `withdrawn_at` and `withdrawn_reason` fields from a record. It returns nil if the record
+is not withdrawn.
+*/
+func withdrawalFromDynamo(rec *RawDynamoRecord) *Withdrawal {
+	if _, haveWithdrawnAt := (*rec)["withdrawn_at"]; !haveWithdrawnAt {
+		return nil
+	}
+	result := &Withdrawal{}
+	if withdrawnAt, isString := (*rec)["withdrawn_at"].(*types.AttributeValueMemberS); isString {
+		parsed, err := time.Parse(time.RFC3339, withdrawnAt.Value)
+		if err != nil {
+			//if we can't tell when it was withdrawn, it's still withdrawn
+			DefaultLogger.Warning("Field 'withdrawn_at' is not a valid timestamp: %s", err)
+		}
+		result.At = parsed
+	}
+	if reason, isString := (*rec)["withdrawn_reason"].(*types.AttributeValueMemberS); isString {
+		result.Reason = reason.Value
+	}
+	return result
+}
+
+/*
+addWithdrawalToDynamo sets the withdrawal fields on a record that is about to be written, if `w` is not nil
+*/
+func addWithdrawalToDynamo(record RawDynamoRecord, w *Withdrawal) {
+	if w != nil {
+		record["withdrawn_at"] = &types.AttributeValueMemberS{Value: w.At.Format(time.RFC3339)}
+		record["withdrawn_reason"] = &types.AttributeValueMemberS{Value: w.Reason}
+	}
+}
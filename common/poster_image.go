@@ -2,7 +2,6 @@ package common
 
 import (
 	"errors"
-	"log"
 	"regexp"
 )
 
@@ -20,12 +19,12 @@ func GeneratePosterImageURL(url string, pngPoster bool) (string, error) {
 		return "", errors.New("the CDN URL was malformed (no file extension) ")
 	}
 
-	log.Printf("GeneratePosterImageURL: pngPoster is %t", pngPoster)
+	DefaultLogger.Debug("GeneratePosterImageURL: pngPoster is %t", pngPoster)
 	xtn := ".jpg"
 	if pngPoster {
 		xtn = ".png"
 	}
-	log.Printf("poster path is %s", matches[1]+"_poster"+xtn)
+	DefaultLogger.Debug("GeneratePosterImageURL: poster path is %s", matches[1]+"_poster"+xtn)
 
 	return matches[1] + "_poster" + xtn, nil
 }
@@ -4,14 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
-	"log"
 )
 
+/*
+ErrorDetail is the json body returned to clients that ask for errors as json, see MakeErrorResponse
+*/
 type ErrorDetail struct {
-	ErrorCode   int    `json:"error_code"`
-	ErrorString string `json:"error_string"`
-	FileName    string `json:"file_name"`
-	QueryUrl    string `json:"query_url"`
+	ErrorCode   int            `json:"error_code"`
+	ErrorType   string         `json:"error_type"`
+	ErrorString string         `json:"error_string"`
+	FileName    string         `json:"file_name"`
+	QueryUrl    string         `json:"query_url"`
+	Reasons     map[string]int `json:"reasons,omitempty"`
 }
 
 var DefaultHeaders = map[string]string{
@@ -59,7 +63,7 @@ func MakeResponseJson(responseCode int, contentBody interface{}) *events.APIGate
 		var marshalErr error
 		jsonBytes, marshalErr = json.Marshal(contentBody)
 		if marshalErr != nil {
-			log.Printf("ERROR MakeResponseJson could not marshal %v into json: %s", contentBody, marshalErr)
+			DefaultLogger.Error("MakeResponseJson could not marshal %v into json: %s", contentBody, marshalErr)
 			return MakeResponseJson(500, GenericErrorBody("invalid output content"))
 		}
 		stringContent = string(jsonBytes)
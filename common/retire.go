@@ -0,0 +1,306 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const AuditActionRetire = "retire"
+const AuditActionRestore = "restore"
+
+/*
+RetireRequest is the body of a call to the retire or restore endpoints.  Exactly one target must be given:
+- `filebase` withdraws the idmapping record, so that nothing is served for that file at all
+- `fcs_id` withdraws every encoding of a single version
+- `fcs_id` and `encodingid` together withdraw a single encoding
+*/
+type RetireRequest struct {
+	Filebase    string `json:"filebase,omitempty"`
+	FCSID       string `json:"fcs_id,omitempty"`
+	EncodingId  *int32 `json:"encodingid,omitempty"`
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requested_by"`
+}
+
+/*
+Target returns the key that audit records for this request are stored under, e.g. "idmapping/{filebase}",
+"fcs/{fcs_id}" or "encoding/{fcs_id}/{encodingid}"
+*/
+func (r *RetireRequest) Target() string {
+	switch {
+	case r.Filebase != "":
+		return "idmapping/" + r.Filebase
+	case r.EncodingId != nil:
+		return fmt.Sprintf("encoding/%s/%d", r.FCSID, *r.EncodingId)
+	default:
+		return "fcs/" + r.FCSID
+	}
+}
+
+/*
+validate checks that the request makes sense. `withdraw` is true for a retire request, which must give a reason.
+*/
+func (r *RetireRequest) validate(withdraw bool) *LookupError {
+	if r.Filebase != "" && r.FCSID != "" {
+		return NewInvalidQueryError("Give either filebase or fcs_id, not both")
+	}
+	if r.Filebase == "" && r.FCSID == "" {
+		return NewInvalidQueryError("One of filebase or fcs_id is required")
+	}
+	if r.EncodingId != nil && r.FCSID == "" {
+		return NewInvalidQueryError("encodingid requires fcs_id")
+	}
+	if r.Filebase != "" && !isFilenameValid(r.Filebase) {
+		return NewInvalidQueryError("Invalid filespec")
+	}
+	if withdraw && strings.TrimSpace(r.Reason) == "" {
+		return NewInvalidQueryError("A reason is required to retire content")
+	}
+	if strings.TrimSpace(r.RequestedBy) == "" {
+		return NewInvalidQueryError("requested_by is required")
+	}
+	return nil
+}
+
+/*
+AuditRecord is a single entry in the history of retire and restore operations
+*/
+type AuditRecord struct {
+	Target          string    `json:"target"`
+	Timestamp       time.Time `json:"timestamp"`
+	Action          string    `json:"action"` //one of the AuditAction* constants
+	Reason          string    `json:"reason,omitempty"`
+	RequestedBy     string    `json:"requested_by"`
+	RecordsAffected int       `json:"records_affected"`
+}
+
+/*
+toDynamo converts the record into the form that is stored in the audit table. The timestamp has nanosecond precision
+because it is the sort key, and two operations on the same target in the same second must not overwrite each other.
+*/
+func (a *AuditRecord) toDynamo() RawDynamoRecord {
+	record := RawDynamoRecord{
+		"target":           &types.AttributeValueMemberS{Value: a.Target},
+		"timestamp":        &types.AttributeValueMemberS{Value: a.Timestamp.Format(time.RFC3339Nano)},
+		"action":           &types.AttributeValueMemberS{Value: a.Action},
+		"requested_by":     &types.AttributeValueMemberS{Value: a.RequestedBy},
+		"records_affected": &types.AttributeValueMemberN{Value: strconv.Itoa(a.RecordsAffected)},
+	}
+	if a.Reason != "" {
+		record["reason"] = &types.AttributeValueMemberS{Value: a.Reason}
+	}
+	return record
+}
+
+/*
+AuditRecordFromDynamo is the reverse of AuditRecord.toDynamo
+*/
+func AuditRecordFromDynamo(rec RawDynamoRecord) (*AuditRecord, error) {
+	stringField := func(name string, required bool) (string, error) {
+		if value, isString := rec[name].(*types.AttributeValueMemberS); isString {
+			return value.Value, nil
+		}
+		if required {
+			return "", fmt.Errorf("field %s is missing or not a string", name)
+		}
+		return "", nil
+	}
+
+	result := &AuditRecord{}
+	var err error
+	if result.Target, err = stringField("target", true); err != nil {
+		return nil, err
+	}
+	timestamp, err := stringField("timestamp", true)
+	if err != nil {
+		return nil, err
+	}
+	if result.Timestamp, err = time.Parse(time.RFC3339Nano, timestamp); err != nil {
+		return nil, err
+	}
+	if result.Action, err = stringField("action", true); err != nil {
+		return nil, err
+	}
+	result.Reason, _ = stringField("reason", false)
+	result.RequestedBy, _ = stringField("requested_by", false)
+	if affected, isNumber := rec["records_affected"].(*types.AttributeValueMemberN); isNumber {
+		result.RecordsAffected, _ = strconv.Atoi(affected.Value)
+	}
+	return result, nil
+}
+
+// nowForAudit gives the timestamp that is used for withdrawals and audit records. It is a variable so that tests can fix it.
+var nowForAudit = func() time.Time {
+	return time.Now().UTC()
+}
+
+/*
+withdrawIdMapping sets or clears the withdrawal on the idmapping record for the given file.  Returns the number of
+records that were changed, which is 0 if the record was already in the requested state.
+*/
+func withdrawIdMapping(ctx context.Context, filebase string, w *Withdrawal, ops DynamoDbOps, writeOps DynamoWriteOps) (int, *LookupError) {
+	logger := LoggerFromContext(ctx)
+	rec, err := ops.QueryIdMappings(ctx, IdMappingIndexFilebase, IdMappingKeyfieldFilebase, filebase)
+	if err != nil {
+		logger.Error("SetWithdrawn could not look up idmapping record for %s: %s", filebase, err)
+		return 0, NewBackendError("Database error", err)
+	}
+	if rec == nil {
+		return 0, NewNotFoundError("Content not found")
+	}
+	if (rec.withdrawn != nil) == (w != nil) {
+		logger.Info("SetWithdrawn idmapping record for %s is already in the requested state", filebase)
+		return 0, nil
+	}
+	err = writeOps.SetIdMappingWithdrawn(ctx, rec, w)
+	if errors.Is(err, ErrWriteConflict) {
+		return 0, NewConflictError(fmt.Sprintf("The idmapping record for %s was changed by another request, try again", filebase))
+	} else if err != nil {
+		logger.Error("SetWithdrawn could not update idmapping record for %s: %s", filebase, err)
+		return 0, NewBackendError("Database error", err)
+	}
+	return 1, nil
+}
+
+/*
+withdrawEncodings sets or clears the withdrawal on every encoding for the given FCS ID, or just on the one with the given
+encoding ID if that is not nil.  Returns the number of encodings that were changed.
+*/
+func withdrawEncodings(ctx context.Context, fcsId string, maybeEncodingId *int32, w *Withdrawal, ops DynamoDbOps, writeOps DynamoWriteOps) (int, *LookupError) {
+	logger := LoggerFromContext(ctx)
+	encodings, err := ops.QueryEncodingsForFCSId(ctx, fcsId)
+	if err != nil {
+		logger.Error("SetWithdrawn could not look up encodings for %s: %s", fcsId, err)
+		return 0, NewBackendError("Database error", err)
+	}
+
+	found := 0
+	changed := 0
+	for _, e := range encodings {
+		if maybeEncodingId != nil && e.EncodingId != *maybeEncodingId {
+			continue
+		}
+		found++
+		if (e.Withdrawn != nil) == (w != nil) {
+			continue
+		}
+		err = writeOps.SetEncodingWithdrawn(ctx, fcsId, e.EncodingId, w)
+		if errors.Is(err, ErrWriteConflict) {
+			return changed, NewConflictError(fmt.Sprintf("Encoding %d was removed by another request", e.EncodingId))
+		} else if err != nil {
+			logger.Error("SetWithdrawn could not update encoding %d: %s", e.EncodingId, err)
+			return changed, NewBackendError("Database error", err)
+		}
+		changed++
+	}
+	if found == 0 {
+		return 0, NewNotFoundError("No encodings found")
+	}
+	return changed, nil
+}
+
+/*
+SetWithdrawn retires (withdraws) or restores content, and records what was done in the audit table.  Withdrawn records
+stay in the database, so restoring them puts things back exactly as they were.  Retiring content that is already
+retired (or restoring content that is not retired) succeeds, but changes nothing.
+
+Arguments:
+- ctx - context carrying the request logger, metrics and trace
+- body - the request body, a json RetireRequest
+- withdraw - true to retire the content, false to restore it
+- ops - DynamoDbOps used to find the records to change
+- writeOps - DynamoWriteOps used to change them and to write the audit record
+Returns:
+- the AuditRecord that was written on success
+- a LookupError on failure
+*/
+func SetWithdrawn(ctx context.Context, body string, withdraw bool, ops DynamoDbOps, writeOps DynamoWriteOps) (*AuditRecord, *LookupError) {
+	logger := LoggerFromContext(ctx)
+	var rq RetireRequest
+	err := json.Unmarshal([]byte(body), &rq)
+	if err != nil {
+		return nil, NewInvalidQueryError(fmt.Sprintf("Request body is not a valid retire request: %s", err))
+	}
+	if lookupErr := rq.validate(withdraw); lookupErr != nil {
+		return nil, lookupErr
+	}
+
+	now := nowForAudit()
+	audit := &AuditRecord{
+		Target:      rq.Target(),
+		Timestamp:   now,
+		Action:      AuditActionRestore,
+		Reason:      rq.Reason,
+		RequestedBy: rq.RequestedBy,
+	}
+	var w *Withdrawal
+	if withdraw {
+		w = &Withdrawal{Reason: rq.Reason, At: now.Truncate(time.Second)}
+		audit.Action = AuditActionRetire
+	}
+
+	var lookupErr *LookupError
+	if rq.Filebase != "" {
+		audit.RecordsAffected, lookupErr = withdrawIdMapping(ctx, rq.Filebase, w, ops, writeOps)
+	} else {
+		audit.RecordsAffected, lookupErr = withdrawEncodings(ctx, rq.FCSID, rq.EncodingId, w, ops, writeOps)
+	}
+	if lookupErr != nil && audit.RecordsAffected == 0 {
+		return nil, lookupErr
+	}
+	//if we failed part way through an fcs_id then some records were changed, so they must still be audited
+
+	err = writeOps.PutAuditRecord(ctx, audit)
+	if err != nil {
+		logger.Error("SetWithdrawn could not write audit record for %s %s: %s", audit.Action, audit.Target, err)
+		return nil, NewBackendError("The change was applied but could not be audited", err)
+	}
+	logger.Info("SetWithdrawn %s of %s by %s changed %d records", audit.Action, audit.Target, audit.RequestedBy, audit.RecordsAffected)
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+	return audit, nil
+}
+
+/*
+GetAuditHistory returns the retire and restore history for a single target.
+
+Arguments:
+- ctx - context carrying the request logger, metrics and trace
+- queryStringParams - either `filebase`, `fcs_id` or `fcs_id` and `encodingid`, with the same meaning as in RetireRequest
+- writeOps - DynamoWriteOps used to read the audit table
+Returns:
+- a slice of AuditRecord pointers, oldest first, on success
+- a LookupError on failure
+*/
+func GetAuditHistory(ctx context.Context, queryStringParams map[string]string, writeOps DynamoWriteOps) ([]*AuditRecord, *LookupError) {
+	rq := RetireRequest{
+		Filebase: queryStringParams["filebase"],
+		FCSID:    queryStringParams["fcs_id"],
+	}
+	if encodingIdString, haveEncodingId := queryStringParams["encodingid"]; haveEncodingId {
+		encodingId, err := strconv.ParseInt(encodingIdString, 10, 32)
+		if err != nil {
+			return nil, NewInvalidQueryError("Invalid encodingid")
+		}
+		typedEncodingId := int32(encodingId)
+		rq.EncodingId = &typedEncodingId
+	}
+	rq.RequestedBy = "-" //not relevant when reading
+	if lookupErr := rq.validate(false); lookupErr != nil {
+		return nil, lookupErr
+	}
+
+	history, err := writeOps.QueryAuditHistory(ctx, rq.Target())
+	if err != nil {
+		LoggerFromContext(ctx).Error("GetAuditHistory could not query history for %s: %s", rq.Target(), err)
+		return nil, NewBackendError("Database error", err)
+	}
+	return history, nil
+}
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func fixAuditTime(t *testing.T) time.Time {
+	fixed := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC)
+	original := nowForAudit
+	nowForAudit = func() time.Time { return fixed }
+	t.Cleanup(func() { nowForAudit = original })
+	return fixed
+}
+
+func TestSetWithdrawnIdMapping(t *testing.T) {
+	fixed := fixAuditTime(t)
+	ops := &DynamoOpsMock{
+		IdMappingResult: IdMappingRecord{uuid: "abcd", contentId: 2222, filebase: "mygreatvideo"},
+	}
+	writeOps := &DynamoWriteOpsMock{}
+
+	audit, lookupErr := SetWithdrawn(context.Background(), `{"filebase":"mygreatvideo","reason":"legal","requested_by":"fred"}`, true, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("SetWithdrawn returned an unexpected error: %s", lookupErr)
+	}
+	if len(writeOps.IdMappingsWithdrawn) != 1 || writeOps.IdMappingsWithdrawn[0].uuid != "abcd" {
+		t.Fatalf("Expected the idmapping record to be withdrawn, got %v", writeOps.IdMappingsWithdrawn)
+	}
+	if writeOps.IdMappingWithdrawal == nil || writeOps.IdMappingWithdrawal.Reason != "legal" || !writeOps.IdMappingWithdrawal.At.Equal(fixed.Truncate(time.Second)) {
+		t.Errorf("Unexpected withdrawal %v", writeOps.IdMappingWithdrawal)
+	}
+	if audit.Target != "idmapping/mygreatvideo" || audit.Action != AuditActionRetire || audit.RecordsAffected != 1 || audit.RequestedBy != "fred" {
+		t.Errorf("Unexpected audit record %v", audit)
+	}
+	if len(writeOps.AuditRecordsPut) != 1 || writeOps.AuditRecordsPut[0] != audit {
+		t.Error("Expected the audit record to be written")
+	}
+
+	//retiring again changes nothing, but is still audited
+	ops.IdMappingResult.withdrawn = writeOps.IdMappingWithdrawal
+	audit, lookupErr = SetWithdrawn(context.Background(), `{"filebase":"mygreatvideo","reason":"legal","requested_by":"fred"}`, true, ops, writeOps)
+	if lookupErr != nil || audit.RecordsAffected != 0 || len(writeOps.IdMappingsWithdrawn) != 1 {
+		t.Errorf("Expected a second retire to change nothing, got %v %v", audit, lookupErr)
+	}
+
+	audit, lookupErr = SetWithdrawn(context.Background(), `{"filebase":"mygreatvideo","requested_by":"fred"}`, false, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("SetWithdrawn returned an unexpected error: %s", lookupErr)
+	}
+	if len(writeOps.IdMappingsWithdrawn) != 2 || writeOps.IdMappingWithdrawal != nil || audit.Action != AuditActionRestore {
+		t.Errorf("Expected the idmapping record to be restored")
+	}
+}
+
+func TestSetWithdrawnEncodings(t *testing.T) {
+	fixAuditTime(t)
+	ops := &DynamoOpsMock{
+		EncodingsForFCSIdResults: []*Encoding{
+			{EncodingId: 123, FCSID: "KP-12345"},
+			{EncodingId: 124, FCSID: "KP-12345"},
+		},
+	}
+	writeOps := &DynamoWriteOpsMock{}
+
+	audit, lookupErr := SetWithdrawn(context.Background(), `{"fcs_id":"KP-12345","encodingid":124,"reason":"broken","requested_by":"fred"}`, true, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("SetWithdrawn returned an unexpected error: %s", lookupErr)
+	}
+	if len(writeOps.EncodingsWithdrawn) != 1 || writeOps.EncodingsWithdrawn[0] != 124 {
+		t.Errorf("Expected only encoding 124 to be withdrawn, got %v", writeOps.EncodingsWithdrawn)
+	}
+	if audit.Target != "encoding/KP-12345/124" {
+		t.Errorf("Unexpected audit target %s", audit.Target)
+	}
+
+	writeOps = &DynamoWriteOpsMock{}
+	audit, lookupErr = SetWithdrawn(context.Background(), `{"fcs_id":"KP-12345","reason":"broken","requested_by":"fred"}`, true, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("SetWithdrawn returned an unexpected error: %s", lookupErr)
+	}
+	if len(writeOps.EncodingsWithdrawn) != 2 || audit.RecordsAffected != 2 || audit.Target != "fcs/KP-12345" {
+		t.Errorf("Expected the whole version to be withdrawn, got %v", writeOps.EncodingsWithdrawn)
+	}
+
+	_, lookupErr = SetWithdrawn(context.Background(), `{"fcs_id":"KP-12345","encodingid":999,"reason":"broken","requested_by":"fred"}`, true, ops, writeOps)
+	if lookupErr == nil || lookupErr.StatusCode() != 404 {
+		t.Errorf("Expected a 404 for an unknown encoding, got %v", lookupErr)
+	}
+}
+
+func TestSetWithdrawnValidation(t *testing.T) {
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{}
+	for _, body := range []string{
+		`not json`,
+		`{"reason":"legal","requested_by":"fred"}`,
+		`{"filebase":"a","fcs_id":"KP-1","reason":"legal","requested_by":"fred"}`,
+		`{"encodingid":1,"reason":"legal","requested_by":"fred"}`,
+		`{"filebase":"a","requested_by":"fred"}`,
+		`{"filebase":"a","reason":"legal"}`,
+	} {
+		_, lookupErr := SetWithdrawn(context.Background(), body, true, ops, writeOps)
+		if lookupErr == nil || lookupErr.StatusCode() != 400 {
+			t.Errorf("Expected a 400 for %s, got %v", body, lookupErr)
+		}
+	}
+	if len(writeOps.AuditRecordsPut) != 0 {
+		t.Error("Nothing should be audited for an invalid request")
+	}
+}
+
+func TestSetWithdrawnAuditFailure(t *testing.T) {
+	ops := &DynamoOpsMock{
+		IdMappingResult: IdMappingRecord{uuid: "abcd", contentId: 2222, filebase: "mygreatvideo"},
+	}
+	writeOps := &DynamoWriteOpsMock{PutAuditRecordErr: errors.New("kaboom")}
+
+	_, lookupErr := SetWithdrawn(context.Background(), `{"filebase":"mygreatvideo","reason":"legal","requested_by":"fred"}`, true, ops, writeOps)
+	if lookupErr == nil || lookupErr.StatusCode() != 500 {
+		t.Errorf("Expected a 500 if the audit record can't be written, got %v", lookupErr)
+	}
+}
+
+func TestAuditRecordRoundTrip(t *testing.T) {
+	original := &AuditRecord{
+		Target:          "fcs/KP-12345",
+		Timestamp:       time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC),
+		Action:          AuditActionRetire,
+		Reason:          "legal",
+		RequestedBy:     "fred",
+		RecordsAffected: 3,
+	}
+	decoded, err := AuditRecordFromDynamo(original.toDynamo())
+	if err != nil {
+		t.Fatalf("AuditRecordFromDynamo returned an unexpected error: %s", err)
+	}
+	if *decoded != *original {
+		t.Errorf("Round trip changed the record, got %v", decoded)
+	}
+}
+
+func TestGetAuditHistory(t *testing.T) {
+	writeOps := &DynamoWriteOpsMock{AuditHistoryResults: []*AuditRecord{{Target: "encoding/KP-12345/12"}}}
+	history, lookupErr := GetAuditHistory(context.Background(), map[string]string{"fcs_id": "KP-12345", "encodingid": "12"}, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("GetAuditHistory returned an unexpected error: %s", lookupErr)
+	}
+	if writeOps.AuditTargetQueried != "encoding/KP-12345/12" || len(history) != 1 {
+		t.Errorf("GetAuditHistory queried the wrong target %s", writeOps.AuditTargetQueried)
+	}
+
+	_, lookupErr = GetAuditHistory(context.Background(), map[string]string{}, writeOps)
+	if lookupErr == nil || lookupErr.StatusCode() != 400 {
+		t.Errorf("Expected a 400 without a target, got %v", lookupErr)
+	}
+}
+
+func TestWithdrawalFromDynamo(t *testing.T) {
+	rec := RawDynamoRecord{}
+	if withdrawalFromDynamo(&rec) != nil {
+		t.Error("A record without withdrawn_at should not be withdrawn")
+	}
+	w := &Withdrawal{Reason: "legal", At: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	addWithdrawalToDynamo(rec, w)
+	decoded := withdrawalFromDynamo(&rec)
+	if decoded == nil || *decoded != *w {
+		t.Errorf("Round trip changed the withdrawal, got %v", decoded)
+	}
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"io"
+	"time"
+)
+
+/*
+S3Ops abstracts the S3 operations used by the ingest lambda, so that we can mock them in testing
+*/
+type S3Ops interface {
+	GetObject(ctx context.Context, bucket string, key string) ([]byte, error)
+	ObjectSize(ctx context.Context, bucket string, key string) (int64, error)
+}
+
+type S3OpsImpl struct {
+	client *s3.Client
+}
+
+/*
+NewS3Ops creates a new S3Ops object from the given configuration
+*/
+func NewS3Ops(config Config) S3Ops {
+	return &S3OpsImpl{client: config.GetS3Client()}
+}
+
+/*
+GetObject downloads the whole of the given object into memory. Only use this for small objects like sidecar files.
+*/
+func (ops *S3OpsImpl) GetObject(ctx context.Context, bucket string, key string) (content []byte, err error) {
+	start := time.Now()
+	ctx, span := StartSpan(ctx, "S3Ops.GetObject", attribute.String("bucket", bucket), attribute.String("key", key))
+	defer func() { EndSpan(span, err) }()
+
+	response, err := ops.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	content, err = io.ReadAll(response.Body)
+	LoggerFromContext(ctx).WithDuration(start).Debug("GetObject read %d bytes from s3://%s/%s", len(content), bucket, key)
+	return content, err
+}
+
+/*
+ObjectSize returns the size in bytes of the given object, without downloading it
+*/
+func (ops *S3OpsImpl) ObjectSize(ctx context.Context, bucket string, key string) (size int64, err error) {
+	ctx, span := StartSpan(ctx, "S3Ops.ObjectSize", attribute.String("bucket", bucket), attribute.String("key", key))
+	defer func() { EndSpan(span, err) }()
+
+	response, err := ops.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return response.ContentLength, nil
+}
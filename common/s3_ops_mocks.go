@@ -0,0 +1,27 @@
+package common
+
+import (
+	"context"
+	"errors"
+)
+
+type S3OpsMock struct {
+	Objects     map[string][]byte //keyed by "bucket/key"
+	ObjectSizes map[string]int64  //keyed by "bucket/key"
+	KeysRead    []string
+}
+
+func (ops *S3OpsMock) GetObject(ctx context.Context, bucket string, key string) ([]byte, error) {
+	ops.KeysRead = append(ops.KeysRead, bucket+"/"+key)
+	if content, haveContent := ops.Objects[bucket+"/"+key]; haveContent {
+		return content, nil
+	}
+	return nil, errors.New("NoSuchKey")
+}
+
+func (ops *S3OpsMock) ObjectSize(ctx context.Context, bucket string, key string) (int64, error) {
+	if size, haveSize := ops.ObjectSizes[bucket+"/"+key]; haveSize {
+		return size, nil
+	}
+	return 0, errors.New("NotFound")
+}
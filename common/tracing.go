@@ -0,0 +1,148 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"strings"
+)
+
+const TracerName = "github.com/guardian/new-encodings-endpoints/common"
+
+const TracingExporterNone = "none"
+const TracingExporterStdout = "stdout"
+const TracingExporterOTLP = "otlp"
+
+// tracerProvider is nil if tracing is not enabled
+var tracerProvider *sdktrace.TracerProvider
+
+/*
+newSpanExporter builds the span exporter named by `exporterName`. A nil exporter with no error means that tracing
+should be disabled.
+The OTLP exporter is only available when built with `-tags otlp`, see newOTLPExporter.
+*/
+func newSpanExporter(ctx context.Context, exporterName string) (sdktrace.SpanExporter, error) {
+	switch strings.ToLower(strings.TrimSpace(exporterName)) {
+	case "":
+		fallthrough
+	case TracingExporterNone:
+		return nil, nil
+	case TracingExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TracingExporterOTLP:
+		return newOTLPExporter(ctx)
+	default:
+		return nil, errors.New(fmt.Sprintf("tracing exporter '%s' is not recognised", exporterName))
+	}
+}
+
+/*
+InitTracing sets up the global tracer provider with the exporter named in the TRACING_EXPORTER environment variable,
+which can be "otlp", "stdout" or "none" (the default).  If tracing is disabled then the spans created by StartSpan are
+no-ops and cost next to nothing.
+
+Call this once from `main`, before the lambda runtime is started.
+*/
+func InitTracing(ctx context.Context, serviceName string) error {
+	exporter, err := newSpanExporter(ctx, os.Getenv("TRACING_EXPORTER"))
+	if err != nil {
+		return err
+	}
+	if exporter == nil {
+		DefaultLogger.Debug("InitTracing tracing is disabled")
+		return nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return err
+	}
+
+	SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	))
+	DefaultLogger.Info("InitTracing sending traces for %s via %s exporter", serviceName, os.Getenv("TRACING_EXPORTER"))
+	return nil
+}
+
+/*
+SetTracerProvider installs the given provider as the global one.  This is used by InitTracing and by tests.
+*/
+func SetTracerProvider(provider *sdktrace.TracerProvider) {
+	tracerProvider = provider
+	otel.SetTracerProvider(provider)
+}
+
+/*
+FlushTracing pushes out any spans that are still buffered. Lambda freezes the process between invocations, so this
+must be called at the end of every request otherwise spans can be delayed indefinitely or lost.
+*/
+func FlushTracing(ctx context.Context) {
+	if tracerProvider != nil {
+		err := tracerProvider.ForceFlush(ctx)
+		if err != nil {
+			LoggerFromContext(ctx).Warning("FlushTracing could not flush spans: %s", err)
+		}
+	}
+}
+
+/*
+StartSpan starts a new span as a child of any span in the given context.  The caller must call `End` on the returned span,
+normally via EndSpan
+*/
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+/*
+EndSpan records the error (if any) on the span and then ends it
+*/
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+/*
+StartRequestSpan starts the root span for an incoming API Gateway request. If tracing is enabled then the trace ID is
+also added to the request logger, so that logs and traces can be matched up.
+Call EndRequestSpan once the request is complete.
+*/
+func StartRequestSpan(ctx context.Context, endpointName string, event *events.APIGatewayProxyRequest) (context.Context, trace.Span) {
+	ctx, span := StartSpan(ctx, endpointName,
+		attribute.String("endpoint", endpointName),
+		attribute.String("request_id", event.RequestContext.RequestID),
+		attribute.String("stage", event.RequestContext.Stage),
+		attribute.String("http.path", event.Path),
+	)
+	if span.SpanContext().IsValid() {
+		ctx = ContextWithLogger(ctx, LoggerFromContext(ctx).With("trace_id", span.SpanContext().TraceID().String()))
+	}
+	return ctx, span
+}
+
+/*
+EndRequestSpan records the response status on the request span, ends it and flushes the trace
+*/
+func EndRequestSpan(ctx context.Context, span trace.Span, response *events.APIGatewayProxyResponse) {
+	if response != nil {
+		span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
+		if response.StatusCode >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("returned status %d", response.StatusCode))
+		}
+	}
+	span.End()
+	FlushTracing(ctx)
+}
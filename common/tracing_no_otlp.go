@@ -0,0 +1,17 @@
+//go:build !otlp
+
+package common
+
+import (
+	"context"
+	"errors"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+/*
+newOTLPExporter is left out of normal builds, because the OTLP client pulls grpc and protobuf into every lambda.
+Build with `-tags otlp` to include it.
+*/
+func newOTLPExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	return nil, errors.New("the otlp tracing exporter is not included in this build, rebuild with -tags otlp")
+}
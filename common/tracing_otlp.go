@@ -0,0 +1,18 @@
+//go:build otlp
+
+package common
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+/*
+newOTLPExporter builds an exporter that sends spans over OTLP/HTTP.  It is configured through the standard
+OTEL_EXPORTER_OTLP_* environment variables, see
+https://opentelemetry.io/docs/concepts/sdk-configuration/otlp-exporter-configuration/
+*/
+func newOTLPExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	return otlptracehttp.New(ctx)
+}
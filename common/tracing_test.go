@@ -0,0 +1,118 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+	"time"
+)
+
+/*
+setUpTestTracing installs a tracer provider that records spans in memory, and removes it again when the test completes
+*/
+func setUpTestTracing(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		tracerProvider = nil
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	})
+	return recorder
+}
+
+func spanNames(recorder *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	result := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		result[s.Name()] = s
+	}
+	return result
+}
+
+/*
+newSpanExporter should reject exporters that it does not know about and disable tracing if nothing is set
+*/
+func TestNewSpanExporter(t *testing.T) {
+	exporter, err := newSpanExporter(context.Background(), "")
+	if exporter != nil || err != nil {
+		t.Errorf("Expected no exporter and no error for an empty name, got %v %v", exporter, err)
+	}
+	exporter, err = newSpanExporter(context.Background(), "none")
+	if exporter != nil || err != nil {
+		t.Errorf("Expected no exporter and no error for 'none', got %v %v", exporter, err)
+	}
+	exporter, err = newSpanExporter(context.Background(), "stdout")
+	if exporter == nil || err != nil {
+		t.Errorf("Expected an exporter for 'stdout', got %v %v", exporter, err)
+	}
+	_, err = newSpanExporter(context.Background(), "carrier-pigeon")
+	if err == nil {
+		t.Error("Expected an error for an unknown exporter")
+	}
+}
+
+/*
+FindContent should produce spans for each stage of the lookup, parented to the span in the incoming context
+*/
+func TestFindContentTracesLookup(t *testing.T) {
+	recorder := setUpTestTracing(t)
+
+	tim, _ := time.Parse(time.RFC3339, time.RFC3339)
+	ops := &DynamoOpsMock{
+		IdMappingResult: IdMappingRecord{
+			contentId:  2222,
+			filebase:   "mygreatvideo",
+			lastupdate: tim,
+		},
+		FCSIdForContentIdResults: &[]string{"KP-12345"},
+		EncodingsForFCSIdResults: []*Encoding{
+			{EncodingId: 123, Url: "http://url/to/content.mp4", Format: "video/mp4", LastUpdate: tim},
+		},
+	}
+	config := &ConfigMock{}
+	fakeParams := map[string]string{"file": "mygreatvideo"}
+
+	ctx, rootSpan := StartSpan(context.Background(), "test-root")
+	_, errResponse := FindContent(ctx, &fakeParams, ops, config, &MimeEquivalentsCacheMock{})
+	rootSpan.End()
+	if errResponse != nil {
+		t.Fatalf("FindContent returned an unexpected error response %v", errResponse)
+	}
+
+	spans := spanNames(recorder)
+	for _, expected := range []string{"getIDMapping", "getFCSId", "ContentFilter"} {
+		span, haveSpan := spans[expected]
+		if !haveSpan {
+			t.Errorf("Expected a span called %s, got %v", expected, spans)
+			continue
+		}
+		if span.Parent().SpanID() != rootSpan.SpanContext().SpanID() {
+			t.Errorf("Span %s was not a child of the root span", expected)
+		}
+	}
+}
+
+/*
+EndSpan should mark the span as failed if there was an error
+*/
+func TestEndSpanRecordsError(t *testing.T) {
+	recorder := setUpTestTracing(t)
+
+	_, span := StartSpan(context.Background(), "failing")
+	EndSpan(span, errors.New("kaboom"))
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("Expected 1 ended span, got %d", len(ended))
+	}
+	if ended[0].Status().Code != codes.Error {
+		t.Errorf("Expected span status to be Error, got %v", ended[0].Status())
+	}
+	if ended[0].Status().Description != "kaboom" {
+		t.Errorf("Unexpected status description '%s'", ended[0].Status().Description)
+	}
+}
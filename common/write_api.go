@@ -0,0 +1,431 @@
+package common
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const WriteStatusCreated = "created"
+const WriteStatusUpdated = "updated"
+const WriteStatusUnchanged = "unchanged"
+const WriteStatusStale = "stale" //the stored record is newer, so nothing was written
+
+/*
+WriteResult is the response body for a successful call to the write API
+*/
+type WriteResult struct {
+	Status     string    `json:"status"` //one of the WriteStatus* constants
+	EncodingId *int32    `json:"encodingid,omitempty"`
+	Filebase   string    `json:"filebase,omitempty"`
+	Uuid       string    `json:"uuid,omitempty"`
+	LastUpdate time.Time `json:"lastupdate"`
+}
+
+/*
+StatusCode returns 201 if a new record was created and 200 otherwise
+*/
+func (r *WriteResult) StatusCode() int {
+	if r.Status == WriteStatusCreated {
+		return 201
+	}
+	return 200
+}
+
+// nowForWrite gives the timestamp that is stamped onto written records. It is a variable so that tests can fix it.
+var nowForWrite = func() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+/*
+IsWriteAuthorised returns true if the request carries an `Authorization: Bearer {key}` header that matches the
+WRITE_API_KEY environment variable.  If WRITE_API_KEY is not set then nothing is authorised.
+*/
+func IsWriteAuthorised(event *events.APIGatewayProxyRequest) bool {
+	expectedKey := os.Getenv("WRITE_API_KEY")
+	if expectedKey == "" {
+		return false
+	}
+	var providedKey string
+	for k, v := range event.Headers {
+		if strings.EqualFold(k, "Authorization") && len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+			providedKey = strings.TrimSpace(v[7:])
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(providedKey), []byte(expectedKey)) == 1
+}
+
+/*
+rawDynamoRecordFromJson converts a flat json object into a RawDynamoRecord, so that it can be validated by the same
+functions that validate records coming out of the database.  Nulls are dropped, and nested values are not allowed.
+*/
+func rawDynamoRecordFromJson(body string) (RawDynamoRecord, error) {
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	err := decoder.Decode(&fields)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make(RawDynamoRecord, len(fields))
+	for k, v := range fields {
+		switch typedValue := v.(type) {
+		case nil:
+			continue
+		case json.Number:
+			record[k] = &types.AttributeValueMemberN{Value: typedValue.String()}
+		case string:
+			record[k] = &types.AttributeValueMemberS{Value: typedValue}
+		case bool:
+			record[k] = &types.AttributeValueMemberBOOL{Value: typedValue}
+		default:
+			return nil, fmt.Errorf("field %s has an unsupported type", k)
+		}
+	}
+	return record, nil
+}
+
+/*
+EncodingToDynamo converts an Encoding into the record that is stored in the Encodings table. This is the reverse of
+EncodingFromDynamo; empty optional strings are left out and an empty FCS ID is stored as "ABSENT", in the same way
+as the migration tool does, because it is part of the table key.
+*/
+func EncodingToDynamo(enc *Encoding) RawDynamoRecord {
+	number := func(v int64) types.AttributeValue {
+		return &types.AttributeValueMemberN{Value: strconv.FormatInt(v, 10)}
+	}
+	record := RawDynamoRecord{
+		"encodingid":   number(int64(enc.EncodingId)),
+		"contentid":    number(int64(enc.ContentId)),
+		"url":          &types.AttributeValueMemberS{Value: enc.Url},
+		"format":       &types.AttributeValueMemberS{Value: enc.Format},
+		"mobile":       &types.AttributeValueMemberBOOL{Value: enc.Mobile},
+		"multirate":    &types.AttributeValueMemberBOOL{Value: enc.Multirate},
+		"vbitrate":     number(int64(enc.VBitrate)),
+		"abitrate":     number(int64(enc.ABitrate)),
+		"lastupdate":   &types.AttributeValueMemberS{Value: enc.LastUpdate.Format(time.RFC3339)},
+		"frame_width":  number(int64(enc.FrameWidth)),
+		"frame_height": number(int64(enc.FrameHeight)),
+		"duration":     &types.AttributeValueMemberN{Value: strconv.FormatFloat(float64(enc.Duration), 'f', -1, 32)},
+		"file_size":    number(enc.FileSize),
+		"aspect":       &types.AttributeValueMemberS{Value: enc.Aspect},
+	}
+	if enc.VCodec != "" {
+		record["vcodec"] = &types.AttributeValueMemberS{Value: enc.VCodec}
+	}
+	if enc.ACodec != "" {
+		record["acodec"] = &types.AttributeValueMemberS{Value: enc.ACodec}
+	}
+	if enc.OctopusId != 0 {
+		record["octopus_id"] = number(int64(enc.OctopusId))
+	}
+	if enc.FCSID == "" {
+		record["fcs_id"] = &types.AttributeValueMemberS{Value: "ABSENT"}
+	} else {
+		record["fcs_id"] = &types.AttributeValueMemberS{Value: enc.FCSID}
+	}
+	addWithdrawalToDynamo(record, enc.Withdrawn)
+	return record
+}
+
+/*
+IdMappingToDynamo converts an IdMappingRecord into the record that is stored in the IdMapping table. This is the
+reverse of NewIdMappingRecord
+*/
+func IdMappingToDynamo(rec *IdMappingRecord) RawDynamoRecord {
+	record := RawDynamoRecord{
+		"uuid":       &types.AttributeValueMemberS{Value: rec.uuid},
+		"contentid":  &types.AttributeValueMemberN{Value: strconv.FormatInt(rec.contentId, 10)},
+		"filebase":   &types.AttributeValueMemberS{Value: rec.filebase},
+		"lastupdate": &types.AttributeValueMemberS{Value: rec.lastupdate.Format(time.RFC3339)},
+	}
+	if rec.project != nil {
+		record["project"] = &types.AttributeValueMemberS{Value: *rec.project}
+	}
+	if rec.octopus_id != nil {
+		record["octopus_id"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(*rec.octopus_id, 10)}
+	}
+	addWithdrawalToDynamo(record, rec.withdrawn)
+	return record
+}
+
+/*
+encodingsEqual returns true if the two encodings are the same apart from their lastupdate time
+*/
+func encodingsEqual(a *Encoding, b *Encoding) bool {
+	copiedA := *a
+	copiedB := *b
+	copiedA.LastUpdate = time.Time{}
+	copiedB.LastUpdate = time.Time{}
+	return reflect.DeepEqual(copiedA, copiedB)
+}
+
+/*
+idMappingsEqual returns true if the two records point the same file to the same content
+*/
+func idMappingsEqual(a *IdMappingRecord, b *IdMappingRecord) bool {
+	optionalString := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	optionalInt := func(i *int64) int64 {
+		if i == nil {
+			return 0
+		}
+		return *i
+	}
+	return a.filebase == b.filebase &&
+		a.contentId == b.contentId &&
+		optionalString(a.project) == optionalString(b.project) &&
+		optionalInt(a.octopus_id) == optionalInt(b.octopus_id)
+}
+
+/*
+RegisterEncoding validates an encoding sent to the write API and stores it.  The request is idempotent on `fcs_id` and
+`encodingid`, the key of the table: sending the same encoding twice does nothing the second time.  `lastupdate` is always set to the current time, whatever
+the client sent.
+
+Arguments:
+- ctx - context carrying the request logger, metrics and trace
+- body - the request body. This is a json object with the same field names as the Encodings table
+- replace - if false (i.e. POST) then an existing encoding with different content is a conflict. If true (i.e. PUT) it is overwritten.
+- ops - DynamoDbOps used to find the same encoding under another FCS ID
+- writeOps - DynamoWriteOps used to read any existing encoding and to store the new one
+Returns:
+- a WriteResult on success
+- a LookupError on failure
+*/
+func RegisterEncoding(ctx context.Context, body string, replace bool, ops DynamoDbOps, writeOps DynamoWriteOps) (*WriteResult, *LookupError) {
+	return registerEncoding(ctx, body, replace, nil, ops, writeOps)
+}
+
+/*
+UpsertEncodingAsOf stores an encoding as it was at the given time, overwriting any existing encoding with the same
+`encodingid` that is older.  If the existing encoding was updated at or after `asOf` then it is left alone and the
+result is WriteStatusStale, like UpsertIdMappingAsOf.
+
+Arguments:
+- ctx - context carrying the logger, metrics and trace
+- body - a json object with the same field names as the Encodings table
+- asOf - when the change was made. This becomes the `lastupdate` of the encoding.
+- ops - DynamoDbOps used to find the same encoding under another FCS ID
+- writeOps - DynamoWriteOps used to read any existing encoding and to store the new one
+Returns:
+- a WriteResult on success
+- a LookupError on failure
+*/
+func UpsertEncodingAsOf(ctx context.Context, body string, asOf time.Time, ops DynamoDbOps, writeOps DynamoWriteOps) (*WriteResult, *LookupError) {
+	return registerEncoding(ctx, body, true, &asOf, ops, writeOps)
+}
+
+/*
+registerEncoding does the work for RegisterEncoding and UpsertEncodingAsOf.  If `asOf` is nil the encoding is stamped
+with the current time, and always overwrites an older one.
+*/
+func registerEncoding(ctx context.Context, body string, replace bool, asOf *time.Time, ops DynamoDbOps, writeOps DynamoWriteOps) (*WriteResult, *LookupError) {
+	logger := LoggerFromContext(ctx)
+	raw, err := rawDynamoRecordFromJson(body)
+	if err != nil {
+		return nil, NewInvalidQueryError(fmt.Sprintf("Request body is not a valid json object: %s", err))
+	}
+	lastupdate := nowForWrite()
+	if asOf != nil {
+		lastupdate = asOf.UTC().Truncate(time.Second)
+	}
+	raw["lastupdate"] = &types.AttributeValueMemberS{Value: lastupdate.Format(time.RFC3339)}
+
+	delete(raw, "withdrawn_at") //withdrawal can only be changed by SetWithdrawn
+	delete(raw, "withdrawn_reason")
+	enc, err := EncodingFromDynamo(&raw)
+	if err != nil {
+		return nil, NewInvalidQueryError("Encoding is missing required fields, or they have the wrong type")
+	}
+	if enc.FCSID == "" {
+		enc.FCSID = "ABSENT"
+	}
+
+	//a consistent read on the key, so that a retry of a write that has just succeeded is seen as unchanged
+	existing, err := writeOps.GetEncoding(ctx, enc.FCSID, enc.EncodingId)
+	if err != nil {
+		logger.Error("RegisterEncoding could not look up existing encoding %d: %s", enc.EncodingId, err)
+		return nil, NewBackendError("Database error", err)
+	}
+	if existing == nil {
+		//the FCS ID is part of the key, so the same encoding under another FCS ID would be a second item
+		siblings, err := ops.QueryEncodingsForContentId(ctx, int64(enc.ContentId), nil)
+		if err != nil {
+			logger.Error("RegisterEncoding could not look up existing encodings for content %d: %s", enc.ContentId, err)
+			return nil, NewBackendError("Database error", err)
+		}
+		for _, e := range siblings {
+			if e.EncodingId == enc.EncodingId && e.FCSID != enc.FCSID {
+				return nil, NewConflictError(fmt.Sprintf("Encoding %d belongs to FCS ID %s and can't be moved to %s", enc.EncodingId, e.FCSID, enc.FCSID))
+			}
+		}
+	}
+
+	result := &WriteResult{EncodingId: &enc.EncodingId, LastUpdate: enc.LastUpdate}
+	if existing != nil {
+		enc.Withdrawn = existing.Withdrawn //re-publishing must not silently un-withdraw an encoding
+		if encodingsEqual(existing, enc) {
+			logger.Info("RegisterEncoding encoding %d is unchanged", enc.EncodingId)
+			result.Status = WriteStatusUnchanged
+			result.LastUpdate = existing.LastUpdate
+			return result, nil
+		}
+		if !replace {
+			return nil, NewConflictError(fmt.Sprintf("Encoding %d already exists with different content, use PUT to replace it", enc.EncodingId))
+		}
+		if asOf != nil && !enc.LastUpdate.After(existing.LastUpdate) {
+			logger.Info("RegisterEncoding encoding %d was updated at %s, which is not before %s, so is left alone", enc.EncodingId, existing.LastUpdate.Format(time.RFC3339), enc.LastUpdate.Format(time.RFC3339))
+			result.Status = WriteStatusStale
+			result.LastUpdate = existing.LastUpdate
+			return result, nil
+		}
+	}
+
+	err = writeOps.PutEncoding(ctx, EncodingToDynamo(enc), existing == nil)
+	if errors.Is(err, ErrWriteConflict) {
+		return nil, NewConflictError(fmt.Sprintf("Encoding %d was created by another request, try again", enc.EncodingId))
+	} else if err != nil {
+		logger.Error("RegisterEncoding could not write encoding %d: %s", enc.EncodingId, err)
+		return nil, NewBackendError("Database error", err)
+	}
+
+	if existing == nil {
+		result.Status = WriteStatusCreated
+	} else {
+		result.Status = WriteStatusUpdated
+	}
+	logger.Info("RegisterEncoding encoding %d for content %d was %s", enc.EncodingId, enc.ContentId, result.Status)
+	return result, nil
+}
+
+/*
+RegisterIdMapping validates an idmapping record sent to the write API and stores it.  The request is idempotent on
+`filebase`, and `uuid` and `lastupdate` are always set by us.
+
+Arguments:
+- ctx - context carrying the request logger, metrics and trace
+- body - the request body. This is a json object with the same field names as the IdMapping table
+- replace - if false (i.e. POST) then an existing record with different content is a conflict. If true (i.e. PUT) it is replaced.
+- ops - DynamoDbOps used to find any existing record
+- writeOps - DynamoWriteOps used to store the record
+Returns:
+- a WriteResult on success
+- a LookupError on failure
+*/
+func RegisterIdMapping(ctx context.Context, body string, replace bool, ops DynamoDbOps, writeOps DynamoWriteOps) (*WriteResult, *LookupError) {
+	return registerIdMapping(ctx, body, replace, nil, ops, writeOps)
+}
+
+/*
+UpsertIdMappingAsOf stores an idmapping record as it was at the given time, replacing any existing record for the
+same `filebase` that is older.  If the existing record was updated at or after `asOf` then it is left alone and the
+result is WriteStatusStale, so that replaying an old change (e.g. a repeated S3 notification) can't roll the record
+back.
+
+Arguments:
+- ctx - context carrying the logger, metrics and trace
+- body - a json object with the same field names as the IdMapping table
+- asOf - when the change was made. This becomes the `lastupdate` of the record.
+- ops - DynamoDbOps used to find any existing record
+- writeOps - DynamoWriteOps used to store the record
+Returns:
+- a WriteResult on success
+- a LookupError on failure
+*/
+func UpsertIdMappingAsOf(ctx context.Context, body string, asOf time.Time, ops DynamoDbOps, writeOps DynamoWriteOps) (*WriteResult, *LookupError) {
+	return registerIdMapping(ctx, body, true, &asOf, ops, writeOps)
+}
+
+/*
+registerIdMapping does the work for RegisterIdMapping and UpsertIdMappingAsOf.  If `asOf` is nil the record is stamped
+with the current time, and always replaces an older one.
+*/
+func registerIdMapping(ctx context.Context, body string, replace bool, asOf *time.Time, ops DynamoDbOps, writeOps DynamoWriteOps) (*WriteResult, *LookupError) {
+	logger := LoggerFromContext(ctx)
+	raw, err := rawDynamoRecordFromJson(body)
+	if err != nil {
+		return nil, NewInvalidQueryError(fmt.Sprintf("Request body is not a valid json object: %s", err))
+	}
+	delete(raw, "uuid")
+	lastupdate := nowForWrite()
+	if asOf != nil {
+		lastupdate = asOf.UTC().Truncate(time.Second)
+	}
+	raw["lastupdate"] = &types.AttributeValueMemberS{Value: lastupdate.Format(time.RFC3339)}
+
+	delete(raw, "withdrawn_at")
+	delete(raw, "withdrawn_reason")
+	rec, err := NewIdMappingRecord((*map[string]types.AttributeValue)(&raw))
+	if err != nil {
+		return nil, NewInvalidQueryError("Idmapping record is missing required fields, or they have the wrong type")
+	}
+	if !isFilenameValid(rec.filebase) {
+		return nil, NewInvalidQueryError("Invalid filespec")
+	}
+
+	existing, err := ops.QueryIdMappings(ctx, IdMappingIndexFilebase, IdMappingKeyfieldFilebase, rec.filebase)
+	if err != nil {
+		logger.Error("RegisterIdMapping could not look up existing record for %s: %s", rec.filebase, err)
+		return nil, NewBackendError("Database error", err)
+	}
+
+	if existing != nil {
+		rec.withdrawn = existing.withdrawn
+		if idMappingsEqual(existing, rec) {
+			logger.Info("RegisterIdMapping record for %s is unchanged", rec.filebase)
+			return &WriteResult{Status: WriteStatusUnchanged, Filebase: existing.filebase, Uuid: existing.uuid, LastUpdate: existing.lastupdate}, nil
+		}
+		if !replace {
+			return nil, NewConflictError(fmt.Sprintf("An idmapping record for %s already exists with different content, use PUT to replace it", rec.filebase))
+		}
+		if asOf != nil && !rec.lastupdate.After(existing.lastupdate) {
+			logger.Info("RegisterIdMapping record for %s was updated at %s, which is not before %s, so is left alone", rec.filebase, existing.lastupdate.Format(time.RFC3339), rec.lastupdate.Format(time.RFC3339))
+			return &WriteResult{Status: WriteStatusStale, Filebase: existing.filebase, Uuid: existing.uuid, LastUpdate: existing.lastupdate}, nil
+		}
+		if existing.uuid == "" {
+			return nil, NewBackendError("Existing record can't be replaced", errors.New("existing idmapping record has no uuid"))
+		}
+		rec.uuid = existing.uuid
+		if !rec.lastupdate.After(existing.lastupdate) {
+			//lastupdate is part of the key, so the new item must not have the same one as the item it replaces
+			rec.lastupdate = existing.lastupdate.Add(time.Second)
+		}
+	} else {
+		newUuid, err := uuid.NewRandom()
+		if err != nil {
+			return nil, NewBackendError("Could not generate uuid", err)
+		}
+		rec.uuid = newUuid.String()
+	}
+
+	err = writeOps.ReplaceIdMapping(ctx, IdMappingToDynamo(rec), existing)
+	if errors.Is(err, ErrWriteConflict) {
+		return nil, NewConflictError(fmt.Sprintf("The idmapping record for %s was changed by another request, try again", rec.filebase))
+	} else if err != nil {
+		logger.Error("RegisterIdMapping could not write record for %s: %s", rec.filebase, err)
+		return nil, NewBackendError("Database error", err)
+	}
+
+	result := &WriteResult{Status: WriteStatusCreated, Filebase: rec.filebase, Uuid: rec.uuid, LastUpdate: rec.lastupdate}
+	if existing != nil {
+		result.Status = WriteStatusUpdated
+	}
+	logger.Info("RegisterIdMapping record for %s was %s", rec.filebase, result.Status)
+	return result, nil
+}
@@ -0,0 +1,304 @@
+package common
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"testing"
+	"time"
+)
+
+const testEncodingBody = `{"encodingid": 123, "contentid": 111, "url": "https://url/to/content.mp4", "format": "video/mp4",
+	"mobile": false, "multirate": false, "vcodec": "h264", "vbitrate": 1500, "frame_width": 1280, "frame_height": 720,
+	"duration": 12.5, "file_size": 98765432, "fcs_id": "KP-12345", "aspect": "16:9", "lastupdate": "2001-01-01T00:00:00Z"}`
+
+func fixWriteClock(t *testing.T, fixed time.Time) {
+	previous := nowForWrite
+	nowForWrite = func() time.Time { return fixed }
+	t.Cleanup(func() { nowForWrite = previous })
+}
+
+func TestIsWriteAuthorised(t *testing.T) {
+	t.Setenv("WRITE_API_KEY", "sekrit")
+	expected := map[string]bool{
+		"Bearer sekrit": true,
+		"bearer sekrit": true,
+		"Bearer wrong":  false,
+		"sekrit":        false,
+		"":              false,
+	}
+	for header, result := range expected {
+		evt := &events.APIGatewayProxyRequest{Headers: map[string]string{"authorization": header}}
+		if IsWriteAuthorised(evt) != result {
+			t.Errorf("IsWriteAuthorised for '%s' should have been %v", header, result)
+		}
+	}
+
+	t.Setenv("WRITE_API_KEY", "")
+	evt := &events.APIGatewayProxyRequest{Headers: map[string]string{"Authorization": "Bearer "}}
+	if IsWriteAuthorised(evt) {
+		t.Error("IsWriteAuthorised should never pass if WRITE_API_KEY is not set")
+	}
+}
+
+/*
+RegisterEncoding should store a new encoding with a fresh lastupdate, and only if it does not exist already
+*/
+func TestRegisterEncodingCreates(t *testing.T) {
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	fixWriteClock(t, now)
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{}
+
+	result, lookupErr := RegisterEncoding(context.Background(), testEncodingBody, false, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("RegisterEncoding returned an unexpected error: %s", lookupErr)
+	}
+	if result.Status != WriteStatusCreated || result.StatusCode() != 201 || *result.EncodingId != 123 {
+		t.Errorf("Unexpected result %v", result)
+	}
+	if ops.ContentIdQueried != 111 {
+		t.Errorf("RegisterEncoding should have looked for existing encodings on content 111, got %d", ops.ContentIdQueried)
+	}
+	if len(writeOps.EncodingsPut) != 1 || !writeOps.EncodingMustNotExist {
+		t.Fatalf("RegisterEncoding should have made one conditional write, got %d", len(writeOps.EncodingsPut))
+	}
+
+	written := writeOps.EncodingsPut[0]
+	if written["lastupdate"].(*types.AttributeValueMemberS).Value != "2022-03-04T05:06:07Z" {
+		t.Errorf("lastupdate was not stamped, got %v", written["lastupdate"])
+	}
+	if _, haveAcodec := written["acodec"]; haveAcodec {
+		t.Error("Empty optional field acodec should not have been written")
+	}
+	roundTripped, err := EncodingFromDynamo(&written)
+	if err != nil {
+		t.Fatalf("Written record could not be read back: %s", err)
+	}
+	if roundTripped.Duration != 12.5 || roundTripped.FCSID != "KP-12345" {
+		t.Errorf("Written record did not round-trip, got %v", roundTripped)
+	}
+}
+
+func TestRegisterEncodingValidation(t *testing.T) {
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{}
+
+	for _, body := range []string{
+		`not json`,
+		`{"encodingid": 123, "contentid": 111}`,
+		`{"encodingid": "123", "contentid": 111, "url": "u", "format": "f", "mobile": false, "multirate": false, "frame_width": 1, "frame_height": 1, "duration": 1, "file_size": 1, "aspect": "a"}`,
+		`{"encodingid": 123, "url": {"nested": true}}`,
+	} {
+		_, lookupErr := RegisterEncoding(context.Background(), body, false, ops, writeOps)
+		if lookupErr == nil || lookupErr.StatusCode() != 400 {
+			t.Errorf("RegisterEncoding should have rejected %s with a 400, got %v", body, lookupErr)
+		}
+	}
+	if len(writeOps.EncodingsPut) != 0 {
+		t.Errorf("Invalid encodings should not be written, got %d writes", len(writeOps.EncodingsPut))
+	}
+}
+
+/*
+Sending the same encoding twice should not write anything the second time; sending a different one should conflict
+unless it is a PUT
+*/
+func TestRegisterEncodingIdempotent(t *testing.T) {
+	earlier := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	existing := &Encoding{
+		EncodingId: 123, ContentId: 111, Url: "https://url/to/content.mp4", Format: "video/mp4", VCodec: "h264",
+		VBitrate: 1500, FrameWidth: 1280, FrameHeight: 720, Duration: 12.5, FileSize: 98765432, FCSID: "KP-12345",
+		Aspect: "16:9", LastUpdate: earlier,
+	}
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{ExistingEncodings: []*Encoding{existing}}
+
+	result, lookupErr := RegisterEncoding(context.Background(), testEncodingBody, false, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("RegisterEncoding returned an unexpected error: %s", lookupErr)
+	}
+	if result.Status != WriteStatusUnchanged || result.StatusCode() != 200 || result.LastUpdate != earlier {
+		t.Errorf("Unexpected result %v", result)
+	}
+	if len(writeOps.EncodingsPut) != 0 {
+		t.Error("An unchanged encoding should not be written")
+	}
+
+	existing.VBitrate = 768
+	_, lookupErr = RegisterEncoding(context.Background(), testEncodingBody, false, ops, writeOps)
+	if lookupErr == nil || lookupErr.StatusCode() != 409 {
+		t.Errorf("POST of a changed encoding should conflict, got %v", lookupErr)
+	}
+
+	result, lookupErr = RegisterEncoding(context.Background(), testEncodingBody, true, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("PUT of a changed encoding returned an unexpected error: %s", lookupErr)
+	}
+	if result.Status != WriteStatusUpdated || len(writeOps.EncodingsPut) != 1 || writeOps.EncodingMustNotExist {
+		t.Errorf("PUT of a changed encoding should have overwritten it, got %v", result)
+	}
+
+	existing.FCSID = "KP-99999"
+	writeOps = &DynamoWriteOpsMock{ExistingEncodings: []*Encoding{existing}}
+	ops.EncodingsForContentIdResults = []*Encoding{existing}
+	_, lookupErr = RegisterEncoding(context.Background(), testEncodingBody, true, ops, writeOps)
+	if lookupErr == nil || lookupErr.StatusCode() != 409 || len(writeOps.EncodingsPut) != 0 {
+		t.Errorf("PUT that moves an encoding to another FCS ID should conflict, got %v", lookupErr)
+	}
+}
+
+/*
+A client retrying a POST that has already succeeded must get `unchanged`, even if the contentid index has not caught up
+*/
+func TestRegisterEncodingRetry(t *testing.T) {
+	fixWriteClock(t, time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC))
+	ops := &DynamoOpsMock{} //the index doesn't have the first write yet
+	writeOps := &DynamoWriteOpsMock{}
+
+	first, lookupErr := RegisterEncoding(context.Background(), testEncodingBody, false, ops, writeOps)
+	if lookupErr != nil || first.Status != WriteStatusCreated {
+		t.Fatalf("First POST should create the encoding, got %v, %v", first, lookupErr)
+	}
+	stored, err := EncodingFromDynamo(&writeOps.EncodingsPut[0])
+	if err != nil {
+		t.Fatalf("Written record could not be read back: %s", err)
+	}
+	writeOps.ExistingEncodings = []*Encoding{stored}
+
+	retry, lookupErr := RegisterEncoding(context.Background(), testEncodingBody, false, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("Retried POST returned an unexpected error: %s", lookupErr)
+	}
+	if retry.Status != WriteStatusUnchanged || len(writeOps.EncodingsPut) != 1 {
+		t.Errorf("Retried POST should be unchanged, got %v and %d writes", retry, len(writeOps.EncodingsPut))
+	}
+}
+
+/*
+An encoding stored with the wrong contentid is found by its key, so PUT can correct it
+*/
+func TestRegisterEncodingChangedContentId(t *testing.T) {
+	existing := &Encoding{
+		EncodingId: 123, ContentId: 999, Url: "https://url/to/content.mp4", Format: "video/mp4", VCodec: "h264",
+		VBitrate: 1500, FrameWidth: 1280, FrameHeight: 720, Duration: 12.5, FileSize: 98765432, FCSID: "KP-12345",
+		Aspect: "16:9", LastUpdate: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{ExistingEncodings: []*Encoding{existing}}
+
+	_, lookupErr := RegisterEncoding(context.Background(), testEncodingBody, false, ops, writeOps)
+	if lookupErr == nil || lookupErr.StatusCode() != 409 {
+		t.Errorf("POST that changes the contentid should conflict, got %v", lookupErr)
+	}
+
+	result, lookupErr := RegisterEncoding(context.Background(), testEncodingBody, true, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("PUT that changes the contentid returned an unexpected error: %s", lookupErr)
+	}
+	if result.Status != WriteStatusUpdated || len(writeOps.EncodingsPut) != 1 || writeOps.EncodingMustNotExist {
+		t.Fatalf("PUT that changes the contentid should overwrite the encoding, got %v", result)
+	}
+	if updated, _ := EncodingFromDynamo(&writeOps.EncodingsPut[0]); updated.ContentId != 111 {
+		t.Errorf("Expected the contentid to be corrected, got %d", updated.ContentId)
+	}
+}
+
+/*
+Re-publishing a withdrawn encoding must keep it withdrawn
+*/
+func TestRegisterEncodingKeepsWithdrawal(t *testing.T) {
+	withdrawal := &Withdrawal{Reason: "legal", At: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	existing := &Encoding{EncodingId: 123, ContentId: 111, FCSID: "KP-12345", VBitrate: 768, Withdrawn: withdrawal}
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{ExistingEncodings: []*Encoding{existing}}
+
+	_, lookupErr := RegisterEncoding(context.Background(), testEncodingBody, true, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("RegisterEncoding returned an unexpected error: %s", lookupErr)
+	}
+	if len(writeOps.EncodingsPut) != 1 {
+		t.Fatal("Expected the encoding to be written")
+	}
+	if withdrawalFromDynamo(&writeOps.EncodingsPut[0]) == nil {
+		t.Error("The withdrawal was lost when the encoding was replaced")
+	}
+}
+
+func TestRegisterEncodingWriteConflict(t *testing.T) {
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{PutEncodingError: ErrWriteConflict}
+
+	_, lookupErr := RegisterEncoding(context.Background(), testEncodingBody, false, ops, writeOps)
+	if lookupErr == nil || lookupErr.Kind != LookupErrorConflict {
+		t.Errorf("A conditional write failure should be reported as a conflict, got %v", lookupErr)
+	}
+}
+
+func TestRegisterIdMappingCreates(t *testing.T) {
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	fixWriteClock(t, now)
+	ops := &DynamoOpsMock{}
+	writeOps := &DynamoWriteOpsMock{}
+
+	body := `{"filebase": "mygreatvideo", "contentid": 2222, "octopus_id": 34567, "uuid": "client-supplied"}`
+	result, lookupErr := RegisterIdMapping(context.Background(), body, false, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("RegisterIdMapping returned an unexpected error: %s", lookupErr)
+	}
+	if result.Status != WriteStatusCreated || result.Uuid == "" || result.Uuid == "client-supplied" || result.LastUpdate != now {
+		t.Errorf("Unexpected result %v", result)
+	}
+	if ops.IdMappingSearchTermQueried != "mygreatvideo" {
+		t.Errorf("RegisterIdMapping should have looked for an existing record, got %v", ops.IdMappingSearchTermQueried)
+	}
+	if len(writeOps.IdMappingsPut) != 1 || writeOps.IdMappingReplaced != nil {
+		t.Fatal("RegisterIdMapping should have written one new record")
+	}
+	written := writeOps.IdMappingsPut[0]
+	readBack, err := NewIdMappingRecord((*map[string]types.AttributeValue)(&written))
+	if err != nil {
+		t.Fatalf("Written record could not be read back: %s", err)
+	}
+	if readBack.uuid != result.Uuid || readBack.contentId != 2222 || *readBack.octopus_id != 34567 {
+		t.Errorf("Written record did not round-trip, got %v", readBack)
+	}
+
+	_, lookupErr = RegisterIdMapping(context.Background(), `{"filebase": "bad;name", "contentid": 2222}`, false, ops, writeOps)
+	if lookupErr == nil || lookupErr.StatusCode() != 400 {
+		t.Errorf("RegisterIdMapping should reject filenames that can't be looked up, got %v", lookupErr)
+	}
+}
+
+/*
+Replacing an idmapping record should keep its uuid and always move lastupdate forward, because it is part of the key
+*/
+func TestRegisterIdMappingReplaces(t *testing.T) {
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	fixWriteClock(t, now)
+	ops := &DynamoOpsMock{
+		IdMappingResult: IdMappingRecord{uuid: "existing-uuid", contentId: 1111, filebase: "mygreatvideo", lastupdate: now},
+	}
+	writeOps := &DynamoWriteOpsMock{}
+
+	result, lookupErr := RegisterIdMapping(context.Background(), `{"filebase": "mygreatvideo", "contentid": 1111}`, false, ops, writeOps)
+	if lookupErr != nil || result.Status != WriteStatusUnchanged || len(writeOps.IdMappingsPut) != 0 {
+		t.Errorf("Re-sending the same record should do nothing, got %v %v", result, lookupErr)
+	}
+
+	_, lookupErr = RegisterIdMapping(context.Background(), `{"filebase": "mygreatvideo", "contentid": 2222}`, false, ops, writeOps)
+	if lookupErr == nil || lookupErr.StatusCode() != 409 {
+		t.Errorf("POST of a changed record should conflict, got %v", lookupErr)
+	}
+
+	result, lookupErr = RegisterIdMapping(context.Background(), `{"filebase": "mygreatvideo", "contentid": 2222}`, true, ops, writeOps)
+	if lookupErr != nil {
+		t.Fatalf("PUT of a changed record returned an unexpected error: %s", lookupErr)
+	}
+	if result.Status != WriteStatusUpdated || result.Uuid != "existing-uuid" || !result.LastUpdate.After(now) {
+		t.Errorf("Unexpected result %v", result)
+	}
+	if writeOps.IdMappingReplaced == nil || writeOps.IdMappingReplaced.uuid != "existing-uuid" {
+		t.Errorf("The existing record should have been replaced, got %v", writeOps.IdMappingReplaced)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+/*
+This function checks that the endpoints' configuration is valid and that all of the tables they use can be read, and
+returns a json report.  It returns a 503 if anything is wrong, so it can be used as a canary check during deployment.
+*/
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/guardian/new-encodings-endpoints/common"
+)
+
+var ops common.DynamoDbOps
+var config common.Config
+var configErr error
+var mimeEquivelentsCache common.MimeEquivalentsCache
+var cacheErr error
+
+func HandleEvent(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+	report := common.RunHealthCheck(ctx, config, configErr, ops, mimeEquivelentsCache, cacheErr)
+	return report.MakeResponse(), nil
+}
+
+func main() {
+	err := common.InitTracing(context.Background(), "healthcheck")
+	if err != nil {
+		common.DefaultLogger.Error("Could not initialise tracing: %s", err)
+		panic("could not initialise tracing")
+	}
+
+	//unlike the other endpoints we don't panic if setup fails, because reporting that is the whole point
+	config, configErr = common.NewConfig()
+	if configErr != nil {
+		common.DefaultLogger.Error("Could not initialise config: %s", configErr)
+	} else {
+		ops = common.NewDynamoDbOps(config)
+		mimeEquivelentsCache, cacheErr = common.NewMimeEquivalentsCache(context.Background(), ops)
+		if cacheErr != nil {
+			common.DefaultLogger.Error("Could not initialise mime equivalents: %s", cacheErr)
+		}
+	}
+
+	lambda.Start(common.InstrumentHandler("healthcheck", HandleEvent))
+}
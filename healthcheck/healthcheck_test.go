@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"testing"
+	"time"
+)
+
+func setUpHealthCheck(tableErrors map[string]error) *common.DynamoOpsMock {
+	mockOps := &common.DynamoOpsMock{CheckTableErrors: tableErrors}
+	ops = mockOps
+	config = &common.ConfigMock{IdMappingTableVal: "id-mapping-table", EncodingsTableVal: "encodings-table"}
+	configErr = nil
+	mimeEquivelentsCache = &common.MimeEquivalentsCacheMock{SizeVal: 3, LoadedAtVal: time.Now().Add(-1 * time.Minute)}
+	cacheErr = nil
+	return mockOps
+}
+
+func TestHealthCheckAllOk(t *testing.T) {
+	mockOps := setUpHealthCheck(nil)
+
+	response, err := HandleEvent(context.Background(), &events.APIGatewayProxyRequest{})
+	if err != nil {
+		t.Fatalf("HandleEvent returned an unexpected error: %s", err)
+	}
+	if response.StatusCode != 200 {
+		t.Errorf("Expected a 200 response, got %d: %s", response.StatusCode, response.Body)
+	}
+	if len(mockOps.TablesChecked) != 4 {
+		t.Errorf("Expected 4 tables to be checked, got %v", mockOps.TablesChecked)
+	}
+
+	var report common.HealthReport
+	err = json.Unmarshal([]byte(response.Body), &report)
+	if err != nil {
+		t.Fatalf("Response was not valid json: %s", err)
+	}
+	if report.Status != common.HealthStatusOk || len(report.Dependencies) != 5 {
+		t.Errorf("Unexpected report %v", report)
+	}
+	if report.MimeEquivalentsCache.Entries != 3 || report.MimeEquivalentsCache.AgeSeconds < 60 {
+		t.Errorf("Unexpected cache report %v", report.MimeEquivalentsCache)
+	}
+}
+
+func TestHealthCheckTableFailure(t *testing.T) {
+	setUpHealthCheck(map[string]error{"encodings-table": errors.New("AccessDeniedException")})
+
+	response, _ := HandleEvent(context.Background(), &events.APIGatewayProxyRequest{})
+	if response.StatusCode != 503 {
+		t.Errorf("Expected a 503 response, got %d", response.StatusCode)
+	}
+	var report common.HealthReport
+	json.Unmarshal([]byte(response.Body), &report)
+	for _, d := range report.Dependencies {
+		if d.Name == "dynamodb:encodings" && (d.Status != common.HealthStatusFailed || d.Error != "AccessDeniedException") {
+			t.Errorf("Encodings table failure was not reported, got %v", d)
+		}
+		if d.Name == "dynamodb:idmapping" && d.Status != common.HealthStatusOk {
+			t.Errorf("Idmapping table should have been ok, got %v", d)
+		}
+	}
+}
+
+func TestHealthCheckConfigFailure(t *testing.T) {
+	mockOps := setUpHealthCheck(nil)
+	config = nil
+	configErr = errors.New("ID_MAPPING_TABLE not set")
+	mimeEquivelentsCache = nil
+
+	response, _ := HandleEvent(context.Background(), &events.APIGatewayProxyRequest{})
+	if response.StatusCode != 503 {
+		t.Errorf("Expected a 503 response, got %d", response.StatusCode)
+	}
+	if len(mockOps.TablesChecked) != 0 {
+		t.Errorf("Tables should not be checked if the config is invalid, got %v", mockOps.TablesChecked)
+	}
+}
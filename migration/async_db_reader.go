@@ -5,37 +5,128 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type GeneralRecord map[string]interface{}
 
 /**
-takes an untyped byte array from mysql and converts it into a string (assuming utf-8 bytes)
+takes an untyped byte array from mysql and converts it into a string (assuming utf-8 bytes).
+Queries with arguments use the binary protocol, which sends numbers as numbers, so those are formatted back into text.
 */
 func derefTypeString(value *interface{}) string {
 	if value == nil || *value == nil {
 		return ""
 	}
 
-	byteValue := (*value).([]byte)
-	return string(byteValue)
+	switch typedValue := (*value).(type) {
+	case []byte:
+		return string(typedValue)
+	case string:
+		return typedValue
+	case time.Time: //if the DSN has parseTime=true
+		return typedValue.UTC().Format(mysqlTimestampFormat)
+	default:
+		return fmt.Sprintf("%v", typedValue)
+	}
+}
+
+/*
+derefTypeBytes returns the raw bytes of a BLOB or BINARY value
+*/
+func derefTypeBytes(value *interface{}) []byte {
+	if value == nil || *value == nil {
+		return nil
+	}
+	if byteValue, isBytes := (*value).([]byte); isBytes {
+		return byteValue
+	}
+	return []byte(derefTypeString(value))
+}
+
+// layouts for DATETIME and DATE columns. The fractional seconds are optional when parsing.
+const mysqlDateTimeFormat = "2006-01-02 15:04:05.999999999"
+const mysqlDateFormat = "2006-01-02"
+
+/*
+ReadOptions limits AsyncDbReader to the rows that have changed since the last run, and/or that come after a checkpoint
+*/
+type ReadOptions struct {
+	WatermarkColumn string     //TIMESTAMP column that is updated whenever a row changes
+	Since           *time.Time //only rows with a watermark at or after this are read. nil reads every row.
+	OrderColumn     string     //if set, rows are read in order of this column rather than the watermark column
+	After           *string    //only rows with OrderColumn greater than this are read. nil reads every row.
 }
 
 /*
-AsyncDbReader scans an entire mysql table and outputs generic (typed) records of map[string]interface{}.
+ReadProgress is filled in by AsyncDbReader as it goes. It must only be read after the output stream has terminated.
+*/
+type ReadProgress struct {
+	Rows         int
+	MaxWatermark *time.Time     //highest value of the watermark column that was read, nil if no rows had one
+	Warnings     map[string]int //number of values that could not be converted, by "column (TYPE)"
+}
+
+/*
+warn logs a value that could not be converted, and counts it against the column
+*/
+func (p *ReadProgress) warn(column string, columnType string, format string, args ...interface{}) {
+	log.Printf("WARNING "+column+": "+format, args...)
+	p.Warnings[fmt.Sprintf("%s (%s)", column, columnType)]++
+}
+
+/*
+buildSelectQuery returns the query for reading a table, and its arguments.  The watermark comparison is inclusive,
+because rows updated in the same second as the last run may not have been committed when it read them; writing a row
+to Dynamo twice does no harm.
+*/
+func buildSelectQuery(tableToScan string, opts *ReadOptions) (string, []interface{}) {
+	q := fmt.Sprintf("select * from %s", tableToScan)
+	if opts == nil {
+		return q, nil
+	}
+
+	conditions := make([]string, 0, 2)
+	args := make([]interface{}, 0, 2)
+	if opts.WatermarkColumn != "" && opts.Since != nil {
+		conditions = append(conditions, opts.WatermarkColumn+" >= ?")
+		args = append(args, opts.Since.UTC().Format(mysqlTimestampFormat))
+	}
+	if opts.OrderColumn != "" && opts.After != nil {
+		conditions = append(conditions, opts.OrderColumn+" > ?")
+		args = append(args, *opts.After)
+	}
+	if len(conditions) > 0 {
+		q += " where " + strings.Join(conditions, " and ")
+	}
+
+	if opts.OrderColumn != "" {
+		q += " order by " + opts.OrderColumn
+	} else if opts.WatermarkColumn != "" {
+		q += " order by " + opts.WatermarkColumn
+	}
+	return q, args
+}
+
+/*
+AsyncDbReader scans a mysql table and outputs generic (typed) records of map[string]interface{}.
 The output stream terminates with a `nil` value if successful, or a single value in the error channel if unsuccessful.
+If `opts` is not nil then only the rows changed since opts.Since are read, and the returned ReadProgress records the
+highest watermark seen.
 
 Columns are converted to Go native data types before being output to the map.
 */
-func AsyncDbReader(db *sql.DB, tableToScan string) (chan GeneralRecord, chan error) {
+func AsyncDbReader(db *sql.DB, tableToScan string, opts *ReadOptions) (chan GeneralRecord, chan error, *ReadProgress) {
 	outputCh := make(chan GeneralRecord, 100)
 	errCh := make(chan error, 1)
+	progress := &ReadProgress{Warnings: make(map[string]int)}
 
 	go func() {
-		q := fmt.Sprintf("select * from %s", tableToScan)
+		q, args := buildSelectQuery(tableToScan, opts)
+		log.Printf("INFO AsyncDbReader running %s %v", q, args)
 
-		rowsPtr, err := db.Query(q)
+		rowsPtr, err := db.Query(q, args...)
 		if err != nil {
 			log.Printf("ERROR AsyncDbReader could not query %s: %s", tableToScan, err)
 			errCh <- err
@@ -69,13 +160,17 @@ func AsyncDbReader(db *sql.DB, tableToScan string) (chan GeneralRecord, chan err
 			}
 
 			for i, col := range columns {
+				if *(values[i].(*interface{})) == nil {
+					rec[col] = nil //NULL, which is left out of the Dynamo item unless the mapping has a default
+					continue
+				}
 				switch colTypes[i].DatabaseTypeName() {
 				case "TINYINT": //8 bit integer
 					stringValue := derefTypeString(values[i].(*interface{}))
 					if stringValue != "" {
 						bigint, err := strconv.ParseInt(stringValue, 10, 8)
 						if err != nil {
-							log.Printf("WARNING could not convert TINYINT value %s: %s", stringValue, err)
+							progress.warn(col, colTypes[i].DatabaseTypeName(), "could not convert TINYINT value %s: %s", stringValue, err)
 						}
 						rec[col] = int8(bigint)
 					}
@@ -85,17 +180,19 @@ func AsyncDbReader(db *sql.DB, tableToScan string) (chan GeneralRecord, chan err
 					if stringValue != "" {
 						bigint, err := strconv.ParseInt(stringValue, 10, 16)
 						if err != nil {
-							log.Printf("WARNING could not convert SMALLINT value %s: %s", stringValue, err)
+							progress.warn(col, colTypes[i].DatabaseTypeName(), "could not convert SMALLINT value %s: %s", stringValue, err)
 						}
 						rec[col] = int16(bigint)
 					}
 					break
+				case "MEDIUMINT": //24 bit integer
+					fallthrough
 				case "INT": //32 bit integer
 					stringValue := derefTypeString(values[i].(*interface{}))
 					if stringValue != "" {
 						bigint, err := strconv.ParseInt(stringValue, 10, 32)
 						if err != nil {
-							log.Printf("WARNING could not convert INT value %s: %s", stringValue, err)
+							progress.warn(col, colTypes[i].DatabaseTypeName(), "could not convert INT value %s: %s", stringValue, err)
 						}
 						rec[col] = int32(bigint)
 					}
@@ -105,17 +202,43 @@ func AsyncDbReader(db *sql.DB, tableToScan string) (chan GeneralRecord, chan err
 					if stringValue != "" {
 						rec[col], err = strconv.ParseInt(stringValue, 10, 64)
 						if err != nil {
-							log.Printf("WARNING could not convert INT value %s: %s", stringValue, err)
+							progress.warn(col, colTypes[i].DatabaseTypeName(), "could not convert INT value %s: %s", stringValue, err)
 						}
 					}
 					break
+				case "UNSIGNED TINYINT", "UNSIGNED SMALLINT", "UNSIGNED MEDIUMINT", "UNSIGNED INT":
+					stringValue := derefTypeString(values[i].(*interface{}))
+					rec[col], err = strconv.ParseInt(stringValue, 10, 64)
+					if err != nil {
+						progress.warn(col, colTypes[i].DatabaseTypeName(), "could not convert unsigned value %s: %s", stringValue, err)
+						delete(rec, col)
+					}
+				case "UNSIGNED BIGINT", "DECIMAL", "DOUBLE":
+					//these may not fit in an int64 or float64, so keep the exact text that MySQL sent
+					rec[col] = Decimal(derefTypeString(values[i].(*interface{})))
+				case "DATETIME", "DATE":
+					stringValue := derefTypeString(values[i].(*interface{}))
+					layout := mysqlDateTimeFormat
+					if colTypes[i].DatabaseTypeName() == "DATE" {
+						layout = mysqlDateFormat
+					}
+					timeValue, err := time.Parse(layout, stringValue)
+					if err != nil {
+						progress.warn(col, colTypes[i].DatabaseTypeName(), "invalid time value %s: %s", stringValue, err)
+					} else {
+						rec[col] = timeValue
+					}
+				case "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BINARY", "VARBINARY":
+					rec[col] = derefTypeBytes(values[i].(*interface{}))
+				case "CHAR", "TINYTEXT", "MEDIUMTEXT", "LONGTEXT", "ENUM", "SET", "JSON":
+					rec[col] = derefTypeString(values[i].(*interface{}))
 				case "TIMESTAMP":
 					//stringValue := *(values[i].(*string))
 					stringValue := derefTypeString(values[i].(*interface{}))
 
 					timeValue, err := time.Parse("2006-01-02 15:04:05", stringValue)
 					if err != nil {
-						log.Printf("WARNING invalid time value %s: %s", stringValue, err)
+						progress.warn(col, colTypes[i].DatabaseTypeName(), "invalid time value %s: %s", stringValue, err)
 					} else {
 						rec[col] = timeValue
 					}
@@ -125,7 +248,7 @@ func AsyncDbReader(db *sql.DB, tableToScan string) (chan GeneralRecord, chan err
 					if stringValue != "" {
 						floatValue, err := strconv.ParseFloat(stringValue, 64)
 						if err != nil {
-							log.Printf("WARNING invalid float value %f: %s", floatValue, err)
+							progress.warn(col, colTypes[i].DatabaseTypeName(), "invalid float value %f: %s", floatValue, err)
 						} else {
 							rec[col] = floatValue
 						}
@@ -142,14 +265,25 @@ func AsyncDbReader(db *sql.DB, tableToScan string) (chan GeneralRecord, chan err
 				//case bool:
 				//	rec[col] = t
 				default:
-					log.Printf("WARNING unrecognised type %s", colTypes[i].DatabaseTypeName())
+					progress.warn(col, colTypes[i].DatabaseTypeName(), "unrecognised type %s", colTypes[i].DatabaseTypeName())
 				}
 			}
 
+			progress.Rows++
+			if opts != nil && opts.WatermarkColumn != "" {
+				if watermark, isTime := rec[opts.WatermarkColumn].(time.Time); isTime && (progress.MaxWatermark == nil || watermark.After(*progress.MaxWatermark)) {
+					progress.MaxWatermark = &watermark
+				}
+			}
 			outputCh <- rec
 		}
+		if err := rowsPtr.Err(); err != nil {
+			log.Printf("ERROR AsyncDbReader lost connection part way through %s: %s", tableToScan, err)
+			errCh <- err
+			return
+		}
 		outputCh <- nil
 	}()
 
-	return outputCh, errCh
+	return outputCh, errCh, progress
 }
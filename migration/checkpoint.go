@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Checkpoint records how far a run has got, so that it can be resumed after a crash or an interrupt.  Rows are read in
+order of `Column`, and every row up to and including `After` is known to be in Dynamo.
+*/
+type Checkpoint struct {
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+	Column string `json:"column"`
+	After  string `json:"after"`
+}
+
+/*
+checkpointValue renders a key value from a GeneralRecord in a form that MySQL will compare correctly with the column
+*/
+func checkpointValue(value interface{}) string {
+	if timeValue, isTime := value.(time.Time); isTime {
+		return timeValue.UTC().Format(mysqlTimestampFormat)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+/*
+LoadCheckpoint reads a checkpoint file. Returns nil with no error if there is no file.
+*/
+func LoadCheckpoint(filename string) (*Checkpoint, error) {
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var checkpoint Checkpoint
+	err = json.Unmarshal(content, &checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid checkpoint file: %s", filename, err)
+	}
+	return &checkpoint, nil
+}
+
+/*
+CheckpointTracker works out the checkpoint while batches are committed in parallel.  Batches are numbered in the
+order that their rows were read, and the checkpoint only moves past a batch once it and every batch before it have
+been committed.
+*/
+type CheckpointTracker struct {
+	mutex        sync.Mutex
+	filename     string
+	checkpoint   Checkpoint
+	nextSeq      int                 //lowest batch number that has not been committed
+	committed    map[int]interface{} //batches that have been committed out of order, and their last key
+	dirty        bool
+	lastSaved    time.Time
+	saveInterval time.Duration
+}
+
+func NewCheckpointTracker(filename string, source string, dest string, column string) *CheckpointTracker {
+	return &CheckpointTracker{
+		filename:     filename,
+		checkpoint:   Checkpoint{Source: source, Dest: dest, Column: column},
+		committed:    make(map[int]interface{}),
+		saveInterval: time.Second,
+	}
+}
+
+/*
+Column returns the name of the column that rows must be ordered by
+*/
+func (t *CheckpointTracker) Column() string {
+	return t.checkpoint.Column
+}
+
+/*
+Committed records that batch number `seq`, whose last row had key `lastKey`, is in Dynamo. The checkpoint file is
+saved at most once every second, call Flush at the end to make sure that it is up to date.
+*/
+func (t *CheckpointTracker) Committed(seq int, lastKey interface{}) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.committed[seq] = lastKey
+	for {
+		key, haveNext := t.committed[t.nextSeq]
+		if !haveNext {
+			break
+		}
+		delete(t.committed, t.nextSeq)
+		t.checkpoint.After = checkpointValue(key)
+		t.nextSeq++
+		t.dirty = true
+	}
+	if t.dirty && time.Since(t.lastSaved) >= t.saveInterval {
+		return t.save()
+	}
+	return nil
+}
+
+/*
+Flush saves the checkpoint file if it has moved on since it was last saved
+*/
+func (t *CheckpointTracker) Flush() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.dirty {
+		return nil
+	}
+	return t.save()
+}
+
+func (t *CheckpointTracker) save() error {
+	content, err := json.MarshalIndent(&t.checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(t.filename, content)
+	if err != nil {
+		log.Printf("ERROR Could not save checkpoint to %s: %s", t.filename, err)
+		return err
+	}
+	t.dirty = false
+	t.lastSaved = time.Now()
+	return nil
+}
+
+/*
+Clear removes the checkpoint file once a run has completed, so that the next run starts from the beginning
+*/
+func (t *CheckpointTracker) Clear() error {
+	err := os.Remove(t.filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpointTrackerOutOfOrder(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "checkpoint.json")
+	tracker := NewCheckpointTracker(filename, "encodings", "dest", "encodingid")
+	tracker.saveInterval = 0
+
+	tracker.Committed(1, int32(50))
+	if checkpoint, _ := LoadCheckpoint(filename); checkpoint != nil {
+		t.Errorf("checkpoint should not move past an uncommitted batch, got %v", checkpoint)
+	}
+
+	tracker.Committed(0, int32(25))
+	checkpoint, err := LoadCheckpoint(filename)
+	if err != nil || checkpoint == nil {
+		t.Fatalf("expected a checkpoint, got %v", err)
+	}
+	if checkpoint.After != "50" || checkpoint.Source != "encodings" || checkpoint.Column != "encodingid" {
+		t.Errorf("unexpected checkpoint %+v", checkpoint)
+	}
+
+	err = tracker.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint, _ := LoadCheckpoint(filename); checkpoint != nil {
+		t.Error("checkpoint should have been removed")
+	}
+}
+
+func TestCheckpointValue(t *testing.T) {
+	if value := checkpointValue(time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)); value != "2022-03-04 05:06:07" {
+		t.Errorf("unexpected time value %s", value)
+	}
+	if value := checkpointValue("abc"); value != "abc" {
+		t.Errorf("unexpected string value %s", value)
+	}
+}
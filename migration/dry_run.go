@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"strings"
+)
+
+/*
+RecordValidator checks that a marshalled record can be read back by the endpoints
+*/
+type RecordValidator func(rec *RawDynamoRecord) error
+
+var recordValidators = map[string]RecordValidator{
+	"encodings": func(rec *RawDynamoRecord) error {
+		_, err := common.EncodingFromDynamo((*common.RawDynamoRecord)(rec))
+		return err
+	},
+	"idmapping": func(rec *RawDynamoRecord) error {
+		_, err := common.NewIdMappingRecord((*map[string]types.AttributeValue)(rec))
+		return err
+	},
+	"none": nil,
+}
+
+/*
+ValidatorFor returns the RecordValidator to use.  If `validateAs` is empty then it is chosen from the name of the
+source table.  Returns an error if `validateAs` is not a known record type.
+*/
+func ValidatorFor(validateAs string, sourceTable string) (RecordValidator, error) {
+	if validateAs == "" {
+		switch {
+		case strings.Contains(sourceTable, "encodings"):
+			validateAs = "encodings"
+		case strings.Contains(sourceTable, "idmapping"):
+			validateAs = "idmapping"
+		default:
+			validateAs = "none"
+		}
+	}
+	validator, known := recordValidators[validateAs]
+	if !known {
+		return nil, fmt.Errorf("don't know how to validate %s records, use encodings, idmapping or none", validateAs)
+	}
+	return validator, nil
+}
+
+/*
+DryRunReport counts what would have happened if the records had been written
+*/
+type DryRunReport struct {
+	Rows               int
+	MarshalFailures    int
+	ValidationFailures int
+}
+
+/*
+DryRun marshals every incoming record exactly as AsyncDynamoWriter would, but writes nothing.  Records that can't be
+marshalled, or that `validator` says the endpoints would not be able to read, are sent to `reportCh`, which is closed
+at the end.
+*/
+func DryRun(inputCh chan GeneralRecord, readErrCh chan error, validator RecordValidator, marshaller *RecordMarshaller, reportCh chan *ReportRow) (*DryRunReport, error) {
+	defer close(reportCh)
+	report := &DryRunReport{}
+	for {
+		var rec GeneralRecord
+		select {
+		case rec = <-inputCh:
+		case err := <-readErrCh:
+			return report, err
+		}
+		if rec == nil {
+			return report, nil
+		}
+		report.Rows++
+
+		ddbRec, err := marshaller.Marshal(&rec)
+		if err != nil {
+			report.MarshalFailures++
+			reportCh <- &ReportRow{Record: describeRecord(rec), Problem: fmt.Sprintf("could not marshal: %s", err)}
+			continue
+		}
+		if validator != nil {
+			if err := validator(ddbRec); err != nil {
+				report.ValidationFailures++
+				reportCh <- &ReportRow{Record: describeRecord(rec), Problem: fmt.Sprintf("endpoints could not read it: %s", err)}
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidatorFor(t *testing.T) {
+	validator, err := ValidatorFor("", "encodings")
+	if err != nil || validator == nil {
+		t.Errorf("expected the encodings validator from the table name, got %v", err)
+	}
+	validator, err = ValidatorFor("", "something_else")
+	if err != nil || validator != nil {
+		t.Errorf("expected no validator for an unknown table, got %v", err)
+	}
+	_, err = ValidatorFor("posterframes", "encodings")
+	if err == nil {
+		t.Error("expected an error for an unknown record type")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	validator, _ := ValidatorFor("idmapping", "")
+	lastupdate := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	inputCh := make(chan GeneralRecord, 4)
+	inputCh <- GeneralRecord{"filebase": "good", "contentid": int32(1), "lastupdate": lastupdate}
+	inputCh <- GeneralRecord{"filebase": "nodate", "contentid": int32(2)}
+	inputCh <- GeneralRecord{"filebase": "badtype", "contentid": uint(3), "lastupdate": lastupdate}
+	inputCh <- nil
+	reportCh := make(chan *ReportRow, 10)
+
+	report, err := DryRun(inputCh, make(chan error), validator, NewRecordMarshaller(nil, true, "", ""), reportCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows != 3 || report.MarshalFailures != 1 || report.ValidationFailures != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	rows := make([]*ReportRow, 0)
+	for row := range reportCh {
+		rows = append(rows, row)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 report rows, got %d", len(rows))
+	}
+	if rows[0].Record != "filebase=nodate contentid=2" {
+		t.Errorf("unexpected validation failure %+v", rows[0])
+	}
+	if rows[1].Record != "filebase=badtype contentid=3" {
+		t.Errorf("unexpected marshal failure %+v", rows[1])
+	}
+}
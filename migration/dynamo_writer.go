@@ -6,123 +6,253 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/google/uuid"
+	"github.com/aws/smithy-go"
 	"log"
-	"reflect"
+	"math/rand"
+	"sync"
 	"time"
-	"strings"
 )
 
 type RawDynamoRecord map[string]types.AttributeValue
 
-func buildPutRequests(queuePtr *[]*RawDynamoRecord) []types.WriteRequest {
-	out := make([]types.WriteRequest, len(*queuePtr))
-	for i, rec := range *queuePtr {
+// BatchWriteItem can't take more than this many items at once
+const maxBatchSize = 25
+
+/*
+BatchWriter is the part of the Dynamo client that the writer uses, so that it can be mocked in testing
+*/
+type BatchWriter interface {
+	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+/*
+Backoff works out how long to wait before retrying a batch, using exponential backoff with full jitter
+*/
+type Backoff struct {
+	Base        time.Duration
+	Max         time.Duration
+	MaxAttempts int
+}
+
+var DefaultBackoff = Backoff{Base: 50 * time.Millisecond, Max: 20 * time.Second, MaxAttempts: 12}
+
+/*
+Delay returns a random wait of up to Base*2^attempt, capped at Max. `attempt` counts from 0.
+*/
+func (b Backoff) Delay(attempt int) time.Duration {
+	ceiling := b.Max
+	if attempt < 32 {
+		if exponential := b.Base << attempt; exponential > 0 && exponential < ceiling {
+			ceiling = exponential
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+/*
+isThrottlingError returns true if Dynamo turned down a request because we are going too fast
+*/
+func isThrottlingError(err error) bool {
+	var throughputExceeded *types.ProvisionedThroughputExceededException
+	var limitExceeded *types.RequestLimitExceeded
+	if errors.As(err, &throughputExceeded) || errors.As(err, &limitExceeded) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "ThrottlingException"
+}
+
+func buildPutRequests(queue []*RawDynamoRecord) []types.WriteRequest {
+	out := make([]types.WriteRequest, len(queue))
+	for i, rec := range queue {
 		out[i] = types.WriteRequest{PutRequest: &types.PutRequest{Item: *rec}}
 	}
 	return out
 }
 
-func commitQueue(ddbClient *dynamodb.Client, ctx context.Context, queuePtr *[]*RawDynamoRecord, tableNamePtr *string) error {
+/*
+commitQueue writes a batch of records.  Items that Dynamo leaves unprocessed, and throttled requests, are retried
+after a backoff.  Any other error is returned straight away.
+*/
+func commitQueue(ctx context.Context, ddbClient BatchWriter, queue []*RawDynamoRecord, tableNamePtr *string, backoff Backoff) error {
 	var requestItems = map[string][]types.WriteRequest{
-		*tableNamePtr: buildPutRequests(queuePtr),
+		*tableNamePtr: buildPutRequests(queue),
 	}
 
-	for {
-		log.Printf("INFO commitQueue committing %d records to dynamo", len(*queuePtr))
-		req := &dynamodb.BatchWriteItemInput{
+	for attempt := 0; ; attempt++ {
+		log.Printf("INFO commitQueue committing %d records to dynamo", len(requestItems[*tableNamePtr]))
+		response, err := ddbClient.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
 			RequestItems: requestItems,
-		}
-
-		response, err := ddbClient.BatchWriteItem(ctx, req)
-		if err != nil {
-			log.Printf("ERROR commitQueue could not commit %d records: %s", len(*queuePtr), err)
+		})
+		if err != nil && !isThrottlingError(err) {
+			log.Printf("ERROR commitQueue could not commit %d records: %s", len(queue), err)
 			return err
 		}
-
-		if len(response.UnprocessedItems) > 0 {
+		if err == nil {
+			if len(response.UnprocessedItems) == 0 {
+				log.Printf("INFO commitQueue completed")
+				return nil
+			}
 			requestItems = response.UnprocessedItems
-		} else {
-			log.Printf("INFO commitQueue completed")
-			break
+		}
+
+		if attempt+1 >= backoff.MaxAttempts {
+			return fmt.Errorf("gave up after %d attempts to commit %d records", backoff.MaxAttempts, len(queue))
+		}
+		delay := backoff.Delay(attempt)
+		log.Printf("WARNING commitQueue throttled, retrying %d records in %s", len(requestItems[*tableNamePtr]), delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
-	return nil
 }
 
-func newWriteQueue() []*RawDynamoRecord {
-	return make([]*RawDynamoRecord, 0)
+/*
+WriterOptions configures AsyncDynamoWriter
+*/
+type WriterOptions struct {
+	Marshaller  *RecordMarshaller
+	Parallel    int //number of batches to write at once
+	Backoff     Backoff
+	Checkpoints *CheckpointTracker //nil if not checkpointing
+}
+
+type writeBatch struct {
+	seq     int
+	records []*RawDynamoRecord
+	lastKey interface{} //value of the checkpoint column in the last record
 }
 
-/**
-marshalGeneralRecord marshals a `GeneralRecord` structure from the sql reader into a DynamoDB record,
-setting the types appropriately
+/*
+ErrInterrupted is returned by AsyncDynamoWriter when its context is cancelled. Everything that was read before the
+cancellation has been written.
 */
-func marshalGeneralRecord(in *GeneralRecord, addUUID bool, nullableKeyFields string) (*RawDynamoRecord, error) {
-	output := make(RawDynamoRecord, 0)
-	for k, v := range *in {
-		var val types.AttributeValue
-		switch typeValue := v.(type) {
-		case int8:
-			val = &types.AttributeValueMemberBOOL{Value: typeValue != 0}
-		case int16:
-			val = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", typeValue)}
-		case int32:
-			val = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", typeValue)}
-		case int64:
-			val = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", typeValue)}
-		case float64:
-			val = &types.AttributeValueMemberN{Value: fmt.Sprintf("%f", typeValue)}
-		case string:
-			if ((v == "") && (strings.Contains(nullableKeyFields, k))) {
-				val = &types.AttributeValueMemberS{Value: "ABSENT"}
-			} else {
-				val = &types.AttributeValueMemberS{Value: typeValue}
+var ErrInterrupted = errors.New("interrupted")
+
+/*
+batchRecords marshals the incoming records into batches, until the input ends or ctx is cancelled.  When ctx is
+cancelled the partial batch is still sent, so that everything that has been read gets written.
+*/
+func batchRecords(ctx context.Context, inputCh chan GeneralRecord, batchCh chan *writeBatch, opts *WriterOptions) error {
+	defer close(batchCh)
+	seq := 0
+	batch := &writeBatch{records: make([]*RawDynamoRecord, 0, maxBatchSize)}
+	sendBatch := func() {
+		if len(batch.records) > 0 {
+			batchCh <- batch
+			seq++
+			batch = &writeBatch{seq: seq, records: make([]*RawDynamoRecord, 0, maxBatchSize)}
+		}
+	}
+
+	for {
+		var rec GeneralRecord
+		select {
+		case rec = <-inputCh:
+		case <-ctx.Done():
+			log.Printf("INFO AsyncDynamoWriter stopping, flushing %d queued records", len(batch.records))
+			sendBatch()
+			return ErrInterrupted
+		}
+		if rec == nil {
+			sendBatch()
+			return nil
+		}
+
+		ddbRec, err := opts.Marshaller.Marshal(&rec)
+		if err != nil {
+			log.Printf("ERROR Could not marshal %v: %s", rec, err)
+			sendBatch()
+			return err
+		}
+		if opts.Checkpoints != nil {
+			key, haveKey := rec[opts.Checkpoints.Column()]
+			if !haveKey {
+				sendBatch()
+				return fmt.Errorf("record %v has no %s to checkpoint on", rec, opts.Checkpoints.Column())
 			}
-		case time.Time:
-			val = &types.AttributeValueMemberS{Value: typeValue.Format(time.RFC3339)}
-		default:
-			return nil, errors.New(fmt.Sprintf("unknown type %s for value %v in column %s", reflect.TypeOf(v), v, k))
+			batch.lastKey = key
+		}
+		batch.records = append(batch.records, ddbRec)
+		if len(batch.records) >= maxBatchSize {
+			sendBatch()
 		}
-		output[k] = val
 	}
-	if addUUID {
-		uid, _ := uuid.NewRandom()
-		output["uuid"] = &types.AttributeValueMemberS{Value: uid.String()}
+}
+
+/*
+startBatchWriters starts `parallel` goroutines that commit every batch from batchCh, and tell `checkpoints` (if it is
+not nil) about each one.  Errors are passed to onError, and the writers carry on with the next batch.  The returned
+WaitGroup is done once batchCh has been closed and everything in it has been dealt with.
+*/
+func startBatchWriters(batchCh chan *writeBatch, ddbClient BatchWriter, tableNamePtr *string, parallel int, backoff Backoff, checkpoints *CheckpointTracker, onError func(error)) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	wg.Add(parallel)
+	for i := 0; i < parallel; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range batchCh {
+				//deliberately not a cancellable context, so that an interrupt doesn't lose batches that have already been read
+				err := commitQueue(context.Background(), ddbClient, batch.records, tableNamePtr, backoff)
+				if err != nil {
+					onError(err)
+					continue //the checkpoint can't move past this batch now, but the others are still worth writing
+				}
+				if checkpoints != nil {
+					if err := checkpoints.Committed(batch.seq, batch.lastKey); err != nil {
+						onError(err)
+					}
+				}
+			}
+		}()
 	}
-	return &output, nil
+	return wg
 }
 
-func AsyncDynamoWriter(inputCh chan GeneralRecord, ddbClient *dynamodb.Client, tableNamePtr *string, addUUID bool, nullableKeyFields string) chan error {
+/*
+AsyncDynamoWriter writes every record from inputCh to the given table, using opts.Parallel goroutines.  The input
+stream must be terminated by a `nil`.  The returned channel gets a single value once everything has been written:
+nil on success, ErrInterrupted if ctx was cancelled, or the first error that happened.
+
+Writes carry on after ctx is cancelled until everything that has been read is in Dynamo; cancelling ctx only stops
+more records being taken from inputCh.
+*/
+func AsyncDynamoWriter(ctx context.Context, inputCh chan GeneralRecord, ddbClient BatchWriter, tableNamePtr *string, opts *WriterOptions) chan error {
 	errCh := make(chan error, 1)
+	batchCh := make(chan *writeBatch, opts.Parallel)
+	stopCtx, stop := context.WithCancel(ctx)
 
-	go func() {
-		writeQueue := newWriteQueue()
-		for {
-			rec := <-inputCh
-			if rec == nil {
-				err := commitQueue(ddbClient, context.Background(), &writeQueue, tableNamePtr)
-				errCh <- err //will be nil if there is no error
-				return
-			}
+	var firstErr error
+	var errMutex sync.Mutex
+	recordError := func(err error) {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		stop()
+	}
 
-			ddbRec, err := marshalGeneralRecord(&rec, addUUID, nullableKeyFields)
-			if err != nil {
-				log.Printf("ERROR Could not marshal %v: %s", rec, err)
-				errCh <- err
-				return
-			}
+	wg := startBatchWriters(batchCh, ddbClient, tableNamePtr, opts.Parallel, opts.Backoff, opts.Checkpoints, recordError)
 
-			writeQueue = append(writeQueue, ddbRec)
-			if len(writeQueue) >= 25 {
-				err := commitQueue(ddbClient, context.Background(), &writeQueue, tableNamePtr)
-				if err != nil {
-					errCh <- err
-					return
-				}
-				writeQueue = newWriteQueue()
+	go func() {
+		batchErr := batchRecords(stopCtx, inputCh, batchCh, opts)
+		wg.Wait()
+		stop()
+		if opts.Checkpoints != nil {
+			if err := opts.Checkpoints.Flush(); err != nil {
+				recordError(err)
 			}
 		}
+		if firstErr == nil && batchErr != nil {
+			firstErr = batchErr
+		}
+		errCh <- firstErr //will be nil if there is no error
 	}()
 	return errCh
 }
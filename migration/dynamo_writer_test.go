@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testBackoff = Backoff{Base: time.Millisecond, Max: 5 * time.Millisecond, MaxAttempts: 4}
+
+/*
+batchWriterMock records everything that is written. The first `unprocessedCalls` calls leave their last item
+unprocessed, and the first `throttledCalls` calls after that are throttled.
+*/
+type batchWriterMock struct {
+	mutex            sync.Mutex
+	calls            int
+	unprocessedCalls int
+	throttledCalls   int
+	err              error
+	written          []RawDynamoRecord
+}
+
+func (m *batchWriterMock) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.calls++
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.calls <= m.unprocessedCalls {
+		unprocessed := make(map[string][]types.WriteRequest)
+		for table, requests := range params.RequestItems {
+			last := len(requests) - 1
+			for _, rq := range requests[:last] {
+				m.written = append(m.written, rq.PutRequest.Item)
+			}
+			unprocessed[table] = requests[last:]
+		}
+		return &dynamodb.BatchWriteItemOutput{UnprocessedItems: unprocessed}, nil
+	}
+	if m.calls <= m.unprocessedCalls+m.throttledCalls {
+		return nil, &types.ProvisionedThroughputExceededException{}
+	}
+	for _, requests := range params.RequestItems {
+		for _, rq := range requests {
+			m.written = append(m.written, rq.PutRequest.Item)
+		}
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func testQueue(n int) []*RawDynamoRecord {
+	queue := make([]*RawDynamoRecord, n)
+	for i := range queue {
+		queue[i] = &RawDynamoRecord{"id": &types.AttributeValueMemberN{Value: "1"}}
+	}
+	return queue
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Base: 10 * time.Millisecond, Max: 100 * time.Millisecond}
+	for attempt := 0; attempt < 40; attempt++ {
+		ceiling := 100 * time.Millisecond
+		if attempt < 4 {
+			ceiling = (10 * time.Millisecond) << attempt
+		}
+		for i := 0; i < 20; i++ {
+			if delay := b.Delay(attempt); delay < 0 || delay >= ceiling {
+				t.Errorf("attempt %d gave delay %s, expected under %s", attempt, delay, ceiling)
+			}
+		}
+	}
+}
+
+func TestCommitQueueRetries(t *testing.T) {
+	tableName := "test"
+	mock := &batchWriterMock{unprocessedCalls: 1, throttledCalls: 1}
+	err := commitQueue(context.Background(), mock, testQueue(5), &tableName, testBackoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mock.calls != 3 {
+		t.Errorf("expected 3 calls, got %d", mock.calls)
+	}
+	if len(mock.written) != 5 {
+		t.Errorf("expected 5 records written, got %d", len(mock.written))
+	}
+}
+
+func TestCommitQueueGivesUp(t *testing.T) {
+	tableName := "test"
+	mock := &batchWriterMock{throttledCalls: 100}
+	err := commitQueue(context.Background(), mock, testQueue(5), &tableName, testBackoff)
+	if err == nil {
+		t.Error("expected an error when always throttled")
+	}
+	if mock.calls != testBackoff.MaxAttempts {
+		t.Errorf("expected %d calls, got %d", testBackoff.MaxAttempts, mock.calls)
+	}
+}
+
+func TestCommitQueueOtherError(t *testing.T) {
+	tableName := "test"
+	mock := &batchWriterMock{err: errors.New("kaboom")}
+	err := commitQueue(context.Background(), mock, testQueue(5), &tableName, testBackoff)
+	if err == nil || mock.calls != 1 {
+		t.Errorf("expected an error without retrying, got %v after %d calls", err, mock.calls)
+	}
+}
+
+func TestAsyncDynamoWriter(t *testing.T) {
+	tableName := "test"
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	tracker := NewCheckpointTracker(checkpointFile, "encodings", "test", "encodingid")
+	mock := &batchWriterMock{throttledCalls: 2}
+
+	inputCh := make(chan GeneralRecord, 101)
+	for i := 1; i <= 100; i++ {
+		inputCh <- GeneralRecord{"encodingid": int32(i)}
+	}
+	inputCh <- nil
+
+	opts := &WriterOptions{Marshaller: NewRecordMarshaller(nil, false, "", ""), Parallel: 3, Backoff: testBackoff, Checkpoints: tracker}
+	err := <-AsyncDynamoWriter(context.Background(), inputCh, mock, &tableName, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.written) != 100 {
+		t.Errorf("expected 100 records written, got %d", len(mock.written))
+	}
+	checkpoint, err := LoadCheckpoint(checkpointFile)
+	if err != nil || checkpoint == nil {
+		t.Fatalf("expected a checkpoint, got %v", err)
+	}
+	if checkpoint.After != "100" {
+		t.Errorf("expected checkpoint after 100, got %s", checkpoint.After)
+	}
+}
+
+func TestAsyncDynamoWriterInterrupted(t *testing.T) {
+	tableName := "test"
+	mock := &batchWriterMock{}
+
+	inputCh := make(chan GeneralRecord, 10)
+	for i := 1; i <= 10; i++ {
+		inputCh <- GeneralRecord{"encodingid": int32(i)}
+	}
+	//no terminating nil, so the writer would wait forever without the interrupt
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := AsyncDynamoWriter(ctx, inputCh, mock, &tableName, &WriterOptions{Marshaller: NewRecordMarshaller(nil, false, "", ""), Parallel: 2, Backoff: testBackoff})
+	for len(inputCh) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	err := <-errCh
+	if !errors.Is(err, ErrInterrupted) {
+		t.Errorf("expected ErrInterrupted, got %v", err)
+	}
+	if len(mock.written) != 10 {
+		t.Errorf("expected the queued records to be flushed, got %d", len(mock.written))
+	}
+}
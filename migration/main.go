@@ -3,51 +3,200 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/google/uuid"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
-func processTable(db *sql.DB, tableName string, ddbClient *dynamodb.Client, outputTableName *string, addUuid bool, nullableKeyFields string) error {
-	recordsCh, errCh := AsyncDbReader(db, tableName)
-	writeErrCh := AsyncDynamoWriter(recordsCh, ddbClient, outputTableName, addUuid, nullableKeyFields)
+func processTable(ctx context.Context, db *sql.DB, tableName string, readOpts *ReadOptions, ddbClient *dynamodb.Client, outputTableName *string, writerOpts *WriterOptions) (*ReadProgress, error) {
+	recordsCh, errCh, progress := AsyncDbReader(db, tableName, readOpts)
+	writeCtx, stopWriting := context.WithCancel(ctx)
+	defer stopWriting()
+	writeErrCh := AsyncDynamoWriter(writeCtx, recordsCh, ddbClient, outputTableName, writerOpts)
 
 	for {
 		select {
-		//case rec := <-recordsCh:
-		//	if rec == nil {
-		//		log.Print("All done")
-		//		return nil
-		//	}
-		//
-		//	log.Printf("DEBUG processTable got %v", rec)
-		//	break
 		case err := <-writeErrCh:
 			if err == nil {
-				log.Print("All done")
-				return nil
+				log.Printf("All done, copied %d rows", progress.Rows)
+				return progress, nil
 			}
 			log.Printf("ERROR processTable got error %s", err)
-			return err
+			return nil, err
 		case err := <-errCh:
 			log.Printf("DEBUG processTable got error %s", err)
-			return err
+			//let the writer finish what it has, so that the checkpoint is as far on as possible
+			stopWriting()
+			<-writeErrCh
+			return nil, err
 		}
 	}
 }
 
+/*
+dryRunTable marshals and validates every row of the table without writing anything, and reports problems to a CSV file
+*/
+func dryRunTable(db *sql.DB, tableName string, readOpts *ReadOptions, validator RecordValidator, marshaller *RecordMarshaller, reportFile string) (bool, error) {
+	recordsCh, errCh, progress := AsyncDbReader(db, tableName, readOpts)
+	reportCh := make(chan *ReportRow, 100)
+	reportErrCh := AsyncReportWriter(reportCh, reportFile)
+
+	report, err := DryRun(recordsCh, errCh, validator, marshaller, reportCh)
+	if reportErr := <-reportErrCh; reportErr != nil {
+		log.Printf("ERROR Could not write report to %s: %s", reportFile, reportErr)
+	}
+	if err != nil {
+		return false, err
+	}
+	logWarnings(progress)
+	log.Printf("INFO Dry run read %d rows: %d could not be marshalled, %d could not be read by the endpoints, %d conversion warnings. Details are in %s",
+		report.Rows, report.MarshalFailures, report.ValidationFailures, totalWarnings(progress), reportFile)
+	return report.MarshalFailures == 0 && report.ValidationFailures == 0, nil
+}
+
+/*
+verifyTable compares every row of the table with what is in Dynamo, and reports differences to a CSV file
+*/
+func verifyTable(db *sql.DB, tableName string, readOpts *ReadOptions, ddbClient *dynamodb.Client, outputTableName *string, indexName string, marshaller *RecordMarshaller, ignore map[string]bool, reportFile string) (bool, error) {
+	finder, err := NewDynamoItemFinder(context.Background(), ddbClient, outputTableName, indexName)
+	if err != nil {
+		return false, err
+	}
+	recordsCh, errCh, _ := AsyncDbReader(db, tableName, readOpts)
+	reportCh := make(chan *ReportRow, 100)
+	reportErrCh := AsyncReportWriter(reportCh, reportFile)
+
+	report, err := Verify(context.Background(), recordsCh, errCh, finder, marshaller, ignore, reportCh)
+	if reportErr := <-reportErrCh; reportErr != nil {
+		log.Printf("ERROR Could not write report to %s: %s", reportFile, reportErr)
+	}
+	if err != nil {
+		return false, err
+	}
+	log.Printf("INFO Verified %d rows: %d match, %d are different, %d are missing from dynamo, %d could not be checked. Details are in %s",
+		report.Rows, report.Matched, report.Mismatched, report.Missing, report.Failed, reportFile)
+	return report.Matched == report.Rows, nil
+}
+
+func totalWarnings(progress *ReadProgress) int {
+	total := 0
+	for _, count := range progress.Warnings {
+		total += count
+	}
+	return total
+}
+
+/*
+exportCommand implements `migration export`, which dumps a Dynamo table to a JSON Lines snapshot
+*/
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	tableName := flags.String("table", "", "dynamodb table to export, e.g. the encodings, idmapping, mime_equivalents or posterframes table")
+	outputFile := flags.String("out", "", "file to write, - for stdout. Names ending in .gz are compressed")
+	pageSize := flags.Int("s", 500, "page size for retrieval")
+	flags.Parse(args)
+	if *tableName == "" || *outputFile == "" {
+		log.Fatal("export needs -table and -out")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	out, finish, err := openSnapshotForWrite(*outputFile)
+	if err != nil {
+		log.Fatalf("Could not open %s: %s", *outputFile, err)
+	}
+	count, err := ExportTable(context.Background(), dynamodb.NewFromConfig(cfg), tableName, out, int32(*pageSize))
+	if finishErr := finish(); err == nil {
+		err = finishErr
+	}
+	if err != nil {
+		log.Fatalf("Export failed after %d items: %s", count, err)
+	}
+	log.Printf("INFO Exported %d items from %s to %s", count, *tableName, *outputFile)
+}
+
+/*
+importCommand implements `migration import`, which loads a JSON Lines snapshot into a Dynamo table
+*/
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	tableName := flags.String("table", "", "dynamodb table to write to. Existing items with the same key are overwritten.")
+	inputFile := flags.String("in", "", "snapshot file to read, - for stdin. Names ending in .gz are decompressed")
+	parallel := flags.Int("parallel", 4, "number of batches to write to dynamo at once")
+	maxAttempts := flags.Int("max-attempts", DefaultBackoff.MaxAttempts, "number of times to try a throttled batch before giving up")
+	flags.Parse(args)
+	if *tableName == "" || *inputFile == "" {
+		log.Fatal("import needs -table and -in")
+	}
+	if *parallel < 1 {
+		log.Fatal("-parallel must be at least 1")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+	in, finish, err := openSnapshotForRead(*inputFile)
+	if err != nil {
+		log.Fatalf("Could not open %s: %s", *inputFile, err)
+	}
+	defer finish()
+
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	backoff := DefaultBackoff
+	backoff.MaxAttempts = *maxAttempts
+	count, err := ImportSnapshot(ctx, in, dynamodb.NewFromConfig(cfg), tableName, *parallel, backoff)
+	if err != nil {
+		log.Fatalf("Import failed after reading %d items: %s", count, err)
+	}
+	log.Printf("INFO Imported %d items from %s into %s", count, *inputFile, *tableName)
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			exportCommand(os.Args[2:])
+			return
+		case "import":
+			importCommand(os.Args[2:])
+			return
+		}
+	}
+
 	dsn := flag.String("dsn", "", "MySQL DSN in the form [username[:password]@][protocol[(address)]]/dbname. See https://github.com/go-sql-driver/mysql for details.")
 	sourceTable := flag.String("source", "idmapping", "table to read from the SQL database")
 	destTable := flag.String("dest", "", "dynamodb table to write to")
 	addUUID := flag.Bool("add-uuid", false, "add a uniquely generated id if this is specified")
+	uuidFrom := flag.String("uuid-from", "", "add a uuid made from the value of this column, e.g. the primary key, so that it is the same every run")
 	nullableKeyFields := flag.String("nullable-fields", "", "A comma separated list of fields that can be null")
+	mappingFile := flag.String("mapping", "", "json file describing how to map the source columns to dynamo attributes")
+	incremental := flag.Bool("incremental", false, "only copy rows that have changed since the last incremental run")
+	stateFile := flag.String("state-file", "migration-state.json", "file that records how far incremental runs have got")
+	watermarkColumn := flag.String("watermark-column", "lastupdate", "TIMESTAMP column that shows when a row last changed, for -incremental")
+	dryRun := flag.Bool("dry-run", false, "marshal and check every row, but don't write anything")
+	verify := flag.Bool("verify", false, "compare every row with what is already in the dest table, and don't write anything")
+	reportFile := flag.String("report", "migration-report.csv", "CSV file for the -dry-run or -verify report")
+	validateAs := flag.String("validate-as", "", "for -dry-run, check that rows can be read as encodings, idmapping or none. Defaults to the source table name")
+	verifyIndex := flag.String("verify-index", "", "for -verify, find the items through this index of the dest table rather than its key")
+	verifyIgnore := flag.String("verify-ignore", "uuid,withdrawn_at,withdrawn_reason,url_broken_at,url_broken_reason", "for -verify, comma separated list of fields that are only set in dynamo")
+	parallel := flag.Int("parallel", 4, "number of batches to write to dynamo at once")
+	maxAttempts := flag.Int("max-attempts", DefaultBackoff.MaxAttempts, "number of times to try a throttled batch before giving up")
+	checkpointColumn := flag.String("checkpoint-column", "", "unique column to read rows in order of, so that the run can be resumed. Usually the primary key.")
+	checkpointFile := flag.String("checkpoint-file", "migration-checkpoint.json", "file that records how far this run has got, with -checkpoint-column")
+	resume := flag.Bool("resume", false, "carry on from the checkpoint left by a run that failed or was interrupted")
 	flag.Parse()
 
 	uuid.EnableRandPool()
@@ -55,6 +204,78 @@ func main() {
 	if *dsn == "" {
 		log.Fatal("You need to specify -dsn on the commandline. Use --help for more options.")
 	}
+	if *dryRun && *verify {
+		log.Fatal("Use either -dry-run or -verify, not both")
+	}
+	if *destTable == "" && !*dryRun {
+		log.Fatal("You need to specify -dest on the commandline")
+	}
+	var mapping *TableMapping
+	if *mappingFile != "" {
+		loaded, err := LoadTableMapping(*mappingFile)
+		if err != nil {
+			log.Fatalf("Could not load column mapping: %s", err)
+		}
+		mapping = loaded
+	}
+	if *addUUID && *uuidFrom != "" {
+		log.Fatal("Use either -add-uuid or -uuid-from, not both")
+	}
+	marshaller := NewRecordMarshaller(mapping, *addUUID, *uuidFrom, *nullableKeyFields)
+
+	validator, err := ValidatorFor(*validateAs, *sourceTable)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *resume && *checkpointColumn == "" {
+		log.Fatal("-resume needs -checkpoint-column")
+	}
+	if *parallel < 1 {
+		log.Fatal("-parallel must be at least 1")
+	}
+	if *incremental && marshaller.GeneratesIds() && !*dryRun && !*verify {
+		//every run would give the changed rows a new uuid, so they would be duplicated rather than updated
+		log.Fatal("-incremental can't be used with -add-uuid, or a mapping that derives a random uuid. Use -uuid-from instead")
+	}
+
+	var readOpts *ReadOptions
+	var state *WatermarkState
+	if *incremental {
+		loaded, err := LoadWatermarkState(*stateFile)
+		if err != nil {
+			log.Fatalf("Could not load incremental state: %s", err)
+		}
+		state = loaded
+		readOpts = &ReadOptions{WatermarkColumn: *watermarkColumn, Since: state.Since(*sourceTable)}
+		if readOpts.Since == nil {
+			log.Printf("INFO No watermark for %s in %s, copying everything", *sourceTable, *stateFile)
+		} else {
+			log.Printf("INFO Reading rows of %s changed since %s", *sourceTable, readOpts.Since.Format(time.RFC3339))
+		}
+	}
+
+	var checkpoints *CheckpointTracker
+	if *checkpointColumn != "" && !*dryRun && !*verify {
+		checkpoints = NewCheckpointTracker(*checkpointFile, *sourceTable, *destTable, *checkpointColumn)
+		if readOpts == nil {
+			readOpts = &ReadOptions{}
+		}
+		readOpts.OrderColumn = *checkpointColumn
+	}
+	if *resume && checkpoints != nil {
+		checkpoint, err := LoadCheckpoint(*checkpointFile)
+		if err != nil {
+			log.Fatalf("Could not load checkpoint: %s", err)
+		}
+		if checkpoint == nil {
+			log.Printf("INFO There is no checkpoint in %s, starting from the beginning", *checkpointFile)
+		} else if checkpoint.Source != *sourceTable || checkpoint.Dest != *destTable || checkpoint.Column != *checkpointColumn {
+			log.Fatalf("The checkpoint in %s is for %s -> %s on %s, not this run", *checkpointFile, checkpoint.Source, checkpoint.Dest, checkpoint.Column)
+		} else {
+			log.Printf("INFO Resuming from %s > %s", checkpoint.Column, checkpoint.After)
+			readOpts.After = &checkpoint.After
+		}
+	}
 
 	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
@@ -72,10 +293,62 @@ func main() {
 	db.SetMaxOpenConns(10)
 	db.SetMaxIdleConns(10)
 
-	err = processTable(db, *sourceTable, ddbClient, destTable, *addUUID, *nullableKeyFields)
+	if *dryRun || *verify {
+		var clean bool
+		if *dryRun {
+			clean, err = dryRunTable(db, *sourceTable, readOpts, validator, marshaller, *reportFile)
+		} else {
+			clean, err = verifyTable(db, *sourceTable, readOpts, ddbClient, destTable, *verifyIndex, marshaller, ParseIgnoreList(*verifyIgnore), *reportFile)
+		}
+		if err != nil {
+			log.Fatalf("Error exit: %s", err)
+		}
+		//nothing was written, so the watermark stays where it was
+		if !clean {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	//the first interrupt stops reading and lets the rows that have been read be written. A second one kills us.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stopSignals()
+	}()
+
+	writerOpts := &WriterOptions{
+		Marshaller:  marshaller,
+		Parallel:    *parallel,
+		Backoff:     DefaultBackoff,
+		Checkpoints: checkpoints,
+	}
+	writerOpts.Backoff.MaxAttempts = *maxAttempts
+
+	progress, err := processTable(ctx, db, *sourceTable, readOpts, ddbClient, destTable, writerOpts)
 	if err != nil {
+		if checkpoints != nil {
+			log.Printf("INFO Run again with -resume to carry on from the checkpoint in %s", *checkpointFile)
+		}
+		if errors.Is(err, ErrInterrupted) {
+			log.Print("Interrupted")
+			os.Exit(130)
+		}
 		log.Fatal("Error exit")
-	} else {
-		os.Exit(0)
 	}
+	if checkpoints != nil {
+		if err := checkpoints.Clear(); err != nil {
+			log.Printf("WARNING Could not remove %s: %s", *checkpointFile, err)
+		}
+	}
+	//the watermark is only saved once everything up to it is in Dynamo, so a failed run is simply repeated
+	if state != nil && progress.MaxWatermark != nil {
+		state.Advance(*sourceTable, *progress.MaxWatermark)
+		err = state.Save(*stateFile)
+		if err != nil {
+			log.Fatalf("Rows were copied but the watermark could not be saved to %s: %s", *stateFile, err)
+		}
+		log.Printf("INFO Watermark for %s is now %s", *sourceTable, progress.MaxWatermark.Format(time.RFC3339))
+	}
+	os.Exit(0)
 }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Decimal is a DECIMAL or DOUBLE value from MySQL, kept as the text that MySQL sent so that no precision is lost
+*/
+type Decimal string
+
+// the Dynamo types that a column can be converted to
+const (
+	AttributeTypeString = "S"
+	AttributeTypeNumber = "N"
+	AttributeTypeBool   = "BOOL"
+	AttributeTypeBinary = "B"
+)
+
+/*
+ColumnMapping says what to do with one source column.  Everything is optional.
+*/
+type ColumnMapping struct {
+	Attribute   string      `json:"attribute,omitempty"`     //name of the Dynamo attribute, if different from the column
+	Type        string      `json:"type,omitempty"`          //one of the AttributeType constants. Defaults to the natural type of the column.
+	TimeFormat  string      `json:"time_format,omitempty"`   //Go layout for writing times as strings, or "unix" for numbers. Defaults to RFC3339.
+	Default     interface{} `json:"default,omitempty"`       //value to write when the column is NULL. Without one, NULLs are left out.
+	EmptyIsNull bool        `json:"empty_is_null,omitempty"` //treat empty strings as NULL
+	Skip        bool        `json:"skip,omitempty"`          //leave the column out altogether
+}
+
+/*
+TableMapping describes how the rows of one source table become Dynamo items.  It is loaded from a json file, e.g.
+
+	{
+	  "columns": {
+	    "id": {"skip": true},
+	    "mobile": {"type": "BOOL"},
+	    "title_id": {"attribute": "octopus_id", "type": "N"},
+	    "vcodec": {"default": "ABSENT", "empty_is_null": true}
+	  },
+	  "derived": {"uuid": "uuid"}
+	}
+*/
+type TableMapping struct {
+	Columns map[string]*ColumnMapping `json:"columns"`
+	Derived map[string]string         `json:"derived"`        //attribute name -> generator, see derivedGenerators
+	Only    bool                      `json:"only,omitempty"` //if true, columns that are not in Columns are skipped
+}
+
+/*
+derivedUuidFromPrefix starts a generator that makes a uuid from the value of a source column, e.g. "uuid-from:id".
+The same value always gives the same uuid, so copying a row again updates its item rather than adding another one.
+*/
+const derivedUuidFromPrefix = "uuid-from:"
+
+// namespace for the uuids made by "uuid-from:" generators
+var derivedUuidNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/guardian/new-encodings-endpoints/migration"))
+
+// generators for derived attributes, which are not in the source table at all
+var derivedGenerators = map[string]func() types.AttributeValue{
+	"uuid": func() types.AttributeValue {
+		uid, _ := uuid.NewRandom()
+		return &types.AttributeValueMemberS{Value: uid.String()}
+	},
+	"now": func() types.AttributeValue {
+		return &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+	},
+}
+
+/*
+LoadTableMapping reads a mapping file and checks that it makes sense
+*/
+func LoadTableMapping(filename string) (*TableMapping, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var mapping TableMapping
+	decoder := json.NewDecoder(strings.NewReader(string(content)))
+	decoder.DisallowUnknownFields() //so that a typo doesn't silently do nothing
+	decoder.UseNumber()
+	err = decoder.Decode(&mapping)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid mapping file: %s", filename, err)
+	}
+	err = mapping.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return &mapping, nil
+}
+
+func (m *TableMapping) validate() error {
+	for col, colMapping := range m.Columns {
+		switch colMapping.Type {
+		case "", AttributeTypeString, AttributeTypeNumber, AttributeTypeBool, AttributeTypeBinary:
+		default:
+			return fmt.Errorf("column %s has unknown type %s", col, colMapping.Type)
+		}
+	}
+	for attribute, generator := range m.Derived {
+		if strings.HasPrefix(generator, derivedUuidFromPrefix) {
+			if strings.TrimPrefix(generator, derivedUuidFromPrefix) == "" {
+				return fmt.Errorf("derived attribute %s needs a column name after %s", attribute, derivedUuidFromPrefix)
+			}
+			continue
+		}
+		if _, known := derivedGenerators[generator]; !known {
+			return fmt.Errorf("derived attribute %s has unknown generator %s", attribute, generator)
+		}
+	}
+	return nil
+}
+
+/*
+RecordMarshaller turns GeneralRecords from the sql reader into Dynamo items, following a TableMapping
+*/
+type RecordMarshaller struct {
+	mapping *TableMapping
+}
+
+/*
+NewRecordMarshaller combines a mapping file (which can be nil) with the older commandline options.  `-add-uuid` is
+the same as deriving `uuid`, `-uuid-from {column}` is the same as deriving `uuid` from that column, and each of
+`-nullable-fields` defaults to "ABSENT" when it is NULL or empty.  The mapping file wins if it says something different.
+*/
+func NewRecordMarshaller(mapping *TableMapping, addUUID bool, uuidFrom string, nullableKeyFields string) *RecordMarshaller {
+	combined := &TableMapping{Columns: make(map[string]*ColumnMapping), Derived: make(map[string]string)}
+	if addUUID {
+		combined.Derived["uuid"] = "uuid"
+	}
+	if uuidFrom != "" {
+		combined.Derived["uuid"] = derivedUuidFromPrefix + uuidFrom
+	}
+	for _, field := range strings.Split(nullableKeyFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			combined.Columns[field] = &ColumnMapping{Default: "ABSENT", EmptyIsNull: true}
+		}
+	}
+	if mapping != nil {
+		for col, colMapping := range mapping.Columns {
+			combined.Columns[col] = colMapping
+		}
+		for attribute, generator := range mapping.Derived {
+			combined.Derived[attribute] = generator
+		}
+		combined.Only = mapping.Only
+	}
+	return &RecordMarshaller{mapping: combined}
+}
+
+/*
+GeneratesIds returns true if any attribute is derived from a random generator, so that writing the same row twice
+creates two items rather than updating one.  "uuid-from:" generators don't count, since they always give the same uuid
+for the same row.
+*/
+func (m *RecordMarshaller) GeneratesIds() bool {
+	for _, generator := range m.mapping.Derived {
+		if generator == "uuid" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Marshal converts a record, including the derived attributes
+*/
+func (m *RecordMarshaller) Marshal(in *GeneralRecord) (*RawDynamoRecord, error) {
+	return m.marshal(in, true)
+}
+
+/*
+MarshalWithoutDerived converts a record, leaving out the derived attributes. This is used to compare a source row with
+what is already in Dynamo, where the derived attributes will always be different.
+*/
+func (m *RecordMarshaller) MarshalWithoutDerived(in *GeneralRecord) (*RawDynamoRecord, error) {
+	return m.marshal(in, false)
+}
+
+func (m *RecordMarshaller) marshal(in *GeneralRecord, derive bool) (*RawDynamoRecord, error) {
+	output := make(RawDynamoRecord, len(*in)+len(m.mapping.Derived))
+	for col, value := range *in {
+		colMapping, haveMapping := m.mapping.Columns[col]
+		if !haveMapping {
+			if m.mapping.Only {
+				continue
+			}
+			colMapping = &ColumnMapping{}
+		}
+		if colMapping.Skip {
+			continue
+		}
+		attribute := col
+		if colMapping.Attribute != "" {
+			attribute = colMapping.Attribute
+		}
+
+		if stringValue, isString := value.(string); isString && stringValue == "" && colMapping.EmptyIsNull {
+			value = nil
+		}
+		if value == nil {
+			if colMapping.Default == nil {
+				continue
+			}
+			value = colMapping.Default
+		}
+
+		converted, err := convertValue(value, colMapping)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %s", col, err)
+		}
+		output[attribute] = converted
+	}
+
+	//defaults also apply to columns that are not in the source at all
+	for col, colMapping := range m.mapping.Columns {
+		if _, haveColumn := (*in)[col]; haveColumn || colMapping.Skip || colMapping.Default == nil {
+			continue
+		}
+		attribute := col
+		if colMapping.Attribute != "" {
+			attribute = colMapping.Attribute
+		}
+		converted, err := convertValue(colMapping.Default, colMapping)
+		if err != nil {
+			return nil, fmt.Errorf("default for column %s: %s", col, err)
+		}
+		output[attribute] = converted
+	}
+
+	if derive {
+		for attribute, generator := range m.mapping.Derived {
+			if strings.HasPrefix(generator, derivedUuidFromPrefix) {
+				col := strings.TrimPrefix(generator, derivedUuidFromPrefix)
+				value := (*in)[col]
+				if value == nil {
+					return nil, fmt.Errorf("derived attribute %s needs a value for column %s", attribute, col)
+				}
+				if b, isBytes := value.([]byte); isBytes {
+					value = string(b)
+				}
+				derived := uuid.NewSHA1(derivedUuidNamespace, []byte(fmt.Sprintf("%s=%v", col, value)))
+				output[attribute] = &types.AttributeValueMemberS{Value: derived.String()}
+				continue
+			}
+			output[attribute] = derivedGenerators[generator]()
+		}
+	}
+	return &output, nil
+}
+
+/*
+naturalType is the Dynamo type that a value is converted to if the mapping doesn't say otherwise.  TINYINT is
+treated as a boolean, because that is how MySQL stores them.
+*/
+func naturalType(value interface{}) string {
+	switch value.(type) {
+	case int8, bool:
+		return AttributeTypeBool
+	case int16, int32, int64, float64, Decimal, json.Number:
+		return AttributeTypeNumber
+	case []byte:
+		return AttributeTypeBinary
+	default:
+		return AttributeTypeString
+	}
+}
+
+/*
+convertValue converts a value from the sql reader (or a default from the mapping file) to the Dynamo type that the
+mapping asks for
+*/
+func convertValue(value interface{}, colMapping *ColumnMapping) (types.AttributeValue, error) {
+	targetType := colMapping.Type
+	if targetType == "" {
+		targetType = naturalType(value)
+	}
+
+	switch targetType {
+	case AttributeTypeString:
+		switch v := value.(type) {
+		case string:
+			return &types.AttributeValueMemberS{Value: v}, nil
+		case time.Time:
+			return &types.AttributeValueMemberS{Value: formatTime(v, colMapping.TimeFormat)}, nil
+		case []byte:
+			return &types.AttributeValueMemberS{Value: string(v)}, nil
+		case float64:
+			return &types.AttributeValueMemberS{Value: strconv.FormatFloat(v, 'f', -1, 64)}, nil
+		case int8, int16, int32, int64, bool, Decimal, json.Number:
+			return &types.AttributeValueMemberS{Value: fmt.Sprintf("%v", v)}, nil
+		}
+	case AttributeTypeNumber:
+		switch v := value.(type) {
+		case int8, int16, int32, int64:
+			return &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", v)}, nil
+		case float64:
+			return &types.AttributeValueMemberN{Value: fmt.Sprintf("%f", v)}, nil
+		case bool:
+			if v {
+				return &types.AttributeValueMemberN{Value: "1"}, nil
+			}
+			return &types.AttributeValueMemberN{Value: "0"}, nil
+		case time.Time:
+			return &types.AttributeValueMemberN{Value: strconv.FormatInt(v.Unix(), 10)}, nil
+		case Decimal, json.Number, string:
+			text := strings.TrimSpace(fmt.Sprintf("%v", v))
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, fmt.Errorf("%q is not a number", text)
+			}
+			return &types.AttributeValueMemberN{Value: text}, nil
+		}
+	case AttributeTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return &types.AttributeValueMemberBOOL{Value: v}, nil
+		case int8, int16, int32, int64:
+			return &types.AttributeValueMemberBOOL{Value: reflect.ValueOf(v).Int() != 0}, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "1", "true", "yes", "y":
+				return &types.AttributeValueMemberBOOL{Value: true}, nil
+			case "0", "false", "no", "n":
+				return &types.AttributeValueMemberBOOL{Value: false}, nil
+			}
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		}
+	case AttributeTypeBinary:
+		switch v := value.(type) {
+		case []byte:
+			return &types.AttributeValueMemberB{Value: v}, nil
+		case string:
+			return &types.AttributeValueMemberB{Value: []byte(v)}, nil
+		}
+	}
+	return nil, fmt.Errorf("can't convert %s value %v to %s", reflect.TypeOf(value), value, targetType)
+}
+
+func formatTime(t time.Time, layout string) string {
+	switch layout {
+	case "":
+		return t.Format(time.RFC3339)
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	default:
+		return t.Format(layout)
+	}
+}
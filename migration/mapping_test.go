@@ -0,0 +1,209 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMarshalWithoutMapping(t *testing.T) {
+	//the behaviour before there were mapping files must not change
+	lastupdate := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	rec := GeneralRecord{
+		"mobile":     int8(1),
+		"contentid":  int32(12),
+		"duration":   1.5,
+		"vcodec":     "",
+		"lastupdate": lastupdate,
+		"acodec":     nil,
+	}
+	marshaller := NewRecordMarshaller(nil, true, "", "vcodec")
+	out, err := marshaller.Marshal(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := (*out)["mobile"].(*types.AttributeValueMemberBOOL); v == nil || !v.Value {
+		t.Errorf("TINYINT should be a true BOOL, got %v", (*out)["mobile"])
+	}
+	if v, _ := (*out)["duration"].(*types.AttributeValueMemberN); v == nil || v.Value != "1.500000" {
+		t.Errorf("unexpected float %v", (*out)["duration"])
+	}
+	if v, _ := (*out)["vcodec"].(*types.AttributeValueMemberS); v == nil || v.Value != "ABSENT" {
+		t.Errorf("nullable field should be ABSENT, got %v", (*out)["vcodec"])
+	}
+	if v, _ := (*out)["lastupdate"].(*types.AttributeValueMemberS); v == nil || v.Value != "2022-03-04T05:06:07Z" {
+		t.Errorf("unexpected time %v", (*out)["lastupdate"])
+	}
+	if _, haveNull := (*out)["acodec"]; haveNull {
+		t.Error("NULL without a default should be left out")
+	}
+	if _, haveUuid := (*out)["uuid"]; !haveUuid {
+		t.Error("expected a uuid")
+	}
+	if !marshaller.GeneratesIds() {
+		t.Error("a marshaller that adds a uuid should say that it generates ids")
+	}
+
+	withoutDerived, _ := marshaller.MarshalWithoutDerived(&rec)
+	if _, haveUuid := (*withoutDerived)["uuid"]; haveUuid {
+		t.Error("MarshalWithoutDerived should not add a uuid")
+	}
+
+	_, err = marshaller.Marshal(&GeneralRecord{"odd": uint(1)})
+	if err == nil {
+		t.Error("expected an error for an unsupported type")
+	}
+}
+
+func TestMarshalWithMapping(t *testing.T) {
+	mapping := &TableMapping{
+		Columns: map[string]*ColumnMapping{
+			"id":        {Skip: true},
+			"title_id":  {Attribute: "octopus_id"},
+			"flags":     {Type: AttributeTypeNumber},
+			"price":     {Type: AttributeTypeNumber},
+			"published": {Type: AttributeTypeString, TimeFormat: "2006-01-02"},
+			"project":   {Default: "unknown", EmptyIsNull: true},
+			"live":      {Type: AttributeTypeBool},
+			"missing":   {Default: "added"},
+		},
+		Derived: map[string]string{"created": "now"},
+	}
+	rec := GeneralRecord{
+		"id":        int32(1),
+		"title_id":  int64(123),
+		"flags":     int8(3),
+		"price":     Decimal("12.3400"),
+		"published": time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC),
+		"project":   "",
+		"live":      "yes",
+		"thumbnail": []byte{1, 2, 3},
+	}
+	out, err := NewRecordMarshaller(mapping, false, "", "").Marshal(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectString := func(field string, expected string) {
+		if v, _ := (*out)[field].(*types.AttributeValueMemberS); v == nil || v.Value != expected {
+			t.Errorf("expected %s to be %q, got %v", field, expected, (*out)[field])
+		}
+	}
+	expectNumber := func(field string, expected string) {
+		if v, _ := (*out)[field].(*types.AttributeValueMemberN); v == nil || v.Value != expected {
+			t.Errorf("expected %s to be %s, got %v", field, expected, (*out)[field])
+		}
+	}
+
+	if _, haveId := (*out)["id"]; haveId {
+		t.Error("skipped column should not be written")
+	}
+	if _, haveOld := (*out)["title_id"]; haveOld {
+		t.Error("renamed column should not be written under its old name")
+	}
+	expectNumber("octopus_id", "123")
+	expectNumber("flags", "3")
+	expectNumber("price", "12.3400")
+	expectString("published", "2022-03-04")
+	expectString("project", "unknown")
+	expectString("missing", "added")
+	if v, _ := (*out)["live"].(*types.AttributeValueMemberBOOL); v == nil || !v.Value {
+		t.Errorf("expected live to be true, got %v", (*out)["live"])
+	}
+	if v, _ := (*out)["thumbnail"].(*types.AttributeValueMemberB); v == nil || len(v.Value) != 3 {
+		t.Errorf("expected thumbnail to be binary, got %v", (*out)["thumbnail"])
+	}
+	if _, haveCreated := (*out)["created"]; !haveCreated {
+		t.Error("expected a derived created field")
+	}
+
+	mapping.Only = true
+	out, _ = NewRecordMarshaller(mapping, false, "", "").Marshal(&rec)
+	if _, haveThumbnail := (*out)["thumbnail"]; haveThumbnail {
+		t.Error("unmapped column should be skipped when only is set")
+	}
+
+	_, err = NewRecordMarshaller(mapping, false, "", "").Marshal(&GeneralRecord{"live": "perhaps"})
+	if err == nil {
+		t.Error("expected an error for a value that is not a boolean")
+	}
+}
+
+/*
+A uuid derived from a column must be the same every time the row is copied, so that -incremental updates the item
+*/
+func TestMarshalUuidFrom(t *testing.T) {
+	marshaller := NewRecordMarshaller(nil, false, "id", "")
+	if marshaller.GeneratesIds() {
+		t.Error("a uuid derived from a column should not count as a generated id")
+	}
+	first, err := marshaller.Marshal(&GeneralRecord{"id": int32(12), "filebase": "myfile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := marshaller.Marshal(&GeneralRecord{"id": int32(12), "filebase": "renamed"})
+	other, _ := marshaller.Marshal(&GeneralRecord{"id": int32(13), "filebase": "myfile"})
+	uuidOf := func(rec *RawDynamoRecord) string {
+		v, _ := (*rec)["uuid"].(*types.AttributeValueMemberS)
+		if v == nil {
+			return ""
+		}
+		return v.Value
+	}
+	if uuidOf(first) == "" || uuidOf(first) != uuidOf(again) {
+		t.Errorf("the same id should always give the same uuid, got %s and %s", uuidOf(first), uuidOf(again))
+	}
+	if uuidOf(first) == uuidOf(other) {
+		t.Error("different ids should give different uuids")
+	}
+
+	if _, err := marshaller.Marshal(&GeneralRecord{"filebase": "myfile"}); err == nil {
+		t.Error("expected an error for a row without the column to derive from")
+	}
+}
+
+func TestLoadTableMapping(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.json")
+	os.WriteFile(good, []byte(`{"columns": {"n": {"type": "N", "default": 0}}, "derived": {"uuid": "uuid"}}`), 0600)
+	mapping, err := LoadTableMapping(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewRecordMarshaller(mapping, false, "", "").Marshal(&GeneralRecord{"n": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := (*out)["n"].(*types.AttributeValueMemberN); v == nil || v.Value != "0" {
+		t.Errorf("expected the default to be a number, got %v", (*out)["n"])
+	}
+
+	for name, content := range map[string]string{
+		"typo.json":      `{"columns": {"n": {"tpye": "N"}}}`,
+		"badtype.json":   `{"columns": {"n": {"type": "SS"}}}`,
+		"badderive.json": `{"derived": {"x": "random"}}`,
+		"nocolumn.json":  `{"derived": {"uuid": "uuid-from:"}}`,
+	} {
+		filename := filepath.Join(dir, name)
+		os.WriteFile(filename, []byte(content), 0600)
+		if _, err := LoadTableMapping(filename); err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+}
+
+func TestDerefTypeString(t *testing.T) {
+	var bytesValue interface{} = []byte("abc")
+	var intValue interface{} = int64(12)
+	var nullValue interface{}
+	if v := derefTypeString(&bytesValue); v != "abc" {
+		t.Errorf("unexpected %s", v)
+	}
+	if v := derefTypeString(&intValue); v != "12" {
+		t.Errorf("binary protocol ints should be formatted, got %s", v)
+	}
+	if v := derefTypeString(&nullValue); v != "" {
+		t.Errorf("unexpected %s for NULL", v)
+	}
+}
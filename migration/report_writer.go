@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+ReportRow is one problem found by a dry run or a verification
+*/
+type ReportRow struct {
+	Record      string //identifies the source row, see describeRecord
+	Field       string
+	SourceValue string
+	DynamoValue string
+	Problem     string
+}
+
+func (r *ReportRow) toCSV() []string {
+	return []string{r.Record, r.Field, r.SourceValue, r.DynamoValue, r.Problem}
+}
+
+// columns that identify a row in the tables that we migrate, in order of preference
+var identifyingColumns = []string{"fcs_id", "encodingid", "filebase", "contentid", "id"}
+
+/*
+describeRecord returns a short description of a source row that is good enough to find it again
+*/
+func describeRecord(rec GeneralRecord) string {
+	parts := make([]string, 0, len(identifyingColumns))
+	for _, col := range identifyingColumns {
+		if value, haveValue := rec[col]; haveValue {
+			parts = append(parts, fmt.Sprintf("%s=%v", col, value))
+		}
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("%v", map[string]interface{}(rec))
+	}
+	return strings.Join(parts, " ")
+}
+
+/*
+AsyncReportWriter writes every incoming ReportRow to the given CSV file. The returned channel gets a nil once the input
+channel has been closed and everything has been written, or the error that stopped it.
+*/
+func AsyncReportWriter(inputCh chan *ReportRow, filename string) chan error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer f.Close()
+
+		writer := csv.NewWriter(f)
+		defer writer.Flush()
+
+		writer.Write([]string{"Record", "Field", "Source value", "Dynamo value", "Problem"})
+		for row := range inputCh {
+			err := writer.Write(row.toCSV())
+			if err != nil {
+				log.Printf("ERROR Could not write report row for %s: %s", row.Record, err)
+				errCh <- err
+				return
+			}
+		}
+		writer.Flush()
+		errCh <- writer.Error()
+	}()
+	return errCh
+}
+
+/*
+logWarnings writes out the conversion warnings from a ReadProgress, most common first
+*/
+func logWarnings(progress *ReadProgress) {
+	columns := make([]string, 0, len(progress.Warnings))
+	for col := range progress.Warnings {
+		columns = append(columns, col)
+	}
+	sort.Slice(columns, func(i, j int) bool { return progress.Warnings[columns[i]] > progress.Warnings[columns[j]] })
+	for _, col := range columns {
+		log.Printf("WARNING %d values in %s could not be converted", progress.Warnings[col], col)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+TableScanner is the part of the Dynamo client that the export uses, so that it can be mocked in testing
+*/
+type TableScanner interface {
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+/*
+ExportTable scans the whole of a Dynamo table and writes every item to `out` as a line of typed json (JSON Lines),
+in the format that common.RawDynamoRecordToJSON makes.
+
+Returns the number of items written.
+*/
+func ExportTable(ctx context.Context, client TableScanner, tableName *string, out io.Writer, pageSize int32) (int, error) {
+	writer := bufio.NewWriter(out)
+	count := 0
+	var continuationKey map[string]types.AttributeValue
+	for {
+		response, err := client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         tableName,
+			ExclusiveStartKey: continuationKey,
+			Limit:             aws.Int32(pageSize),
+			ConsistentRead:    aws.Bool(true),
+		})
+		if err != nil {
+			return count, err
+		}
+		for _, item := range response.Items {
+			line, err := common.RawDynamoRecordToJSON(item)
+			if err != nil {
+				return count, fmt.Errorf("item %d: %s", count, err)
+			}
+			writer.Write(line)
+			writer.WriteByte('\n')
+			count++
+		}
+		log.Printf("INFO ExportTable exported %d items from %s", count, *tableName)
+		if response.LastEvaluatedKey == nil {
+			break //docs say that LastEvaluatedKey is blank when we get to the end
+		}
+		continuationKey = response.LastEvaluatedKey
+	}
+	return count, writer.Flush()
+}
+
+/*
+ImportSnapshot reads a JSON Lines snapshot made by ExportTable and writes every item to a Dynamo table, using
+`parallel` batch writers.  Existing items with the same key are overwritten.  Blank lines are ignored.
+
+Returns the number of items read, and the first error that happened.  If there is an error, some items may have
+been written.
+*/
+func ImportSnapshot(ctx context.Context, in io.Reader, client BatchWriter, tableName *string, parallel int, backoff Backoff) (int, error) {
+	var firstErr error
+	var errMutex sync.Mutex
+	recordError := func(err error) {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	hasFailed := func() bool {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		return firstErr != nil
+	}
+
+	batchCh := make(chan *writeBatch, parallel)
+	wg := startBatchWriters(batchCh, client, tableName, parallel, backoff, nil, recordError)
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024) //Dynamo items can be up to 400k
+	count := 0
+	lineNumber := 0
+	batch := &writeBatch{records: make([]*RawDynamoRecord, 0, maxBatchSize)}
+	for scanner.Scan() && !hasFailed() && ctx.Err() == nil {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		rec, err := common.RawDynamoRecordFromJSON([]byte(line))
+		if err != nil {
+			recordError(fmt.Errorf("line %d: %s", lineNumber, err))
+			break
+		}
+		item := RawDynamoRecord(rec)
+		batch.records = append(batch.records, &item)
+		count++
+		if len(batch.records) >= maxBatchSize {
+			batchCh <- batch
+			batch = &writeBatch{records: make([]*RawDynamoRecord, 0, maxBatchSize)}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		recordError(err)
+	}
+	if len(batch.records) > 0 && !hasFailed() {
+		batchCh <- batch
+	}
+	close(batchCh)
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		return count, ErrInterrupted
+	}
+	return count, firstErr
+}
+
+/*
+openSnapshotForWrite opens a snapshot file for writing. "-" is stdout, and names ending in .gz are compressed.
+The returned function must be called to finish the file.
+*/
+func openSnapshotForWrite(filename string) (io.Writer, func() error, error) {
+	if filename == "-" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return f, f.Close, nil
+	}
+	compressed := gzip.NewWriter(f)
+	return compressed, func() error {
+		err := compressed.Close()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+/*
+openSnapshotForRead opens a snapshot file for reading. "-" is stdin, and names ending in .gz are decompressed.
+*/
+func openSnapshotForRead(filename string) (io.Reader, func() error, error) {
+	if filename == "-" {
+		return os.Stdin, func() error { return nil }, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return f, f.Close, nil
+	}
+	decompressed, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return decompressed, f.Close, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+tableScannerMock returns each of its pages in turn
+*/
+type tableScannerMock struct {
+	pages [][]map[string]types.AttributeValue
+	calls int
+}
+
+func (m *tableScannerMock) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	page := m.pages[m.calls]
+	m.calls++
+	output := &dynamodb.ScanOutput{Items: page}
+	if m.calls < len(m.pages) {
+		output.LastEvaluatedKey = page[len(page)-1]
+	}
+	return output, nil
+}
+
+func snapshotItem(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"encodingid": &types.AttributeValueMemberN{Value: id},
+		"url":        &types.AttributeValueMemberS{Value: "https://example.com/" + id + ".mp4"},
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	tableName := "test"
+	scanner := &tableScannerMock{pages: [][]map[string]types.AttributeValue{
+		{snapshotItem("1"), snapshotItem("2")},
+		{snapshotItem("3")},
+	}}
+
+	out := &bytes.Buffer{}
+	count, err := ExportTable(context.Background(), scanner, &tableName, out, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || scanner.calls != 2 {
+		t.Errorf("expected 3 items in 2 pages, got %d in %d", count, scanner.calls)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || lines[0] != `{"encodingid":{"N":"1"},"url":{"S":"https://example.com/1.mp4"}}` {
+		t.Errorf("unexpected snapshot %s", out.String())
+	}
+
+	writer := &batchWriterMock{throttledCalls: 1}
+	count, err = ImportSnapshot(context.Background(), strings.NewReader(out.String()+"\n"), writer, &tableName, 2, testBackoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || len(writer.written) != 3 {
+		t.Errorf("expected 3 items imported, got %d read and %d written", count, len(writer.written))
+	}
+}
+
+func TestImportSnapshotInvalidLine(t *testing.T) {
+	tableName := "test"
+	writer := &batchWriterMock{}
+	snapshot := `{"encodingid":{"N":"1"}}` + "\n" + `{"encodingid":{"Q":"2"}}` + "\n"
+	_, err := ImportSnapshot(context.Background(), strings.NewReader(snapshot), writer, &tableName, 1, testBackoff)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error on line 2, got %v", err)
+	}
+}
+
+func TestSnapshotFileCompression(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "snapshot.jsonl.gz")
+	out, finish, err := openSnapshotForWrite(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("hello\n"))
+	if err := finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	in, finish, err := openSnapshotForRead(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer finish()
+	content := &bytes.Buffer{}
+	content.ReadFrom(in)
+	if content.String() != "hello\n" {
+		t.Errorf("unexpected content %q", content.String())
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ItemFinder finds the Dynamo item that a marshalled source row was migrated to
+*/
+type ItemFinder interface {
+	Find(ctx context.Context, rec *RawDynamoRecord) (*RawDynamoRecord, error)
+}
+
+/*
+DynamoItemFinder finds items by querying the table, or one of its indexes, on the key fields of the source row.  An
+index is needed when the table's own key can't be worked out from the source, e.g. the idmapping table which is
+keyed on a generated uuid.
+*/
+type DynamoItemFinder struct {
+	client    *dynamodb.Client
+	tableName *string
+	indexName *string
+	hashKey   string
+	rangeKey  string //empty if there is no range key
+}
+
+/*
+NewDynamoItemFinder looks up the key schema of the table (or of the index, if indexName is not empty)
+*/
+func NewDynamoItemFinder(ctx context.Context, client *dynamodb.Client, tableName *string, indexName string) (*DynamoItemFinder, error) {
+	response, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: tableName})
+	if err != nil {
+		return nil, err
+	}
+	finder := &DynamoItemFinder{client: client, tableName: tableName}
+	keySchema := response.Table.KeySchema
+	if indexName != "" {
+		keySchema = nil
+		for _, index := range response.Table.GlobalSecondaryIndexes {
+			if aws.ToString(index.IndexName) == indexName {
+				keySchema = index.KeySchema
+			}
+		}
+		if keySchema == nil {
+			return nil, fmt.Errorf("table %s has no index called %s", *tableName, indexName)
+		}
+		finder.indexName = aws.String(indexName)
+	}
+	for _, key := range keySchema {
+		if key.KeyType == types.KeyTypeHash {
+			finder.hashKey = aws.ToString(key.AttributeName)
+		} else {
+			finder.rangeKey = aws.ToString(key.AttributeName)
+		}
+	}
+	return finder, nil
+}
+
+func (f *DynamoItemFinder) Find(ctx context.Context, rec *RawDynamoRecord) (*RawDynamoRecord, error) {
+	names := map[string]string{"#h": f.hashKey}
+	values := make(map[string]types.AttributeValue, 2)
+	var haveHash bool
+	if values[":h"], haveHash = (*rec)[f.hashKey]; !haveHash {
+		return nil, fmt.Errorf("source row has no %s, try -verify-index", f.hashKey)
+	}
+	condition := "#h = :h"
+	if f.rangeKey != "" {
+		var haveRange bool
+		if values[":r"], haveRange = (*rec)[f.rangeKey]; !haveRange {
+			return nil, fmt.Errorf("source row has no %s, try -verify-index", f.rangeKey)
+		}
+		names["#r"] = f.rangeKey
+		condition += " AND #r = :r"
+	}
+
+	response, err := f.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 f.tableName,
+		IndexName:                 f.indexName,
+		KeyConditionExpression:    aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		Limit:                     aws.Int32(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Items) == 0 {
+		return nil, nil
+	}
+	item := RawDynamoRecord(response.Items[0])
+	return &item, nil
+}
+
+/*
+attributeString renders a Dynamo value for the report
+*/
+func attributeString(value types.AttributeValue) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case *types.AttributeValueMemberS:
+		return v.Value
+	case *types.AttributeValueMemberN:
+		return v.Value
+	case *types.AttributeValueMemberBOOL:
+		return strconv.FormatBool(v.Value)
+	case *types.AttributeValueMemberNULL:
+		return "NULL"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+/*
+attributesEqual compares two Dynamo values.  Numbers are compared by value, because the migration writes floats
+with trailing zeros and Dynamo gives them back without.
+*/
+func attributesEqual(a types.AttributeValue, b types.AttributeValue) bool {
+	aNum, aIsNum := a.(*types.AttributeValueMemberN)
+	bNum, bIsNum := b.(*types.AttributeValueMemberN)
+	if aIsNum && bIsNum {
+		aValue, aErr := strconv.ParseFloat(aNum.Value, 64)
+		bValue, bErr := strconv.ParseFloat(bNum.Value, 64)
+		if aErr == nil && bErr == nil {
+			return aValue == bValue
+		}
+		return aNum.Value == bNum.Value
+	}
+	if aIsNum != bIsNum {
+		return false
+	}
+	return fmt.Sprintf("%T", a) == fmt.Sprintf("%T", b) && attributeString(a) == attributeString(b)
+}
+
+/*
+compareRecords lists every field that differs between a marshalled source row and the Dynamo item, apart from the
+ones in `ignore`.  The rows are sorted by field name and have no Record set.
+*/
+func compareRecords(source *RawDynamoRecord, dynamo *RawDynamoRecord, ignore map[string]bool) []*ReportRow {
+	rows := make([]*ReportRow, 0)
+	for field, sourceValue := range *source {
+		if ignore[field] {
+			continue
+		}
+		dynamoValue, haveField := (*dynamo)[field]
+		if !haveField {
+			rows = append(rows, &ReportRow{Field: field, SourceValue: attributeString(sourceValue), Problem: "missing from dynamo"})
+		} else if !attributesEqual(sourceValue, dynamoValue) {
+			rows = append(rows, &ReportRow{Field: field, SourceValue: attributeString(sourceValue), DynamoValue: attributeString(dynamoValue), Problem: "different"})
+		}
+	}
+	for field, dynamoValue := range *dynamo {
+		if _, haveField := (*source)[field]; !haveField && !ignore[field] {
+			rows = append(rows, &ReportRow{Field: field, DynamoValue: attributeString(dynamoValue), Problem: "not in source"})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Field < rows[j].Field })
+	return rows
+}
+
+/*
+ParseIgnoreList turns a comma-separated list of field names into a set
+*/
+func ParseIgnoreList(list string) map[string]bool {
+	ignore := make(map[string]bool)
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ignore[field] = true
+		}
+	}
+	return ignore
+}
+
+/*
+VerifyReport counts what a verification found
+*/
+type VerifyReport struct {
+	Rows       int
+	Matched    int
+	Missing    int
+	Mismatched int
+	Failed     int //rows that could not be checked at all
+}
+
+/*
+Verify compares every incoming source row with the item that it was migrated to, and sends a ReportRow for each
+difference to `reportCh`, which is closed at the end.  Source rows are marshalled exactly as AsyncDynamoWriter would,
+so a row that was migrated and has not changed since gives no ReportRows.
+*/
+func Verify(ctx context.Context, inputCh chan GeneralRecord, readErrCh chan error, finder ItemFinder, marshaller *RecordMarshaller, ignore map[string]bool, reportCh chan *ReportRow) (*VerifyReport, error) {
+	defer close(reportCh)
+	report := &VerifyReport{}
+	for {
+		var rec GeneralRecord
+		select {
+		case rec = <-inputCh:
+		case err := <-readErrCh:
+			return report, err
+		}
+		if rec == nil {
+			return report, nil
+		}
+		report.Rows++
+		description := describeRecord(rec)
+
+		source, err := marshaller.MarshalWithoutDerived(&rec)
+		if err != nil {
+			report.Failed++
+			reportCh <- &ReportRow{Record: description, Problem: fmt.Sprintf("could not marshal: %s", err)}
+			continue
+		}
+		item, err := finder.Find(ctx, source)
+		if err != nil {
+			report.Failed++
+			reportCh <- &ReportRow{Record: description, Problem: fmt.Sprintf("could not look up: %s", err)}
+			continue
+		}
+		if item == nil {
+			report.Missing++
+			reportCh <- &ReportRow{Record: description, Problem: "not in dynamo"}
+			continue
+		}
+
+		differences := compareRecords(source, item, ignore)
+		if len(differences) == 0 {
+			report.Matched++
+			continue
+		}
+		report.Mismatched++
+		for _, row := range differences {
+			row.Record = description
+			reportCh <- row
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"testing"
+	"time"
+)
+
+func TestCompareRecords(t *testing.T) {
+	source := &RawDynamoRecord{
+		"encodingid": &types.AttributeValueMemberN{Value: "12"},
+		"duration":   &types.AttributeValueMemberN{Value: "1.500000"},
+		"url":        &types.AttributeValueMemberS{Value: "https://example.com/a.mp4"},
+		"mobile":     &types.AttributeValueMemberBOOL{Value: false},
+		"format":     &types.AttributeValueMemberS{Value: "video/mp4"},
+	}
+	dynamo := &RawDynamoRecord{
+		"encodingid":   &types.AttributeValueMemberN{Value: "12"},
+		"duration":     &types.AttributeValueMemberN{Value: "1.5"},
+		"url":          &types.AttributeValueMemberS{Value: "https://example.com/b.mp4"},
+		"mobile":       &types.AttributeValueMemberS{Value: "false"},
+		"uuid":         &types.AttributeValueMemberS{Value: "abcd"},
+		"withdrawn_at": &types.AttributeValueMemberS{Value: "2022-01-01T00:00:00Z"},
+	}
+
+	rows := compareRecords(source, dynamo, ParseIgnoreList("uuid, withdrawn_at"))
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 differences, got %d: %v", len(rows), rows)
+	}
+	if rows[0].Field != "format" || rows[0].Problem != "missing from dynamo" {
+		t.Errorf("unexpected first difference %+v", rows[0])
+	}
+	if rows[1].Field != "mobile" || rows[1].Problem != "different" {
+		t.Errorf("a bool and a string should be different, got %+v", rows[1])
+	}
+	if rows[2].Field != "url" || rows[2].SourceValue != "https://example.com/a.mp4" || rows[2].DynamoValue != "https://example.com/b.mp4" {
+		t.Errorf("unexpected url difference %+v", rows[2])
+	}
+}
+
+type itemFinderMock struct {
+	items map[string]*RawDynamoRecord //keyed by filebase
+	err   error
+}
+
+func (f *itemFinderMock) Find(ctx context.Context, rec *RawDynamoRecord) (*RawDynamoRecord, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.items[attributeString((*rec)["filebase"])], nil
+}
+
+func TestVerify(t *testing.T) {
+	lastupdate := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	finder := &itemFinderMock{items: map[string]*RawDynamoRecord{
+		"same": {
+			"filebase":   &types.AttributeValueMemberS{Value: "same"},
+			"contentid":  &types.AttributeValueMemberN{Value: "1"},
+			"lastupdate": &types.AttributeValueMemberS{Value: "2022-03-04T05:06:07Z"},
+			"uuid":       &types.AttributeValueMemberS{Value: "abcd"},
+		},
+		"changed": {
+			"filebase":   &types.AttributeValueMemberS{Value: "changed"},
+			"contentid":  &types.AttributeValueMemberN{Value: "3"},
+			"lastupdate": &types.AttributeValueMemberS{Value: "2022-03-04T05:06:07Z"},
+		},
+	}}
+
+	inputCh := make(chan GeneralRecord, 4)
+	inputCh <- GeneralRecord{"filebase": "same", "contentid": int32(1), "lastupdate": lastupdate}
+	inputCh <- GeneralRecord{"filebase": "changed", "contentid": int32(2), "lastupdate": lastupdate}
+	inputCh <- GeneralRecord{"filebase": "gone", "contentid": int32(4), "lastupdate": lastupdate}
+	inputCh <- nil
+	reportCh := make(chan *ReportRow, 10)
+
+	report, err := Verify(context.Background(), inputCh, make(chan error), finder, NewRecordMarshaller(nil, false, "", ""), ParseIgnoreList("uuid"), reportCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows != 3 || report.Matched != 1 || report.Mismatched != 1 || report.Missing != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	rows := make([]*ReportRow, 0)
+	for row := range reportCh {
+		rows = append(rows, row)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 report rows, got %d", len(rows))
+	}
+	if rows[0].Record != "filebase=changed contentid=2" || rows[0].Field != "contentid" || rows[0].DynamoValue != "3" {
+		t.Errorf("unexpected mismatch row %+v", rows[0])
+	}
+	if rows[1].Record != "filebase=gone contentid=4" || rows[1].Problem != "not in dynamo" {
+		t.Errorf("unexpected missing row %+v", rows[1])
+	}
+}
+
+func TestVerifyLookupFailure(t *testing.T) {
+	inputCh := make(chan GeneralRecord, 2)
+	inputCh <- GeneralRecord{"filebase": "any"}
+	inputCh <- nil
+	reportCh := make(chan *ReportRow, 10)
+
+	report, err := Verify(context.Background(), inputCh, make(chan error), &itemFinderMock{err: errors.New("kaboom")}, NewRecordMarshaller(nil, false, "", ""), nil, reportCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 1 || report.Matched != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+mysqlTimestampFormat is how MySQL renders TIMESTAMP columns, and so how we send them back to it
+*/
+const mysqlTimestampFormat = "2006-01-02 15:04:05"
+
+/*
+WatermarkState records, for each source table, the highest value of the watermark column that has been copied to
+Dynamo. It is kept in a small json file between runs of the tool.
+*/
+type WatermarkState struct {
+	Tables map[string]time.Time `json:"tables"`
+}
+
+/*
+LoadWatermarkState reads the state file. A missing file is not an error, it just means that nothing has been copied yet.
+*/
+func LoadWatermarkState(filename string) (*WatermarkState, error) {
+	state := &WatermarkState{Tables: make(map[string]time.Time)}
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid state file: %s", filename, err)
+	}
+	if state.Tables == nil {
+		state.Tables = make(map[string]time.Time)
+	}
+	return state, nil
+}
+
+/*
+Save writes the state file. It is written atomically, so that a crash part way through can't leave a corrupt state
+file behind.
+*/
+func (s *WatermarkState) Save(filename string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filename, content)
+}
+
+/*
+writeFileAtomically writes to a temporary file and renames it into place, so that readers only ever see the old
+content or the new content
+*/
+func writeFileAtomically(filename string, content []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name()) //fails harmlessly once the rename has happened
+	_, err = tempFile.Write(content)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), filename)
+}
+
+/*
+Since returns the watermark for the given table, or nil if the table has not been copied before
+*/
+func (s *WatermarkState) Since(tableName string) *time.Time {
+	if watermark, haveWatermark := s.Tables[tableName]; haveWatermark {
+		return &watermark
+	}
+	return nil
+}
+
+/*
+Advance moves the watermark for the given table on to `to`. It never goes backwards.
+*/
+func (s *WatermarkState) Advance(tableName string, to time.Time) {
+	if current, haveCurrent := s.Tables[tableName]; !haveCurrent || to.After(current) {
+		s.Tables[tableName] = to
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatermarkStateRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := LoadWatermarkState(filename)
+	if err != nil {
+		t.Fatalf("a missing state file should not be an error: %s", err)
+	}
+	if state.Since("encodings") != nil {
+		t.Error("expected no watermark before anything has been copied")
+	}
+
+	first := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	state.Advance("encodings", first)
+	state.Advance("encodings", first.Add(-time.Hour))
+	if !state.Since("encodings").Equal(first) {
+		t.Errorf("watermark went backwards to %s", state.Since("encodings"))
+	}
+	err = state.Save(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadWatermarkState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since := loaded.Since("encodings"); since == nil || !since.Equal(first) {
+		t.Errorf("expected %s after reload, got %v", first, since)
+	}
+	if loaded.Since("idmapping") != nil {
+		t.Error("expected no watermark for a different table")
+	}
+}
+
+func TestBuildSelectQuery(t *testing.T) {
+	q, args := buildSelectQuery("encodings", nil)
+	if q != "select * from encodings" || len(args) != 0 {
+		t.Errorf("unexpected full query %s %v", q, args)
+	}
+
+	since := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	q, args = buildSelectQuery("encodings", &ReadOptions{WatermarkColumn: "lastupdate", Since: &since})
+	if q != "select * from encodings where lastupdate >= ? order by lastupdate" {
+		t.Errorf("unexpected incremental query %s", q)
+	}
+	if len(args) != 1 || args[0] != "2022-03-04 05:06:07" {
+		t.Errorf("unexpected incremental args %v", args)
+	}
+
+	q, _ = buildSelectQuery("encodings", &ReadOptions{WatermarkColumn: "lastupdate"})
+	if q != "select * from encodings order by lastupdate" {
+		t.Errorf("unexpected first incremental query %s", q)
+	}
+}
+
+func TestBuildSelectQueryWithCheckpoint(t *testing.T) {
+	since := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	after := "1234"
+	q, args := buildSelectQuery("encodings", &ReadOptions{WatermarkColumn: "lastupdate", Since: &since, OrderColumn: "encodingid", After: &after})
+	if q != "select * from encodings where lastupdate >= ? and encodingid > ? order by encodingid" {
+		t.Errorf("unexpected query %s", q)
+	}
+	if len(args) != 2 || args[1] != "1234" {
+		t.Errorf("unexpected args %v", args)
+	}
+
+	q, args = buildSelectQuery("encodings", &ReadOptions{OrderColumn: "encodingid"})
+	if q != "select * from encodings order by encodingid" || len(args) != 0 {
+		t.Errorf("unexpected query for a new checkpointed run %s %v", q, args)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+/*
+This function is triggered by S3 when the transcoder writes a sidecar metadata file (`*.json`) into the media bucket.
+It reads the sidecar and upserts the idmapping record and encodings that it describes, so that new content can be
+served without going via the legacy MySQL database and the migration tool.
+
+Notifications for any other kind of object are ignored, because the media files on their own don't carry enough
+information (e.g. the content ID) to make a record.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"go.opentelemetry.io/otel/attribute"
+	"net/url"
+	"strings"
+)
+
+var ops common.DynamoDbOps
+var writeOps common.DynamoWriteOps
+var s3ops common.S3Ops
+var config common.Config
+
+/*
+HandleEvent ingests every sidecar in the notification.  An error is only returned if something went wrong that is
+worth retrying (e.g. DynamoDB was unavailable); a sidecar that is invalid will never work so it is logged and dropped.
+*/
+func HandleEvent(ctx context.Context, event events.S3Event) (err error) {
+	ctx, metrics := common.ContextWithJobMetrics(ctx, "s3ingest")
+	defer metrics.Flush()
+	ctx, span := common.StartSpan(ctx, "s3ingest", attribute.Int("records", len(event.Records)))
+	defer common.FlushTracing(ctx)
+	defer func() { common.EndSpan(span, err) }()
+
+	var retryable []string
+	for _, record := range event.Records {
+		//keys in S3 notifications are url-encoded
+		key, unescapeErr := url.QueryUnescape(record.S3.Object.Key)
+		if unescapeErr != nil {
+			key = record.S3.Object.Key
+		}
+		bucket := record.S3.Bucket.Name
+		logger := common.DefaultLogger.With("function", "s3ingest").With("bucket", bucket).With("key", key)
+		recordCtx := common.ContextWithLogger(ctx, logger)
+
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			logger.Debug("Ignoring %s event", record.EventName)
+			continue
+		}
+		if !strings.HasSuffix(strings.ToLower(key), ".json") {
+			logger.Info("Ignoring %s, it is not a sidecar file", key)
+			continue
+		}
+
+		result, lookupErr := common.IngestSidecarFile(recordCtx, bucket, key, record.EventTime, s3ops, ops, writeOps)
+		for range result.Encodings {
+			metrics.PutCount(common.MetricIngestEncodingsStored)
+		}
+		for i := 0; i < result.Failed; i++ {
+			metrics.PutCount(common.MetricIngestEncodingsFailed)
+		}
+		if lookupErr != nil {
+			metrics.PutCount(common.MetricIngestSidecarFailed)
+			if lookupErr.Kind == common.LookupErrorBackend || lookupErr.Kind == common.LookupErrorConflict {
+				retryable = append(retryable, fmt.Sprintf("s3://%s/%s: %s", bucket, key, lookupErr))
+			} else {
+				logger.Error("Dropping sidecar s3://%s/%s: %s", bucket, key, lookupErr)
+			}
+		}
+	}
+
+	if len(retryable) > 0 {
+		return errors.New("could not ingest " + strings.Join(retryable, "; "))
+	}
+	return nil
+}
+
+func main() {
+	var err error
+	err = common.InitTracing(context.Background(), "s3ingest")
+	if err != nil {
+		common.DefaultLogger.Error("Could not initialise tracing: %s", err)
+		panic("could not initialise tracing")
+	}
+
+	config, err = common.NewConfig()
+	if err != nil {
+		common.DefaultLogger.Error("Could not initialise config: %s", err)
+		panic("could not initialise config")
+	}
+
+	ops = common.NewDynamoDbOps(config)
+	writeOps = common.NewDynamoWriteOps(config)
+	s3ops = common.NewS3Ops(config)
+	lambda.Start(HandleEvent)
+}
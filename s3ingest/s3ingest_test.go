@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"testing"
+)
+
+func makeS3Event(eventName string, key string) events.S3Event {
+	return events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				EventName: eventName,
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "media"},
+					Object: events.S3Object{Key: key},
+				},
+			},
+		},
+	}
+}
+
+func TestHandleEventIngestsSidecar(t *testing.T) {
+	t.Setenv("MEDIA_BASE_URL", "https://media.example.com")
+	mockS3 := &common.S3OpsMock{Objects: map[string][]byte{
+		"media/my great video.json": []byte(`{"filebase": "mygreatvideo", "contentid": 2222, "encodings": [
+			{"encodingid": 123, "file": "mygreatvideo_1280x720_2000k.mp4", "duration": 12.5, "file_size": 1000}
+		]}`),
+	}}
+	mockWriteOps := &common.DynamoWriteOpsMock{}
+	s3ops = mockS3
+	ops = &common.DynamoOpsMock{}
+	writeOps = mockWriteOps
+
+	err := HandleEvent(context.Background(), makeS3Event("ObjectCreated:Put", "my+great+video.json"))
+	if err != nil {
+		t.Fatalf("HandleEvent returned an unexpected error: %s", err)
+	}
+	if len(mockS3.KeysRead) != 1 || mockS3.KeysRead[0] != "media/my great video.json" {
+		t.Errorf("Expected the url-encoded key to be decoded, got %v", mockS3.KeysRead)
+	}
+	if len(mockWriteOps.IdMappingsPut) != 1 || len(mockWriteOps.EncodingsPut) != 1 {
+		t.Errorf("Expected an idmapping record and an encoding to be stored, got %d and %d", len(mockWriteOps.IdMappingsPut), len(mockWriteOps.EncodingsPut))
+	}
+}
+
+func TestHandleEventIgnoresOtherObjects(t *testing.T) {
+	mockS3 := &common.S3OpsMock{}
+	s3ops = mockS3
+	ops = &common.DynamoOpsMock{}
+	writeOps = &common.DynamoWriteOpsMock{}
+
+	for _, event := range []events.S3Event{
+		makeS3Event("ObjectCreated:Put", "mygreatvideo_1280x720_2000k.mp4"),
+		makeS3Event("ObjectRemoved:Delete", "mygreatvideo.json"),
+	} {
+		err := HandleEvent(context.Background(), event)
+		if err != nil {
+			t.Errorf("HandleEvent returned an unexpected error: %s", err)
+		}
+	}
+	if len(mockS3.KeysRead) != 0 {
+		t.Errorf("Nothing should have been read, got %v", mockS3.KeysRead)
+	}
+}
+
+func TestHandleEventRetries(t *testing.T) {
+	s3ops = &common.S3OpsMock{Objects: map[string][]byte{
+		"media/invalid.json": []byte(`not json`),
+		"media/valid.json":   []byte(`{"filebase": "mygreatvideo", "contentid": 2222, "encodings": []}`),
+	}}
+	ops = &common.DynamoOpsMock{}
+	writeOps = &common.DynamoWriteOpsMock{}
+
+	err := HandleEvent(context.Background(), makeS3Event("ObjectCreated:Put", "invalid.json"))
+	if err != nil {
+		t.Errorf("An invalid sidecar should be dropped rather than retried, got %s", err)
+	}
+
+	writeOps = &common.DynamoWriteOpsMock{ReplaceIdMappingError: errors.New("kaboom")}
+	err = HandleEvent(context.Background(), makeS3Event("ObjectCreated:Put", "valid.json"))
+	if err == nil {
+		t.Error("A database failure should return an error so that the event is retried")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/google/uuid"
 	"github.com/guardian/new-encodings-endpoints/common"
 	"log"
+	"net/url"
+	"path"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -13,12 +15,12 @@ import (
 )
 
 type EndpointEvent struct {
-	Uid                   uuid.UUID
-	Timestamp             *time.Time
-	AccessUrl             string
-	ExpectedOutputMessage string
-	ExpectedOutputHeaders map[string]string
-	ExpectedResponse      int16
+	Uid                   uuid.UUID         `json:"uid"`
+	Timestamp             *time.Time        `json:"timestamp"`
+	AccessUrl             string            `json:"access_url"`
+	ExpectedOutputMessage string            `json:"output_message"`
+	ExpectedOutputHeaders map[string]string `json:"headers"`
+	ExpectedResponse      int16             `json:"response_code"`
 }
 
 /*
@@ -33,6 +35,17 @@ func (e *EndpointEvent) FormattedTimestamp() string {
 	return e.Timestamp.Format(time.RFC3339)
 }
 
+/*
+Endpoint returns the name of the endpoint that the request was for, e.g. `video.php`
+*/
+func (e *EndpointEvent) Endpoint() string {
+	parsed, err := url.Parse(e.AccessUrl)
+	if err != nil || parsed.Path == "" {
+		return "unknown"
+	}
+	return path.Base(parsed.Path)
+}
+
 func getStringValue(d types.AttributeValue) (string, error) {
 	if stringVal, haveStringVal := d.(*types.AttributeValueMemberS); haveStringVal {
 		return stringVal.Value, nil
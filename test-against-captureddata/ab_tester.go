@@ -0,0 +1,42 @@
+package main
+
+import "fmt"
+
+/*
+ABTester sends each captured request to two targets, and compares the response from B with the response from A
+instead of with the captured response.  Use it to check that a canary stage (or the Go endpoints) behave the same as
+what is live, before promoting it.
+*/
+type ABTester struct {
+	A     Fetcher
+	B     Fetcher
+	Rules *Rules
+}
+
+func NewABTester(a Fetcher, b Fetcher, rules *Rules) *ABTester {
+	return &ABTester{A: a, B: b, Rules: rules}
+}
+
+/*
+Test fetches the captured request from both targets and compares them.  The response from A becomes the expected
+response in the output, keeping the captured URL and timestamp so that tests are named the same way as when comparing
+with captured data.
+*/
+func (t *ABTester) Test(evt *EndpointEvent) (*TestOutput, bool, error) {
+	responseA, err := t.A.Fetch(evt)
+	if err != nil {
+		return nil, false, fmt.Errorf("target A: %s", err)
+	}
+	responseB, err := t.B.Fetch(evt)
+	if err != nil {
+		return nil, false, fmt.Errorf("target B: %s", err)
+	}
+
+	expected := responseEvent(responseA)
+	expected.Uid = evt.Uid
+	expected.Timestamp = evt.Timestamp
+	expected.AccessUrl = evt.AccessUrl
+
+	out := compareResponse(t.Rules, expected, responseB)
+	return out, out.Passed, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestABTesterSameResponses(t *testing.T) {
+	evt := testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=myfile", 404, "not what either target says", nil)
+	a := &FetcherMock{Response: testResponse(200, "https://cdn.example.com/low.mp4\n", map[string]string{
+		"Content-Type": "text/plain;charset=UTF-8",
+		"Date":         "Mon, 19 Oct 2026 10:00:00 GMT",
+		"Server":       "Apache",
+	})}
+	b := &FetcherMock{Response: testResponse(200, "https://cdn.example.com/low.mp4", map[string]string{
+		"Content-Type": "text/plain",
+		"Date":         "Mon, 19 Oct 2026 10:00:01 GMT",
+		"X-Amz-Cf-Id":  "abcd",
+	})}
+
+	out, success, err := NewABTester(a, b, DefaultRules()).Test(evt)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !success {
+		t.Errorf("expected the targets to match, got %s", out.ErrorList)
+	}
+	if out.Request.AccessUrl != evt.AccessUrl || out.Request.Timestamp != evt.Timestamp || out.Request.ExpectedResponse != 200 {
+		t.Errorf("expected response should be from target A with the captured url and time, got %v", out.Request)
+	}
+	if out.Endpoint() != "reference.php" {
+		t.Errorf("got unexpected endpoint %s", out.Endpoint())
+	}
+}
+
+func TestABTesterDifferentResponses(t *testing.T) {
+	evt := testEvent("https://multimedia.example.com/interactivevideos/video.php?file=myfile", 302, "", nil)
+	a := &FetcherMock{Response: testResponse(302, "", map[string]string{"Location": "https://cdn.example.com/low.mp4"})}
+	b := &FetcherMock{Response: testResponse(302, "", map[string]string{"Location": "https://cdn.example.com/high.mp4"})}
+
+	out, success, err := NewABTester(a, b, DefaultRules()).Test(evt)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if success || len(out.Problems) != 1 || out.Problems[0].Header != "Location" {
+		t.Errorf("expected a Location problem, got %v", out.Problems)
+	}
+	if out.Result.ExpectedOutputHeaders["Location"] != "https://cdn.example.com/high.mp4" {
+		t.Errorf("result should be the response from target B, got %v", out.Result)
+	}
+
+	_, _, err = NewABTester(a, &FetcherMock{}, DefaultRules()).Test(evt)
+	if err == nil || !strings.HasPrefix(err.Error(), "target B") {
+		t.Errorf("expected an error naming target B, got %v", err)
+	}
+	_, _, err = NewABTester(&FetcherMock{}, b, DefaultRules()).Test(evt)
+	if err == nil || !strings.HasPrefix(err.Error(), "target A") {
+		t.Errorf("expected an error naming target A, got %v", err)
+	}
+}
+
+func TestAsyncTestEndpointErrors(t *testing.T) {
+	inputCh := make(chan *EndpointEvent, 2)
+	inputCh <- testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=a", 200, "", nil)
+	inputCh <- testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=b", 200, "", nil)
+	close(inputCh)
+
+	fetcher := &FetcherMock{}
+	resultsCh, _ := AsyncTestEndpoint(inputCh, &CapturedTester{Fetcher: fetcher, Rules: DefaultRules()}, 1)
+	count := 0
+	for result := range resultsCh {
+		count++
+		if result.Passed || len(result.Problems) != 1 || result.Problems[0].Category != ProblemError {
+			t.Errorf("expected an error result, got %v", result)
+		}
+	}
+	if count != 2 || fetcher.Calls != 2 {
+		t.Errorf("expected 2 results from 2 calls, got %d from %d", count, fetcher.Calls)
+	}
+}
@@ -7,10 +7,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/guardian/new-encodings-endpoints/common"
 	"log"
-	"strings"
 )
 
-func AsyncRecordReader(client *dynamodb.Client, tableName *string, limitToEndpoint string, pageSize int32) (chan *EndpointEvent, chan error) {
+func AsyncRecordReader(client *dynamodb.Client, tableName *string, filter *EventFilter, pageSize int32) (chan *EndpointEvent, chan error) {
 	outputCh := make(chan *EndpointEvent, pageSize*2)
 	errCh := make(chan error, 1)
 
@@ -35,15 +34,11 @@ func AsyncRecordReader(client *dynamodb.Client, tableName *string, limitToEndpoi
 				event, marshalErr := EndpointEventFromDynamo((*common.RawDynamoRecord)(&item))
 				if marshalErr != nil {
 					log.Printf("ERROR %s", marshalErr)
-					errCh <- err
+					errCh <- marshalErr
 					close(outputCh)
 					return
 				}
-				if limitToEndpoint != "" {
-					if strings.Contains(event.AccessUrl, limitToEndpoint) {
-						outputCh <- event
-					}
-				} else {
+				if filter.Accept(event) {
 					outputCh <- event
 				}
 			}
@@ -53,7 +48,7 @@ func AsyncRecordReader(client *dynamodb.Client, tableName *string, limitToEndpoi
 				continuationKey = response.LastEvaluatedKey
 			}
 		}
-		log.Printf("INFO AsyncReader reached the end of records")
+		log.Printf("INFO AsyncReader reached the end of records, %s", filter.Describe())
 		close(outputCh)
 	}()
 	return outputCh, errCh
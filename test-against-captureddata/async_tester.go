@@ -16,26 +16,22 @@ import (
 
 var UrlMatcher = regexp.MustCompile(`^(https?)://[^/]+/(.*)$`)
 
+/*
+makeTargetUrl moves a captured URL onto the given server.  A bare hostname is assumed to be https, or a base URL like
+`http://localhost:8080` can be given to test a local server.
+*/
 func makeTargetUrl(endpointBase *string, evt *EndpointEvent) (string, error) {
 	matches := UrlMatcher.FindAllStringSubmatch(evt.AccessUrl, -1)
 	if matches == nil {
 		return "", errors.New(fmt.Sprintf("original URL %s could not be parsed", evt.AccessUrl))
 	}
+	if strings.Contains(*endpointBase, "://") {
+		return fmt.Sprintf("%s/%s", strings.TrimSuffix(*endpointBase, "/"), matches[0][2]), nil
+	}
 	newUrl := fmt.Sprintf("https://%s/%s", *endpointBase, matches[0][2])
 	return newUrl, nil
 }
 
-var IrrelevantHeaders = []string{"X-Powered-By"}
-
-func isHeaderIrrelevant(key string) bool {
-	for _, hdr := range IrrelevantHeaders {
-		if hdr == key {
-			return true
-		}
-	}
-	return false
-}
-
 /*
 normaliseHtml will "pretty-print" html with standard indentation and return it.
 This allows insignificant whitespace changes to be ignored
@@ -45,136 +41,152 @@ func normaliseHtml(input *string) string {
 	return xmlfmt.FormatXML(*input, "", "  ")
 }
 
-var urlNormaliser = regexp.MustCompile("^https?://")
-
-func normaliseUrl(input *string) string {
-	return urlNormaliser.ReplaceAllString(*input, "http://")
+/*
+FetchedResponse is what an endpoint returned for one of the captured requests
+*/
+type FetchedResponse struct {
+	Url        string //where the request was sent
+	StatusCode int
+	Header     http.Header
+	Body       []byte
 }
 
-func checkHeaders(evt *EndpointEvent, response *http.Response, targetUrl string) (bool, string) {
-	errorList := ""
-	for k, v := range evt.ExpectedOutputHeaders {
-		if k == "Content-type" {
-			k = "Content-Type"
-		}
+/*
+Fetcher replays a captured request against the endpoints under test
+*/
+type Fetcher interface {
+	Fetch(evt *EndpointEvent) (*FetchedResponse, error)
+}
 
-		if headerVal, haveHeader := response.Header[k]; haveHeader {
-			if v == "text/plain" { //fix for an irritation that some events were logged with "text/plain" and others with "text/plain;charset=UTF-8"
-				v = "text/plain;charset=UTF-8"
-			}
+/*
+HttpFetcher sends the captured requests to a deployed stage, given by its hostname
+*/
+type HttpFetcher struct {
+	client       *http.Client
+	endpointBase *string
+}
 
-			actualHeader := normaliseUrl(&headerVal[0])
-			actualHeader = strings.TrimSpace(actualHeader)
-			expectedHeader := normaliseUrl(&v)
-			expectedHeader = strings.TrimSpace(expectedHeader)
+// requests that take longer than this are failed, rather than holding up the run
+const fetchTimeout = 30 * time.Second
 
-			if actualHeader != expectedHeader {
-				prob := fmt.Sprintf("header %s got value %s expected %s", k, actualHeader, expectedHeader)
-				errorList += prob + "\n"
-				log.Printf("INFO Request %s from %s %s", targetUrl, evt.FormattedTimestamp(), prob)
-				return false, errorList
-			}
-		} else {
-			if !isHeaderIrrelevant(k) {
-				prob := fmt.Sprintf("response was missing header %s", k)
-				errorList += prob + "\n"
-				log.Printf("INFO Request %s from %s %s", targetUrl, evt.FormattedTimestamp(), prob)
-				return false, errorList
-			}
-		}
+/*
+NewHttpFetcher returns an HttpFetcher for the given hostname, or base URL.  Redirects are not followed, because they
+are what video.php returns.
+*/
+func NewHttpFetcher(endpointBase *string) *HttpFetcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 100 //the default of 2 means opening new connections all the time under load
+	return &HttpFetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   fetchTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		endpointBase: endpointBase,
 	}
-	return true, ""
 }
 
-func Test(httpClient *http.Client, endpointBase *string, evt *EndpointEvent) (*TestOutput, bool, error) {
-	targetUrl, err := makeTargetUrl(endpointBase, evt)
+func (f *HttpFetcher) Fetch(evt *EndpointEvent) (*FetchedResponse, error) {
+	targetUrl, err := makeTargetUrl(f.endpointBase, evt)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 	rq, err := http.NewRequest("GET", targetUrl, nil)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
-	response, err := httpClient.Do(rq)
+	response, err := f.client.Do(rq)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 	defer response.Body.Close()
 
 	content, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, false, err
-	}
-
-	errorList := ""
-	success := true
-	if response.StatusCode != int(evt.ExpectedResponse) {
-		prob := fmt.Sprintf("expected response %d got %d", evt.ExpectedResponse, response.StatusCode)
-		errorList += prob + "\n"
-		log.Printf("INFO Request %s from %s %s", targetUrl, evt.FormattedTimestamp(), prob)
-		success = false
-	}
-
-	var actualContentString string
-	var expectedContentString string
-
-	if ct, haveCt := response.Header["Content-Type"]; haveCt && strings.HasPrefix(ct[0], "text/html") {
-		actualContentString = string(content)
-		actualContentString = normaliseHtml(&actualContentString)
-		expectedContentString = normaliseHtml(&evt.ExpectedOutputMessage)
-	} else {
-		actualContentString = strings.TrimSpace(string(content))
-		expectedContentString = strings.TrimSpace(evt.ExpectedOutputMessage)
-	}
-
-	if actualContentString != expectedContentString &&
-		!(strings.HasPrefix(actualContentString, "No content found") && expectedContentString == "") &&
-		!(actualContentString == "" && strings.HasPrefix(expectedContentString, "No content found")) {
-
-		prob := fmt.Sprintf("expected body '%s' got '%s'", expectedContentString, actualContentString)
-		errorList += prob + "\n"
-		log.Printf("INFO Request %s from %s %s", targetUrl, evt.FormattedTimestamp(), prob)
-		success = false
-	}
-
-	headerCheckPassed, headerCheckProblems := checkHeaders(evt, response, targetUrl)
-	if !headerCheckPassed {
-		success = false
-		errorList += headerCheckProblems
-	}
+		return nil, err
+	}
+	return &FetchedResponse{
+		Url:        targetUrl,
+		StatusCode: response.StatusCode,
+		Header:     response.Header,
+		Body:       content,
+	}, nil
+}
 
+/*
+responseEvent records a response in the same form as a captured one, so that it can be reported on
+*/
+func responseEvent(response *FetchedResponse) *EndpointEvent {
 	reformattedHeaders := make(map[string]string, len(response.Header))
 	for k, values := range response.Header {
 		reformattedHeaders[k] = strings.Join(values, ";")
 	}
 
 	ts := time.Now()
-	responseEvt := &EndpointEvent{
+	return &EndpointEvent{
 		Uid:                   uuid.UUID{},
 		Timestamp:             &ts,
-		AccessUrl:             targetUrl,
-		ExpectedOutputMessage: string(content),
+		AccessUrl:             response.Url,
+		ExpectedOutputMessage: string(response.Body),
 		ExpectedOutputHeaders: reformattedHeaders,
 		ExpectedResponse:      int16(response.StatusCode),
 	}
+}
+
+/*
+compareResponse compares a response with the expected one using the given rules, and logs any problems
+*/
+func compareResponse(rules *Rules, expected *EndpointEvent, response *FetchedResponse) *TestOutput {
 	out := &TestOutput{
-		Request:   evt,
-		Result:    responseEvt,
-		ErrorList: errorList,
+		Request: expected,
 	}
-	return out, success, nil
+	out.Problems, out.Allowed = rules.Compare(expected, out.Endpoint(), response)
+	for _, problem := range out.Problems {
+		out.ErrorList += problem.Message + "\n"
+		log.Printf("INFO Request %s from %s %s", response.Url, expected.FormattedTimestamp(), problem.Message)
+	}
+	out.Passed = len(out.Problems) == 0
+	out.Result = responseEvent(response)
+	return out
 }
 
-func testProcessingThread(inputCh chan *EndpointEvent, outputCh chan TestOutput, endpointBase *string, wg *sync.WaitGroup) {
-	successCount := 0
-	totalCount := 0
-
-	httpClient := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+/*
+Test replays a captured request with the given fetcher, and compares the response with what was captured using the
+given rules.
+Returns the test output, whether the test passed, and an error if the request could not be made at all.
+*/
+func Test(fetcher Fetcher, rules *Rules, evt *EndpointEvent) (*TestOutput, bool, error) {
+	response, err := fetcher.Fetch(evt)
+	if err != nil {
+		return nil, false, err
 	}
+	out := compareResponse(rules, evt, response)
+	return out, out.Passed, nil
+}
+
+/*
+Tester runs the test for one captured request
+*/
+type Tester interface {
+	Test(evt *EndpointEvent) (*TestOutput, bool, error)
+}
+
+/*
+CapturedTester compares the responses from one target with the captured responses
+*/
+type CapturedTester struct {
+	Fetcher Fetcher
+	Rules   *Rules
+}
+
+func (t *CapturedTester) Test(evt *EndpointEvent) (*TestOutput, bool, error) {
+	return Test(t.Fetcher, t.Rules, evt)
+}
+
+func testProcessingThread(inputCh chan *EndpointEvent, outputCh chan TestOutput, tester Tester, wg *sync.WaitGroup) {
 	for {
 		evt, haveMore := <-inputCh
 		if !haveMore {
@@ -183,28 +195,35 @@ func testProcessingThread(inputCh chan *EndpointEvent, outputCh chan TestOutput,
 			return
 		}
 
-		responseEvent, result, err := Test(httpClient, endpointBase, evt)
+		start := time.Now()
+		result, _, err := tester.Test(evt)
 		if err != nil {
 			log.Printf("ERROR Could not perform test for %s at %s: %s", evt.AccessUrl, evt.FormattedTimestamp(), err)
+			prob := fmt.Sprintf("could not perform test: %s", err)
+			result = &TestOutput{
+				Request:   evt,
+				Result:    &EndpointEvent{AccessUrl: evt.AccessUrl},
+				ErrorList: prob + "\n",
+				Problems:  []TestProblem{{Category: ProblemError, Message: prob}},
+			}
 		}
-		totalCount++
-		if result {
-			successCount++
-		} else {
-			outputCh <- *responseEvent
-		}
-		log.Printf("INFO Running total %d / %d tests successful", successCount, totalCount)
+		result.Duration = time.Since(start)
+		outputCh <- *result
 	}
 }
 
-func AsyncTestEndpoint(inputCh chan *EndpointEvent, endpointBase *string, parallel int) (chan TestOutput, *sync.WaitGroup) {
+/*
+AsyncTestEndpoint runs the tester for every event from `inputCh` on `parallel` goroutines, and outputs the result of
+every test, passed or failed
+*/
+func AsyncTestEndpoint(inputCh chan *EndpointEvent, tester Tester, parallel int) (chan TestOutput, *sync.WaitGroup) {
 	outputCh := make(chan TestOutput, 100)
 
 	waitGroup := &sync.WaitGroup{}
 	waitGroup.Add(parallel)
 
 	for i := 0; i < parallel; i++ {
-		go testProcessingThread(inputCh, outputCh, endpointBase, waitGroup)
+		go testProcessingThread(inputCh, outputCh, tester, waitGroup)
 	}
 
 	outputWaitGroup := &sync.WaitGroup{}
@@ -0,0 +1,19 @@
+package main
+
+import "errors"
+
+/*
+FetcherMock returns the same response for every request, or an error if Response is nil
+*/
+type FetcherMock struct {
+	Response *FetchedResponse
+	Calls    int
+}
+
+func (f *FetcherMock) Fetch(evt *EndpointEvent) (*FetchedResponse, error) {
+	f.Calls++
+	if f.Response == nil {
+		return nil, errors.New("connection refused")
+	}
+	return f.Response, nil
+}
@@ -4,14 +4,44 @@ import (
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"os"
+	"time"
 )
 
+// categories of TestProblem
+const ProblemStatus = "status" //the status code was different
+const ProblemBody = "body"     //the body was different
+const ProblemHeader = "header" //a header was different or missing
+const ProblemError = "error"   //the request could not be made at all
+
+/*
+TestProblem is one difference between the captured response and the one we got
+*/
+type TestProblem struct {
+	Category      string `json:"category"` //one of the Problem* constants
+	Message       string `json:"message"`
+	Header        string `json:"header,omitempty"`        //for ProblemHeader, the header that was different
+	Expected      string `json:"expected,omitempty"`      //the normalised value that was captured
+	Actual        string `json:"actual,omitempty"`        //the normalised value that we got
+	Justification string `json:"justification,omitempty"` //if the problem was allowed, the reason why
+}
+
 type TestOutput struct {
 	Request   *EndpointEvent
 	Result    *EndpointEvent
 	ErrorList string //newline-separated list of problems detected
+	Problems  []TestProblem
+	Allowed   []TestProblem //differences that were accepted by an AllowRule, and don't fail the test
+	Passed    bool
+	Duration  time.Duration
+}
+
+/*
+Endpoint returns the name of the endpoint that the request was for, e.g. `video.php`
+*/
+func (t *TestOutput) Endpoint() string {
+	return t.Request.Endpoint()
 }
 
 /*
@@ -35,42 +65,84 @@ func (t *TestOutput) toCSV() *[]string {
 }
 
 /*
-AsyncWriter marshals incoming events into CSV rows and writes them to the given output file
+ReportWriter writes out test results in some format.  Add is called for every result, passed or failed, and Finish
+once all the tests are done.
 */
-func AsyncWriter(inputCh chan TestOutput, filename string) chan error {
-	errCh := make(chan error, 1)
+type ReportWriter interface {
+	Add(result *TestOutput) error
+	Finish(summary *Summary) error
+}
 
-	go func() {
-		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
-		if err != nil {
-			errCh <- err
-			return
-		}
-		defer f.Close()
+/*
+CSVReportWriter writes a row for every failed test as it comes in
+*/
+type CSVReportWriter struct {
+	writer       *csv.Writer
+	wroteHeaders bool
+}
 
-		writer := csv.NewWriter(f)
-		defer writer.Flush()
+func NewCSVReportWriter(out io.Writer) *CSVReportWriter {
+	return &CSVReportWriter{writer: csv.NewWriter(out)}
+}
 
-		writer.Write([]string{"Request URL", "Test result", "Expected status", "Actual status", "Expected output", "Actual output", "Expected headers", "Actual headers"})
-		n := 0
-		for {
-			n++
-			evt, moreEvents := <-inputCh
-			if !moreEvents {
-				log.Printf("INFO AsyncWriter got to end of input, shutting down")
-				errCh <- nil
-				return
-			}
+func (w *CSVReportWriter) Add(result *TestOutput) error {
+	if !w.wroteHeaders {
+		w.writer.Write([]string{"Request URL", "Test result", "Expected status", "Actual status", "Expected output", "Actual output", "Expected headers", "Actual headers"})
+		w.wroteHeaders = true
+	}
+	if result.Passed {
+		return nil
+	}
+	w.writer.Write(*result.toCSV())
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func (w *CSVReportWriter) Finish(summary *Summary) error {
+	if !w.wroteHeaders { //there were no results at all, so still write the header row
+		w.Add(&TestOutput{Passed: true})
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+/*
+AsyncWriter adds every incoming result to `summary` and to each of the report writers, then finishes them all once the
+input channel is closed.  Exactly one value is sent to the returned channel once the input is finished: nil if all the
+reports were written, or the first error.  The summary must only be read after that.
+*/
+func AsyncWriter(inputCh chan TestOutput, writers []ReportWriter, summary *Summary) chan error {
+	errCh := make(chan error, 1)
 
-			err := writer.Write(*evt.toCSV())
-			writer.Flush()
+	go func() {
+		var writeErr error
+		for evt := range inputCh {
+			summary.Add(&evt)
+			if summary.Total%100 == 0 {
+				log.Printf("INFO Running total %d / %d tests successful", summary.Passed, summary.Total)
+			}
+			if writeErr != nil {
+				continue //keep reading so that the tests can finish
+			}
+			for _, writer := range writers {
+				if err := writer.Add(&evt); err != nil {
+					log.Printf("ERROR Could not write result %d: %s", summary.Total, err)
+					writeErr = err
+					break
+				}
+			}
+		}
 
-			if err != nil {
-				log.Printf("ERROR Could not write CSV record %d: %s", n, err)
-				errCh <- err
-				return
+		log.Printf("INFO AsyncWriter got to end of input, shutting down")
+		if writeErr == nil {
+			for _, writer := range writers {
+				if err := writer.Finish(summary); err != nil {
+					writeErr = err
+					break
+				}
 			}
 		}
+		errCh <- writeErr
 	}()
 	return errCh
 }
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CorpusFormatJSONL = "jsonl"
+const CorpusFormatCSV = "csv"
+const CorpusFormatHAR = "har"
+
+/*
+CorpusFormatFor works out the format of a corpus file from its name, ignoring any .gz.  If `override` is set then it
+is used instead.
+*/
+func CorpusFormatFor(filename string, override string) (string, error) {
+	format := override
+	if format == "" {
+		name := strings.TrimSuffix(filename, ".gz")
+		dot := strings.LastIndex(name, ".")
+		if dot == -1 {
+			return "", fmt.Errorf("can't tell the format of %s from its name, use -format", filename)
+		}
+		format = strings.ToLower(name[dot+1:])
+	}
+
+	switch format {
+	case CorpusFormatJSONL, "ndjson":
+		return CorpusFormatJSONL, nil
+	case CorpusFormatCSV, CorpusFormatHAR:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown corpus format %s, expected jsonl, csv or har", format)
+	}
+}
+
+/*
+openForRead opens a file for reading, decompressing it if the name ends in .gz.  Call the returned function to close it.
+*/
+func openForRead(filename string) (io.Reader, func() error, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return f, f.Close, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return gz, func() error {
+		gz.Close()
+		return f.Close()
+	}, nil
+}
+
+/*
+openForWrite creates a file for writing, compressing it if the name ends in .gz.  Call the returned function to flush
+and close it.
+*/
+func openForWrite(filename string) (io.Writer, func() error, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return f, f.Close, nil
+	}
+
+	gz := gzip.NewWriter(f)
+	return gz, func() error {
+		if err := gz.Close(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
+
+/*
+fillInUid gives an event that was not captured with a uid a stable one, made from its timestamp and URL, so that it
+has the same uid every time the file is read
+*/
+func fillInUid(evt *EndpointEvent) {
+	if evt.Uid == (uuid.UUID{}) && evt.Timestamp != nil {
+		evt.Uid = uuid.NewSHA1(uuid.NameSpaceURL, []byte(evt.FormattedTimestamp()+" "+evt.AccessUrl))
+	}
+}
+
+/*
+ReadCorpusJSONL reads events from JSON Lines, one EndpointEvent per line, and passes each one to `emit`.  Blank lines
+are ignored.  Reading stops at the first invalid event.
+*/
+func ReadCorpusJSONL(in io.Reader, emit func(evt *EndpointEvent)) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		evt := &EndpointEvent{}
+		if err := json.Unmarshal([]byte(line), evt); err != nil {
+			return fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		fillInUid(evt)
+		if !evt.IsValid() {
+			return fmt.Errorf("line %d: EndpointEvent record is not valid", lineNo)
+		}
+		emit(evt)
+	}
+	return scanner.Err()
+}
+
+var corpusCSVColumns = []string{"uid", "timestamp", "access_url", "response_code", "output_message", "headers"}
+
+/*
+ReadCorpusCSV reads events from a CSV file.  The first row must name the columns, which can be in any order:
+`timestamp` (RFC3339), `access_url` and `response_code` are required, `uid`, `output_message` and `headers` (a json
+object) are optional.  Other columns are ignored.  Reading stops at the first invalid event.
+*/
+func ReadCorpusCSV(in io.Reader, emit func(evt *EndpointEvent)) error {
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	titles, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("could not read the header row: %s", err)
+	}
+	columnIndex := make(map[string]int, len(titles))
+	for i, title := range titles {
+		columnIndex[strings.ToLower(strings.TrimSpace(title))] = i
+	}
+	for _, required := range []string{"timestamp", "access_url", "response_code"} {
+		if _, haveColumn := columnIndex[required]; !haveColumn {
+			return fmt.Errorf("there is no %s column", required)
+		}
+	}
+
+	rowNo := 1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rowNo++
+		field := func(name string) string {
+			if i, haveColumn := columnIndex[name]; haveColumn && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+
+		evt := &EndpointEvent{
+			AccessUrl:             field("access_url"),
+			ExpectedOutputMessage: field("output_message"),
+		}
+		if uidString := field("uid"); uidString != "" {
+			evt.Uid, err = uuid.Parse(uidString)
+			if err != nil {
+				return fmt.Errorf("row %d: invalid uid: %s", rowNo, err)
+			}
+		}
+		timestamp, err := time.Parse(time.RFC3339, field("timestamp"))
+		if err != nil {
+			return fmt.Errorf("row %d: invalid timestamp: %s", rowNo, err)
+		}
+		evt.Timestamp = &timestamp
+		responseCode, err := strconv.ParseInt(field("response_code"), 10, 16)
+		if err != nil {
+			return fmt.Errorf("row %d: invalid response_code: %s", rowNo, err)
+		}
+		evt.ExpectedResponse = int16(responseCode)
+		if headers := field("headers"); headers != "" {
+			if err := json.Unmarshal([]byte(headers), &evt.ExpectedOutputHeaders); err != nil {
+				return fmt.Errorf("row %d: headers must be a json object: %s", rowNo, err)
+			}
+		}
+
+		fillInUid(evt)
+		if !evt.IsValid() {
+			return fmt.Errorf("row %d: EndpointEvent record is not valid", rowNo)
+		}
+		emit(evt)
+	}
+}
+
+/*
+harFile is the part of an HTTP Archive (as saved by a browser's developer tools) that we need
+*/
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime string `json:"startedDateTime"`
+			Request         struct {
+				Method string `json:"method"`
+				Url    string `json:"url"`
+			} `json:"request"`
+			Response struct {
+				Status  int `json:"status"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				Content struct {
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+/*
+ReadCorpusHAR reads events from an HTTP Archive.  Only GET requests are used, and entries that did not get a response
+(such as blocked or cancelled requests) are skipped with a warning.
+*/
+func ReadCorpusHAR(in io.Reader, emit func(evt *EndpointEvent)) error {
+	var har harFile
+	if err := json.NewDecoder(in).Decode(&har); err != nil {
+		return err
+	}
+	if har.Log.Entries == nil {
+		return errors.New("there is no log.entries list, this does not look like a HAR file")
+	}
+
+	for i, entry := range har.Log.Entries {
+		if entry.Request.Method != "GET" {
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339, entry.StartedDateTime)
+		if err != nil {
+			return fmt.Errorf("entry %d: invalid startedDateTime: %s", i, err)
+		}
+		evt := &EndpointEvent{
+			Timestamp:             &timestamp,
+			AccessUrl:             entry.Request.Url,
+			ExpectedOutputMessage: entry.Response.Content.Text,
+			ExpectedOutputHeaders: make(map[string]string, len(entry.Response.Headers)),
+			ExpectedResponse:      int16(entry.Response.Status),
+		}
+		if entry.Response.Content.Encoding == "base64" {
+			body, err := base64.StdEncoding.DecodeString(entry.Response.Content.Text)
+			if err != nil {
+				return fmt.Errorf("entry %d: invalid base64 content: %s", i, err)
+			}
+			evt.ExpectedOutputMessage = string(body)
+		}
+		for _, hdr := range entry.Response.Headers {
+			evt.ExpectedOutputHeaders[hdr.Name] = hdr.Value
+		}
+
+		fillInUid(evt)
+		if !evt.IsValid() {
+			log.Printf("WARNING Skipping HAR entry %d for %s, it has no usable response", i, entry.Request.Url)
+			continue
+		}
+		emit(evt)
+	}
+	return nil
+}
+
+/*
+AsyncFileReader reads a corpus from a file in the given format and outputs its events, in the same way as
+AsyncRecordReader does for a table.  The output channel is closed at the end of the file or on error, and an error is
+put onto the error channel if the file could not be read.
+*/
+func AsyncFileReader(filename string, format string, filter *EventFilter) (chan *EndpointEvent, chan error) {
+	outputCh := make(chan *EndpointEvent, 100)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(outputCh)
+		in, closeFile, err := openForRead(filename)
+		if err != nil {
+			log.Printf("ERROR %s", err)
+			errCh <- err
+			return
+		}
+		defer closeFile()
+
+		emit := func(evt *EndpointEvent) {
+			if filter.Accept(evt) {
+				outputCh <- evt
+			}
+		}
+
+		switch format {
+		case CorpusFormatJSONL:
+			err = ReadCorpusJSONL(in, emit)
+		case CorpusFormatCSV:
+			err = ReadCorpusCSV(in, emit)
+		case CorpusFormatHAR:
+			err = ReadCorpusHAR(in, emit)
+		default:
+			err = fmt.Errorf("unknown corpus format %s", format)
+		}
+		if err != nil {
+			log.Printf("ERROR Could not read %s: %s", filename, err)
+			errCh <- fmt.Errorf("%s: %s", filename, err)
+			return
+		}
+		log.Printf("INFO AsyncFileReader read %s, %s", filename, filter.Describe())
+	}()
+	return outputCh, errCh
+}
+
+/*
+CorpusWriter writes events out to a corpus file
+*/
+type CorpusWriter interface {
+	Write(evt *EndpointEvent) error
+	Flush() error
+}
+
+type jsonlCorpusWriter struct {
+	writer *bufio.Writer
+}
+
+func (w *jsonlCorpusWriter) Write(evt *EndpointEvent) error {
+	content, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	w.writer.Write(content)
+	return w.writer.WriteByte('\n')
+}
+
+func (w *jsonlCorpusWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+type csvCorpusWriter struct {
+	writer       *csv.Writer
+	wroteHeaders bool
+}
+
+func (w *csvCorpusWriter) Write(evt *EndpointEvent) error {
+	if !w.wroteHeaders {
+		if err := w.writer.Write(corpusCSVColumns); err != nil {
+			return err
+		}
+		w.wroteHeaders = true
+	}
+	headers, err := json.Marshal(evt.ExpectedOutputHeaders)
+	if err != nil {
+		return err
+	}
+	return w.writer.Write([]string{
+		evt.Uid.String(),
+		evt.FormattedTimestamp(),
+		evt.AccessUrl,
+		strconv.Itoa(int(evt.ExpectedResponse)),
+		evt.ExpectedOutputMessage,
+		string(headers),
+	})
+}
+
+func (w *csvCorpusWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+/*
+NewCorpusWriter returns a CorpusWriter for the given format.  HAR files can be read but not written.
+*/
+func NewCorpusWriter(out io.Writer, format string) (CorpusWriter, error) {
+	switch format {
+	case CorpusFormatJSONL:
+		return &jsonlCorpusWriter{writer: bufio.NewWriter(out)}, nil
+	case CorpusFormatCSV:
+		return &csvCorpusWriter{writer: csv.NewWriter(out)}, nil
+	default:
+		return nil, fmt.Errorf("can't write a corpus as %s, use jsonl or csv", format)
+	}
+}
+
+/*
+ExportCorpus writes every event from `inputCh` to `writer` until the channel is closed.  An error from `errCh` stops the
+export.  Returns the number of events written.
+*/
+func ExportCorpus(inputCh chan *EndpointEvent, errCh chan error, writer CorpusWriter) (int, error) {
+	count := 0
+	for {
+		select {
+		case evt, haveMore := <-inputCh:
+			if !haveMore {
+				select { //the reader closes the output channel after sending an error, so make sure we don't miss it
+				case err := <-errCh:
+					if err != nil {
+						return count, err
+					}
+				default:
+				}
+				return count, writer.Flush()
+			}
+			if err := writer.Write(evt); err != nil {
+				return count, err
+			}
+			count++
+		case err := <-errCh:
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+}
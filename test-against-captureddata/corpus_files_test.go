@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"strings"
+	"testing"
+)
+
+func TestCorpusFormatFor(t *testing.T) {
+	tests := map[string]string{
+		"corpus.jsonl":    CorpusFormatJSONL,
+		"corpus.jsonl.gz": CorpusFormatJSONL,
+		"corpus.ndjson":   CorpusFormatJSONL,
+		"Corpus.CSV":      CorpusFormatCSV,
+		"capture.har":     CorpusFormatHAR,
+	}
+	for filename, expected := range tests {
+		format, err := CorpusFormatFor(filename, "")
+		if err != nil || format != expected {
+			t.Errorf("%s: expected %s got %s, %v", filename, expected, format, err)
+		}
+	}
+
+	if _, err := CorpusFormatFor("corpus", ""); err == nil {
+		t.Error("expected an error for a file with no extension")
+	}
+	if _, err := CorpusFormatFor("corpus.txt", ""); err == nil {
+		t.Error("expected an error for an unknown extension")
+	}
+	if format, _ := CorpusFormatFor("corpus.txt", "csv"); format != CorpusFormatCSV {
+		t.Errorf("the override should be used, got %s", format)
+	}
+}
+
+func collectEvents(t *testing.T, read func(func(evt *EndpointEvent)) error) []*EndpointEvent {
+	events := make([]*EndpointEvent, 0)
+	err := read(func(evt *EndpointEvent) {
+		events = append(events, evt)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return events
+}
+
+func TestCorpusRoundTrip(t *testing.T) {
+	original := []*EndpointEvent{
+		testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=myfile", 200, "https://cdn.example.com/low.mp4\n",
+			map[string]string{"Content-type": "text/plain"}),
+		testEvent("https://multimedia.example.com/interactivevideos/mediatag.php?file=myfile", 404, "No content found, \"quoted\"\nwith a newline", nil),
+	}
+
+	for _, format := range []string{CorpusFormatJSONL, CorpusFormatCSV} {
+		buffer := &bytes.Buffer{}
+		writer, err := NewCorpusWriter(buffer, format)
+		if err != nil {
+			t.Fatalf("%s: could not make writer: %s", format, err)
+		}
+		for _, evt := range original {
+			if err := writer.Write(evt); err != nil {
+				t.Fatalf("%s: could not write: %s", format, err)
+			}
+		}
+		writer.Flush()
+
+		var events []*EndpointEvent
+		if format == CorpusFormatJSONL {
+			events = collectEvents(t, func(emit func(evt *EndpointEvent)) error { return ReadCorpusJSONL(buffer, emit) })
+		} else {
+			events = collectEvents(t, func(emit func(evt *EndpointEvent)) error { return ReadCorpusCSV(buffer, emit) })
+		}
+		if len(events) != len(original) {
+			t.Fatalf("%s: expected %d events got %d", format, len(original), len(events))
+		}
+		for i, evt := range events {
+			if evt.Uid != original[i].Uid || evt.AccessUrl != original[i].AccessUrl || !evt.Timestamp.Equal(*original[i].Timestamp) ||
+				evt.ExpectedResponse != original[i].ExpectedResponse || evt.ExpectedOutputMessage != original[i].ExpectedOutputMessage ||
+				len(evt.ExpectedOutputHeaders) != len(original[i].ExpectedOutputHeaders) {
+				t.Errorf("%s: event %d did not survive the round trip, got %v", format, i, evt)
+			}
+		}
+	}
+}
+
+func TestReadCorpusCSVWithoutUids(t *testing.T) {
+	content := "access_url,timestamp,response_code,extra\n" +
+		"https://multimedia.example.com/interactivevideos/video.php?file=a,2020-01-01T00:00:00Z,302,ignored\n"
+	first := collectEvents(t, func(emit func(evt *EndpointEvent)) error { return ReadCorpusCSV(strings.NewReader(content), emit) })
+	second := collectEvents(t, func(emit func(evt *EndpointEvent)) error { return ReadCorpusCSV(strings.NewReader(content), emit) })
+	if len(first) != 1 || first[0].ExpectedResponse != 302 {
+		t.Fatalf("got unexpected events %v", first)
+	}
+	if first[0].Uid != second[0].Uid {
+		t.Error("the generated uid should be the same every time the file is read")
+	}
+
+	err := ReadCorpusCSV(strings.NewReader("access_url,timestamp\n"), func(evt *EndpointEvent) {})
+	if err == nil || !strings.Contains(err.Error(), "response_code") {
+		t.Errorf("expected an error for the missing column, got %v", err)
+	}
+}
+
+func TestReadCorpusHAR(t *testing.T) {
+	content := `{"log":{"entries":[
+{"startedDateTime":"2020-01-01T10:00:00.123Z","request":{"method":"GET","url":"https://multimedia.example.com/interactivevideos/reference.php?file=a"},
+ "response":{"status":200,"headers":[{"name":"Content-Type","value":"text/plain;charset=UTF-8"}],"content":{"text":"aHR0cHM6Ly9jZG4uZXhhbXBsZS5jb20vYS5tcDQ=","encoding":"base64"}}},
+{"startedDateTime":"2020-01-01T10:00:01Z","request":{"method":"OPTIONS","url":"https://multimedia.example.com/interactivevideos/reference.php?file=a"},
+ "response":{"status":200,"headers":[],"content":{}}},
+{"startedDateTime":"2020-01-01T10:00:02Z","request":{"method":"GET","url":"https://multimedia.example.com/interactivevideos/video.php?file=b"},
+ "response":{"status":0,"headers":[],"content":{}}}
+]}}`
+	events := collectEvents(t, func(emit func(evt *EndpointEvent)) error { return ReadCorpusHAR(strings.NewReader(content), emit) })
+	if len(events) != 1 {
+		t.Fatalf("expected only the GET with a response, got %d events", len(events))
+	}
+	if events[0].ExpectedOutputMessage != "https://cdn.example.com/a.mp4" {
+		t.Errorf("the base64 body was not decoded, got %s", events[0].ExpectedOutputMessage)
+	}
+	if events[0].ExpectedOutputHeaders["Content-Type"] != "text/plain;charset=UTF-8" {
+		t.Errorf("got unexpected headers %v", events[0].ExpectedOutputHeaders)
+	}
+
+	if err := ReadCorpusHAR(strings.NewReader(`{"something":"else"}`), func(evt *EndpointEvent) {}); err == nil {
+		t.Error("expected an error for a file that is not a HAR")
+	}
+}
+
+func TestExportCorpusStopsOnError(t *testing.T) {
+	inputCh := make(chan *EndpointEvent, 2)
+	errCh := make(chan error, 1)
+	inputCh <- testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=a", 200, "", nil)
+	errCh <- errors.New("scan failed")
+	close(inputCh)
+
+	writer, _ := NewCorpusWriter(&bytes.Buffer{}, CorpusFormatJSONL)
+	_, err := ExportCorpus(inputCh, errCh, writer)
+	if err == nil || err.Error() != "scan failed" {
+		t.Errorf("expected the read error to be returned, got %v", err)
+	}
+}
+
+func TestReadCorpusFromCapture(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	capture := common.NewCapture(common.NewJSONLCaptureSink(buffer), 100)
+	capture.Record(context.Background(), &events.APIGatewayProxyRequest{
+		Path:                  "/interactivevideos/reference.php",
+		Headers:               map[string]string{"Host": "multimedia.example.com"},
+		QueryStringParameters: map[string]string{"file": "myfile"},
+	}, &events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       "https://cdn.example.com/low.mp4",
+	})
+
+	captured := make([]*EndpointEvent, 0)
+	if err := ReadCorpusJSONL(buffer, func(evt *EndpointEvent) { captured = append(captured, evt) }); err != nil {
+		t.Fatalf("captured requests could not be read as a corpus: %s", err)
+	}
+	if len(captured) != 1 || !captured[0].IsValid() || captured[0].AccessUrl != "https://multimedia.example.com/interactivevideos/reference.php?file=myfile" ||
+		captured[0].ExpectedOutputHeaders["Content-Type"] != "text/plain" {
+		t.Errorf("got unexpected events %v", captured)
+	}
+}
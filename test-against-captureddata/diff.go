@@ -0,0 +1,87 @@
+package main
+
+import "strings"
+
+// kinds of diffRow
+const DiffSame = "same"
+const DiffChanged = "changed"
+const DiffRemoved = "removed" //only on the left (expected) side
+const DiffAdded = "added"     //only on the right (actual) side
+
+/*
+diffRow is one row of a side-by-side diff
+*/
+type diffRow struct {
+	Left  string
+	Right string
+	Kind  string //one of the Diff* constants
+}
+
+// beyond this many line comparisons the texts are shown side by side without lining them up
+const maxDiffComparisons = 1000000
+
+/*
+diffLines lines up two texts for a side-by-side comparison, using the longest common subsequence of lines.  A run of
+removed lines followed by added lines is shown as changed lines next to each other.
+*/
+func diffLines(left string, right string) []diffRow {
+	a := strings.Split(left, "\n")
+	b := strings.Split(right, "\n")
+	if len(a)*len(b) > maxDiffComparisons {
+		return []diffRow{{Left: left, Right: right, Kind: DiffChanged}}
+	}
+
+	//lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	rows := make([]diffRow, 0, len(a)+len(b))
+	removed := make([]string, 0)
+	added := make([]string, 0)
+	flush := func() {
+		for k := 0; k < len(removed) || k < len(added); k++ {
+			switch {
+			case k < len(removed) && k < len(added):
+				rows = append(rows, diffRow{Left: removed[k], Right: added[k], Kind: DiffChanged})
+			case k < len(removed):
+				rows = append(rows, diffRow{Left: removed[k], Kind: DiffRemoved})
+			default:
+				rows = append(rows, diffRow{Right: added[k], Kind: DiffAdded})
+			}
+		}
+		removed = removed[:0]
+		added = added[:0]
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			flush()
+			rows = append(rows, diffRow{Left: a[i], Right: b[j], Kind: DiffSame})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, a[i])
+			i++
+		default:
+			added = append(added, b[j])
+			j++
+		}
+	}
+	flush()
+	return rows
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+EventFilter decides which of the captured events are used.  Sampling and sharding are decided from a hash of each
+event rather than the order they are read in, so that the same options always give the same events from the same
+corpus.  It keeps state for deduplication, so use a new one for each reader.
+*/
+type EventFilter struct {
+	Endpoint      string           //only events whose URL contains this
+	Include       []*regexp.Regexp //if set, only events whose URL matches at least one of these
+	Exclude       []*regexp.Regexp //no events whose URL matches any of these
+	Since         *time.Time       //only events captured at or after this
+	Until         *time.Time       //only events captured before this
+	Statuses      []string         //if set, only events with one of these response codes. `3xx` matches a class
+	SamplePercent float64          //if between 0 and 100, only this percentage of events
+	Seed          int64            //changes which events are sampled
+	Dedup         bool             //only the first event for each URL
+	Shard         int              //with Shards, only events in this shard, counting from 1
+	Shards        int              //if more than 1, split the events into this many shards
+	Read          int              //number of events that were checked
+	Accepted      int              //number of events that were used
+	seen          map[string]bool
+}
+
+/*
+NewEventFilter returns a filter that accepts everything
+*/
+func NewEventFilter() *EventFilter {
+	return &EventFilter{SamplePercent: 100, seen: make(map[string]bool)}
+}
+
+func hashOf(parts ...string) uint64 {
+	h := fnv.New64a()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+/*
+selectionKey is what sampling and sharding are decided on.  When deduplicating it is the URL, so that every capture of
+a URL ends up in the same shard and the shards don't overlap.
+*/
+func (f *EventFilter) selectionKey(evt *EndpointEvent) string {
+	if f.Dedup {
+		return evt.AccessUrl
+	}
+	return evt.Uid.String()
+}
+
+func (f *EventFilter) statusMatches(status int16) bool {
+	if len(f.Statuses) == 0 {
+		return true
+	}
+	code := strconv.Itoa(int(status))
+	for _, wanted := range f.Statuses {
+		if wanted == code || (strings.HasSuffix(wanted, "xx") && len(code) == 3 && code[0] == wanted[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *EventFilter) urlMatches(accessUrl string) bool {
+	if f.Endpoint != "" && !strings.Contains(accessUrl, f.Endpoint) {
+		return false
+	}
+	for _, pattern := range f.Exclude {
+		if pattern.MatchString(accessUrl) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if pattern.MatchString(accessUrl) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *EventFilter) timeMatches(timestamp *time.Time) bool {
+	if f.Since == nil && f.Until == nil {
+		return true
+	}
+	if timestamp == nil {
+		return false
+	}
+	return (f.Since == nil || !timestamp.Before(*f.Since)) && (f.Until == nil || timestamp.Before(*f.Until))
+}
+
+/*
+Accept returns true if the event should be used.  It is not safe to call from more than one goroutine.
+*/
+func (f *EventFilter) Accept(evt *EndpointEvent) bool {
+	f.Read++
+	if !f.urlMatches(evt.AccessUrl) || !f.timeMatches(evt.Timestamp) || !f.statusMatches(evt.ExpectedResponse) {
+		return false
+	}
+	key := f.selectionKey(evt)
+	if f.Shards > 1 && int(hashOf("shard", key)%uint64(f.Shards)) != f.Shard-1 {
+		return false
+	}
+	if f.SamplePercent < 100 && float64(hashOf("sample", strconv.FormatInt(f.Seed, 10), key)%10000) >= f.SamplePercent*100 {
+		return false
+	}
+	if f.Dedup {
+		if f.seen[evt.AccessUrl] {
+			return false
+		}
+		f.seen[evt.AccessUrl] = true
+	}
+	f.Accepted++
+	return true
+}
+
+/*
+Describe returns a summary of how many events the filter used, for the log
+*/
+func (f *EventFilter) Describe() string {
+	if f.Shards > 1 {
+		return fmt.Sprintf("selected %d of %d events for shard %d of %d", f.Accepted, f.Read, f.Shard, f.Shards)
+	}
+	return fmt.Sprintf("selected %d of %d events", f.Accepted, f.Read)
+}
+
+/*
+stringList is a flag that can be given more than once
+*/
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func parseFilterTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a time like 2006-01-02 or 2006-01-02T15:04:05Z", value)
+}
+
+var statusFilterMatcher = regexp.MustCompile(`^[1-5]([0-9][0-9]|xx)$`)
+
+/*
+AddEventFilterFlags adds the options for choosing events to the given flags.  Call the returned function after the
+flags are parsed to get the EventFilter.
+*/
+func AddEventFilterFlags(flags *flag.FlagSet) func() (*EventFilter, error) {
+	endpoint := flags.String("filter", "", "if set, limit to only this endpoint")
+	var include, exclude stringList
+	flags.Var(&include, "url-regex", "only use events whose URL matches this regex. Can be given more than once")
+	flags.Var(&exclude, "exclude-url-regex", "don't use events whose URL matches this regex. Can be given more than once")
+	since := flags.String("since", "", "only use events captured at or after this time, e.g. 2020-01-31 or 2020-01-31T12:00:00Z")
+	until := flags.String("until", "", "only use events captured before this time")
+	statuses := flags.String("status", "", "only use events with these response codes, separated by commas, e.g. 200,3xx")
+	sample := flags.Float64("sample", 100, "only use this percentage of the events")
+	seed := flags.Int64("seed", 0, "change this to pick a different sample with -sample")
+	dedup := flags.Bool("dedup", false, "only use the first event for each URL")
+	shard := flags.String("shard", "", "N/M to only use the Nth of M shards of the events, e.g. to split a run between CI jobs")
+
+	return func() (*EventFilter, error) {
+		filter := NewEventFilter()
+		filter.Endpoint = *endpoint
+		for _, list := range []struct {
+			values  stringList
+			targets *[]*regexp.Regexp
+		}{{include, &filter.Include}, {exclude, &filter.Exclude}} {
+			for _, value := range list.values {
+				pattern, err := regexp.Compile(value)
+				if err != nil {
+					return nil, err
+				}
+				*list.targets = append(*list.targets, pattern)
+			}
+		}
+
+		var err error
+		if filter.Since, err = parseFilterTime(*since); err != nil {
+			return nil, err
+		}
+		if filter.Until, err = parseFilterTime(*until); err != nil {
+			return nil, err
+		}
+		if *statuses != "" {
+			for _, status := range strings.Split(*statuses, ",") {
+				status = strings.ToLower(strings.TrimSpace(status))
+				if !statusFilterMatcher.MatchString(status) {
+					return nil, fmt.Errorf("%s is not a response code like 200 or 3xx", status)
+				}
+				filter.Statuses = append(filter.Statuses, status)
+			}
+		}
+
+		if *sample <= 0 || *sample > 100 {
+			return nil, errors.New("-sample must be more than 0 and at most 100")
+		}
+		filter.SamplePercent = *sample
+		filter.Seed = *seed
+		filter.Dedup = *dedup
+
+		if *shard != "" {
+			if _, err := fmt.Sscanf(*shard, "%d/%d", &filter.Shard, &filter.Shards); err != nil ||
+				filter.Shards < 1 || filter.Shard < 1 || filter.Shard > filter.Shards {
+				return nil, fmt.Errorf("-shard must be like 2/5, got %s", *shard)
+			}
+		}
+		return filter, nil
+	}
+}
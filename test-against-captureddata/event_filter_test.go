@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testFilterEvents() []*EndpointEvent {
+	events := make([]*EndpointEvent, 0, 200)
+	for i := 0; i < 200; i++ {
+		evt := testEvent(fmt.Sprintf("https://multimedia.example.com/interactivevideos/reference.php?file=%d", i%100), 200, "", nil)
+		ts := time.Date(2020, 1, 1, 0, 0, i, 0, time.UTC)
+		evt.Timestamp = &ts
+		events = append(events, evt)
+	}
+	return events
+}
+
+func acceptedBy(filter *EventFilter, events []*EndpointEvent) []*EndpointEvent {
+	accepted := make([]*EndpointEvent, 0)
+	for _, evt := range events {
+		if filter.Accept(evt) {
+			accepted = append(accepted, evt)
+		}
+	}
+	return accepted
+}
+
+func parseFilter(t *testing.T, args ...string) (*EventFilter, error) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	newFilter := AddEventFilterFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("could not parse %v: %s", args, err)
+	}
+	return newFilter()
+}
+
+func TestEventFilterDefaultsAcceptEverything(t *testing.T) {
+	filter, err := parseFilter(t)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if accepted := acceptedBy(filter, testFilterEvents()); len(accepted) != 200 {
+		t.Errorf("expected every event, got %d", len(accepted))
+	}
+	if filter.Describe() != "selected 200 of 200 events" {
+		t.Errorf("got unexpected description %s", filter.Describe())
+	}
+}
+
+func TestEventFilterUrlTimeAndStatus(t *testing.T) {
+	events := testFilterEvents()
+	events[0].ExpectedResponse = 302
+	events[1].ExpectedResponse = 404
+
+	filter, err := parseFilter(t, "-url-regex", `file=1\d$`, "-url-regex", `file=2$`, "-exclude-url-regex", `file=15`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if accepted := acceptedBy(filter, events); len(accepted) != 20 { //10-19 and 2, less 15, twice each
+		t.Errorf("expected 20 events, got %d", len(accepted))
+	}
+
+	filter, _ = parseFilter(t, "-since", "2020-01-01T00:01:00Z", "-until", "2020-01-01T00:02:00Z")
+	if accepted := acceptedBy(filter, events); len(accepted) != 60 || accepted[0].Timestamp.Second() != 0 {
+		t.Errorf("expected a minute of events, got %d", len(accepted))
+	}
+
+	filter, _ = parseFilter(t, "-status", "3xx, 404")
+	if accepted := acceptedBy(filter, events); len(accepted) != 2 {
+		t.Errorf("expected the 302 and the 404, got %d", len(accepted))
+	}
+}
+
+func TestEventFilterSamplingIsReproducible(t *testing.T) {
+	events := testFilterEvents()
+	first, _ := parseFilter(t, "-sample", "25", "-seed", "1")
+	again, _ := parseFilter(t, "-sample", "25", "-seed", "1")
+	other, _ := parseFilter(t, "-sample", "25", "-seed", "2")
+
+	sampled := acceptedBy(first, events)
+	if len(sampled) < 30 || len(sampled) > 70 {
+		t.Errorf("expected about 50 events, got %d", len(sampled))
+	}
+	reversed := make([]*EndpointEvent, len(events))
+	for i, evt := range events {
+		reversed[len(events)-1-i] = evt
+	}
+	if sampledAgain := acceptedBy(again, reversed); len(sampledAgain) != len(sampled) || sampledAgain[0] != sampled[len(sampled)-1] {
+		t.Error("the same seed should give the same sample whatever order the events are read in")
+	}
+	if sampledOther := acceptedBy(other, events); len(sampledOther) == len(sampled) && sampledOther[0] == sampled[0] {
+		t.Error("a different seed should give a different sample")
+	}
+}
+
+func TestEventFilterShardsAndDedup(t *testing.T) {
+	events := testFilterEvents()
+	seen := make(map[string]int)
+	total := 0
+	for shard := 1; shard <= 3; shard++ {
+		filter, err := parseFilter(t, "-shard", fmt.Sprintf("%d/3", shard), "-dedup")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, evt := range acceptedBy(filter, events) {
+			seen[evt.AccessUrl]++
+			total++
+		}
+	}
+	if total != 100 || len(seen) != 100 {
+		t.Errorf("expected the shards to cover each of the 100 URLs once, got %d events for %d URLs", total, len(seen))
+	}
+
+	filter, _ := parseFilter(t, "-shard", "2/2")
+	if accepted := acceptedBy(filter, events); len(accepted) == 0 || len(accepted) == 200 || filter.Describe() != fmt.Sprintf("selected %d of 200 events for shard 2 of 2", len(accepted)) {
+		t.Errorf("expected some of the events in shard 2, got %s", filter.Describe())
+	}
+}
+
+func TestEventFilterInvalidOptions(t *testing.T) {
+	for _, args := range [][]string{
+		{"-url-regex", "("},
+		{"-since", "yesterday"},
+		{"-status", "20"},
+		{"-sample", "0"},
+		{"-shard", "3/2"},
+		{"-shard", "1"},
+	} {
+		if _, err := parseFilter(t, args...); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+/*
+HandlerFetcher runs the captured requests through the endpoint handlers in this process, rather than sending them to
+a deployed stage.  The handlers are looked up by the last part of the captured URL's path, e.g. `video.php`.
+*/
+type HandlerFetcher struct {
+	handlers map[string]common.EndpointHandler
+}
+
+/*
+NewHandlerFetcher returns a HandlerFetcher for reference.php, video.php and mediatag.php, answering from the given deps
+*/
+func NewHandlerFetcher(deps *common.HandlerDeps) *HandlerFetcher {
+	return &HandlerFetcher{
+		handlers: map[string]common.EndpointHandler{
+			"reference.php": common.InstrumentHandler("reference", common.NewReferenceHandler(deps)),
+			"video.php":     common.InstrumentHandler("video", common.NewVideoHandler(deps)),
+			"mediatag.php":  common.InstrumentHandler("mediatag", common.NewMediaTagHandler(deps)),
+		},
+	}
+}
+
+/*
+makeProxyRequest builds the event that API Gateway would send to the lambda for the given URL.
+Returns the event and the name of the endpoint, i.e. the last part of the path.
+*/
+func makeProxyRequest(accessUrl string) (*events.APIGatewayProxyRequest, string, error) {
+	parsed, err := url.Parse(accessUrl)
+	if err != nil {
+		return nil, "", err
+	}
+	query, err := url.ParseQuery(parsed.RawQuery)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not parse query string of %s: %s", accessUrl, err)
+	}
+
+	rq := &events.APIGatewayProxyRequest{
+		HTTPMethod:                      "GET",
+		Path:                            parsed.Path,
+		Headers:                         map[string]string{"Host": parsed.Host},
+		MultiValueHeaders:               map[string][]string{"Host": {parsed.Host}},
+		QueryStringParameters:           make(map[string]string, len(query)),
+		MultiValueQueryStringParameters: make(map[string][]string, len(query)),
+	}
+	for k, values := range query {
+		rq.QueryStringParameters[k] = values[len(values)-1] //API Gateway gives the last value if there are several
+		rq.MultiValueQueryStringParameters[k] = values
+	}
+	return rq, path.Base(parsed.Path), nil
+}
+
+func (f *HandlerFetcher) Fetch(evt *EndpointEvent) (*FetchedResponse, error) {
+	rq, endpointName, err := makeProxyRequest(evt.AccessUrl)
+	if err != nil {
+		return nil, err
+	}
+	handler, haveHandler := f.handlers[endpointName]
+	if !haveHandler {
+		return nil, fmt.Errorf("there is no in-process handler for %s", endpointName)
+	}
+
+	response, err := handler(context.Background(), rq)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header, len(response.Headers))
+	for k, v := range response.Headers {
+		header.Set(k, v)
+	}
+	for k, values := range response.MultiValueHeaders {
+		for _, v := range values {
+			header.Add(k, v)
+		}
+	}
+
+	body := []byte(response.Body)
+	if response.IsBase64Encoded {
+		body, err = base64.StdEncoding.DecodeString(response.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &FetchedResponse{
+		Url:        evt.AccessUrl,
+		StatusCode: response.StatusCode,
+		Header:     header,
+		Body:       body,
+	}, nil
+}
+
+/*
+loadSnapshotFile reads a snapshot made by `migration export`.  Files ending in .gz are decompressed.
+*/
+func loadSnapshotFile(filename string) ([]common.RawDynamoRecord, error) {
+	in, closeFile, err := openForRead(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+
+	records, err := common.ReadSnapshot(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return records, nil
+}
+
+/*
+NewSnapshotOps returns a DynamoDbOps that answers from snapshots of the encodings, idmapping and (optionally) mime
+equivalents tables, so that the handlers can be run without AWS access
+*/
+func NewSnapshotOps(encodingsFile string, idMappingFile string, mimeEquivalentsFile string) (*common.MemoryDynamoDbOps, error) {
+	ops := &common.MemoryDynamoDbOps{}
+	var err error
+	ops.Encodings, err = loadSnapshotFile(encodingsFile)
+	if err != nil {
+		return nil, err
+	}
+	ops.IdMappings, err = loadSnapshotFile(idMappingFile)
+	if err != nil {
+		return nil, err
+	}
+	if mimeEquivalentsFile != "" {
+		ops.MimeEquivalents, err = loadSnapshotFile(mimeEquivalentsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
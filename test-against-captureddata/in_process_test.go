@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEncodings = `{"encodingid":{"N":"1"},"contentid":{"N":"1234"},"fcs_id":{"S":"KP-1234"},"url":{"S":"https://cdn.example.com/low.mp4"},"format":{"S":"video/mp4"},"mobile":{"BOOL":false},"multirate":{"BOOL":false},"vbitrate":{"N":"512"},"lastupdate":{"S":"2020-01-02T03:04:05Z"},"frame_width":{"N":"640"},"frame_height":{"N":"360"},"duration":{"N":"12.5"},"file_size":{"N":"100000"},"octopus_id":{"N":"5678"},"aspect":{"S":"16:9"}}`
+const testIdMappings = `{"uuid":{"S":"b"},"contentid":{"N":"1234"},"filebase":{"S":"myfile"},"octopus_id":{"N":"5678"},"lastupdate":{"S":"2020-01-01T00:00:00Z"}}`
+
+func testFetcher(t *testing.T) *HandlerFetcher {
+	encodings, err := common.ReadSnapshot(strings.NewReader(testEncodings))
+	if err != nil {
+		t.Fatalf("could not load encodings: %s", err)
+	}
+	idMappings, err := common.ReadSnapshot(strings.NewReader(testIdMappings))
+	if err != nil {
+		t.Fatalf("could not load id mappings: %s", err)
+	}
+	return NewHandlerFetcher(&common.HandlerDeps{
+		Ops:       &common.MemoryDynamoDbOps{Encodings: encodings, IdMappings: idMappings},
+		Config:    &common.ConfigMock{},
+		MimeCache: &common.MimeEquivalentsCacheMock{},
+	})
+}
+
+func testEvent(accessUrl string, expectedStatus int16, expectedBody string, expectedHeaders map[string]string) *EndpointEvent {
+	ts := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	return &EndpointEvent{
+		Uid:                   uuid.New(),
+		Timestamp:             &ts,
+		AccessUrl:             accessUrl,
+		ExpectedOutputMessage: expectedBody,
+		ExpectedOutputHeaders: expectedHeaders,
+		ExpectedResponse:      expectedStatus,
+	}
+}
+
+func TestMakeProxyRequest(t *testing.T) {
+	rq, endpointName, err := makeProxyRequest("https://multimedia.example.com/interactivevideos/video.php?octopusid=5678&format=video%2Fmp4&format=video%2Fwebm")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if endpointName != "video.php" {
+		t.Errorf("expected endpoint video.php got %s", endpointName)
+	}
+	if rq.Path != "/interactivevideos/video.php" {
+		t.Errorf("got unexpected path %s", rq.Path)
+	}
+	if rq.QueryStringParameters["octopusid"] != "5678" {
+		t.Errorf("got unexpected octopusid %s", rq.QueryStringParameters["octopusid"])
+	}
+	if rq.QueryStringParameters["format"] != "video/webm" || len(rq.MultiValueQueryStringParameters["format"]) != 2 {
+		t.Errorf("repeated parameters were not handled like API Gateway does, got %v", rq.MultiValueQueryStringParameters)
+	}
+}
+
+func TestInProcessPassingEvents(t *testing.T) {
+	fetcher := testFetcher(t)
+	events := []*EndpointEvent{
+		testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=myfile", 200, "https://cdn.example.com/low.mp4\n",
+			map[string]string{"Content-type": "text/plain"}),
+		testEvent("https://multimedia.example.com/interactivevideos/video.php?octopusid=5678", 302, "",
+			map[string]string{"Location": "http://cdn.example.com/low.mp4", "X-Powered-By": "PHP/5.3.3"}),
+		testEvent("https://multimedia.example.com/interactivevideos/mediatag.php?file=myfile&nocontrols", 200,
+			"<video preload='auto' id='video_5678' poster='https://cdn.example.com/low_poster.jpg'>\n  <source src='https://cdn.example.com/low.mp4' type='video/mp4'>\n</video>",
+			map[string]string{"Content-Type": "text/html;charset=UTF-8"}),
+	}
+
+	for _, evt := range events {
+		out, success, err := Test(fetcher, DefaultRules(), evt)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", evt.AccessUrl, err)
+			continue
+		}
+		if !success {
+			t.Errorf("%s: expected success, got %s", evt.AccessUrl, out.ErrorList)
+		}
+	}
+}
+
+func TestInProcessFailingEvent(t *testing.T) {
+	out, success, err := Test(testFetcher(t), DefaultRules(), testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=myfile", 200, "https://cdn.example.com/other.mp4", nil))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if success {
+		t.Error("expected a body mismatch to fail")
+	}
+	if !strings.Contains(out.ErrorList, "expected body") || out.Passed {
+		t.Errorf("got unexpected problems %s", out.ErrorList)
+	}
+	if len(out.Problems) != 1 || out.Problems[0].Category != ProblemBody {
+		t.Errorf("expected a single body problem, got %v", out.Problems)
+	}
+	if out.Result.ExpectedResponse != 200 || out.Result.ExpectedOutputMessage != "https://cdn.example.com/low.mp4" {
+		t.Errorf("result did not record the actual response: %v", out.Result)
+	}
+
+	_, _, err = Test(testFetcher(t), DefaultRules(), testEvent("https://multimedia.example.com/interactivevideos/unknown.php", 200, "", nil))
+	if err == nil {
+		t.Error("expected an error for an endpoint with no handler")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+LoadResult is the outcome of one request sent during a load test
+*/
+type LoadResult struct {
+	Endpoint   string
+	Sent       time.Time
+	StatusCode int           //0 if no response was received
+	Latency    time.Duration //from sending the request to reading the whole body
+	Late       time.Duration //how long after its scheduled time the request was actually sent
+	Err        error
+}
+
+/*
+Schedule decides when each request of a load test is sent, as an offset from the start of the test
+*/
+type Schedule interface {
+	Offset(index int, evt *EndpointEvent) time.Duration
+}
+
+/*
+FixedRateSchedule sends requests at a steady rate
+*/
+type FixedRateSchedule struct {
+	RequestsPerSecond float64
+}
+
+func (s *FixedRateSchedule) Offset(index int, evt *EndpointEvent) time.Duration {
+	return time.Duration(float64(index) / s.RequestsPerSecond * float64(time.Second))
+}
+
+/*
+CapturedSchedule sends requests with the same gaps between them as when they were captured, divided by Speedup.  The
+events must arrive in timestamp order, see SortByTimestamp.
+*/
+type CapturedSchedule struct {
+	Speedup float64
+	first   *time.Time
+	last    time.Duration
+}
+
+func NewCapturedSchedule(speedup float64) *CapturedSchedule {
+	return &CapturedSchedule{Speedup: speedup}
+}
+
+func (s *CapturedSchedule) Offset(index int, evt *EndpointEvent) time.Duration {
+	if evt.Timestamp == nil { //send straight after the one before
+		return s.last
+	}
+	if s.first == nil {
+		s.first = evt.Timestamp
+	}
+	s.last = time.Duration(float64(evt.Timestamp.Sub(*s.first)) / s.Speedup)
+	return s.last
+}
+
+/*
+SortByTimestamp reads every event from `inputCh` and then outputs them in the order they were captured.  The table is
+not read in any particular order, so this is needed for a CapturedSchedule.
+*/
+func SortByTimestamp(inputCh chan *EndpointEvent) chan *EndpointEvent {
+	outputCh := make(chan *EndpointEvent, 100)
+	go func() {
+		events := make([]*EndpointEvent, 0)
+		for evt := range inputCh {
+			events = append(events, evt)
+		}
+		log.Printf("INFO Read %d events, sorting by timestamp", len(events))
+		sort.SliceStable(events, func(i, j int) bool {
+			if events[i].Timestamp == nil || events[j].Timestamp == nil {
+				return events[j].Timestamp == nil && events[i].Timestamp != nil
+			}
+			return events[i].Timestamp.Before(*events[j].Timestamp)
+		})
+		for _, evt := range events {
+			outputCh <- evt
+		}
+		close(outputCh)
+	}()
+	return outputCh
+}
+
+/*
+RunLoad sends every event from `inputCh` with the fetcher at the time given by the schedule, and outputs the result of
+each one.  No more than `maxInFlight` requests are outstanding at once; if the server can't keep up then requests are
+sent late, which is recorded in the results.  The output channel is closed once every request has finished.
+*/
+func RunLoad(inputCh chan *EndpointEvent, fetcher Fetcher, schedule Schedule, maxInFlight int) chan LoadResult {
+	outputCh := make(chan LoadResult, 100)
+	go func() {
+		inFlight := make(chan struct{}, maxInFlight)
+		waitGroup := &sync.WaitGroup{}
+		var start time.Time
+		index := 0
+		for evt := range inputCh {
+			if index == 0 { //the schedule starts with the first event, not while the corpus is being read
+				start = time.Now()
+			}
+			due := start.Add(schedule.Offset(index, evt))
+			index++
+			time.Sleep(time.Until(due))
+			inFlight <- struct{}{}
+
+			waitGroup.Add(1)
+			go func(evt *EndpointEvent) {
+				sent := time.Now()
+				response, err := fetcher.Fetch(evt)
+				result := LoadResult{
+					Endpoint: evt.Endpoint(),
+					Sent:     sent,
+					Latency:  time.Since(sent),
+					Late:     sent.Sub(due),
+					Err:      err,
+				}
+				if response != nil {
+					result.StatusCode = response.StatusCode
+				}
+				<-inFlight
+				outputCh <- result
+				waitGroup.Done()
+			}(evt)
+		}
+		waitGroup.Wait()
+		close(outputCh)
+	}()
+	return outputCh
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// requests sent later than this after their scheduled time are counted as late in the summary
+const lateThreshold = 100 * time.Millisecond
+
+/*
+LoadStats collects the results of a load test for one endpoint, or for the whole run
+*/
+type LoadStats struct {
+	Requests     int
+	Errors       int //requests that got no response at all
+	ServerErrors int //requests that got a 5xx response
+	Late         int //requests that were sent more than lateThreshold after they should have been
+	ByStatus     map[int]int
+	latencies    []time.Duration
+	sorted       bool
+}
+
+func newLoadStats() *LoadStats {
+	return &LoadStats{ByStatus: make(map[int]int), latencies: make([]time.Duration, 0)}
+}
+
+func (s *LoadStats) add(result *LoadResult) {
+	s.Requests++
+	if result.Late > lateThreshold {
+		s.Late++
+	}
+	if result.Err != nil {
+		s.Errors++
+		return
+	}
+	s.ByStatus[result.StatusCode]++
+	if result.StatusCode >= 500 {
+		s.ServerErrors++
+	}
+	s.latencies = append(s.latencies, result.Latency)
+	s.sorted = false
+}
+
+/*
+ErrorRate returns the percentage of requests that failed or got a 5xx response
+*/
+func (s *LoadStats) ErrorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return 100 * float64(s.Errors+s.ServerErrors) / float64(s.Requests)
+}
+
+/*
+Percentile returns the latency that `p` percent of the requests that got a response were at or under, using the
+nearest-rank method.  Returns 0 if there were none.
+*/
+func (s *LoadStats) Percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	if !s.sorted {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		s.sorted = true
+	}
+	rank := int(math.Ceil(p/100*float64(len(s.latencies)))) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(s.latencies) {
+		rank = len(s.latencies) - 1
+	}
+	return s.latencies[rank]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+type jsonLoadStats struct {
+	Requests     int         `json:"requests"`
+	Errors       int         `json:"errors"`
+	ServerErrors int         `json:"server_errors"`
+	ErrorRate    float64     `json:"error_rate"`
+	Late         int         `json:"late"`
+	ByStatus     map[int]int `json:"by_status"`
+	P50Ms        float64     `json:"p50_ms"`
+	P90Ms        float64     `json:"p90_ms"`
+	P99Ms        float64     `json:"p99_ms"`
+	MaxMs        float64     `json:"max_ms"`
+}
+
+func (s *LoadStats) toJSON() jsonLoadStats {
+	return jsonLoadStats{
+		Requests:     s.Requests,
+		Errors:       s.Errors,
+		ServerErrors: s.ServerErrors,
+		ErrorRate:    s.ErrorRate(),
+		Late:         s.Late,
+		ByStatus:     s.ByStatus,
+		P50Ms:        milliseconds(s.Percentile(50)),
+		P90Ms:        milliseconds(s.Percentile(90)),
+		P99Ms:        milliseconds(s.Percentile(99)),
+		MaxMs:        milliseconds(s.Percentile(100)),
+	}
+}
+
+/*
+LoadSummary collects the results of a load test for the whole run, and for each endpoint
+*/
+type LoadSummary struct {
+	LoadStats
+	ByEndpoint map[string]*LoadStats
+	StartedAt  time.Time //when the first request was sent
+	FinishedAt time.Time //when the last response was received
+}
+
+func NewLoadSummary() *LoadSummary {
+	return &LoadSummary{
+		LoadStats:  *newLoadStats(),
+		ByEndpoint: make(map[string]*LoadStats),
+	}
+}
+
+/*
+Add counts a result. It is not safe to call from more than one goroutine.
+*/
+func (s *LoadSummary) Add(result *LoadResult) {
+	s.LoadStats.add(result)
+	if _, haveEndpoint := s.ByEndpoint[result.Endpoint]; !haveEndpoint {
+		s.ByEndpoint[result.Endpoint] = newLoadStats()
+	}
+	s.ByEndpoint[result.Endpoint].add(result)
+	if s.StartedAt.IsZero() || result.Sent.Before(s.StartedAt) {
+		s.StartedAt = result.Sent
+	}
+	if finished := result.Sent.Add(result.Latency); finished.After(s.FinishedAt) {
+		s.FinishedAt = finished
+	}
+}
+
+/*
+Collect adds every result from the channel, until it is closed
+*/
+func (s *LoadSummary) Collect(inputCh chan LoadResult) {
+	for result := range inputCh {
+		s.Add(&result)
+		if s.Requests%1000 == 0 {
+			log.Printf("INFO Sent %d requests, %.2f%% errors so far", s.Requests, s.ErrorRate())
+		}
+	}
+}
+
+/*
+Endpoints returns the names of the endpoints that were requested, in order
+*/
+func (s *LoadSummary) Endpoints() []string {
+	names := make([]string, 0, len(s.ByEndpoint))
+	for name := range s.ByEndpoint {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+RequestsPerSecond returns the rate that requests were actually completed at
+*/
+func (s *LoadSummary) RequestsPerSecond() float64 {
+	elapsed := s.FinishedAt.Sub(s.StartedAt).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Requests) / elapsed
+}
+
+func logLoadStats(name string, stats *LoadStats) {
+	log.Printf("INFO   %s: %d requests, p50 %.1fms p90 %.1fms p99 %.1fms max %.1fms, %.2f%% errors (%d failed, %d 5xx) %v",
+		name, stats.Requests, milliseconds(stats.Percentile(50)), milliseconds(stats.Percentile(90)),
+		milliseconds(stats.Percentile(99)), milliseconds(stats.Percentile(100)), stats.ErrorRate(), stats.Errors,
+		stats.ServerErrors, stats.ByStatus)
+}
+
+/*
+Log writes the summary out to the log
+*/
+func (s *LoadSummary) Log() {
+	log.Printf("INFO %d requests in %s, %.1f requests/s", s.Requests, s.FinishedAt.Sub(s.StartedAt).Round(time.Millisecond), s.RequestsPerSecond())
+	for _, name := range s.Endpoints() {
+		logLoadStats(name, s.ByEndpoint[name])
+	}
+	logLoadStats("Total", &s.LoadStats)
+	if s.Late > 0 {
+		log.Printf("WARNING %d requests were sent more than %s late, because -max-in-flight requests were already outstanding. The server could not keep up with the schedule", s.Late, lateThreshold)
+	}
+}
+
+/*
+WriteJSON writes the summary out as a json document
+*/
+func (s *LoadSummary) WriteJSON(out io.Writer) error {
+	byEndpoint := make(map[string]jsonLoadStats, len(s.ByEndpoint))
+	for name, stats := range s.ByEndpoint {
+		byEndpoint[name] = stats.toJSON()
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]interface{}{
+		"started_at":          s.StartedAt,
+		"finished_at":         s.FinishedAt,
+		"requests_per_second": s.RequestsPerSecond(),
+		"total":               s.toJSON(),
+		"by_endpoint":         byEndpoint,
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMakeTargetUrl(t *testing.T) {
+	evt := testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=a", 200, "", nil)
+	for base, expected := range map[string]string{
+		"endpoints.example.com":  "https://endpoints.example.com/interactivevideos/reference.php?file=a",
+		"http://localhost:8080":  "http://localhost:8080/interactivevideos/reference.php?file=a",
+		"http://localhost:8080/": "http://localhost:8080/interactivevideos/reference.php?file=a",
+	} {
+		got, err := makeTargetUrl(&base, evt)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", base, err)
+		} else if got != expected {
+			t.Errorf("%s: expected %s got %s", base, expected, got)
+		}
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	fixed := &FixedRateSchedule{RequestsPerSecond: 4}
+	if fixed.Offset(0, nil) != 0 || fixed.Offset(6, nil) != 1500*time.Millisecond {
+		t.Errorf("got unexpected fixed rate offsets %s %s", fixed.Offset(0, nil), fixed.Offset(6, nil))
+	}
+
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(10 * time.Second)
+	captured := NewCapturedSchedule(2)
+	offsets := []time.Duration{
+		captured.Offset(0, &EndpointEvent{Timestamp: &first}),
+		captured.Offset(1, &EndpointEvent{Timestamp: &second}),
+		captured.Offset(2, &EndpointEvent{}),
+	}
+	if offsets[0] != 0 || offsets[1] != 5*time.Second || offsets[2] != 5*time.Second {
+		t.Errorf("got unexpected captured offsets %v", offsets)
+	}
+}
+
+func TestSortByTimestamp(t *testing.T) {
+	inputCh := make(chan *EndpointEvent, 3)
+	inputCh <- testEvent("https://example.com/b", 200, "", nil)
+	inputCh <- &EndpointEvent{AccessUrl: "https://example.com/c"}
+	earlier := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	inputCh <- &EndpointEvent{AccessUrl: "https://example.com/a", Timestamp: &earlier}
+	close(inputCh)
+
+	urls := make([]string, 0)
+	for evt := range SortByTimestamp(inputCh) {
+		urls = append(urls, evt.Endpoint())
+	}
+	if strings.Join(urls, ",") != "a,b,c" {
+		t.Errorf("expected events in timestamp order with no timestamp last, got %v", urls)
+	}
+}
+
+func TestLoadStatsPercentiles(t *testing.T) {
+	stats := newLoadStats()
+	for i := 100; i >= 1; i-- {
+		stats.add(&LoadResult{StatusCode: 200, Latency: time.Duration(i) * time.Millisecond})
+	}
+	stats.add(&LoadResult{StatusCode: 502, Latency: time.Second})
+	stats.add(&LoadResult{Err: http.ErrHandlerTimeout})
+
+	if stats.Percentile(50) != 51*time.Millisecond || stats.Percentile(90) != 91*time.Millisecond || stats.Percentile(100) != time.Second {
+		t.Errorf("got unexpected percentiles %s %s %s", stats.Percentile(50), stats.Percentile(90), stats.Percentile(100))
+	}
+	if stats.Requests != 102 || stats.Errors != 1 || stats.ServerErrors != 1 || stats.ByStatus[200] != 100 {
+		t.Errorf("got unexpected counts %v", stats)
+	}
+	if rate := stats.ErrorRate(); rate < 1.96 || rate > 1.97 {
+		t.Errorf("expected an error rate of 1.96%%, got %f", rate)
+	}
+	if newLoadStats().Percentile(99) != 0 {
+		t.Error("expected 0 for no requests")
+	}
+}
+
+func TestRunLoadAgainstLocalServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "video.php") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("https://cdn.example.com/a.mp4"))
+	}))
+	defer server.Close()
+
+	inputCh := make(chan *EndpointEvent, 10)
+	for i := 0; i < 8; i++ {
+		inputCh <- testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=a", 200, "", nil)
+	}
+	inputCh <- testEvent("https://multimedia.example.com/interactivevideos/video.php?file=a", 302, "", nil)
+	inputCh <- testEvent("not a url", 200, "", nil)
+	close(inputCh)
+
+	base := server.URL
+	start := time.Now()
+	summary := NewLoadSummary()
+	summary.Collect(RunLoad(inputCh, NewHttpFetcher(&base), &FixedRateSchedule{RequestsPerSecond: 100}, 2))
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("10 requests at 100/s should take at least 90ms, took %s", elapsed)
+	}
+
+	if summary.Requests != 10 || summary.Errors != 1 || summary.ServerErrors != 1 {
+		t.Errorf("got unexpected totals %d requests %d errors %d 5xx", summary.Requests, summary.Errors, summary.ServerErrors)
+	}
+	if summary.ByEndpoint["reference.php"].ByStatus[200] != 8 || summary.ByEndpoint["video.php"].ByStatus[500] != 1 {
+		t.Errorf("got unexpected endpoints %v", summary.Endpoints())
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := summary.WriteJSON(buffer); err != nil {
+		t.Fatalf("could not write json: %s", err)
+	}
+	var doc struct {
+		Total      jsonLoadStats            `json:"total"`
+		ByEndpoint map[string]jsonLoadStats `json:"by_endpoint"`
+	}
+	if err := json.Unmarshal(buffer.Bytes(), &doc); err != nil {
+		t.Fatalf("summary was not valid json: %s", err)
+	}
+	if doc.Total.Requests != 10 || doc.ByEndpoint["reference.php"].P99Ms <= 0 {
+		t.Errorf("got unexpected json summary %s", buffer.String())
+	}
+}
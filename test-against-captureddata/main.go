@@ -2,46 +2,332 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"io"
 	"log"
+	"os"
 )
 
+/*
+setUpInProcess builds a HandlerFetcher.  If snapshot files are given then lookups are answered from them, otherwise they
+go to the DynamoDB tables given in the environment in the same way as the lambdas.
+*/
+func setUpInProcess(encodingsSnapshot string, idMappingSnapshot string, mimeSnapshot string) (*HandlerFetcher, error) {
+	var ops common.DynamoDbOps
+	var endpointConfig common.Config
+	if encodingsSnapshot != "" {
+		snapshotOps, err := NewSnapshotOps(encodingsSnapshot, idMappingSnapshot, mimeSnapshot)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("INFO Loaded %d encodings, %d id mappings and %d mime equivalents from snapshots", len(snapshotOps.Encodings), len(snapshotOps.IdMappings), len(snapshotOps.MimeEquivalents))
+		ops = snapshotOps
+		endpointConfig = &common.ConfigMock{} //nothing needs a client or table name when running from snapshots
+	} else {
+		var err error
+		endpointConfig, err = common.NewConfig()
+		if err != nil {
+			return nil, err
+		}
+		ops = common.NewDynamoDbOps(endpointConfig)
+	}
+
+	deps, err := common.NewHandlerDeps(context.Background(), ops, endpointConfig)
+	if err != nil {
+		return nil, err
+	}
+	return NewHandlerFetcher(deps), nil
+}
+
+/*
+openCorpus starts reading events from either a DynamoDB table or a corpus file, whichever is given
+*/
+func openCorpus(tableName string, inputFile string, format string, filter *EventFilter, pageSize int) (chan *EndpointEvent, chan error, error) {
+	if (tableName == "") == (inputFile == "") {
+		return nil, nil, errors.New("you must specify one of -table or -in")
+	}
+	if inputFile != "" {
+		corpusFormat, err := CorpusFormatFor(inputFile, format)
+		if err != nil {
+			return nil, nil, err
+		}
+		eventCh, errCh := AsyncFileReader(inputFile, corpusFormat, filter)
+		return eventCh, errCh, nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not set up AWS SDK: %s", err)
+	}
+	eventCh, errCh := AsyncRecordReader(dynamodb.NewFromConfig(cfg), &tableName, filter, int32(pageSize))
+	return eventCh, errCh, nil
+}
+
+/*
+openReports opens a ReportWriter for each report file that was asked for.  Call the returned function to close them
+all once the reports are finished.
+*/
+func openReports(csvFile string, junitFile string, jsonFile string, htmlFile string) ([]ReportWriter, func() error, error) {
+	reports := make([]ReportWriter, 0, 4)
+	closers := make([]func() error, 0, 4)
+	closeAll := func() error {
+		var firstErr error
+		for _, closer := range closers {
+			if err := closer(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	for _, report := range []struct {
+		filename  string
+		newWriter func(out io.Writer) ReportWriter
+	}{
+		{csvFile, func(out io.Writer) ReportWriter { return NewCSVReportWriter(out) }},
+		{junitFile, func(out io.Writer) ReportWriter { return NewJUnitReportWriter(out) }},
+		{jsonFile, func(out io.Writer) ReportWriter { return NewJSONReportWriter(out) }},
+		{htmlFile, func(out io.Writer) ReportWriter { return NewHTMLReportWriter(out) }},
+	} {
+		if report.filename == "" {
+			continue
+		}
+		out, closer, err := openForWrite(report.filename)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		reports = append(reports, report.newWriter(out))
+		closers = append(closers, closer)
+	}
+	return reports, closeAll, nil
+}
+
+/*
+exportCommand implements `test-against-captureddata export`, which writes a corpus out to a file so that it can be
+kept in git and run offline
+*/
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	tableName := flags.String("table", "", "name of the table to read events from")
+	inputFile := flags.String("in", "", "corpus file to read events from instead of a table, e.g. to convert a HAR file")
+	inputFormat := flags.String("in-format", "", "format of -in: jsonl, csv or har. Taken from the file name if not set")
+	pageSize := flags.Int("s", 50, "page size for event retrieval")
+	outputFile := flags.String("out", "", "file to write, ending in .jsonl or .csv. Names ending in .gz are compressed")
+	format := flags.String("format", "", "format to write: jsonl or csv. Taken from the -out file name if not set")
+	newFilter := AddEventFilterFlags(flags)
+	flags.Parse(args)
+	if *outputFile == "" {
+		log.Fatal("export needs -out")
+	}
+
+	outputFormat, err := CorpusFormatFor(*outputFile, *format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	filter, err := newFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	eventCh, errCh, err := openCorpus(*tableName, *inputFile, *inputFormat, filter, *pageSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, finish, err := openForWrite(*outputFile)
+	if err != nil {
+		log.Fatalf("Could not open %s: %s", *outputFile, err)
+	}
+	writer, err := NewCorpusWriter(out, outputFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	count, err := ExportCorpus(eventCh, errCh, writer)
+	if finishErr := finish(); err == nil {
+		err = finishErr
+	}
+	if err != nil {
+		log.Fatalf("Export failed after %d events: %s", count, err)
+	}
+	log.Printf("INFO Exported %d events to %s", count, *outputFile)
+}
+
+/*
+loadCommand implements `test-against-captureddata load`, which replays the corpus against a server at a given rate
+and reports on latency and errors instead of checking the responses
+*/
+func loadCommand(args []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	tableName := flags.String("table", "", "name of the table to read events from")
+	inputFile := flags.String("in", "", "corpus file to read events from instead of a table (.jsonl, .csv or .har, optionally .gz)")
+	format := flags.String("format", "", "format of -in: jsonl, csv or har. Taken from the file name if not set")
+	pageSize := flags.Int("s", 50, "page size for event retrieval")
+	newFilter := AddEventFilterFlags(flags)
+	endpointBase := flags.String("target", "", "server name to test, or a base URL like http://localhost:8080")
+	rps := flags.Float64("rps", 0, "send requests at this many per second")
+	captured := flags.Bool("captured-timing", false, "send requests with the same gaps between them as when they were captured, instead of -rps")
+	speedup := flags.Float64("speedup", 1, "with -captured-timing, divide the gaps between requests by this")
+	maxInFlight := flags.Int("max-in-flight", 200, "maximum number of requests outstanding at once")
+	jsonFile := flags.String("json", "", "if set, write the results to this json file")
+	maxErrorRate := flags.Float64("max-error-rate", 100, "exit with status 2 if more than this percentage of requests fail or get a 5xx response")
+	flags.Parse(args)
+
+	if *endpointBase == "" {
+		log.Fatal("load needs -target")
+	}
+	if (*rps > 0) == *captured {
+		log.Fatal("load needs one of -rps or -captured-timing")
+	}
+	if *speedup <= 0 || *maxInFlight <= 0 {
+		log.Fatal("-speedup and -max-in-flight must be more than 0")
+	}
+
+	filter, err := newFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	eventCh, errCh, err := openCorpus(*tableName, *inputFile, *format, filter, *pageSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var schedule Schedule
+	if *captured {
+		eventCh = SortByTimestamp(eventCh)
+		schedule = NewCapturedSchedule(*speedup)
+	} else {
+		schedule = &FixedRateSchedule{RequestsPerSecond: *rps}
+	}
+
+	summary := NewLoadSummary()
+	summary.Collect(RunLoad(eventCh, NewHttpFetcher(endpointBase), schedule, *maxInFlight))
+	summary.Log()
+
+	var readErr error
+	select { //the readers send any error before they finish, so it is there by now
+	case readErr = <-errCh:
+	default:
+	}
+
+	if *jsonFile != "" {
+		out, closer, err := openForWrite(*jsonFile)
+		if err == nil {
+			err = summary.WriteJSON(out)
+			if closeErr := closer(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			log.Fatalf("Could not write %s: %s", *jsonFile, err)
+		}
+	}
+	if readErr != nil {
+		log.Fatalf("Not every event could be read so the results are incomplete: %s", readErr)
+	}
+	if summary.ErrorRate() > *maxErrorRate {
+		log.Printf("ERROR %.2f%% of requests failed, which is more than the limit of %.2f%%", summary.ErrorRate(), *maxErrorRate)
+		os.Exit(2)
+	}
+	log.Print("Done.")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		exportCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "load" {
+		loadCommand(os.Args[2:])
+		return
+	}
+
 	tableName := flag.String("table", "", "name of the table to read events from")
+	inputFile := flag.String("in", "", "corpus file to read events from instead of a table (.jsonl, .csv or .har, optionally .gz)")
+	format := flag.String("format", "", "format of -in: jsonl, csv or har. Taken from the file name if not set")
 	pageSize := flag.Int("s", 50, "page size for event retrieval")
-	endpointBase := flag.String("target", "", "server name to test")
+	endpointBase := flag.String("target", "", "server name to test, or a base URL like http://localhost:8080")
+	baselineBase := flag.String("baseline", "", "if set, send every request to this server as well and compare the responses from -target (or -in-process) with these instead of with the captured responses")
 	parallel := flag.Int("parallel", 10, "number of requests to run in parallel")
-	outputFilename := flag.String("out", "endpoint-test-results.csv", "name of a CSV file to output")
-	filter := flag.String("filter", "", "if set, limit to only this endpoint")
+	outputFilename := flag.String("out", "endpoint-test-results.csv", "name of a CSV file to output the failures to. Set to \"\" for no CSV")
+	junitFilename := flag.String("junit", "", "if set, write a JUnit XML report to this file")
+	jsonFilename := flag.String("json", "", "if set, write a json report to this file")
+	htmlFilename := flag.String("html", "", "if set, write an HTML report with side-by-side diffs to this file")
+	maxFailureRate := flag.Float64("max-failure-rate", 100, "exit with status 2 if more than this percentage of tests fail")
+	newFilter := AddEventFilterFlags(flag.CommandLine)
+	rulesFile := flag.String("rules", "", "json file of rules for comparing responses and allowed differences. Built-in defaults are used if not set")
+	inProcess := flag.Bool("in-process", false, "run the endpoint handlers in this process instead of sending requests to -target")
+	encodingsSnapshot := flag.String("encodings-snapshot", "", "with -in-process, answer lookups from this snapshot of the encodings table instead of DynamoDB")
+	idMappingSnapshot := flag.String("idmapping-snapshot", "", "with -in-process, answer lookups from this snapshot of the idmapping table instead of DynamoDB")
+	mimeSnapshot := flag.String("mime-snapshot", "", "with -in-process, optional snapshot of the mime equivalents table")
 	flag.Parse()
 
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		log.Fatalf("Could not set up AWS SDK: %s", err)
+	if !*inProcess && *endpointBase == "" {
+		log.Fatal("You must specify either -target or -in-process")
+	}
+	if (*encodingsSnapshot == "") != (*idMappingSnapshot == "") {
+		log.Fatal("-encodings-snapshot and -idmapping-snapshot must be used together")
 	}
-	ddbClient := dynamodb.NewFromConfig(cfg)
 
-	eventCh, errCh := AsyncRecordReader(ddbClient, tableName, *filter, int32(*pageSize))
-	resultsCh, waitGroup := AsyncTestEndpoint(eventCh, endpointBase, *parallel)
+	rules := DefaultRules()
+	if *rulesFile != "" {
+		var err error
+		rules, err = LoadRules(*rulesFile)
+		if err != nil {
+			log.Fatalf("Could not load rules: %s", err)
+		}
+	}
 
-	writeErrCh := AsyncWriter(resultsCh, *outputFilename)
+	filter, err := newFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	eventCh, errCh, err := openCorpus(*tableName, *inputFile, *format, filter, *pageSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var fetcher Fetcher
+	if *inProcess {
+		fetcher, err = setUpInProcess(*encodingsSnapshot, *idMappingSnapshot, *mimeSnapshot)
+		if err != nil {
+			log.Fatalf("Could not set up in-process handlers: %s", err)
+		}
+	} else {
+		fetcher = NewHttpFetcher(endpointBase)
+	}
+	var tester Tester
+	if *baselineBase != "" {
+		log.Printf("INFO Comparing responses with the ones from %s instead of the captured data", *baselineBase)
+		tester = NewABTester(NewHttpFetcher(baselineBase), fetcher, rules)
+	} else {
+		tester = &CapturedTester{Fetcher: fetcher, Rules: rules}
+	}
+	resultsCh, waitGroup := AsyncTestEndpoint(eventCh, tester, *parallel)
+
+	reports, closeReports, err := openReports(*outputFilename, *junitFilename, *jsonFilename, *htmlFilename)
+	if err != nil {
+		log.Fatalf("Could not open reports: %s", err)
+	}
+	summary := NewSummary()
+	writeErrCh := AsyncWriter(resultsCh, reports, summary)
 	waitGroup.Add(1)
 
+	var writeErr error
+	var readErr error
 	go func() {
 		for {
 			select {
 			case err := <-writeErrCh:
-				if err == nil {
-					waitGroup.Done()
-					return
-				} else {
-					log.Printf("ERROR could not write records: %s", err)
-				}
+				writeErr = err
+				waitGroup.Done()
+				return
 			case err := <-errCh:
 				if err != nil {
 					log.Printf("ERROR Could not retrieve events: %s", err)
+					readErr = err
 				}
 			}
 		}
@@ -49,5 +335,27 @@ func main() {
 
 	log.Print("Waiting for threads to complete...")
 	waitGroup.Wait()
+	if err := closeReports(); err != nil && writeErr == nil {
+		writeErr = err
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			readErr = err
+		}
+	default:
+	}
+
+	summary.Log()
+	if writeErr != nil {
+		log.Fatalf("Could not write reports: %s", writeErr)
+	}
+	if readErr != nil {
+		log.Fatalf("Not every event could be read so the results are incomplete: %s", readErr)
+	}
+	if summary.FailureRate() > *maxFailureRate {
+		log.Printf("ERROR %.2f%% of tests failed, which is more than the limit of %.2f%%", summary.FailureRate(), *maxFailureRate)
+		os.Exit(2)
+	}
 	log.Print("Done.")
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+testName identifies a test in the reports. The same URL can have been captured more than once, so the capture time
+is included.
+*/
+func testName(result *TestOutput) string {
+	return fmt.Sprintf("%s (%s)", result.Request.AccessUrl, result.Request.FormattedTimestamp())
+}
+
+func hasErrorProblem(result *TestOutput) bool {
+	for _, problem := range result.Problems {
+		if problem.Category == ProblemError {
+			return true
+		}
+	}
+	return false
+}
+
+func problemCategories(result *TestOutput) string {
+	categories := make([]string, 0, len(result.Problems))
+	for _, problem := range result.Problems {
+		categories = append(categories, problem.Category)
+	}
+	return strings.Join(categories, ",")
+}
+
+type junitFailure struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+/*
+JUnitReportWriter writes a JUnit XML report for CI, with a test suite for each endpoint and a test case for each
+captured request.  Requests that could not be made at all are errors, the rest are failures.
+*/
+type JUnitReportWriter struct {
+	out    io.Writer
+	suites map[string]*junitTestSuite
+}
+
+func NewJUnitReportWriter(out io.Writer) *JUnitReportWriter {
+	return &JUnitReportWriter{out: out, suites: make(map[string]*junitTestSuite)}
+}
+
+func (w *JUnitReportWriter) Add(result *TestOutput) error {
+	endpoint := result.Endpoint()
+	suite, haveSuite := w.suites[endpoint]
+	if !haveSuite {
+		suite = &junitTestSuite{Name: endpoint}
+		w.suites[endpoint] = suite
+	}
+
+	testCase := junitTestCase{
+		ClassName: endpoint,
+		Name:      testName(result),
+		Time:      junitSeconds(result.Duration),
+	}
+	if !result.Passed {
+		failure := &junitFailure{
+			Type: problemCategories(result),
+			Text: result.ErrorList,
+		}
+		if len(result.Problems) > 0 {
+			failure.Message = result.Problems[0].Message
+		}
+		if hasErrorProblem(result) {
+			testCase.Error = failure
+			suite.Errors++
+		} else {
+			testCase.Failure = failure
+			suite.Failures++
+		}
+	}
+	suite.Tests++
+	suite.TestCases = append(suite.TestCases, testCase)
+	return nil
+}
+
+func (w *JUnitReportWriter) Finish(summary *Summary) error {
+	doc := &junitTestSuites{
+		Name: "test-against-captureddata",
+		Time: junitSeconds(time.Since(summary.StartedAt)),
+	}
+	for _, name := range summary.Endpoints() {
+		suite, haveSuite := w.suites[name]
+		if !haveSuite {
+			continue
+		}
+		suite.Time = junitSeconds(summary.ByEndpoint[name].Duration)
+		doc.Tests += suite.Tests
+		doc.Failures += suite.Failures
+		doc.Errors += suite.Errors
+		doc.Suites = append(doc.Suites, *suite)
+	}
+
+	io.WriteString(w.out, xml.Header)
+	encoder := xml.NewEncoder(w.out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.out, "\n")
+	return err
+}
+
+type jsonReportResult struct {
+	Endpoint   string         `json:"endpoint"`
+	Name       string         `json:"name"`
+	TestedUrl  string         `json:"tested_url"`
+	Passed     bool           `json:"passed"`
+	DurationMs float64        `json:"duration_ms"`
+	Problems   []TestProblem  `json:"problems,omitempty"`
+	Allowed    []TestProblem  `json:"allowed,omitempty"`
+	Expected   *EndpointEvent `json:"expected,omitempty"` //only set for failures, to keep the size down
+	Actual     *EndpointEvent `json:"actual,omitempty"`
+}
+
+/*
+JSONReportWriter writes the summary and a list of every result as a json document.  The expected and actual responses
+are only included for failed tests.
+*/
+type JSONReportWriter struct {
+	out     io.Writer
+	results []jsonReportResult
+}
+
+func NewJSONReportWriter(out io.Writer) *JSONReportWriter {
+	return &JSONReportWriter{out: out, results: make([]jsonReportResult, 0)}
+}
+
+func (w *JSONReportWriter) Add(result *TestOutput) error {
+	entry := jsonReportResult{
+		Endpoint:   result.Endpoint(),
+		Name:       testName(result),
+		TestedUrl:  result.Result.AccessUrl,
+		Passed:     result.Passed,
+		DurationMs: float64(result.Duration.Microseconds()) / 1000,
+		Problems:   result.Problems,
+		Allowed:    result.Allowed,
+	}
+	if !result.Passed {
+		entry.Expected = result.Request
+		entry.Actual = result.Result
+	}
+	w.results = append(w.results, entry)
+	return nil
+}
+
+func (w *JSONReportWriter) Finish(summary *Summary) error {
+	encoder := json.NewEncoder(w.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]interface{}{
+		"summary": summary,
+		"results": w.results,
+	})
+}
+
+/*
+htmlFailure is a failed test laid out for the HTML report
+*/
+type htmlFailure struct {
+	Endpoint       string
+	Name           string
+	TestedUrl      string
+	Problems       []TestProblem
+	Allowed        []TestProblem
+	ExpectedStatus int16
+	ActualStatus   int16
+	Headers        []diffRow
+	Body           []diffRow
+}
+
+/*
+formatHeaders puts headers into a stable order, one per line, so that they can be diffed
+*/
+func formatHeaders(headers map[string]string) string {
+	lines := make([]string, 0, len(headers))
+	for k, v := range headers {
+		lines = append(lines, k+": "+v)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+const htmlReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Captured data test report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; vertical-align: top; }
+.diff { width: 100%; table-layout: fixed; }
+.diff td { font-family: monospace; white-space: pre-wrap; word-break: break-all; }
+.changed td { background: #fff5cc; }
+.removed td.left { background: #ffd7d5; }
+.added td.right { background: #d6f5d6; }
+.failure { border-top: 2px solid #999; margin-top: 2em; }
+</style>
+</head>
+<body>
+<h1>Captured data test report</h1>
+<p>Started at {{.Summary.StartedAt.Format "2006-01-02 15:04:05 MST"}}. {{.Summary.Passed}} / {{.Summary.Total}} tests passed, {{printf "%.2f" .Summary.FailureRate}}% failed. {{.Summary.Allowed}} differences were allowed by the rules.</p>
+
+<h2>By endpoint</h2>
+<table>
+<tr><th>Endpoint</th><th>Tests</th><th>Passed</th><th>Failed</th><th>Failure rate</th><th>Allowed differences</th>{{range .Categories}}<th>{{.}}</th>{{end}}</tr>
+{{range .Endpoints}}<tr><td>{{.Name}}</td><td>{{.Summary.Total}}</td><td>{{.Summary.Passed}}</td><td>{{.Summary.Failed}}</td><td>{{printf "%.2f" .Summary.FailureRate}}%</td><td>{{.Summary.Allowed}}</td>{{$s := .Summary}}{{range $.Categories}}<td>{{index $s.ByCategory .}}</td>{{end}}</tr>
+{{end}}</table>
+
+<h2>Failures</h2>
+{{if not .Failures}}<p>None.</p>{{end}}
+{{range .Failures}}<div class="failure">
+<h3>{{.Name}}</h3>
+<p>Endpoint {{.Endpoint}}, tested at {{.TestedUrl}}</p>
+<ul>{{range .Problems}}<li><b>{{.Category}}</b>: {{.Message}}</li>{{end}}{{range .Allowed}}<li><i>allowed {{.Category}}</i>: {{.Message}} ({{.Justification}})</li>{{end}}</ul>
+<table class="diff">
+<tr><th></th><th>Expected</th><th>Actual</th></tr>
+<tr{{if ne .ExpectedStatus .ActualStatus}} class="changed"{{end}}><th>Status</th><td class="left">{{.ExpectedStatus}}</td><td class="right">{{.ActualStatus}}</td></tr>
+{{range .Headers}}<tr class="{{.Kind}}"><th>Header</th><td class="left">{{.Left}}</td><td class="right">{{.Right}}</td></tr>
+{{end}}{{range .Body}}<tr class="{{.Kind}}"><th>Body</th><td class="left">{{.Left}}</td><td class="right">{{.Right}}</td></tr>
+{{end}}</table>
+</div>
+{{end}}
+</body>
+</html>
+`
+
+/*
+HTMLReportWriter writes a static HTML page with the summary, and a side-by-side diff of the expected and actual
+response for every failed test
+*/
+type HTMLReportWriter struct {
+	out      io.Writer
+	failures []htmlFailure
+}
+
+func NewHTMLReportWriter(out io.Writer) *HTMLReportWriter {
+	return &HTMLReportWriter{out: out, failures: make([]htmlFailure, 0)}
+}
+
+func (w *HTMLReportWriter) Add(result *TestOutput) error {
+	if result.Passed {
+		return nil
+	}
+	w.failures = append(w.failures, htmlFailure{
+		Endpoint:       result.Endpoint(),
+		Name:           testName(result),
+		TestedUrl:      result.Result.AccessUrl,
+		Problems:       result.Problems,
+		Allowed:        result.Allowed,
+		ExpectedStatus: result.Request.ExpectedResponse,
+		ActualStatus:   result.Result.ExpectedResponse,
+		Headers:        diffLines(formatHeaders(result.Request.ExpectedOutputHeaders), formatHeaders(result.Result.ExpectedOutputHeaders)),
+		Body:           diffLines(result.Request.ExpectedOutputMessage, result.Result.ExpectedOutputMessage),
+	})
+	return nil
+}
+
+func (w *HTMLReportWriter) Finish(summary *Summary) error {
+	tmpl, err := template.New("report").Parse(htmlReportTemplate)
+	if err != nil {
+		return err
+	}
+
+	type endpointRow struct {
+		Name    string
+		Summary *EndpointSummary
+	}
+	endpoints := make([]endpointRow, 0, len(summary.ByEndpoint)+1)
+	for _, name := range summary.Endpoints() {
+		endpoints = append(endpoints, endpointRow{Name: name, Summary: summary.ByEndpoint[name]})
+	}
+	endpoints = append(endpoints, endpointRow{Name: "Total", Summary: &summary.EndpointSummary})
+
+	return tmpl.Execute(w.out, map[string]interface{}{
+		"Summary":    summary,
+		"Categories": summary.Categories(),
+		"Endpoints":  endpoints,
+		"Failures":   w.failures,
+	})
+}
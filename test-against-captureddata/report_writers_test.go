@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testResults() []TestOutput {
+	passed := testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=a", 200, "https://cdn.example.com/a.mp4", nil)
+	failed := testEvent("https://multimedia.example.com/interactivevideos/mediatag.php?file=b", 200, "<video>\n<source src='a'>\n</video>",
+		map[string]string{"Content-Type": "text/html"})
+	errored := testEvent("https://multimedia.example.com/interactivevideos/video.php?file=c", 302, "", nil)
+	return []TestOutput{
+		{Request: passed, Result: passed, Passed: true, Duration: 10 * time.Millisecond},
+		{
+			Request:   failed,
+			Result:    &EndpointEvent{AccessUrl: failed.AccessUrl, ExpectedResponse: 404, ExpectedOutputMessage: "<video>\n<source src='b'>\n</video>"},
+			ErrorList: "expected response 200 got 404\nexpected body ...\n",
+			Problems:  []TestProblem{{Category: ProblemStatus, Message: "expected response 200 got 404"}, {Category: ProblemBody, Message: "expected body ..."}},
+			Duration:  20 * time.Millisecond,
+		},
+		{
+			Request:   errored,
+			Result:    &EndpointEvent{AccessUrl: errored.AccessUrl},
+			ErrorList: "could not perform test: connection refused\n",
+			Problems:  []TestProblem{{Category: ProblemError, Message: "could not perform test: connection refused"}},
+		},
+	}
+}
+
+func TestSummary(t *testing.T) {
+	summary := NewSummary()
+	for _, result := range testResults() {
+		summary.Add(&result)
+	}
+	if summary.Total != 3 || summary.Passed != 1 || summary.Failed != 2 {
+		t.Errorf("got unexpected totals %d / %d / %d", summary.Total, summary.Passed, summary.Failed)
+	}
+	if summary.ByCategory[ProblemStatus] != 1 || summary.ByCategory[ProblemBody] != 1 || summary.ByCategory[ProblemError] != 1 {
+		t.Errorf("got unexpected categories %v", summary.ByCategory)
+	}
+	if len(summary.Endpoints()) != 3 || summary.ByEndpoint["mediatag.php"].Failed != 1 {
+		t.Errorf("got unexpected endpoints %v", summary.Endpoints())
+	}
+	if rate := summary.FailureRate(); rate < 66 || rate > 67 {
+		t.Errorf("expected a failure rate of 66.7%%, got %f", rate)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	rows := diffLines("a\nb\nc\nd", "a\nx\nc\nd\ne")
+	expected := []diffRow{
+		{Left: "a", Right: "a", Kind: DiffSame},
+		{Left: "b", Right: "x", Kind: DiffChanged},
+		{Left: "c", Right: "c", Kind: DiffSame},
+		{Left: "d", Right: "d", Kind: DiffSame},
+		{Right: "e", Kind: DiffAdded},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("expected %d rows got %v", len(expected), rows)
+	}
+	for i, row := range rows {
+		if row != expected[i] {
+			t.Errorf("row %d: expected %v got %v", i, expected[i], row)
+		}
+	}
+}
+
+func writeReport(t *testing.T, writer ReportWriter) {
+	summary := NewSummary()
+	for _, result := range testResults() {
+		summary.Add(&result)
+		if err := writer.Add(&result); err != nil {
+			t.Fatalf("could not add result: %s", err)
+		}
+	}
+	if err := writer.Finish(summary); err != nil {
+		t.Fatalf("could not finish report: %s", err)
+	}
+}
+
+func TestJUnitReportWriter(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	writeReport(t, NewJUnitReportWriter(buffer))
+
+	var doc junitTestSuites
+	if err := xml.Unmarshal(buffer.Bytes(), &doc); err != nil {
+		t.Fatalf("report was not valid xml: %s", err)
+	}
+	if doc.Tests != 3 || doc.Failures != 1 || doc.Errors != 1 || len(doc.Suites) != 3 {
+		t.Errorf("got unexpected totals %d tests %d failures %d errors %d suites", doc.Tests, doc.Failures, doc.Errors, len(doc.Suites))
+	}
+	for _, suite := range doc.Suites {
+		if suite.Name == "mediatag.php" {
+			if suite.TestCases[0].Failure == nil || suite.TestCases[0].Failure.Type != "status,body" {
+				t.Errorf("mediatag failure was not recorded properly: %v", suite.TestCases[0].Failure)
+			}
+		}
+	}
+}
+
+func TestJSONReportWriter(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	writeReport(t, NewJSONReportWriter(buffer))
+
+	var doc struct {
+		Summary struct {
+			Total  int `json:"total"`
+			Failed int `json:"failed"`
+		} `json:"summary"`
+		Results []jsonReportResult `json:"results"`
+	}
+	if err := json.Unmarshal(buffer.Bytes(), &doc); err != nil {
+		t.Fatalf("report was not valid json: %s", err)
+	}
+	if doc.Summary.Total != 3 || doc.Summary.Failed != 2 || len(doc.Results) != 3 {
+		t.Errorf("got unexpected report %v", doc)
+	}
+	if doc.Results[0].Expected != nil || doc.Results[1].Expected == nil {
+		t.Error("responses should only be included for failures")
+	}
+}
+
+func TestHTMLReportWriter(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	writeReport(t, NewHTMLReportWriter(buffer))
+	content := buffer.String()
+
+	if !strings.Contains(content, "1 / 3 tests passed") {
+		t.Error("report did not contain the summary")
+	}
+	if !strings.Contains(content, `<tr class="changed"><th>Body</th><td class="left">&lt;source src=&#39;a&#39;&gt;</td><td class="right">&lt;source src=&#39;b&#39;&gt;</td></tr>`) {
+		t.Errorf("report did not contain an escaped side-by-side diff: %s", content)
+	}
+	if strings.Contains(content, "reference.php?file=a") {
+		t.Error("passed tests should not be in the report")
+	}
+}
+
+func TestAsyncWriterCSV(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	inputCh := make(chan TestOutput, 3)
+	for _, result := range testResults() {
+		inputCh <- result
+	}
+	close(inputCh)
+
+	summary := NewSummary()
+	if err := <-AsyncWriter(inputCh, []ReportWriter{NewCSVReportWriter(buffer)}, summary); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if summary.Total != 3 {
+		t.Errorf("expected 3 results in the summary, got %d", summary.Total)
+	}
+	lines := strings.Count(buffer.String(), "\nhttps://")
+	if !strings.HasPrefix(buffer.String(), "Request URL,") || lines != 2 {
+		t.Errorf("expected a header and the 2 failures, got %s", buffer.String())
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+headerNormalisers can be applied to header values before they are compared, by name
+*/
+var headerNormalisers = map[string]func(string) string{
+	"trim":      strings.TrimSpace,
+	"lowercase": strings.ToLower,
+	//https://host/path and http://host/path are the same
+	"ignore_scheme": func(value string) string {
+		return urlSchemeMatcher.ReplaceAllString(value, "//")
+	},
+	"ignore_host": ignoreHost,
+	//`text/plain; charset=UTF-8` and `text/plain` are the same, as are differences in case and spacing
+	"media_type": func(value string) string {
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			return value
+		}
+		if strings.EqualFold(params["charset"], "utf-8") {
+			delete(params, "charset")
+		}
+		return mime.FormatMediaType(mediaType, params)
+	},
+}
+
+var urlSchemeMatcher = regexp.MustCompile("^https?://")
+
+/*
+ignoreHost reduces a URL to its path and query, so that URLs on different hosts can be compared
+*/
+func ignoreHost(value string) string {
+	if parsed, err := url.Parse(strings.TrimSpace(value)); err == nil && parsed.Host != "" {
+		return parsed.RequestURI()
+	}
+	return value
+}
+
+func compareTrimmed(expected string, actual string) (bool, string, string) {
+	expected = strings.TrimSpace(expected)
+	actual = strings.TrimSpace(actual)
+	return expected == actual, expected, actual
+}
+
+/*
+bodyComparators decide whether two bodies are the same, by name.  They return the normalised bodies, which are what
+is shown in reports and matched by AllowRules.
+*/
+var bodyComparators = map[string]func(expected string, actual string) (bool, string, string){
+	"exact": func(expected string, actual string) (bool, string, string) {
+		return expected == actual, expected, actual
+	},
+	"trimmed": compareTrimmed,
+	"html": func(expected string, actual string) (bool, string, string) {
+		expected = normaliseHtml(&expected)
+		actual = normaliseHtml(&actual)
+		return expected == actual, expected, actual
+	},
+	//the bodies are URLs, which are the same if they have the same path and query
+	"url": func(expected string, actual string) (bool, string, string) {
+		expected = ignoreHost(strings.TrimSpace(expected))
+		actual = ignoreHost(strings.TrimSpace(actual))
+		return expected == actual, expected, actual
+	},
+	//the bodies are json, which are the same if they have the same content regardless of formatting or key order
+	"json": func(expected string, actual string) (bool, string, string) {
+		var expectedValue, actualValue interface{}
+		expectedErr := json.Unmarshal([]byte(expected), &expectedValue)
+		actualErr := json.Unmarshal([]byte(actual), &actualValue)
+		if expectedErr != nil || actualErr != nil {
+			return compareTrimmed(expected, actual)
+		}
+		return reflect.DeepEqual(expectedValue, actualValue), strings.TrimSpace(expected), strings.TrimSpace(actual)
+	},
+}
+
+/*
+HeaderRule says how one header is compared
+*/
+type HeaderRule struct {
+	Header      string   `json:"header"`
+	Normalisers []string `json:"normalisers"` //names of headerNormalisers, applied in order. Replaces the defaults.
+	Ignore      bool     `json:"ignore"`      //if set, the header is not compared at all
+}
+
+/*
+BodyRule picks the comparator for a body. The first rule that matches is used.
+*/
+type BodyRule struct {
+	Endpoint    string `json:"endpoint"`     //if set, only matches requests for this endpoint, e.g. `reference.php`
+	ContentType string `json:"content_type"` //if set, only matches responses whose Content-Type starts with this
+	Comparator  string `json:"comparator"`   //name of a bodyComparator
+}
+
+/*
+AllowRule accepts a known difference, so that it doesn't fail the test
+*/
+type AllowRule struct {
+	Url           string `json:"url"`           //regex on the captured URL
+	Category      string `json:"category"`      //if set, only allows this category of problem
+	Header        string `json:"header"`        //if set, only allows problems with this header
+	Expected      string `json:"expected"`      //if set, regex on the normalised captured value
+	Actual        string `json:"actual"`        //if set, regex on the normalised value we got
+	Justification string `json:"justification"` //why this difference is ok. Required.
+
+	urlMatcher      *regexp.Regexp
+	expectedMatcher *regexp.Regexp
+	actualMatcher   *regexp.Regexp
+}
+
+func (a *AllowRule) compile() error {
+	if a.Url == "" || a.Justification == "" {
+		return errors.New("url and justification are required")
+	}
+	switch a.Category {
+	case "", ProblemStatus, ProblemBody, ProblemHeader:
+	default:
+		return fmt.Errorf("unknown category %s", a.Category)
+	}
+	var err error
+	if a.urlMatcher, err = regexp.Compile(a.Url); err != nil {
+		return err
+	}
+	if a.Expected != "" {
+		if a.expectedMatcher, err = regexp.Compile(a.Expected); err != nil {
+			return err
+		}
+	}
+	if a.Actual != "" {
+		if a.actualMatcher, err = regexp.Compile(a.Actual); err != nil {
+			return err
+		}
+	}
+	a.Header = canonicalHeaderName(a.Header)
+	return nil
+}
+
+/*
+Matches returns true if the rule allows the given problem with a request for the given URL
+*/
+func (a *AllowRule) Matches(accessUrl string, problem *TestProblem) bool {
+	return a.urlMatcher.MatchString(accessUrl) &&
+		(a.Category == "" || a.Category == problem.Category) &&
+		(a.Header == "" || a.Header == problem.Header) &&
+		(a.expectedMatcher == nil || a.expectedMatcher.MatchString(problem.Expected)) &&
+		(a.actualMatcher == nil || a.actualMatcher.MatchString(problem.Actual))
+}
+
+/*
+Rules says how captured responses are compared with the ones we get.  Load them from a json file with LoadRules, or
+use DefaultRules.
+*/
+type Rules struct {
+	DefaultHeaderNormalisers []string     `json:"default_header_normalisers"` //used for headers that don't have a HeaderRule
+	Headers                  []HeaderRule `json:"headers"`
+	Body                     []BodyRule   `json:"body"`
+	Allow                    []*AllowRule `json:"allow"`
+
+	headerRules map[string]*HeaderRule
+}
+
+func canonicalHeaderName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return http.CanonicalHeaderKey(name)
+}
+
+func checkNormalisers(names []string) error {
+	for _, name := range names {
+		if _, haveNormaliser := headerNormalisers[name]; !haveNormaliser {
+			return fmt.Errorf("unknown header normaliser %s", name)
+		}
+	}
+	return nil
+}
+
+/*
+prepare checks the rules and gets them ready for use
+*/
+func (r *Rules) prepare() error {
+	if err := checkNormalisers(r.DefaultHeaderNormalisers); err != nil {
+		return err
+	}
+	r.headerRules = make(map[string]*HeaderRule, len(r.Headers))
+	for i := range r.Headers {
+		rule := &r.Headers[i]
+		if rule.Header == "" {
+			return fmt.Errorf("header rule %d has no header", i)
+		}
+		if err := checkNormalisers(rule.Normalisers); err != nil {
+			return fmt.Errorf("header rule for %s: %s", rule.Header, err)
+		}
+		rule.Header = canonicalHeaderName(rule.Header)
+		r.headerRules[rule.Header] = rule
+	}
+	for i, rule := range r.Body {
+		if _, haveComparator := bodyComparators[rule.Comparator]; !haveComparator {
+			return fmt.Errorf("body rule %d: unknown comparator %s", i, rule.Comparator)
+		}
+	}
+	for i, rule := range r.Allow {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("allow rule %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+/*
+perResponseHeaders are different on every response, or depend on how the request reached the server.  They are never
+in the captured data, but are when comparing two targets.
+*/
+var perResponseHeaders = []string{
+	"Age", "Connection", "Content-Length", "Date", "Server", "Via", "X-Cache",
+	"X-Amz-Apigw-Id", "X-Amz-Cf-Id", "X-Amz-Cf-Pop", "X-Amzn-Requestid", "X-Amzn-Trace-Id",
+}
+
+/*
+DefaultRules are used when no rules file is given.  They ignore the differences that we know the PHP capture has
+for reasons that don't matter, and headers that are different on every response.
+*/
+func DefaultRules() *Rules {
+	rules := &Rules{
+		DefaultHeaderNormalisers: []string{"ignore_scheme", "trim"},
+		Headers: []HeaderRule{
+			{Header: "Content-Type", Normalisers: []string{"trim", "media_type"}},
+			{Header: "X-Powered-By", Ignore: true},
+		},
+		Body: []BodyRule{
+			{ContentType: "text/html", Comparator: "html"},
+			{Comparator: "trimmed"},
+		},
+		Allow: []*AllowRule{
+			{Url: ".", Category: ProblemBody, Expected: "^$", Actual: "^No content found", Justification: "PHP sent an empty body for some 404s"},
+			{Url: ".", Category: ProblemBody, Expected: "^No content found", Actual: "^$", Justification: "PHP sent a body for some 404s that we leave empty"},
+		},
+	}
+	for _, header := range perResponseHeaders {
+		rules.Headers = append(rules.Headers, HeaderRule{Header: header, Ignore: true})
+	}
+	if err := rules.prepare(); err != nil {
+		panic(fmt.Sprintf("the default rules are invalid: %s", err))
+	}
+	return rules
+}
+
+/*
+LoadRules reads rules from a json file.  Unknown fields are an error, so that typos don't silently do nothing.
+*/
+func LoadRules(filename string) (*Rules, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	rules := &Rules{}
+	if err := decoder.Decode(rules); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if err := rules.prepare(); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return rules, nil
+}
+
+func (r *Rules) normaliseHeader(name string, value string) string {
+	normalisers := r.DefaultHeaderNormalisers
+	if rule, haveRule := r.headerRules[name]; haveRule && rule.Normalisers != nil {
+		normalisers = rule.Normalisers
+	}
+	for _, normaliser := range normalisers {
+		value = headerNormalisers[normaliser](value)
+	}
+	return value
+}
+
+func (r *Rules) comparatorFor(endpoint string, contentType string) string {
+	for _, rule := range r.Body {
+		if (rule.Endpoint == "" || rule.Endpoint == endpoint) &&
+			(rule.ContentType == "" || strings.HasPrefix(strings.ToLower(contentType), strings.ToLower(rule.ContentType))) {
+			return rule.Comparator
+		}
+	}
+	return "trimmed"
+}
+
+/*
+compareHeaders checks every header that was captured against the response. Headers that were not captured are not
+checked.
+*/
+func (r *Rules) compareHeaders(expected map[string]string, actual http.Header) []TestProblem {
+	problems := make([]TestProblem, 0)
+	for k, v := range expected {
+		k = canonicalHeaderName(k)
+		if rule, haveRule := r.headerRules[k]; haveRule && rule.Ignore {
+			continue
+		}
+
+		expectedValue := r.normaliseHeader(k, v)
+		if actualValues, haveHeader := actual[k]; haveHeader {
+			actualValue := r.normaliseHeader(k, actualValues[0])
+			if actualValue != expectedValue {
+				problems = append(problems, TestProblem{
+					Category: ProblemHeader,
+					Header:   k,
+					Expected: expectedValue,
+					Actual:   actualValue,
+					Message:  fmt.Sprintf("header %s got value %s expected %s", k, actualValue, expectedValue),
+				})
+			}
+		} else {
+			problems = append(problems, TestProblem{
+				Category: ProblemHeader,
+				Header:   k,
+				Expected: expectedValue,
+				Message:  fmt.Sprintf("response was missing header %s", k),
+			})
+		}
+	}
+	return problems
+}
+
+/*
+Compare checks a response against what was captured for the same request.
+Returns the problems that fail the test, and the problems that are allowed by an AllowRule (with the Justification
+filled in).
+*/
+func (r *Rules) Compare(captured *EndpointEvent, endpoint string, response *FetchedResponse) ([]TestProblem, []TestProblem) {
+	found := make([]TestProblem, 0)
+	if response.StatusCode != int(captured.ExpectedResponse) {
+		found = append(found, TestProblem{
+			Category: ProblemStatus,
+			Expected: strconv.Itoa(int(captured.ExpectedResponse)),
+			Actual:   strconv.Itoa(response.StatusCode),
+			Message:  fmt.Sprintf("expected response %d got %d", captured.ExpectedResponse, response.StatusCode),
+		})
+	}
+
+	comparator := bodyComparators[r.comparatorFor(endpoint, response.Header.Get("Content-Type"))]
+	if same, expectedBody, actualBody := comparator(captured.ExpectedOutputMessage, string(response.Body)); !same {
+		found = append(found, TestProblem{
+			Category: ProblemBody,
+			Expected: expectedBody,
+			Actual:   actualBody,
+			Message:  fmt.Sprintf("expected body '%s' got '%s'", expectedBody, actualBody),
+		})
+	}
+	found = append(found, r.compareHeaders(captured.ExpectedOutputHeaders, response.Header)...)
+
+	problems := make([]TestProblem, 0, len(found))
+	allowed := make([]TestProblem, 0)
+	for _, problem := range found {
+		problemAllowed := false
+		for _, rule := range r.Allow {
+			if rule.Matches(captured.AccessUrl, &problem) {
+				problem.Justification = rule.Justification
+				allowed = append(allowed, problem)
+				problemAllowed = true
+				break
+			}
+		}
+		if !problemAllowed {
+			problems = append(problems, problem)
+		}
+	}
+	return problems, allowed
+}
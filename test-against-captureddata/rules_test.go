@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testResponse(status int, body string, headers map[string]string) *FetchedResponse {
+	header := make(http.Header)
+	for k, v := range headers {
+		header.Set(k, v)
+	}
+	return &FetchedResponse{Url: "http://localhost/interactivevideos/test", StatusCode: status, Header: header, Body: []byte(body)}
+}
+
+func TestHeaderNormalisers(t *testing.T) {
+	tests := []struct {
+		normaliser string
+		input      string
+		expected   string
+	}{
+		{"trim", "  value ", "value"},
+		{"lowercase", "Text/HTML", "text/html"},
+		{"ignore_scheme", "https://cdn.example.com/a.mp4", "//cdn.example.com/a.mp4"},
+		{"ignore_host", "https://cdn.example.com/a.mp4?b=c", "/a.mp4?b=c"},
+		{"ignore_host", "not a url", "not a url"},
+		{"media_type", "text/plain;charset=UTF-8", "text/plain"},
+		{"media_type", "Text/HTML; charset=iso-8859-1", "text/html; charset=iso-8859-1"},
+	}
+	for _, test := range tests {
+		if got := headerNormalisers[test.normaliser](test.input); got != test.expected {
+			t.Errorf("%s of '%s': expected '%s' got '%s'", test.normaliser, test.input, test.expected, got)
+		}
+	}
+}
+
+func TestBodyComparators(t *testing.T) {
+	tests := []struct {
+		comparator string
+		expected   string
+		actual     string
+		same       bool
+	}{
+		{"exact", "a\n", "a", false},
+		{"trimmed", "a\n", "a", true},
+		{"html", "<video><source src='a'></video>", "<video>\n  <source src='a'>\n</video>", true},
+		{"html", "<video><source src='a'></video>", "<video><source src='b'></video>", false},
+		{"url", "http://cdn.example.com/a.mp4\n", "https://other.example.com/a.mp4", true},
+		{"url", "http://cdn.example.com/a.mp4", "http://cdn.example.com/b.mp4", false},
+		{"json", `{"a": 1, "b": [2, 3]}`, `{"b":[2,3],"a":1}`, true},
+		{"json", `{"a": 1}`, `{"a": 2}`, false},
+		{"json", "not json", " not json ", true},
+	}
+	for _, test := range tests {
+		if same, _, _ := bodyComparators[test.comparator](test.expected, test.actual); same != test.same {
+			t.Errorf("%s of '%s' and '%s': expected %t got %t", test.comparator, test.expected, test.actual, test.same, same)
+		}
+	}
+}
+
+func TestCompareDefaultRules(t *testing.T) {
+	rules := DefaultRules()
+	captured := testEvent("https://multimedia.example.com/interactivevideos/reference.php?file=a", 404, "",
+		map[string]string{"Content-type": "text/plain", "X-Powered-By": "PHP/5.3.3", "Location": "https://cdn.example.com/a.mp4"})
+
+	problems, allowed := rules.Compare(captured, "reference.php", testResponse(404, "No content found for a", map[string]string{
+		"Content-Type": "text/plain;charset=UTF-8",
+		"Location":     "http://cdn.example.com/a.mp4",
+	}))
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+	if len(allowed) != 1 || allowed[0].Category != ProblemBody || allowed[0].Justification == "" {
+		t.Errorf("expected the body difference to be allowed with a justification, got %v", allowed)
+	}
+
+	problems, _ = rules.Compare(captured, "reference.php", testResponse(200, "", map[string]string{"Content-Type": "text/html"}))
+	if len(problems) != 3 {
+		t.Fatalf("expected status, content type and missing location problems, got %v", problems)
+	}
+	headers := make(map[string]string)
+	for _, problem := range problems[1:] {
+		headers[problem.Header] = problem.Actual
+	}
+	if problems[0].Category != ProblemStatus || problems[0].Expected != "404" || problems[0].Actual != "200" {
+		t.Errorf("got unexpected status problem %v", problems[0])
+	}
+	if actual, haveProblem := headers["Content-Type"]; !haveProblem || actual != "text/html" {
+		t.Errorf("expected a Content-Type problem, got %v", problems)
+	}
+	if _, haveProblem := headers["Location"]; !haveProblem {
+		t.Errorf("expected a missing Location problem, got %v", problems)
+	}
+}
+
+func TestAllowRuleMatches(t *testing.T) {
+	rule := &AllowRule{Url: `video\.php\?.*format=video%2Fwebm`, Category: ProblemHeader, Header: "location", Actual: `\.webm$`, Justification: "webm is preferred now"}
+	if err := rule.compile(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	problem := TestProblem{Category: ProblemHeader, Header: "Location", Expected: "//cdn.example.com/a.mp4", Actual: "//cdn.example.com/a.webm"}
+	if !rule.Matches("https://multimedia.example.com/interactivevideos/video.php?file=a&format=video%2Fwebm", &problem) {
+		t.Error("expected the rule to match")
+	}
+	if rule.Matches("https://multimedia.example.com/interactivevideos/video.php?file=a", &problem) {
+		t.Error("rule should not match a different url")
+	}
+	problem.Actual = "//cdn.example.com/a.mp4"
+	if rule.Matches("https://multimedia.example.com/interactivevideos/video.php?file=a&format=video%2Fwebm", &problem) {
+		t.Error("rule should not match a different actual value")
+	}
+}
+
+func writeRulesFile(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("could not write rules: %s", err)
+	}
+	return filename
+}
+
+func TestLoadRules(t *testing.T) {
+	rules, err := LoadRules(writeRulesFile(t, `{
+  "default_header_normalisers": ["trim"],
+  "headers": [{"header": "location", "normalisers": ["ignore_host"]}, {"header": "Cache-Control", "ignore": true}],
+  "body": [{"endpoint": "reference.php", "comparator": "url"}, {"comparator": "exact"}],
+  "allow": [{"url": "mediatag\\.php", "category": "body", "justification": "poster urls changed"}]
+}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rules.normaliseHeader("Location", "https://cdn.example.com/a.mp4") != "/a.mp4" {
+		t.Error("header rule was not applied to a canonicalised header name")
+	}
+	if rules.comparatorFor("reference.php", "text/plain") != "url" || rules.comparatorFor("video.php", "text/plain") != "exact" {
+		t.Error("body rules were not applied in order")
+	}
+	problems, allowed := rules.Compare(testEvent("https://multimedia.example.com/interactivevideos/mediatag.php?file=a", 200, "a",
+		map[string]string{"Cache-Control": "no-cache"}), "mediatag.php", testResponse(200, "b", nil))
+	if len(problems) != 0 || len(allowed) != 1 {
+		t.Errorf("expected the body problem to be allowed, got %v and %v", problems, allowed)
+	}
+
+	invalid := []string{
+		`{"headers": [{"header": "Location", "normalisers": ["nonexistent"]}]}`,
+		`{"body": [{"comparator": "nonexistent"}]}`,
+		`{"allow": [{"url": "a"}]}`,
+		`{"allow": [{"url": "(", "justification": "b"}]}`,
+		`{"allow": [{"url": "a", "category": "nonexistent", "justification": "b"}]}`,
+		`{"alow": []}`,
+	}
+	for _, content := range invalid {
+		if _, err := LoadRules(writeRulesFile(t, content)); err == nil {
+			t.Errorf("expected an error for %s", content)
+		} else if !strings.Contains(err.Error(), "rules.json") {
+			t.Errorf("error should name the file, got %s", err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+/*
+EndpointSummary counts the test results for one endpoint, or for the whole run
+*/
+type EndpointSummary struct {
+	Total      int            `json:"total"`
+	Passed     int            `json:"passed"`
+	Failed     int            `json:"failed"`
+	ByCategory map[string]int `json:"failures_by_category"` //number of failed tests that had each category of problem
+	Allowed    int            `json:"allowed_differences"`  //number of differences that were accepted by an allow rule
+	Duration   time.Duration  `json:"-"`                    //total time spent on the tests
+}
+
+func newEndpointSummary() *EndpointSummary {
+	return &EndpointSummary{ByCategory: make(map[string]int)}
+}
+
+func (s *EndpointSummary) add(result *TestOutput) {
+	s.Total++
+	s.Duration += result.Duration
+	s.Allowed += len(result.Allowed)
+	if result.Passed {
+		s.Passed++
+		return
+	}
+	s.Failed++
+	seen := make(map[string]bool, len(result.Problems))
+	for _, problem := range result.Problems {
+		if !seen[problem.Category] {
+			seen[problem.Category] = true
+			s.ByCategory[problem.Category]++
+		}
+	}
+}
+
+/*
+FailureRate returns the percentage of tests that failed, or 0 if there were none
+*/
+func (s *EndpointSummary) FailureRate() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return 100 * float64(s.Failed) / float64(s.Total)
+}
+
+/*
+Summary counts the test results for the whole run, and for each endpoint
+*/
+type Summary struct {
+	EndpointSummary
+	ByEndpoint map[string]*EndpointSummary `json:"by_endpoint"`
+	StartedAt  time.Time                   `json:"started_at"`
+}
+
+func NewSummary() *Summary {
+	return &Summary{
+		EndpointSummary: *newEndpointSummary(),
+		ByEndpoint:      make(map[string]*EndpointSummary),
+		StartedAt:       time.Now(),
+	}
+}
+
+/*
+Add counts a test result. It is not safe to call from more than one goroutine.
+*/
+func (s *Summary) Add(result *TestOutput) {
+	s.EndpointSummary.add(result)
+	endpoint := result.Endpoint()
+	if _, haveEndpoint := s.ByEndpoint[endpoint]; !haveEndpoint {
+		s.ByEndpoint[endpoint] = newEndpointSummary()
+	}
+	s.ByEndpoint[endpoint].add(result)
+}
+
+/*
+Endpoints returns the names of the endpoints that were tested, in order
+*/
+func (s *Summary) Endpoints() []string {
+	names := make([]string, 0, len(s.ByEndpoint))
+	for name := range s.ByEndpoint {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Categories returns the categories of problem that were found, in order
+*/
+func (s *Summary) Categories() []string {
+	names := make([]string, 0, len(s.ByCategory))
+	for name := range s.ByCategory {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Log writes the summary out to the log
+*/
+func (s *Summary) Log() {
+	log.Printf("INFO %d / %d tests successful, %.2f%% failed, %d allowed differences", s.Passed, s.Total, s.FailureRate(), s.Allowed)
+	for _, name := range s.Endpoints() {
+		endpoint := s.ByEndpoint[name]
+		log.Printf("INFO   %s: %d / %d successful, %.2f%% failed %v", name, endpoint.Passed, endpoint.Total, endpoint.FailureRate(), endpoint.ByCategory)
+	}
+}
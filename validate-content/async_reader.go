@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"log"
+)
+
+/*
+ScannedEncoding is an encoding read from the table, along with whether it has already been flagged as broken
+*/
+type ScannedEncoding struct {
+	Encoding  *common.Encoding
+	WasBroken bool
+}
+
+/*
+AsyncEncodingReader scans the whole of the encodings table and sends every encoding that is still being served to
+the returned channel. Withdrawn encodings are skipped, because readers can't get to them anyway.
+*/
+func AsyncEncodingReader(client *dynamodb.Client, tableName *string, pageSize int32) (chan *ScannedEncoding, chan error) {
+	outputCh := make(chan *ScannedEncoding, pageSize*2)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(outputCh)
+		var continuationKey map[string]types.AttributeValue
+		for {
+			req := &dynamodb.ScanInput{
+				TableName:         tableName,
+				ExclusiveStartKey: continuationKey,
+				Limit:             aws.Int32(pageSize),
+			}
+			log.Printf("Retrieving from %s...", *tableName)
+			response, err := client.Scan(context.Background(), req)
+			if err != nil {
+				log.Printf("ERROR %s", err)
+				errCh <- err
+				return
+			}
+			log.Printf("DEBUG Got page of %d items from %s", len(response.Items), *tableName)
+			for _, item := range response.Items {
+				rec := common.RawDynamoRecord(item)
+				enc, marshalErr := common.EncodingFromDynamo(&rec)
+				if marshalErr != nil {
+					log.Printf("WARNING Skipping invalid encoding %v: %s", item["encodingid"], marshalErr)
+					continue
+				}
+				if enc.Withdrawn != nil {
+					continue
+				}
+				_, wasBroken := item[brokenAtField]
+				outputCh <- &ScannedEncoding{Encoding: enc, WasBroken: wasBroken}
+			}
+			if response.LastEvaluatedKey == nil {
+				break //docs say that LastEvaluatedKey is blank when we get to the end
+			} else {
+				continuationKey = response.LastEvaluatedKey
+			}
+		}
+		log.Printf("INFO AsyncEncodingReader reached the end of records")
+	}()
+	return outputCh, errCh
+}
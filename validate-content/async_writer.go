@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+/*
+ValidationSummary counts what was found over the whole run
+*/
+type ValidationSummary struct {
+	Checked      int
+	Broken       int
+	WithProblems int //includes the broken ones
+	Flagged      int
+	Cleared      int
+}
+
+func (r *ValidationResult) toCSV() []string {
+	posterUrl, posterStatus := "", ""
+	if r.Poster != nil {
+		posterUrl = r.Poster.Url
+		posterStatus = fmt.Sprintf("%d", r.Poster.StatusCode)
+	}
+	return []string{
+		r.Encoding.FCSID,
+		fmt.Sprintf("%d", r.Encoding.EncodingId),
+		r.Encoding.Url,
+		fmt.Sprintf("%t", r.IsBroken()),
+		fmt.Sprintf("%d", r.Media.StatusCode),
+		fmt.Sprintf("%d", r.Encoding.FileSize),
+		fmt.Sprintf("%d", r.Media.ContentLength),
+		r.Encoding.Format,
+		r.Media.ContentType,
+		posterUrl,
+		posterStatus,
+		strings.Join(r.Problems, "\n"),
+	}
+}
+
+/*
+WriteReport writes a CSV row for every result that has a problem (or every result, if `all` is set), and updates
+the broken flags in the table if `flagger` is not nil.  A flag is only cleared if it was set before, so that a clean
+run does not write to every record in the table.
+*/
+func WriteReport(inputCh chan *ValidationResult, out io.Writer, all bool, flagger BrokenFlagger) (*ValidationSummary, error) {
+	summary := &ValidationSummary{}
+	writer := csv.NewWriter(out)
+	defer writer.Flush()
+
+	err := writer.Write([]string{"FCS ID", "Encoding ID", "URL", "Broken", "Status", "Expected size", "Actual size", "Expected type", "Actual type", "Poster URL", "Poster status", "Problems"})
+	if err != nil {
+		return summary, err
+	}
+
+	for result := range inputCh {
+		summary.Checked++
+		if result.IsBroken() {
+			summary.Broken++
+		}
+		if len(result.Problems) > 0 {
+			summary.WithProblems++
+		}
+
+		if all || len(result.Problems) > 0 {
+			if err := writer.Write(result.toCSV()); err != nil {
+				return summary, err
+			}
+		}
+
+		if flagger != nil {
+			var flagErr error
+			if result.IsBroken() {
+				flagErr = flagger.SetBroken(context.Background(), result.Encoding, result.Problems)
+				if flagErr == nil {
+					summary.Flagged++
+				}
+			} else if result.WasBroken {
+				flagErr = flagger.ClearBroken(context.Background(), result.Encoding)
+				if flagErr == nil {
+					summary.Cleared++
+				}
+			}
+			if flagErr != nil {
+				log.Printf("ERROR Could not update broken flag on encoding %d: %s", result.Encoding.EncodingId, flagErr)
+			}
+		}
+	}
+	return summary, nil
+}
+
+/*
+AsyncWriter runs WriteReport on the given output file in the background
+*/
+func AsyncWriter(inputCh chan *ValidationResult, filename string, all bool, flagger BrokenFlagger) (chan *ValidationSummary, chan error) {
+	summaryCh := make(chan *ValidationSummary, 1)
+	errCh := make(chan error, 1)
+
+	go func() {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer f.Close()
+
+		summary, err := WriteReport(inputCh, f, all, flagger)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		log.Printf("INFO AsyncWriter got to end of input, shutting down")
+		summaryCh <- summary
+	}()
+	return summaryCh, errCh
+}
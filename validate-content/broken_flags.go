@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fields that are set on an encoding whose url is broken. The endpoints don't act on these, use the retire API for that.
+const brokenAtField = "url_broken_at"
+const brokenReasonField = "url_broken_reason"
+
+/*
+BrokenFlagger records in the encodings table whether an encoding's url is broken
+*/
+type BrokenFlagger interface {
+	SetBroken(ctx context.Context, enc *common.Encoding, problems []string) error
+	ClearBroken(ctx context.Context, enc *common.Encoding) error
+}
+
+type DynamoBrokenFlagger struct {
+	client    *dynamodb.Client
+	tableName *string
+}
+
+func NewDynamoBrokenFlagger(client *dynamodb.Client, tableName *string) BrokenFlagger {
+	return &DynamoBrokenFlagger{client: client, tableName: tableName}
+}
+
+func (f *DynamoBrokenFlagger) update(ctx context.Context, enc *common.Encoding, update expression.UpdateBuilder) error {
+	//the condition stops us from re-creating an encoding that was deleted while we were checking it
+	expr, err := expression.NewBuilder().
+		WithUpdate(update).
+		WithCondition(expression.AttributeExists(expression.Name("encodingid"))).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = f.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: f.tableName,
+		Key: map[string]types.AttributeValue{
+			"fcs_id":     &types.AttributeValueMemberS{Value: enc.FCSID},
+			"encodingid": &types.AttributeValueMemberN{Value: strconv.FormatInt(int64(enc.EncodingId), 10)},
+		},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
+
+func (f *DynamoBrokenFlagger) SetBroken(ctx context.Context, enc *common.Encoding, problems []string) error {
+	update := expression.
+		Set(expression.Name(brokenAtField), expression.Value(time.Now().UTC().Format(time.RFC3339))).
+		Set(expression.Name(brokenReasonField), expression.Value(strings.Join(problems, "; ")))
+	return f.update(ctx, enc, update)
+}
+
+func (f *DynamoBrokenFlagger) ClearBroken(ctx context.Context, enc *common.Encoding) error {
+	update := expression.Remove(expression.Name(brokenAtField)).Remove(expression.Name(brokenReasonField))
+	return f.update(ctx, enc, update)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+UrlCheck is the result of checking that a single URL exists
+*/
+type UrlCheck struct {
+	Url           string
+	StatusCode    int    //0 if the request failed altogether
+	ContentLength int64  //-1 if the server did not say
+	ContentType   string //media type only, without parameters
+	Error         string
+}
+
+func (c *UrlCheck) IsOk() bool {
+	return c.Error == "" && c.StatusCode >= 200 && c.StatusCode < 300
+}
+
+/*
+ValidationResult is the result of checking one encoding
+*/
+type ValidationResult struct {
+	Encoding  *common.Encoding
+	WasBroken bool //true if the encoding was already flagged as broken in the table
+	Media     *UrlCheck
+	Poster    *UrlCheck //nil if posters are not being checked or no poster url could be made
+	Problems  []string
+}
+
+/*
+IsBroken returns true if the media file itself could not be fetched. Other problems (e.g. a wrong size, or a missing
+poster) are reported but do not count as broken.
+*/
+func (r *ValidationResult) IsBroken() bool {
+	return !r.Media.IsOk()
+}
+
+/*
+checkUrl does a HEAD request for the given url.  Some CDNs and origins don't allow HEAD, in which case a GET for the
+first byte is done instead and the size is taken from the Content-Range header.
+*/
+func checkUrl(ctx context.Context, httpClient *http.Client, url string) *UrlCheck {
+	result := &UrlCheck{Url: url, ContentLength: -1}
+	response, err := doCheckRequest(ctx, httpClient, "HEAD", url)
+	if err == nil && (response.StatusCode == http.StatusMethodNotAllowed || response.StatusCode == http.StatusNotImplemented) {
+		response.Body.Close()
+		response, err = doCheckRequest(ctx, httpClient, "GET", url)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1024)) //so that the connection can be reused
+
+	result.StatusCode = response.StatusCode
+	if mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type")); err == nil {
+		result.ContentType = mediaType
+	}
+	if response.StatusCode == http.StatusPartialContent {
+		//Content-Range: bytes 0-0/12345
+		contentRange := response.Header.Get("Content-Range")
+		if slash := strings.LastIndex(contentRange, "/"); slash >= 0 {
+			if size, err := strconv.ParseInt(contentRange[slash+1:], 10, 64); err == nil {
+				result.ContentLength = size
+			}
+		}
+	} else if response.ContentLength >= 0 {
+		result.ContentLength = response.ContentLength
+	}
+	return result
+}
+
+func doCheckRequest(ctx context.Context, httpClient *http.Client, method string, url string) (*http.Response, error) {
+	rq, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if method == "GET" {
+		rq.Header.Set("Range", "bytes=0-0")
+	}
+	return httpClient.Do(rq)
+}
+
+/*
+CheckEncoding checks the media url of an encoding, and optionally its poster, and compares what the server says about
+the file with what the encoding says.
+*/
+func CheckEncoding(ctx context.Context, httpClient *http.Client, enc *common.Encoding, checkPoster bool) *ValidationResult {
+	result := &ValidationResult{Encoding: enc, Problems: []string{}}
+	result.Media = checkUrl(ctx, httpClient, enc.Url)
+
+	if !result.Media.IsOk() {
+		if result.Media.Error != "" {
+			result.Problems = append(result.Problems, fmt.Sprintf("media request failed: %s", result.Media.Error))
+		} else {
+			result.Problems = append(result.Problems, fmt.Sprintf("media returned %d", result.Media.StatusCode))
+		}
+	} else {
+		if enc.FileSize > 0 && result.Media.ContentLength >= 0 && result.Media.ContentLength != enc.FileSize {
+			result.Problems = append(result.Problems, fmt.Sprintf("size is %d but encoding says %d", result.Media.ContentLength, enc.FileSize))
+		}
+		if strings.Contains(enc.Format, "/") && result.Media.ContentType != "" && !strings.EqualFold(result.Media.ContentType, enc.Format) {
+			result.Problems = append(result.Problems, fmt.Sprintf("content type is %s but format is %s", result.Media.ContentType, enc.Format))
+		}
+	}
+
+	if checkPoster {
+		posterUrl, err := common.GeneratePosterImageURL(enc.Url, false)
+		if err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("no poster url could be made: %s", err))
+		} else {
+			result.Poster = checkUrl(ctx, httpClient, posterUrl)
+			if !result.Poster.IsOk() {
+				result.Problems = append(result.Problems, fmt.Sprintf("poster returned %d %s", result.Poster.StatusCode, result.Poster.Error))
+			}
+		}
+	}
+	return result
+}
+
+func checkerThread(inputCh chan *ScannedEncoding, outputCh chan *ValidationResult, httpClient *http.Client, checkPoster bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for scanned := range inputCh {
+		result := CheckEncoding(context.Background(), httpClient, scanned.Encoding, checkPoster)
+		result.WasBroken = scanned.WasBroken
+		if result.IsBroken() {
+			log.Printf("WARNING Encoding %d (%s) is broken: %s", scanned.Encoding.EncodingId, scanned.Encoding.Url, strings.Join(result.Problems, "; "))
+		}
+		outputCh <- result
+	}
+}
+
+/*
+AsyncChecker checks every encoding from the input channel using `parallel` threads, and sends the results to the
+returned channel. The output channel is closed once the input channel is closed and everything has been checked.
+*/
+func AsyncChecker(inputCh chan *ScannedEncoding, parallel int, timeout time.Duration, checkPoster bool) chan *ValidationResult {
+	outputCh := make(chan *ValidationResult, 100)
+	httpClient := &http.Client{Timeout: timeout}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(parallel)
+	for i := 0; i < parallel; i++ {
+		go checkerThread(inputCh, outputCh, httpClient, checkPoster, wg)
+	}
+	go func() {
+		wg.Wait()
+		close(outputCh)
+	}()
+	return outputCh
+}
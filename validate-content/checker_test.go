@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+testServer serves a 1000-byte mp4 at /good.mp4 and its poster, a 1000-byte mp4 that doesn't allow HEAD at
+/nohead.mp4, and 404 for everything else
+*/
+func testServer() *httptest.Server {
+	body := bytes.Repeat([]byte("x"), 1000)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Write(body)
+		case "/good_poster.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("jpeg"))
+		case "/nohead.mp4":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if r.Header.Get("Range") != "bytes=0-0" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "video/mp4; codecs=avc1")
+			w.Header().Set("Content-Range", "bytes 0-0/1000")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(body[:1])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestCheckEncodingGood(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	enc := &common.Encoding{EncodingId: 1, Url: server.URL + "/good.mp4", Format: "video/mp4", FileSize: 1000}
+	result := CheckEncoding(context.Background(), server.Client(), enc, true)
+	if result.IsBroken() {
+		t.Errorf("good encoding was reported as broken: %v", result.Problems)
+	}
+	if len(result.Problems) != 0 {
+		t.Errorf("expected no problems, got %v", result.Problems)
+	}
+	if result.Media.ContentLength != 1000 {
+		t.Errorf("expected content length 1000, got %d", result.Media.ContentLength)
+	}
+	if result.Poster == nil || result.Poster.StatusCode != 200 {
+		t.Errorf("expected poster to be found, got %v", result.Poster)
+	}
+}
+
+func TestCheckEncodingMissing(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	enc := &common.Encoding{EncodingId: 1, Url: server.URL + "/missing.mp4", Format: "video/mp4", FileSize: 1000}
+	result := CheckEncoding(context.Background(), server.Client(), enc, true)
+	if !result.IsBroken() {
+		t.Error("missing encoding was not reported as broken")
+	}
+	if result.Media.StatusCode != 404 {
+		t.Errorf("expected status 404, got %d", result.Media.StatusCode)
+	}
+	if len(result.Problems) != 2 {
+		t.Errorf("expected problems for the media and the poster, got %v", result.Problems)
+	}
+}
+
+func TestCheckEncodingMismatch(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	enc := &common.Encoding{EncodingId: 1, Url: server.URL + "/good.mp4", Format: "video/webm", FileSize: 2000}
+	result := CheckEncoding(context.Background(), server.Client(), enc, false)
+	if result.IsBroken() {
+		t.Error("a mismatched size or type should not count as broken")
+	}
+	if result.Poster != nil {
+		t.Error("poster should not have been checked")
+	}
+	if len(result.Problems) != 2 {
+		t.Fatalf("expected 2 problems, got %v", result.Problems)
+	}
+	if !strings.Contains(result.Problems[0], "size is 1000") {
+		t.Errorf("unexpected size problem %s", result.Problems[0])
+	}
+	if !strings.Contains(result.Problems[1], "content type is video/mp4") {
+		t.Errorf("unexpected type problem %s", result.Problems[1])
+	}
+}
+
+func TestCheckEncodingNoHead(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	enc := &common.Encoding{EncodingId: 1, Url: server.URL + "/nohead.mp4", Format: "video/mp4", FileSize: 1000}
+	result := CheckEncoding(context.Background(), server.Client(), enc, false)
+	if len(result.Problems) != 0 {
+		t.Errorf("expected no problems, got %v", result.Problems)
+	}
+	if result.Media.StatusCode != http.StatusPartialContent {
+		t.Errorf("expected fallback to a ranged GET, got status %d", result.Media.StatusCode)
+	}
+	if result.Media.ContentLength != 1000 {
+		t.Errorf("expected size to come from Content-Range, got %d", result.Media.ContentLength)
+	}
+	if result.Media.ContentType != "video/mp4" {
+		t.Errorf("expected parameters to be stripped from the content type, got %s", result.Media.ContentType)
+	}
+}
+
+func TestCheckEncodingUnreachable(t *testing.T) {
+	server := testServer()
+	url := server.URL + "/good.mp4"
+	server.Close()
+
+	enc := &common.Encoding{EncodingId: 1, Url: url, Format: "video/mp4"}
+	result := CheckEncoding(context.Background(), http.DefaultClient, enc, false)
+	if !result.IsBroken() {
+		t.Error("unreachable encoding was not reported as broken")
+	}
+	if result.Media.Error == "" {
+		t.Error("expected the request error to be recorded")
+	}
+}
+
+type brokenFlaggerMock struct {
+	set     []int32
+	cleared []int32
+}
+
+func (f *brokenFlaggerMock) SetBroken(ctx context.Context, enc *common.Encoding, problems []string) error {
+	f.set = append(f.set, enc.EncodingId)
+	return nil
+}
+
+func (f *brokenFlaggerMock) ClearBroken(ctx context.Context, enc *common.Encoding) error {
+	f.cleared = append(f.cleared, enc.EncodingId)
+	return nil
+}
+
+func TestAsyncCheckerAndReport(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	inputCh := make(chan *ScannedEncoding, 4)
+	inputCh <- &ScannedEncoding{Encoding: &common.Encoding{EncodingId: 1, Url: server.URL + "/good.mp4", Format: "video/mp4", FileSize: 1000}}
+	inputCh <- &ScannedEncoding{Encoding: &common.Encoding{EncodingId: 2, Url: server.URL + "/good.mp4", Format: "video/mp4", FileSize: 1000}, WasBroken: true}
+	inputCh <- &ScannedEncoding{Encoding: &common.Encoding{EncodingId: 3, Url: server.URL + "/gone.mp4", Format: "video/mp4", FileSize: 1000}}
+	inputCh <- &ScannedEncoding{Encoding: &common.Encoding{EncodingId: 4, Url: server.URL + "/gone.mp4", Format: "video/mp4", FileSize: 1000}, WasBroken: true}
+	close(inputCh)
+
+	flagger := &brokenFlaggerMock{}
+	out := &bytes.Buffer{}
+	summary, err := WriteReport(AsyncChecker(inputCh, 2, server.Client().Timeout, true), out, false, flagger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Checked != 4 || summary.Broken != 2 || summary.Flagged != 2 || summary.Cleared != 1 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if len(flagger.cleared) != 1 || flagger.cleared[0] != 2 {
+		t.Errorf("expected only encoding 2 to be cleared, got %v", flagger.cleared)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	//header, then two broken encodings each with a two-line problem list
+	if len(lines) != 5 {
+		t.Errorf("expected only the broken encodings in the report, got %s", out.String())
+	}
+}
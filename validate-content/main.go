@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	tableName := flag.String("table", os.Getenv("ENCODINGS_TABLE"), "name of the encodings table to check")
+	pageSize := flag.Int("s", 50, "page size for retrieval")
+	parallel := flag.Int("parallel", 10, "number of urls to check in parallel")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout for each request")
+	outputFilename := flag.String("out", "content-validation.csv", "name of a CSV file to output")
+	all := flag.Bool("all", false, "write every encoding to the report, not just the ones with problems")
+	checkPosters := flag.Bool("posters", true, "also check the poster image for each encoding")
+	markBroken := flag.Bool("mark-broken", false, "set (or clear) the broken flag on each encoding in the table")
+	flag.Parse()
+
+	if *tableName == "" {
+		log.Fatal("You must specify an encodings table with -table or ENCODINGS_TABLE")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Could not set up AWS SDK: %s", err)
+	}
+	ddbClient := dynamodb.NewFromConfig(cfg)
+
+	var flagger BrokenFlagger
+	if *markBroken {
+		flagger = NewDynamoBrokenFlagger(ddbClient, tableName)
+	}
+
+	encodingsCh, readErrCh := AsyncEncodingReader(ddbClient, tableName, int32(*pageSize))
+	resultsCh := AsyncChecker(encodingsCh, *parallel, *timeout, *checkPosters)
+	summaryCh, writeErrCh := AsyncWriter(resultsCh, *outputFilename, *all, flagger)
+
+	log.Print("Waiting for threads to complete...")
+	for {
+		select {
+		case err := <-readErrCh:
+			log.Fatalf("ERROR Could not retrieve encodings: %s", err)
+		case err := <-writeErrCh:
+			log.Fatalf("ERROR Could not write report: %s", err)
+		case summary := <-summaryCh:
+			//the reader sends its error before closing its output, so a failed scan is always seen here
+			select {
+			case err := <-readErrCh:
+				log.Fatalf("ERROR Could not retrieve all encodings, the report is incomplete: %s", err)
+			default:
+			}
+			log.Printf("INFO Checked %d encodings, %d broken, %d with problems. %d flagged as broken, %d flags cleared",
+				summary.Checked, summary.Broken, summary.WithProblems, summary.Flagged, summary.Cleared)
+			if summary.Broken > 0 {
+				os.Exit(2)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+/*
+This function lets the encoding pipeline register new encodings and idmapping records directly, instead of going via
+the legacy MySQL database and the migration tool.
+
+	POST|PUT /interactivevideos/encodings  - create (POST) or create/replace (PUT) an encoding
+	POST|PUT /interactivevideos/idmapping  - create (POST) or create/replace (PUT) an idmapping record
+	POST     /interactivevideos/retire     - withdraw an idmapping record, an FCS version or a single encoding
+	POST     /interactivevideos/restore    - undo a retire
+	GET      /interactivevideos/audit      - retire/restore history for ?filebase= or ?fcs_id=[&encodingid=]
+
+Requests must carry `Authorization: Bearer {key}` matching WRITE_API_KEY.
+*/
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"path"
+)
+
+var ops common.DynamoDbOps
+var writeOps common.DynamoWriteOps
+var config common.Config
+
+func HandleEvent(ctx context.Context, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+	if !common.IsWriteAuthorised(event) {
+		common.LoggerFromContext(ctx).Warning("Rejected unauthorised %s to %s", event.HTTPMethod, event.Path)
+		return common.MakeErrorResponse(event, common.NewUnauthorizedError("A valid API key is required"), common.ErrorFormatJson), nil
+	}
+
+	resource := path.Base(event.Path)
+	switch resource {
+	case "encodings", "idmapping":
+		return handleRegister(ctx, event, resource)
+	case "retire", "restore":
+		if event.HTTPMethod != "POST" {
+			return methodNotAllowed(), nil
+		}
+		audit, lookupErr := common.SetWithdrawn(ctx, event.Body, resource == "retire", ops, writeOps)
+		if lookupErr != nil {
+			return common.MakeErrorResponse(event, lookupErr, common.ErrorFormatJson), nil
+		}
+		return common.MakeResponseJson(200, audit), nil
+	case "audit":
+		if event.HTTPMethod != "GET" {
+			return methodNotAllowed(), nil
+		}
+		history, lookupErr := common.GetAuditHistory(ctx, event.QueryStringParameters, writeOps)
+		if lookupErr != nil {
+			return common.MakeErrorResponse(event, lookupErr, common.ErrorFormatJson), nil
+		}
+		return common.MakeResponseJson(200, history), nil
+	default:
+		return common.MakeErrorResponse(event, common.NewNotFoundError("No such resource"), common.ErrorFormatJson), nil
+	}
+}
+
+func methodNotAllowed() *events.APIGatewayProxyResponse {
+	return common.MakeResponseJson(405, common.GenericErrorBody("Method not allowed"))
+}
+
+/*
+handleRegister creates (POST) or creates/replaces (PUT) an encoding or idmapping record
+*/
+func handleRegister(ctx context.Context, event *events.APIGatewayProxyRequest, resource string) (*events.APIGatewayProxyResponse, error) {
+	var replace bool
+	switch event.HTTPMethod {
+	case "POST":
+		replace = false
+	case "PUT":
+		replace = true
+	default:
+		return methodNotAllowed(), nil
+	}
+
+	var result *common.WriteResult
+	var lookupErr *common.LookupError
+	if resource == "encodings" {
+		result, lookupErr = common.RegisterEncoding(ctx, event.Body, replace, ops, writeOps)
+	} else {
+		result, lookupErr = common.RegisterIdMapping(ctx, event.Body, replace, ops, writeOps)
+	}
+
+	if lookupErr != nil {
+		return common.MakeErrorResponse(event, lookupErr, common.ErrorFormatJson), nil
+	}
+	return common.MakeResponseJson(result.StatusCode(), result), nil
+}
+
+func main() {
+	var err error
+	err = common.InitTracing(context.Background(), "writeapi")
+	if err != nil {
+		common.DefaultLogger.Error("Could not initialise tracing: %s", err)
+		panic("could not initialise tracing")
+	}
+
+	config, err = common.NewConfig()
+	if err != nil {
+		common.DefaultLogger.Error("Could not initialise config: %s", err)
+		panic("could not initialise config")
+	}
+
+	ops = common.NewDynamoDbOps(config)
+	writeOps = common.NewDynamoWriteOps(config)
+	lambda.Start(common.InstrumentHandler("writeapi", HandleEvent))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/guardian/new-encodings-endpoints/common"
+	"testing"
+)
+
+func TestWriteApiRequiresKey(t *testing.T) {
+	t.Setenv("WRITE_API_KEY", "sekrit")
+	writeOps = &common.DynamoWriteOpsMock{}
+	ops = &common.DynamoOpsMock{}
+
+	response, err := HandleEvent(context.Background(), &events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Path:       "/interactivevideos/idmapping",
+		Body:       `{"filebase": "mygreatvideo", "contentid": 2222}`,
+	})
+	if err != nil {
+		t.Fatalf("HandleEvent returned an unexpected error: %s", err)
+	}
+	if response.StatusCode != 401 {
+		t.Errorf("Expected a 401 without a key, got %d", response.StatusCode)
+	}
+	if len(writeOps.(*common.DynamoWriteOpsMock).IdMappingsPut) != 0 {
+		t.Error("Nothing should be written without a key")
+	}
+}
+
+func TestWriteApiRouting(t *testing.T) {
+	t.Setenv("WRITE_API_KEY", "sekrit")
+	mockWriteOps := &common.DynamoWriteOpsMock{}
+	writeOps = mockWriteOps
+	ops = &common.DynamoOpsMock{}
+	headers := map[string]string{"Authorization": "Bearer sekrit"}
+
+	response, _ := HandleEvent(context.Background(), &events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Path:       "/interactivevideos/idmapping",
+		Headers:    headers,
+		Body:       `{"filebase": "mygreatvideo", "contentid": 2222}`,
+	})
+	if response.StatusCode != 201 || len(mockWriteOps.IdMappingsPut) != 1 {
+		t.Errorf("Expected idmapping to be created, got %d %s", response.StatusCode, response.Body)
+	}
+
+	response, _ = HandleEvent(context.Background(), &events.APIGatewayProxyRequest{
+		HTTPMethod: "DELETE",
+		Path:       "/interactivevideos/idmapping",
+		Headers:    headers,
+	})
+	if response.StatusCode != 405 {
+		t.Errorf("Expected DELETE to be refused, got %d", response.StatusCode)
+	}
+
+	response, _ = HandleEvent(context.Background(), &events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Path:       "/interactivevideos/something",
+		Headers:    headers,
+		Body:       `{}`,
+	})
+	if response.StatusCode != 404 {
+		t.Errorf("Expected an unknown resource to give 404, got %d", response.StatusCode)
+	}
+}
+
+func TestWriteApiRetireRouting(t *testing.T) {
+	t.Setenv("WRITE_API_KEY", "sekrit")
+	mockWriteOps := &common.DynamoWriteOpsMock{}
+	writeOps = mockWriteOps
+	ops = &common.DynamoOpsMock{
+		EncodingsForFCSIdResults: []*common.Encoding{{EncodingId: 123, FCSID: "KP-12345"}},
+	}
+	headers := map[string]string{"Authorization": "Bearer sekrit"}
+
+	response, _ := HandleEvent(context.Background(), &events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Path:       "/interactivevideos/retire",
+		Headers:    headers,
+		Body:       `{"fcs_id": "KP-12345", "reason": "legal", "requested_by": "fred"}`,
+	})
+	if response.StatusCode != 200 || len(mockWriteOps.EncodingsWithdrawn) != 1 || mockWriteOps.EncodingWithdrawal == nil {
+		t.Errorf("Expected the version to be retired, got %d %s", response.StatusCode, response.Body)
+	}
+
+	response, _ = HandleEvent(context.Background(), &events.APIGatewayProxyRequest{
+		HTTPMethod: "PUT",
+		Path:       "/interactivevideos/restore",
+		Headers:    headers,
+	})
+	if response.StatusCode != 405 {
+		t.Errorf("Expected PUT to restore to be refused, got %d", response.StatusCode)
+	}
+
+	response, _ = HandleEvent(context.Background(), &events.APIGatewayProxyRequest{
+		HTTPMethod:            "GET",
+		Path:                  "/interactivevideos/audit",
+		Headers:               headers,
+		QueryStringParameters: map[string]string{"fcs_id": "KP-12345"},
+	})
+	if response.StatusCode != 200 || mockWriteOps.AuditTargetQueried != "fcs/KP-12345" {
+		t.Errorf("Expected the audit history to be returned, got %d %s", response.StatusCode, response.Body)
+	}
+}